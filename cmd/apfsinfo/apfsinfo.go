@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/apfs"
+	"go-aapl-integrity/pkg/udif"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+func help() {
+	fmt.Println("apfsinfo: List the volumes, snapshots and integrity metadata of a raw APFS container or disk image and recompute sealed volume hashes")
+	fmt.Println()
+	fmt.Println("usage: apfsinfo [--offset <bytes>] [--snapshot <name>] [--verify] <image or dmg>")
+	flag.PrintDefaults()
+}
+
+func printSnapshots(volume *apfs.Volume) []*apfs.Snapshot {
+	snapshots, err := volume.Snapshots()
+	if err != nil {
+		fmt.Printf("  snapshots: %s\n", err)
+		return nil
+	}
+
+	for _, snapshot := range snapshots {
+		fmt.Printf("  snapshot %s xid %d created %s\n", snapshot.Name, snapshot.XID, snapshot.Created.Format("2006-01-02 15:04:05"))
+	}
+	return snapshots
+}
+
+// verifyVolume recomputes the Merkle tree of the file-system tree and the file data hashes,
+// returning the number of failures
+func verifyVolume(volume *apfs.Volume, integrity *apfs.IntegrityMetadata) int {
+	failures := 0
+	nodes, err := volume.VerifyRootTree(integrity)
+	fmt.Printf("  file-system tree: %d nodes verified\n", nodes)
+	if err != nil {
+		fmt.Printf("  %s\n", err)
+		failures++
+	}
+
+	records, errors := volume.VerifyFileData(integrity)
+	fmt.Printf("  file data: %d hashes checked\n", records)
+	for _, err := range errors {
+		fmt.Printf("  %s\n", err)
+	}
+
+	return failures + len(errors)
+}
+
+func printVolume(volume *apfs.Volume, snapshotName string, verify bool) int {
+	fmt.Printf("volume %d %s %s role 0x%04x sealed %t\n", volume.Index, volume.Name, volume.UUID, volume.Role, volume.Sealed())
+	snapshots := printSnapshots(volume)
+	if !volume.Sealed() {
+		return 0
+	}
+
+	if snapshotName != "" {
+		for _, snapshot := range snapshots {
+			if snapshot.Name != snapshotName {
+				continue
+			}
+
+			var err error
+			volume, err = volume.AtSnapshot(snapshot)
+			if err != nil {
+				fmt.Printf("  %s\n", err)
+				return 1
+			}
+			fmt.Printf("  as of snapshot %s\n", snapshot.Name)
+		}
+	}
+
+	integrity, err := volume.IntegrityMetadata()
+	if err != nil {
+		fmt.Printf("  %s\n", err)
+		return 1
+	}
+	fmt.Printf("  integrity: version %d flags 0x%x %s root hash %x\n", integrity.Version, integrity.Flags, apfs.HashTypeName(integrity.HashType), integrity.RootHash)
+	if integrity.Flags & apfs.IntegrityFlagSealBroken != 0 {
+		fmt.Printf("  seal broken by xid %d\n", integrity.BrokenXID)
+	}
+
+	extents, err := volume.FileExtents()
+	if err != nil {
+		fmt.Printf("  %s\n", err)
+	} else {
+		fmt.Printf("  file extents: %d\n", len(extents))
+	}
+
+	if !verify {
+		return 0
+	}
+	return verifyVolume(volume, integrity)
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	offset := flag.Int64("offset", 0, "`bytes` from the start of the image to the container, for raw whole disk images")
+	snapshotName := flag.String("snapshot", "", "check sealed volumes as of the snapshot with this `name`")
+	verify := flag.Bool("verify", false, "recompute the hashes of sealed volumes")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		help()
+		os.Exit(-1)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	reader, err := udif.OpenAPFSPartition(file, info.Size())
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	container, err := apfs.Open(io.NewSectionReader(reader, *offset, math.MaxInt64 - *offset))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	superblock := container.Superblock
+	fmt.Printf("container %s block size %d blocks %d xid %d\n", superblock.UUID, superblock.BlockSize, superblock.BlockCount, superblock.Header.XID)
+
+	volumes, err := container.Volumes()
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-4)
+	}
+
+	failures := 0
+	for _, volume := range volumes {
+		failures += printVolume(volume, *snapshotName, *verify)
+	}
+
+	if failures != 0 {
+		os.Exit(-5)
+	}
+}
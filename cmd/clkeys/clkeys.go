@@ -2,137 +2,207 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"crypto/x509"
-	"debug/macho"
-	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"go-aapl-integrity/pkg/kernelcache"
+	"go/format"
+	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
-const ChunklistKeyCountSymbol = "_rev1_chunklist_num_pubkeys"
-const ChunklistKeysSymbol = "_rev1_chunklist_pubkeys"
-const ChunklistKeyCountSize = 8
-const ChunklistKeySize = 2048/8
 const ChunklistKeyDataType = "RSA PUBLIC KEY"
 
-type Kernel struct {
-	kernelObject *macho.File
+type jsonKey struct {
+	Revision   int    `json:"revision"`
+	Index      int    `json:"index"`
+	Header     string `json:"header"`
+	Production bool   `json:"production"`
+	Exponent   int    `json:"exponent"`
+	Modulus    string `json:"modulus"`
+	Offset     uint64 `json:"offset"`
 }
 
-func loadKernel(path string) (*Kernel, error) {
-	result := new(Kernel)
-	kernelObject, err := macho.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	result.kernelObject = kernelObject
-
-	return result, nil
-}
-
-func parseKey(keyBytes []byte) *rsa.PublicKey {
-	result := new(rsa.PublicKey)
-	result.E = 0x010001
-	result.N = big.NewInt(0)
-	result.N.SetBytes(keyBytes)
-	fmt.Println(result.N.String())
-	return result
+func help() {
+	fmt.Println("clkeys: Chunklist Key Extractor")
+	fmt.Println()
+	fmt.Println("usage: clkeys [--format pem|json|go] [--exponent <e>] [--package <name>] [--output <file>] [--scan] <kernelcache>")
+	fmt.Println()
+	fmt.Println("Rev1 keys are read through their symbols. Stripped kernelcaches, or --scan, also")
+	fmt.Println("search __DATA_CONST,__const for key tables. The revision of a scanned table is")
+	fmt.Println("unknown and given as 0.")
+	flag.PrintDefaults()
 }
 
-func getKeys(kernel *Kernel) ([]*rsa.PublicKey, error) {
-	var keyCount uint64
-	countSymbol := getSymbol(kernel, ChunklistKeyCountSymbol)
-	keySymbol := getSymbol(kernel, ChunklistKeysSymbol)
-
-	countBytes, err := getConstantBytes(kernel, countSymbol, ChunklistKeyCountSize)
-	if err != nil {
+// getKeys reads the rev1 key table through its symbols, adding the tables found by a scan when
+// asked to or when the kernel is stripped
+func getKeys(kernel *kernelcache.Kernel, exponent int, scan bool) ([]*kernelcache.ChunklistKey, error) {
+	keys, err := kernel.ChunklistKeys(exponent)
+	if _, stripped := err.(*kernelcache.SymbolNotFoundError); stripped {
+		keys, scan = nil, true
+	} else if err != nil {
 		return nil, err
 	}
-	err = binary.Read(bytes.NewReader(countBytes), binary.LittleEndian, &keyCount)
-	if err != nil {
-		return nil, err
+	if !scan {
+		return keys, nil
 	}
 
-	keys, err := getConstantBytes(kernel, keySymbol, keyCount * (ChunklistKeySize + 4))
+	scanned, err := kernel.ScanChunklistKeys(exponent)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]*rsa.PublicKey, keyCount)
-	for index, _ := range result {
-		start := (index * (ChunklistKeySize + 4)) + 4
-		end := start + ChunklistKeySize
-		keyBytes := keys[start:end]
-		result[index] = parseKey(keyBytes)
+
+	known := make(map[uint64]bool)
+	for _, key := range keys {
+		known[key.FileOffset] = true
+	}
+	for _, key := range scanned {
+		if !known[key.FileOffset] {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no chunklist key symbols or key tables found")
 	}
 
-	return result, nil
+	return keys, nil
 }
 
-func getSymbol(kernel *Kernel, name string) macho.Symbol {
-	for _, symbol := range kernel.kernelObject.Symtab.Syms {
-		if symbol.Name == name {
-			return symbol
-		}
+func formatKey(key *kernelcache.ChunklistKey) []byte {
+	block := new(pem.Block)
+	block.Type = ChunklistKeyDataType
+	block.Headers = map[string]string{
+		"Revision":   strconv.Itoa(key.Revision),
+		"Production": strconv.FormatBool(key.Production),
+		"Offset":     fmt.Sprintf("0x%x", key.FileOffset),
 	}
-
-	return macho.Symbol{}
+	block.Bytes = x509.MarshalPKCS1PublicKey(key.Key)
+	return pem.EncodeToMemory(block)
 }
 
-func getConstantBytes(kernel *Kernel, symbol macho.Symbol, length uint64) ([]byte, error) {
-	constData := kernel.kernelObject.Sections[symbol.Sect - 1]
-	offset := symbol.Value - constData.Addr
-	result := make([]byte, length)
+func formatPEM(keys []*kernelcache.ChunklistKey) []byte {
+	var buffer bytes.Buffer
+	for _, key := range keys {
+		buffer.Write(formatKey(key))
+	}
+
+	return buffer.Bytes()
+}
 
-	count, err := constData.ReadAt(result, int64(offset))
-	if uint64(count) != length {
-		err = fmt.Errorf("could not read %x bytes", length)
+func formatJSON(keys []*kernelcache.ChunklistKey) ([]byte, error) {
+	result := make([]jsonKey, len(keys))
+	for index, key := range keys {
+		result[index] = jsonKey{
+			Revision:   key.Revision,
+			Index:      key.Index,
+			Header:     fmt.Sprintf("%08x", key.Header),
+			Production: key.Production,
+			Exponent:   key.Key.E,
+			Modulus:    hex.EncodeToString(key.Key.N.Bytes()),
+			Offset:     key.FileOffset,
+		}
 	}
+
+	output, err := json.MarshalIndent(result, "", "  ")
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return append(output, '\n'), nil
 }
 
-func formatKey(key *rsa.PublicKey) []byte {
-	keyBytes := x509.MarshalPKCS1PublicKey(key)
-	block := new(pem.Block)
-	block.Type = ChunklistKeyDataType
-	block.Bytes = keyBytes
-	return pem.EncodeToMemory(block)
+// formatGo writes the keys as a trust store source file for clverify
+func formatGo(keys []*kernelcache.ChunklistKey, packageName string, source string) ([]byte, error) {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "// Code generated by clkeys from %s; DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&buffer, "package %s\n\n", packageName)
+	fmt.Fprintf(&buffer, "var trustedChunklistKeys = []trustedChunklistKey{\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, "// file offset 0x%x\n", key.FileOffset)
+		fmt.Fprintf(&buffer, "{\n")
+		fmt.Fprintf(&buffer, "Revision: %d,\n", key.Revision)
+		fmt.Fprintf(&buffer, "Production: %t,\n", key.Production)
+		fmt.Fprintf(&buffer, "Exponent: 0x%x,\n", key.Key.E)
+		fmt.Fprintf(&buffer, "Modulus: %q,\n", hex.EncodeToString(key.Key.N.Bytes()))
+		fmt.Fprintf(&buffer, "},\n")
+	}
+	fmt.Fprintf(&buffer, "}\n")
+
+	return format.Source(buffer.Bytes())
 }
 
 func main() {
 	stdErr := log.New(os.Stderr, "error: ", 0)
-	if len(os.Args) < 2 {
-		stdErr.Println("no kernel file provided")
+	outputFormat := flag.String("format", "pem", "output `format`: pem, json or go")
+	exponentText := flag.String("exponent", "0x10001", "public `exponent` of the keys")
+	packageName := flag.String("package", "main", "package `name` of go output")
+	outputPath := flag.String("output", "", "write to `file` instead of stdout")
+	scan := flag.Bool("scan", false, "also scan for key tables of unknown revision when the kernelcache has symbols")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		help()
+		os.Exit(-1)
+	}
+
+	exponent, err := strconv.ParseInt(*exponentText, 0, 32)
+	if err != nil || exponent < 3 {
+		stdErr.Printf("invalid exponent %s\n", *exponentText)
 		os.Exit(-1)
 	}
 
-	_, err := os.Stat(os.Args[1])
-	if os.IsExist(err) {
+	_, err = os.Stat(flag.Arg(0))
+	if os.IsNotExist(err) {
 		stdErr.Println("kernel file not found")
 		os.Exit(-2)
 	}
 
-	kernel, err := loadKernel(os.Args[1])
+	kernel, err := kernelcache.Open(flag.Arg(0))
 	if err != nil {
 		stdErr.Println(err)
 		os.Exit(-4)
 	}
 
-	keys, err := getKeys(kernel)
+	keys, err := getKeys(kernel, int(exponent), *scan)
+	kernel.Close()
 	if err != nil {
 		stdErr.Println(err)
 		os.Exit(-5)
 	}
 
-	for _, key := range keys {
-		output := formatKey(key)
+	var output []byte
+	switch *outputFormat {
+	case "pem":
+		output = formatPEM(keys)
+	case "json":
+		output, err = formatJSON(keys)
+	case "go":
+		output, err = formatGo(keys, *packageName, filepath.Base(flag.Arg(0)))
+	default:
+		stdErr.Printf("unknown format %s\n", *outputFormat)
+		os.Exit(-1)
+	}
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-6)
+	}
+
+	if *outputPath == "" {
 		os.Stdout.Write(output)
+		return
+	}
+
+	err = ioutil.WriteFile(*outputPath, output, 0644)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-7)
 	}
-}
\ No newline at end of file
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/binary"
-	"encoding/pem"
+	"flag"
 	"fmt"
 	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
 	"io"
 	"os"
 	"path/filepath"
@@ -28,8 +27,10 @@ const ChunklistPubkeyLen = 2048/8
 const ChunklistPubkeyExp = 0x010001
 const ChunklistSignatureLen = 2048/8
 const Sha256DigestLength = 32
-const HashBufferSize = 1024 * 32
+const DefaultKeysPath = "keys.pem"
 
+var keysPath = flag.String("keys", DefaultKeysPath, "PEM or JSON chunklist key `file` from clkeys, added to the keys in keys.go")
+var development = flag.Bool("development", false, "also accept chunklist keys that are not marked as production keys")
 
 type chunklistSignature interface {
 	verify(bytes []uint8) error
@@ -46,6 +47,7 @@ type chunklist struct {
  	signatureOffset uint64
 	chunks			[]chunklistChunk
 	signature		chunklistSignature
+	signedData		[]byte
 }
 
 type chunklistChunk struct {
@@ -69,40 +71,43 @@ type chunklistPubkey struct {
 	validKeys []*rsa.PublicKey
 }
 
-func readPublicKey() (*rsa.PublicKey, error) {
-	file, err := os.Open("keys.pem")
+// readPublicKeys returns the keys compiled in from keys.go along with those of the key file,
+// only production keys unless --development is given
+func readPublicKeys() ([]*rsa.PublicKey, error) {
+	result, err := builtinKeys(*development)
 	if err != nil {
 		return nil, err
 	}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
+	_, err = os.Stat(*keysPath)
+	if err == nil {
+		keys, err := readKeyFile(*keysPath, *development)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+	} else if *keysPath != DefaultKeysPath {
 		return nil, err
 	}
 
-	publicKeyData := make([]byte, fileInfo.Size())
-	count, err := file.Read(publicKeyData)
-	if int64(count) != fileInfo.Size() {
-		err = fmt.Errorf("could not read entire file")
-	}
-	if err != nil {
-		return nil, err
+	if len(result) == 0 {
+		if !*development {
+			return nil, fmt.Errorf("no production chunklist keys, regenerate keys.go with clkeys, pass --keys or allow --development keys")
+		}
+		return nil, fmt.Errorf("no chunklist keys, regenerate keys.go with clkeys or pass --keys")
 	}
 
-	publicKey, _ := pem.Decode(publicKeyData)
-
-	return x509.ParsePKCS1PublicKey(publicKey.Bytes)
+	return result, nil
 }
 
 func readChunklistPublicKey(file *os.File) (*chunklistPubkey, error) {
 	result := new(chunklistPubkey)
 
-	result.validKeys = make([]*rsa.PublicKey, 1)
-	key, err := readPublicKey()
+	keys, err := readPublicKeys()
 	if err != nil {
 		return nil, err
 	}
-	result.validKeys[0] = key
+	result.validKeys = keys
 
 	result.signature = make([]byte, ChunklistPubkeyLen)
 	count, err := file.Read(result.signature)
@@ -164,46 +169,51 @@ func readChunklist(file *os.File) (*chunklist, error) {
 		return nil, err
 	}
 
+	// The signature covers the chunklist itself up to the signature
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if result.signatureOffset > uint64(fileInfo.Size()) {
+		return nil, fmt.Errorf("signature offset %d is past the end of the chunklist", result.signatureOffset)
+	}
+
+	result.signedData = make([]byte, result.signatureOffset)
+	_, err = file.ReadAt(result.signedData, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
-func hashFile(file *os.File, length uint32) []byte {
-	hash := sha256.New()
-	buffer := make([]byte, HashBufferSize)
-	hash.Reset()
-
+func hashFile(file *os.File, length uint32) (*core.TypedHash, error) {
 	// NOTE: Special case handling.  0 = remainder of file
 	if length == 0 {
-		fi, _ := file.Stat()
-		location, _ := file.Seek(0, io.SeekCurrent)
-		length = uint32(fi.Size() - location)
-	}
-
-	for length > 0 {
-		count, _ := file.Read(buffer)
-		hash.Write(buffer[:count])
-		length -= uint32(count)
+		return core.HashReader(core.HashSHA256, file)
 	}
 
-	return hash.Sum([]byte{})
+	return core.HashReader(core.HashSHA256, io.LimitReader(file, int64(length)))
 }
 
 func (cl *chunklist) verify(file *os.File) []error {
 	errors := make([]error, 0)
 
-	file.Seek(0, io.SeekStart)
-
-	signedBytes := make([]byte, cl.signatureOffset)
-	file.Read(signedBytes)
-
-	err := cl.signature.verify(signedBytes)
+	err := cl.signature.verify(cl.signedData)
 	if err != nil {
 		return []error { err }
 	}
 
+	file.Seek(0, io.SeekStart)
+
 	for index, chunk := range cl.chunks {
-		result := hashFile(file, chunk.chunkSize)
-		if !bytes.Equal(result, chunk.chunkHash[:]) {
+		result, err := hashFile(file, chunk.chunkSize)
+		if err != nil {
+			return append(errors, err)
+		}
+
+		expected := &core.TypedHash{Type: core.HashSHA256, Data: chunk.chunkHash}
+		if equal, _ := result.Equal(expected); !equal {
 			errors = append(errors, fmt.Errorf("invalid chunk %d", index))
 		}
 	}
@@ -221,7 +231,6 @@ func (cp *chunklistPubkey) verify(bytes []byte) error {
 		if err == nil {
 			return nil
 		}
-		fmt.Println(err)
 	}
 
 	return fmt.Errorf("no valid signature")
@@ -233,24 +242,25 @@ func (cp chunklistCertificate) verify(bytes []byte) error {
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	flag.Parse()
+	if flag.NArg() < 1 {
 		fmt.Print("File is required")
 		os.Exit(-1)
 	}
 
-	_, err := os.Stat(os.Args[1])
+	_, err := os.Stat(flag.Arg(0))
 	if os.IsExist(err) {
-		fmt.Printf("File %s does not exist or it cannot be read", os.Args[1])
+		fmt.Printf("File %s does not exist or it cannot be read", flag.Arg(0))
 		os.Exit(-2)
 	}
 
-	ext := filepath.Ext(os.Args[1])
+	ext := filepath.Ext(flag.Arg(0))
 	if ext == "chunklist" {
 		fmt.Print("Specify the name of the file to verify, not the chunklist\n")
 		os.Exit(-3)
 	}
 
-	chunklistPath := fmt.Sprintf("%s.chunklist", strings.TrimSuffix(os.Args[1], ext))
+	chunklistPath := fmt.Sprintf("%s.chunklist", strings.TrimSuffix(flag.Arg(0), ext))
 	_, err = os.Stat(chunklistPath)
 	if os.IsExist(err) {
 		fmt.Printf("Chunklist file %s does not exist\n", chunklistPath)
@@ -269,7 +279,7 @@ func main() {
 		os.Exit(-6)
 	}
 
-	targetFile, err := os.Open(os.Args[1])
+	targetFile, err := os.Open(flag.Arg(0))
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-7)
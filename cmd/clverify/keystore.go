@@ -0,0 +1,122 @@
+package main
+
+//go:generate sh -c "go run ../clkeys --format go --output keys.go $KERNELCACHE"
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+)
+
+// trustedChunklistKey is one entry of the generated keys.go trust store
+type trustedChunklistKey struct {
+	Revision int
+	Production bool
+	Exponent int
+	Modulus string
+}
+
+// jsonChunklistKey matches the JSON output of clkeys
+type jsonChunklistKey struct {
+	Revision   int    `json:"revision"`
+	Production bool   `json:"production"`
+	Exponent   int    `json:"exponent"`
+	Modulus    string `json:"modulus"`
+}
+
+func newPublicKey(modulus string, exponent int) (*rsa.PublicKey, error) {
+	modulusBytes, err := hex.DecodeString(modulus)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulusBytes),
+		E: exponent,
+	}, nil
+}
+
+// builtinKeys returns the keys compiled in from keys.go, leaving out development keys unless
+// they are allowed
+func builtinKeys(development bool) ([]*rsa.PublicKey, error) {
+	result := make([]*rsa.PublicKey, 0, len(trustedChunklistKeys))
+	for _, key := range trustedChunklistKeys {
+		if !key.Production && !development {
+			continue
+		}
+
+		publicKey, err := newPublicKey(key.Modulus, key.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, publicKey)
+	}
+
+	return result, nil
+}
+
+// readKeyFile loads the keys of a clkeys PEM or JSON file, leaving out development keys unless
+// they are allowed. PEM keys without a Production header are taken as development keys.
+func readKeyFile(path string, development bool) ([]*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*rsa.PublicKey, 0)
+	count := 0
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var keys []jsonChunklistKey
+		err = json.Unmarshal(trimmed, &keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			count++
+			if !key.Production && !development {
+				continue
+			}
+
+			publicKey, err := newPublicKey(key.Modulus, key.Exponent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, publicKey)
+		}
+	} else {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			count++
+			production, _ := strconv.ParseBool(block.Headers["Production"])
+			if !production && !development {
+				continue
+			}
+
+			publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, publicKey)
+		}
+	}
+
+	if count == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+
+	return result, nil
+}
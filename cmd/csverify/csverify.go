@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/codesign"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/trustcache"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+type fileList []string
+
+func (list *fileList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *fileList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func help() {
+	fmt.Println("csverify: Verify Mach-O code signatures")
+	fmt.Println()
+	fmt.Println("usage: csverify [--trustcache <file>]... [--roots <pem>] [--info <plist>] [--resources <file>] <binary>")
+	flag.PrintDefaults()
+}
+
+func loadRoots(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := x509.NewCertPool()
+	if !result.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return result, nil
+}
+
+func readOptional(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+func printSlice(slice *codesign.Slice, result *codesign.TrustResult) {
+	fmt.Printf("%s:\n", slice.Cpu)
+	if slice.Signature == nil {
+		fmt.Println("  not signed")
+		return
+	}
+
+	for _, directory := range slice.Signature.CodeDirectories {
+		cdhash, err := directory.CDHash()
+		if err != nil {
+			fmt.Printf("  code directory slot 0x%x: %s\n", directory.Slot, err)
+			continue
+		}
+
+		fmt.Printf("  code directory slot 0x%x: %s version 0x%x %s\n", directory.Slot, core.HashTypeName(int(directory.HashType)), directory.Version, hex.EncodeToString(cdhash.Data))
+	}
+
+	directory := slice.Signature.CodeDirectory()
+	fmt.Printf("  identifier: %s\n", directory.Identifier)
+	if directory.TeamID != "" {
+		fmt.Printf("  team id:    %s\n", directory.TeamID)
+	}
+
+	for _, report := range result.Reports {
+		valid := 0
+		for _, page := range report.Pages {
+			if page.Valid() {
+				valid++
+			}
+		}
+		fmt.Printf("  pages (slot 0x%x): %d/%d valid\n", report.CodeDirectory.Slot, valid, len(report.Pages))
+
+		for _, slot := range report.Slots {
+			if slot.Status != codesign.SlotStatusAbsent {
+				fmt.Printf("    %s: %s\n", codesign.SlotName(slot.Slot), codesign.SlotStatusName(slot.Status))
+			}
+		}
+	}
+
+	fmt.Printf("  trusted by: %s\n", codesign.TrustSourceName(result.Source))
+	if result.Signer != nil {
+		fmt.Printf("  signer:     %s (%s, team %s)\n", result.Signer.Certificate.Subject.CommonName, codesign.CertificateTypeName(result.Signer.CertificateType), result.Signer.TeamID)
+	}
+
+	for _, err := range result.Errors {
+		fmt.Printf("  %s\n", err)
+	}
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	var trustCachePaths fileList
+	flag.Var(&trustCachePaths, "trustcache", "raw or IM4P trust cache `file` to look CDHashes up in (repeatable)")
+	rootsPath := flag.String("roots", "", "PEM `file` of root certificates for CMS signatures")
+	infoPath := flag.String("info", "", "Info.plist `file` covered by the signature")
+	resourcesPath := flag.String("resources", "", "CodeResources `file` covered by the signature")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		help()
+		os.Exit(-1)
+	}
+
+	caches := make([]*trustcache.TrustCache, 0)
+	for _, path := range trustCachePaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-2)
+		}
+
+		cache, err := trustcache.Load(data)
+		if err != nil {
+			stdErr.Printf("%s: %s\n", path, err)
+			os.Exit(-2)
+		}
+		caches = append(caches, cache)
+	}
+
+	options := &codesign.VerifyOptions{}
+	if *rootsPath != "" {
+		roots, err := loadRoots(*rootsPath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-3)
+		}
+		options.Roots = roots
+	}
+
+	external := &codesign.ExternalData{}
+	var err error
+	external.InfoPlist, err = readOptional(*infoPath)
+	if err == nil {
+		external.ResourceDirectory, err = readOptional(*resourcesPath)
+	}
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-4)
+	}
+
+	file, err := codesign.Open(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-5)
+	}
+	defer file.Close()
+
+	untrusted := 0
+	for _, slice := range file.Slices {
+		result := slice.Evaluate(caches, external, options)
+		printSlice(slice, result)
+		if result.Source == codesign.TrustSourceNone {
+			untrusted++
+		}
+	}
+
+	os.Exit(untrusted)
+}
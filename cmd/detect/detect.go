@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/detect"
+	"log"
+	"os"
+)
+
+func help() {
+	fmt.Println("detect: Identify Apple integrity artifacts from their contents")
+	fmt.Println()
+	fmt.Println("usage: detect <file>...")
+	flag.PrintDefaults()
+}
+
+func detectFile(path string) (*detect.Artifact, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return detect.Detect(file, info.Size())
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		help()
+		os.Exit(-1)
+	}
+
+	failures := 0
+	for _, path := range flag.Args() {
+		artifact, err := detectFile(path)
+		if err != nil {
+			stdErr.Printf("%s: %s\n", path, err)
+			failures++
+			continue
+		}
+
+		fmt.Printf("%s: %s\n", path, artifact.Summary())
+	}
+
+	if failures != 0 {
+		os.Exit(-2)
+	}
+}
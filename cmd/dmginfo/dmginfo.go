@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/udif"
+	"io"
+	"log"
+	"os"
+)
+
+func help() {
+	fmt.Println("dmginfo: List the partitions of UDIF disk images, verify their checksums and extract them")
+	fmt.Println()
+	fmt.Println("usage: dmginfo [--verify] [--partition <name> --out <file>] <dmg>")
+	flag.PrintDefaults()
+}
+
+func printImage(image *udif.Image) {
+	trailer := image.Trailer
+	fmt.Printf("udif version %d flags 0x%x variant %d sectors %d segment %d/%d %s\n", trailer.Version, trailer.Flags, trailer.ImageVariant, trailer.SectorCount, trailer.SegmentNumber, trailer.SegmentCount, trailer.SegmentID)
+	fmt.Printf("data fork 0x%x+0x%x %s, master %s\n", trailer.DataForkOffset, trailer.DataForkLength, udif.ChecksumTypeName(trailer.DataChecksum.Type), udif.ChecksumTypeName(trailer.MasterChecksum.Type))
+
+	for index, table := range image.Tables {
+		counts := make(map[uint32]int)
+		order := make([]uint32, 0)
+		for _, chunk := range table.Chunks {
+			if counts[chunk.Type] == 0 {
+				order = append(order, chunk.Type)
+			}
+			counts[chunk.Type]++
+		}
+
+		fmt.Printf("%d %s sectors %d+%d", index, table.Name, table.FirstSector, table.SectorCount)
+		for _, chunkType := range order {
+			fmt.Printf(" %s:%d", udif.ChunkTypeName(chunkType), counts[chunkType])
+		}
+		fmt.Println()
+	}
+}
+
+// verify checks every checksum of the image, returning the number that failed
+func verify(image *udif.Image) int {
+	failures := 0
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Println(err)
+			failures++
+			return
+		}
+		fmt.Printf("%s: ok\n", name)
+	}
+
+	check("data fork", image.VerifyDataChecksum())
+	check("master", image.VerifyMasterChecksum())
+	for _, table := range image.Tables {
+		check(table.Name, image.VerifyTable(table))
+	}
+
+	return failures
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	doVerify := flag.Bool("verify", false, "verify the data fork, master and partition checksums")
+	partition := flag.String("partition", "", "extract the partition whose `name` contains this, such as Apple_APFS")
+	outPath := flag.String("out", "", "output `file` for the extracted partition")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 || (*partition == "") != (*outPath == "") {
+		help()
+		os.Exit(-1)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	image, err := udif.Open(file, info.Size())
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	printImage(image)
+	if *doVerify && verify(image) != 0 {
+		os.Exit(-4)
+	}
+
+	if *partition == "" {
+		return
+	}
+
+	table := image.Table(*partition)
+	if table == nil {
+		stdErr.Printf("no partition named %s\n", *partition)
+		os.Exit(-5)
+	}
+
+	out, err := os.Create(*outPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-6)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, image.Partition(table))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-6)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/uefi"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+func help() {
+	fmt.Println("efiextract: List the volumes, files and sections of EFI firmware images and extract them by GUID")
+	fmt.Println()
+	fmt.Println("usage: efiextract [--guid <guid> --out <file>] <image or scap>")
+	fmt.Println()
+	fmt.Println("SCAP capsules are unwrapped without verifying their signatures.")
+	flag.PrintDefaults()
+}
+
+func describe(element *uefi.Element) string {
+	indent := strings.Repeat("  ", element.Depth)
+	if section := element.Section; section != nil {
+		result := fmt.Sprintf("%ssection %s 0x%x", indent, uefi.SectionTypeName(section.Type), len(section.Data))
+		if section.GUID != uuid.Nil {
+			result += " " + uefi.DisplayGUID(section.GUID)
+		}
+		if section.Name != "" {
+			result += fmt.Sprintf(" %q", section.Name)
+		}
+		if section.SignatureConsistent {
+			result += " signature consistent, key not checked"
+		}
+		if section.Error != nil {
+			result += fmt.Sprintf(" error: %s", section.Error)
+		}
+		return result
+	}
+
+	if file := element.File; file != nil {
+		result := fmt.Sprintf("%sfile 0x%08x %s 0x%x %s", indent, file.Offset, uefi.FileTypeName(file.Type), len(file.Data), uefi.DisplayGUID(file.Name))
+		if !file.ChecksumValid {
+			result += " bad checksum"
+		}
+		if file.SectionError != nil {
+			result += fmt.Sprintf(" error: %s", file.SectionError)
+		}
+		return result
+	}
+
+	volume := element.Volume
+	result := fmt.Sprintf("%svolume 0x%08x 0x%x %s", indent, volume.Offset, len(volume.Data), uefi.DisplayGUID(volume.FileSystem))
+	if volume.Name != uuid.Nil {
+		result += " name " + uefi.DisplayGUID(volume.Name)
+	}
+	if volume.FileError != nil {
+		result += fmt.Sprintf(" error: %s", volume.FileError)
+	}
+	return result
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	guid := flag.String("guid", "", "`GUID` of the volume, file or section to extract")
+	outPath := flag.String("out", "", "output `file` for the extracted contents")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 || (*guid == "") != (*outPath == "") {
+		help()
+		os.Exit(-1)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	data, capsule, err := uefi.Unwrap(data)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+	if capsule != nil {
+		fmt.Printf("capsule %s header 0x%x flags 0x%08x\n", capsule.GUID, capsule.HeaderSize, capsule.Flags)
+		fmt.Println("capsule signature verification is not implemented")
+	}
+
+	image, err := uefi.ParseImage(data)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	if *guid == "" {
+		for _, region := range image.Regions {
+			fmt.Printf("region 0x%08x 0x%x %s\n", region.Offset, len(region.Data), uefi.RegionTypeName(region.Type))
+		}
+		uefi.Walk(image.Volumes, func(element *uefi.Element) {
+			fmt.Println(describe(element))
+		})
+		return
+	}
+
+	target, err := uuid.Parse(*guid)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-4)
+	}
+
+	matches := uefi.Find(image.Volumes, target)
+	if len(matches) == 0 {
+		stdErr.Printf("nothing named %s\n", target)
+		os.Exit(-5)
+	}
+	if len(matches) > 1 {
+		fmt.Printf("%d matches, extracting the first\n", len(matches))
+	}
+
+	fmt.Println(describe(matches[0]))
+	err = ioutil.WriteFile(*outPath, matches[0].Data(), 0644)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-6)
+	}
+}
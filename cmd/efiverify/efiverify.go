@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/ealf"
+	"go-aapl-integrity/pkg/uefi"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func help() {
+	fmt.Println("efiverify: Verify EFI firmware images against an eficheck allow list")
+	fmt.Println()
+	fmt.Println("usage: efiverify --list <ealf> [--all] <image or scap>")
+	fmt.Println()
+	fmt.Println("SCAP capsules are unwrapped without verifying their signatures.")
+	flag.PrintDefaults()
+}
+
+func printReport(report *ealf.Report, all bool) {
+	for _, result := range report.Results {
+		entry := result.Entry
+		if !all && (result.Status == ealf.StatusMatch || result.Status == ealf.StatusPresent) {
+			continue
+		}
+
+		fmt.Printf("%-8s %-6s 0x%08x 0x%08x %s", ealf.StatusName(result.Status), ealf.EntryTypeName(entry.Type), result.Offset, entry.Size, entry.GUID)
+		if result.Status == ealf.StatusModified && entry.Hash != nil && result.Hash != nil {
+			fmt.Printf(" expected %s got %s", entry.Hash.Hex(), result.Hash.Hex())
+		}
+		if result.Offset != entry.Offset {
+			fmt.Printf(" (listed at 0x%08x)", entry.Offset)
+		}
+		fmt.Println()
+	}
+
+	for _, module := range report.Unexpected {
+		fmt.Printf("%-8s %-6s 0x%08x 0x%08x %s\n", "unlisted", ealf.EntryTypeName(module.Type), module.Offset, module.Size, module.GUID)
+	}
+
+	for _, err := range report.Errors {
+		fmt.Println(err)
+	}
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	listPath := flag.String("list", "", "eficheck allow list `file` (.ealf)")
+	all := flag.Bool("all", false, "print matching entries too")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 || *listPath == "" {
+		help()
+		os.Exit(-1)
+	}
+
+	list, err := ealf.Open(*listPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	image, capsule, err := uefi.Unwrap(data)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+	if capsule != nil {
+		fmt.Printf("capsule: %s header 0x%x flags 0x%08x image 0x%x bytes\n", capsule.GUID, capsule.HeaderSize, capsule.Flags, len(capsule.Image))
+		fmt.Println("capsule signature verification is not implemented, only the unwrapped image is checked")
+	}
+
+	fmt.Printf("allow list: %d entries\n", len(list.Entries))
+	report := list.Verify(image)
+	printReport(report, *all)
+
+	if !report.Valid() {
+		fmt.Println("image does not match the allow list")
+		os.Exit(-4)
+	}
+
+	fmt.Println("image matches the allow list")
+}
@@ -1,5 +1,184 @@
 package main
 
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/fdr"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+func help() {
+	fmt.Println("fdrmktrust: FDR Trust Object Builder")
+	fmt.Println()
+	fmt.Println("usage: fdrmktrust --signing <cert> --transport <cert> [--crl <crl>] [--roots <pem>] <output>")
+	fmt.Println()
+	fmt.Println("Certificates and the CRL may be PEM or DER. The written object is parsed again to check it,")
+	fmt.Println("and validated when roots are given.")
+	flag.PrintDefaults()
+}
+
+// readDER reads a DER file, or the first PEM block of blockType
+func readDER(path string, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return data, nil
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %s block found in %s", blockType, path)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := readDER(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return certificate, nil
+}
+
+func readRevocationList(path string) (*x509.RevocationList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := readDER(path, "X509 CRL")
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return list, nil
+}
+
+func loadRoots(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := x509.NewCertPool()
+	if !result.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return result, nil
+}
+
+// check parses an encoded trust object again and compares it with the one it was built from
+func check(object *fdr.TrustObject, data []byte) error {
+	parsed, err := fdr.ParseTrustObject(data)
+	if err != nil {
+		return err
+	}
+
+	if !parsed.SigningCertificate.Equal(object.SigningCertificate) {
+		return fmt.Errorf("signing certificate changed when parsed again")
+	}
+	if !parsed.TransportCertificate.Equal(object.TransportCertificate) {
+		return fmt.Errorf("transport certificate changed when parsed again")
+	}
+	if (parsed.Revocation == nil) != (object.Revocation == nil) || (parsed.Revocation != nil && !bytes.Equal(parsed.Revocation.Raw, object.Revocation.Raw)) {
+		return fmt.Errorf("revocation list changed when parsed again")
+	}
+
+	return nil
+}
+
 func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	signingPath := flag.String("signing", "", "signing (trst) certificate `file`")
+	transportPath := flag.String("transport", "", "transport (rssl) certificate `file`")
+	crlPath := flag.String("crl", "", "revocation list (rvok) `file`, left empty when not given")
+	rootsPath := flag.String("roots", "", "PEM `file` of roots to validate the trust object against")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 || *signingPath == "" || *transportPath == "" {
+		help()
+		os.Exit(-1)
+	}
+
+	var err error
+	object := new(fdr.TrustObject)
+	object.SigningCertificate, err = readCertificate(*signingPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	object.TransportCertificate, err = readCertificate(*transportPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	object.Revocation, err = readRevocationList(*crlPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	data, err := object.Marshal()
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-3)
+	}
+
+	err = check(object, data)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-4)
+	}
+
+	if *rootsPath != "" {
+		roots, err := loadRoots(*rootsPath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-2)
+		}
+
+		validation := object.Validate(roots, time.Now())
+		if !validation.Valid() {
+			for _, err := range validation.Errors {
+				stdErr.Println(err)
+			}
+			os.Exit(-5)
+		}
+	}
+
+	err = ioutil.WriteFile(flag.Arg(0), data, 0644)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-6)
+	}
 
+	fmt.Printf("wrote %d bytes to %s\n", len(data), flag.Arg(0))
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/apfs"
+	"go-aapl-integrity/pkg/seal"
+	"go-aapl-integrity/pkg/udif"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func help() {
+	fmt.Println("sealverify: Verify a sealed system volume root hash against its manifest and an APFS image")
+	fmt.Println()
+	fmt.Println("usage: sealverify --manifest <im4m> [--roots <pem>] [--image <apfs or dmg>] [--volume <name>] [--snapshot <name>] [--full] <root_hash.im4p>")
+	flag.PrintDefaults()
+}
+
+func loadRoots(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := x509.NewCertPool()
+	if !result.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return result, nil
+}
+
+func printVerification(verification *seal.Verification, full bool) {
+	if payload := verification.Payload; payload != nil {
+		fmt.Printf("payload: %s %q 0x%x bytes\n", payload.Name, payload.Description, len(payload.Data))
+	}
+	if manifest := verification.Manifest; manifest != nil {
+		if leaf, err := manifest.Leaf(); err == nil {
+			fmt.Printf("manifest: signed by %s, chain verified %t\n", leaf.Subject.CommonName, verification.ChainVerified)
+		}
+	}
+	if rootHash := verification.RootHash; rootHash != nil {
+		fmt.Printf("root hash: version %d %s\n", rootHash.Version, apfs.HashTypeName(rootHash.HashType))
+		for index, hash := range rootHash.Hashes {
+			fmt.Printf("  %d %x\n", index, hash)
+		}
+	}
+
+	if volume := verification.Volume; volume != nil {
+		fmt.Printf("volume: %s %s sealed %t", volume.Name, volume.UUID, volume.Sealed())
+		if volume.Snapshot != nil {
+			fmt.Printf(" snapshot %s xid %d", volume.Snapshot.Name, volume.Snapshot.XID)
+		}
+		fmt.Println()
+	}
+	if integrity := verification.Integrity; integrity != nil {
+		fmt.Printf("integrity: version %d flags 0x%x %s %x", integrity.Version, integrity.Flags, apfs.HashTypeName(integrity.HashType), integrity.RootHash)
+		if verification.Slot >= 0 {
+			fmt.Printf(" matches slot %d", verification.Slot)
+		}
+		fmt.Println()
+	}
+	if full {
+		fmt.Printf("file-system tree: %d nodes verified\n", verification.NodesVerified)
+		fmt.Printf("file data: %d hashes checked\n", verification.FileHashesVerified)
+	}
+
+	for _, err := range verification.Errors {
+		fmt.Println(err)
+	}
+}
+
+func main() {
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	manifestPath := flag.String("manifest", "", "IM4M `file` signing the root hash")
+	rootsPath := flag.String("roots", "", "PEM `file` of root certificates for the manifest")
+	imagePath := flag.String("image", "", "raw APFS container or UDIF disk image `file` holding the sealed volume")
+	volumeName := flag.String("volume", "", "`name` of the volume, the first sealed one by default")
+	snapshotName := flag.String("snapshot", "", "`name` of the snapshot, the newest by default")
+	full := flag.Bool("full", false, "also verify the file-system Merkle tree and file data hashes")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 || *manifestPath == "" || (*imagePath == "" && (*full || *volumeName != "" || *snapshotName != "")) {
+		help()
+		os.Exit(-1)
+	}
+
+	payload, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	manifest, err := ioutil.ReadFile(*manifestPath)
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	options := &seal.Options{Volume: *volumeName, Snapshot: *snapshotName, Full: *full}
+	if *rootsPath != "" {
+		options.Roots, err = loadRoots(*rootsPath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-3)
+		}
+	}
+
+	var verification *seal.Verification
+	if *imagePath != "" {
+		image, err := os.Open(*imagePath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-4)
+		}
+		defer image.Close()
+
+		info, err := image.Stat()
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-4)
+		}
+
+		reader, err := udif.OpenAPFSPartition(image, info.Size())
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-4)
+		}
+
+		verification = seal.Verify(payload, manifest, reader, options)
+	} else {
+		verification = seal.Verify(payload, manifest, nil, options)
+	}
+
+	printVerification(verification, *full)
+	if !verification.Valid() {
+		os.Exit(-5)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"debug/macho"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/apfs"
+	"go-aapl-integrity/pkg/codesign"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/trustcache"
+	"go-aapl-integrity/pkg/udif"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+type jsonChange struct {
+	CDHash      string   `json:"cdhash"`
+	Path        string   `json:"path,omitempty"`
+	OldHashType string   `json:"old_hash_type"`
+	NewHashType string   `json:"new_hash_type"`
+	OldFlags    []string `json:"old_flags"`
+	NewFlags    []string `json:"new_flags"`
+	OldCategory int      `json:"old_category,omitempty"`
+	NewCategory int      `json:"new_category,omitempty"`
+}
+
+type jsonDiffEntry struct {
+	jsonEntry
+	Path string `json:"path,omitempty"`
+}
+
+type jsonDiff struct {
+	Added   []jsonDiffEntry `json:"added"`
+	Removed []jsonDiffEntry `json:"removed"`
+	Changed []jsonChange    `json:"changed"`
+}
+
+// readPathMap loads a CDHash to path listing. Each line holds a hex CDHash and a
+// path separated by whitespace, in either order; blank lines and # comments are skipped.
+func readPathMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a cdhash and a path", path, lineNumber)
+		}
+
+		hash, filePath := fields[0], strings.Join(fields[1:], " ")
+		if !isCDHash(hash) {
+			hash, filePath = fields[len(fields)-1], strings.Join(fields[:len(fields)-1], " ")
+		}
+		if !isCDHash(hash) {
+			return nil, fmt.Errorf("%s:%d: no cdhash found", path, lineNumber)
+		}
+
+		result[strings.ToLower(hash[:trustcache.HashLength*2])] = filePath
+	}
+
+	return result, scanner.Err()
+}
+
+// isMachO reports whether data starts with a thin or fat Mach-O magic
+func isMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
+	switch binary.LittleEndian.Uint32(data) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	}
+	return binary.BigEndian.Uint32(data) == macho.MagicFat
+}
+
+// addCDHashes maps the CDHash of every code directory of a Mach-O's slices to path
+func addCDHashes(paths map[string]string, path string, reader io.ReaderAt, size int64) error {
+	file, err := codesign.NewFile(reader, size)
+	if err != nil {
+		return err
+	}
+
+	for _, slice := range file.Slices {
+		if slice.Signature == nil {
+			continue
+		}
+
+		for _, directory := range slice.Signature.CodeDirectories {
+			hash, err := directory.CDHash()
+			if err != nil {
+				return err
+			}
+
+			key := hex.EncodeToString(hash.Data[:trustcache.HashLength])
+			if _, ok := paths[key]; !ok {
+				paths[key] = path
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDMGPaths lists the files of the APFS volumes in a disk image and maps the CDHashes of the
+// signed Mach-Os among them to their paths. Files that cannot be read or parsed are reported
+// to stdErr and skipped.
+func readDMGPaths(stdErr *log.Logger, path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := udif.OpenAPFSPartition(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := apfs.Open(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, err := container.Volumes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, volume := range volumes {
+		fs, err := volume.FileSystem()
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %s", volume.Name, err)
+		}
+
+		err = fs.Walk(func(filePath string, inode *apfs.Inode) error {
+			file, err := fs.Open(inode)
+			if err != nil {
+				stdErr.Printf("%s: %s", filePath, err)
+				return nil
+			}
+
+			// Only Mach-O files are read past their magic, and then only their load commands and signature
+			magic := make([]byte, 4)
+			_, err = file.ReadAt(magic, 0)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				stdErr.Printf("%s: %s", filePath, err)
+				return nil
+			}
+			if !isMachO(magic) {
+				return nil
+			}
+
+			err = addCDHashes(result, filePath, file, int64(file.Size))
+			if err != nil {
+				stdErr.Printf("%s: %s", filePath, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %s", volume.Name, err)
+		}
+	}
+
+	return result, nil
+}
+
+func isCDHash(value string) bool {
+	if len(value) < trustcache.HashLength*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+func entryHex(entry trustcache.Entry) string {
+	return hex.EncodeToString(entry.GetHash().Data)
+}
+
+func printDiffText(diff *trustcache.Diff, paths map[string]string) {
+	for _, entry := range diff.Added {
+		fmt.Printf("+ %s %-16s %s %s\n", entryHex(entry), core.HashTypeName(entry.GetType()), formatFlags(entry), paths[entryHex(entry)])
+	}
+
+	for _, entry := range diff.Removed {
+		fmt.Printf("- %s %-16s %s %s\n", entryHex(entry), core.HashTypeName(entry.GetType()), formatFlags(entry), paths[entryHex(entry)])
+	}
+
+	for _, change := range diff.Changed {
+		fmt.Printf("~ %s %-16s %s -> %-16s %s %s\n", entryHex(change.Old), core.HashTypeName(change.Old.GetType()), formatFlags(change.Old), core.HashTypeName(change.New.GetType()), formatFlags(change.New), paths[entryHex(change.Old)])
+	}
+
+	fmt.Printf("\n%d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
+
+func diffEntries(entries []trustcache.Entry, paths map[string]string) []jsonDiffEntry {
+	result := make([]jsonDiffEntry, len(entries))
+	for index, entry := range entries {
+		result[index] = jsonDiffEntry{
+			jsonEntry: jsonEntry{
+				CDHash:   entryHex(entry),
+				HashType: core.HashTypeName(entry.GetType()),
+				Flags:    trustcache.FlagNames(entry.GetFlags()),
+				Category: entry.GetCategory(),
+			},
+			Path: paths[entryHex(entry)],
+		}
+	}
+
+	return result
+}
+
+func printDiffJSON(diff *trustcache.Diff, paths map[string]string) error {
+	output := jsonDiff{
+		Added:   diffEntries(diff.Added, paths),
+		Removed: diffEntries(diff.Removed, paths),
+		Changed: make([]jsonChange, len(diff.Changed)),
+	}
+
+	for index, change := range diff.Changed {
+		output.Changed[index] = jsonChange{
+			CDHash:      entryHex(change.Old),
+			Path:        paths[entryHex(change.Old)],
+			OldHashType: core.HashTypeName(change.Old.GetType()),
+			NewHashType: core.HashTypeName(change.New.GetType()),
+			OldFlags:    trustcache.FlagNames(change.Old.GetFlags()),
+			NewFlags:    trustcache.FlagNames(change.New.GetFlags()),
+			OldCategory: change.Old.GetCategory(),
+			NewCategory: change.New.GetCategory(),
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+func diffMain(stdErr *log.Logger, args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print the differences as JSON")
+	mapPath := flags.String("map", "", "`file` listing cdhash and path pairs used to name entries")
+	dmgPath := flags.String("dmg", "", "disk `image` whose signed Mach-O files name entries by their CDHash")
+	flags.Usage = help
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		help()
+		os.Exit(-1)
+	}
+
+	oldCache, err := loadTrustCache(flags.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	newCache, err := loadTrustCache(flags.Arg(1))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	paths := make(map[string]string)
+	if *dmgPath != "" {
+		paths, err = readDMGPaths(stdErr, *dmgPath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-4)
+		}
+	}
+
+	if *mapPath != "" {
+		listed, err := readPathMap(*mapPath)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-4)
+		}
+		for hash, path := range listed {
+			paths[hash] = path
+		}
+	}
+
+	diff := trustcache.Compare(oldCache, newCache)
+	if *jsonOutput {
+		err = printDiffJSON(diff, paths)
+		if err != nil {
+			stdErr.Println(err)
+			os.Exit(-3)
+		}
+	} else {
+		printDiffText(diff, paths)
+	}
+
+	if !diff.IsEmpty() {
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,194 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/kernelcache"
+	"go-aapl-integrity/pkg/trustcache"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+type jsonEntry struct {
+	CDHash   string   `json:"cdhash"`
+	HashType string   `json:"hash_type"`
+	Flags    []string `json:"flags"`
+	Category int      `json:"category,omitempty"`
+}
+
+type jsonTrustCache struct {
+	UUID    string      `json:"uuid"`
+	Version uint32      `json:"version"`
+	Count   uint32      `json:"count"`
+	Entries []jsonEntry `json:"entries"`
+}
 
 func help() {
 	fmt.Println("tcls: Trust-Cache List")
+	fmt.Println()
+	fmt.Println("usage: tcls [--json] [--grep <hash>] <trustcache | kernelcache>")
+	fmt.Println("       tcls diff [--json] [--map <file>] [--dmg <image>] <old trustcache> <new trustcache>")
+	flag.PrintDefaults()
+}
+
+// loadTrustCaches reads a raw or IM4P trust cache, or the static trust caches of a kernelcache
+func loadTrustCaches(path string) ([]*trustcache.TrustCache, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == macho.Magic64 {
+		kernel, err := kernelcache.NewKernel(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		return kernel.TrustCaches()
+	}
+
+	cache, err := trustcache.Load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*trustcache.TrustCache{cache}, nil
+}
+
+// loadTrustCache reads a trust cache file, combining the entries of a kernelcache's modules
+func loadTrustCache(path string) (*trustcache.TrustCache, error) {
+	caches, err := loadTrustCaches(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(caches) == 1 {
+		return caches[0], nil
+	}
+
+	result := &trustcache.TrustCache{Entries: make([]trustcache.Entry, 0)}
+	for _, cache := range caches {
+		result.Entries = append(result.Entries, cache.Entries...)
+		result.Count += cache.Count
+	}
+
+	return result, nil
+}
+
+func formatFlags(entry trustcache.Entry) string {
+	names := trustcache.FlagNames(entry.GetFlags())
+	if entry.GetCategory() != 0 {
+		names = append(names, fmt.Sprintf("category=%d", entry.GetCategory()))
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+
+	return strings.Join(names, ",")
+}
+
+func filterEntries(entries []trustcache.Entry, pattern string) []trustcache.Entry {
+	if pattern == "" {
+		return entries
+	}
+
+	pattern = strings.ToLower(pattern)
+	result := make([]trustcache.Entry, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(hex.EncodeToString(entry.GetHash().Data), pattern) {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func printText(cache *trustcache.TrustCache, entries []trustcache.Entry) {
+	fmt.Printf("UUID:    %s\n", cache.UUID)
+	fmt.Printf("Version: %d\n", cache.Version)
+	fmt.Printf("Count:   %d\n", cache.Count)
+	fmt.Println()
+
+	for _, entry := range entries {
+		fmt.Printf("%s %-16s %s\n",
+			hex.EncodeToString(entry.GetHash().Data),
+			core.HashTypeName(entry.GetType()),
+			formatFlags(entry))
+	}
+}
+
+func printJSON(cache *trustcache.TrustCache, entries []trustcache.Entry) error {
+	output := jsonTrustCache{
+		UUID:    cache.UUID.String(),
+		Version: cache.Version,
+		Count:   cache.Count,
+		Entries: make([]jsonEntry, len(entries)),
+	}
+
+	for index, entry := range entries {
+		output.Entries[index] = jsonEntry{
+			CDHash:   hex.EncodeToString(entry.GetHash().Data),
+			HashType: core.HashTypeName(entry.GetType()),
+			Flags:    trustcache.FlagNames(entry.GetFlags()),
+			Category: entry.GetCategory(),
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
 }
 
 func main() {
-	help()
-}
\ No newline at end of file
+	stdErr := log.New(os.Stderr, "error: ", 0)
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diffMain(stdErr, os.Args[2:])
+		return
+	}
+
+	jsonOutput := flag.Bool("json", false, "print the trust cache as JSON")
+	grep := flag.String("grep", "", "only list entries whose CDHash starts with this hex `hash`")
+	flag.Usage = help
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		help()
+		os.Exit(-1)
+	}
+
+	caches, err := loadTrustCaches(flag.Arg(0))
+	if err != nil {
+		stdErr.Println(err)
+		os.Exit(-2)
+	}
+
+	found := false
+	for index, cache := range caches {
+		entries := filterEntries(cache.Entries, *grep)
+		found = found || len(entries) > 0
+
+		if *jsonOutput {
+			err = printJSON(cache, entries)
+			if err != nil {
+				stdErr.Println(err)
+				os.Exit(-3)
+			}
+		} else {
+			if index > 0 {
+				fmt.Println()
+			}
+			printText(cache, entries)
+		}
+	}
+
+	if *grep != "" && !found {
+		os.Exit(1)
+	}
+}
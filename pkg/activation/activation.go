@@ -0,0 +1,216 @@
+package activation
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"go-aapl-integrity/pkg/device"
+	"go-aapl-integrity/pkg/plist"
+	"strings"
+)
+
+const (
+	FieldActivationRecord = "ActivationRecord"
+	FieldAccountToken = "AccountToken"
+	FieldAccountTokenSignature = "AccountTokenSignature"
+	FieldAccountTokenCertificate = "AccountTokenCertificate"
+	FieldDeviceCertificate = "DeviceCertificate"
+	FieldFairPlayKeyData = "FairPlayKeyData"
+	FieldUnbrick = "unbrick"
+)
+
+// ActivationRecord is the record activation servers return and devices keep
+type ActivationRecord struct {
+	AccountToken []byte
+	AccountTokenSignature []byte
+	AccountTokenCertificate *x509.Certificate
+	DeviceCertificate *x509.Certificate // nil when the record does not carry one
+	FairPlayKeyData []byte
+	Unbrick bool
+	Token *AccountToken
+}
+
+// AccountToken holds the fields of the OpenStep plist the token signature covers
+type AccountToken struct {
+	UniqueDeviceID string
+	SerialNumber string
+	InternationalMobileEquipmentIdentity string
+	MobileEquipmentIdentifier string
+	ProductType string
+	ActivationRandomness string
+	ActivityURL string
+	Fields map[string]interface{}
+}
+
+// ActivationError reports the activation record field that is malformed or fails verification
+type ActivationError struct {
+	Field string
+	Err error
+}
+
+func (err *ActivationError) Error() string {
+	return fmt.Sprintf("activation record %s: %s", err.Field, err.Err)
+}
+
+func (err *ActivationError) Unwrap() error {
+	return err.Err
+}
+
+func fieldError(field string, format string, args ...interface{}) error {
+	return &ActivationError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+func dataField(record map[string]interface{}, field string, required bool) ([]byte, error) {
+	value, ok := record[field]
+	if !ok {
+		if required {
+			return nil, fieldError(field, "missing")
+		}
+		return nil, nil
+	}
+
+	switch data := value.(type) {
+	case []byte:
+		return data, nil
+	case string:
+		return []byte(data), nil
+	default:
+		return nil, fieldError(field, "is %T, not data", value)
+	}
+}
+
+func certificateField(record map[string]interface{}, field string, required bool) (*x509.Certificate, error) {
+	data, err := dataField(record, field, required)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	certificates, err := device.ParseCertificates(data)
+	if err != nil {
+		return nil, &ActivationError{Field: field, Err: err}
+	}
+
+	return certificates[0], nil
+}
+
+func tokenString(fields map[string]interface{}, key string) string {
+	value, _ := fields[key].(string)
+	return value
+}
+
+// ParseAccountToken decodes the OpenStep plist of an account token
+func ParseAccountToken(data []byte) (*AccountToken, error) {
+	fields, err := plist.Dictionary(data)
+	if err != nil {
+		return nil, &ActivationError{Field: FieldAccountToken, Err: err}
+	}
+
+	return &AccountToken{
+		UniqueDeviceID:                       tokenString(fields, "UniqueDeviceID"),
+		SerialNumber:                         tokenString(fields, "SerialNumber"),
+		InternationalMobileEquipmentIdentity: tokenString(fields, "InternationalMobileEquipmentIdentity"),
+		MobileEquipmentIdentifier:            tokenString(fields, "MobileEquipmentIdentifier"),
+		ProductType:                          tokenString(fields, "ProductType"),
+		ActivationRandomness:                 tokenString(fields, "ActivationRandomness"),
+		ActivityURL:                          tokenString(fields, "ActivityURL"),
+		Fields:                               fields,
+	}, nil
+}
+
+// Parse decodes an activation record plist, either the ActivationRecord dictionary itself or
+// a response that wraps it under that key
+func Parse(data []byte) (*ActivationRecord, error) {
+	record, err := plist.Dictionary(data)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped, ok := record[FieldActivationRecord].(map[string]interface{}); ok {
+		record = wrapped
+	}
+
+	result := new(ActivationRecord)
+	result.AccountToken, err = dataField(record, FieldAccountToken, true)
+	if err != nil { return nil, err }
+	result.AccountTokenSignature, err = dataField(record, FieldAccountTokenSignature, true)
+	if err != nil { return nil, err }
+	result.AccountTokenCertificate, err = certificateField(record, FieldAccountTokenCertificate, true)
+	if err != nil { return nil, err }
+	result.DeviceCertificate, err = certificateField(record, FieldDeviceCertificate, false)
+	if err != nil { return nil, err }
+	result.FairPlayKeyData, err = dataField(record, FieldFairPlayKeyData, false)
+	if err != nil { return nil, err }
+	result.Unbrick, _ = record[FieldUnbrick].(bool)
+
+	result.Token, err = ParseAccountToken(result.AccountToken)
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// Verification lists what an activation record proves and every reason it cannot be trusted
+type Verification struct {
+	Hash crypto.Hash // hash of the verified token signature
+	Signer *device.Identity
+	Device *device.Identity // nil when the record carries no device certificate
+	Errors []error
+}
+
+func (verification *Verification) Valid() bool {
+	return len(verification.Errors) == 0
+}
+
+func (verification *Verification) add(field string, format string, args ...interface{}) {
+	verification.Errors = append(verification.Errors, fieldError(field, format, args...))
+}
+
+// verifySignature checks an RSA PKCS #1 v1.5 token signature, which is SHA-1 on older records
+// and SHA-256 on newer ones
+func verifySignature(certificate *x509.Certificate, data []byte, signature []byte) (crypto.Hash, error) {
+	key, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return 0, fmt.Errorf("%s has a %s key, expected RSA", certificate.Subject, certificate.PublicKeyAlgorithm)
+	}
+
+	sha1Digest := sha1.Sum(data)
+	if rsa.VerifyPKCS1v15(key, crypto.SHA1, sha1Digest[:], signature) == nil {
+		return crypto.SHA1, nil
+	}
+
+	sha256Digest := sha256.Sum256(data)
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, sha256Digest[:], signature) == nil {
+		return crypto.SHA256, nil
+	}
+
+	return 0, fmt.Errorf("does not verify with %s", certificate.Subject)
+}
+
+// Verify checks the account token signature with the AccountTokenCertificate, and checks that
+// certificate and the DeviceCertificate against the device CAs
+func (record *ActivationRecord) Verify(authorities *device.Authorities, options *device.VerifyOptions) *Verification {
+	result := &Verification{Errors: make([]error, 0)}
+
+	var err error
+	result.Hash, err = verifySignature(record.AccountTokenCertificate, record.AccountToken, record.AccountTokenSignature)
+	if err != nil {
+		result.add(FieldAccountTokenSignature, "%s", err)
+	}
+
+	result.Signer, err = authorities.Verify(record.AccountTokenCertificate, options)
+	if err != nil {
+		result.add(FieldAccountTokenCertificate, "%s", err)
+	}
+
+	if record.DeviceCertificate != nil {
+		result.Device, err = authorities.Verify(record.DeviceCertificate, options)
+		if err != nil {
+			result.add(FieldDeviceCertificate, "%s", err)
+		} else if result.Device.UDID != "" && record.Token.UniqueDeviceID != "" && !strings.EqualFold(result.Device.UDID, record.Token.UniqueDeviceID) {
+			result.add(FieldDeviceCertificate, "issued to %s, but the account token is for %s", result.Device.UDID, record.Token.UniqueDeviceID)
+		}
+	}
+
+	return result
+}
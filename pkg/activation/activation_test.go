@@ -0,0 +1,241 @@
+package activation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"go-aapl-integrity/pkg/device"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testUDID = "0123456789abcdef0123456789abcdef01234567"
+
+// issueCertificate creates an RSA certificate for name signed by parent, or self signed without one
+func issueCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+func encodePEM(certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+}
+
+// encodeValue writes a dictionary, data, string or boolean as XML plist elements
+func encodeValue(buffer *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0)
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteString("<dict>\n")
+		for _, key := range keys {
+			buffer.WriteString("<key>" + key + "</key>\n")
+			encodeValue(buffer, value[key])
+		}
+		buffer.WriteString("</dict>\n")
+	case []byte:
+		buffer.WriteString("<data>" + base64.StdEncoding.EncodeToString(value) + "</data>\n")
+	case string:
+		buffer.WriteString("<string>" + value + "</string>\n")
+	case bool:
+		fmt.Fprintf(buffer, "<%t/>\n", value)
+	}
+}
+
+func encodeRecord(record map[string]interface{}) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<plist version=\"1.0\">\n")
+	encodeValue(&buffer, record)
+	buffer.WriteString("</plist>\n")
+
+	return buffer.Bytes()
+}
+
+func accountToken(udid string) []byte {
+	return []byte(fmt.Sprintf("{\n\t\"UniqueDeviceID\" = \"%s\";\n\t\"SerialNumber\" = \"C39ABCDEFGHJ\";\n\t\"ProductType\" = \"iPhone10,3\";\n\t\"ActivityURL\" = \"https://albert.apple.com/deviceservices/activity\";\n}", udid))
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, hash crypto.Hash, data []byte) []byte {
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	}
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signature
+}
+
+func TestParse(t *testing.T) {
+	root, rootKey := issueCertificate(t, device.IPhoneCAName, true, nil, nil)
+	token := accountToken(testUDID)
+	fields := func() map[string]interface{} {
+		return map[string]interface{}{
+			FieldAccountToken: token,
+			FieldAccountTokenSignature: sign(t, rootKey, crypto.SHA1, token),
+			FieldAccountTokenCertificate: encodePEM(root),
+			FieldDeviceCertificate: encodePEM(root),
+			FieldFairPlayKeyData: []byte{1, 2, 3},
+			FieldUnbrick: true,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		record map[string]interface{}
+		field  string // field of the expected error, empty when parsing succeeds
+	}{
+		{"record", fields(), ""},
+		{"wrapped record", map[string]interface{}{FieldActivationRecord: fields()}, ""},
+		{"token as a string", func() map[string]interface{} { record := fields(); record[FieldAccountToken] = string(token); return record }(), ""},
+		{"no device certificate", func() map[string]interface{} { record := fields(); delete(record, FieldDeviceCertificate); return record }(), ""},
+		{"missing token", func() map[string]interface{} { record := fields(); delete(record, FieldAccountToken); return record }(), FieldAccountToken},
+		{"missing signature", func() map[string]interface{} { record := fields(); delete(record, FieldAccountTokenSignature); return record }(), FieldAccountTokenSignature},
+		{"missing certificate", func() map[string]interface{} { record := fields(); delete(record, FieldAccountTokenCertificate); return record }(), FieldAccountTokenCertificate},
+		{"malformed device certificate", func() map[string]interface{} { record := fields(); record[FieldDeviceCertificate] = []byte("certificate"); return record }(), FieldDeviceCertificate},
+		{"signature as a boolean", func() map[string]interface{} { record := fields(); record[FieldAccountTokenSignature] = true; return record }(), FieldAccountTokenSignature},
+		{"token not a plist", func() map[string]interface{} { record := fields(); record[FieldAccountToken] = []byte("{ \"UniqueDeviceID\" = "); return record }(), FieldAccountToken},
+	}
+
+	for _, test := range tests {
+		record, err := Parse(encodeRecord(test.record))
+		if test.field != "" {
+			activationErr, ok := err.(*ActivationError)
+			if !ok {
+				t.Errorf("%s: error %v, expected an activation error", test.name, err)
+			} else if activationErr.Field != test.field {
+				t.Errorf("%s: error is for %s, expected %s", test.name, activationErr.Field, test.field)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if record.Token.UniqueDeviceID != testUDID || record.Token.SerialNumber != "C39ABCDEFGHJ" || record.Token.ProductType != "iPhone10,3" || !record.Unbrick {
+			t.Errorf("%s: token %+v", test.name, record.Token)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root, rootKey := issueCertificate(t, device.IPhoneCAName, true, nil, nil)
+	deviceCA, deviceCAKey := issueCertificate(t, device.DeviceCAName, true, root, rootKey)
+	signer, signerKey := issueCertificate(t, "Activation", false, root, rootKey)
+	deviceCertificate, _ := issueCertificate(t, testUDID, false, deviceCA, deviceCAKey)
+	otherDevice, _ := issueCertificate(t, "fedcba9876543210fedcba9876543210fedcba98", false, deviceCA, deviceCAKey)
+	otherRoot, otherRootKey := issueCertificate(t, device.IPhoneCAName, true, nil, nil)
+	otherSigner, otherSignerKey := issueCertificate(t, "Activation", false, otherRoot, otherRootKey)
+	authorities := device.NewAuthorities([]*x509.Certificate{root, deviceCA})
+
+	token := accountToken(testUDID)
+	newRecord := func(hash crypto.Hash) *ActivationRecord {
+		record, err := Parse(encodeRecord(map[string]interface{}{
+			FieldAccountToken: token,
+			FieldAccountTokenSignature: sign(t, signerKey, hash, token),
+			FieldAccountTokenCertificate: encodePEM(signer),
+			FieldDeviceCertificate: encodePEM(deviceCertificate),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return record
+	}
+
+	valid := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		hash   crypto.Hash
+		mutate func(record *ActivationRecord)
+		now    time.Time
+		errors []string
+	}{
+		{"SHA-1", crypto.SHA1, func(record *ActivationRecord) {}, valid, nil},
+		{"SHA-256", crypto.SHA256, func(record *ActivationRecord) {}, valid, nil},
+		{"no device certificate", crypto.SHA1, func(record *ActivationRecord) { record.DeviceCertificate = nil }, valid, nil},
+		{"tampered signature", crypto.SHA1, func(record *ActivationRecord) { record.AccountTokenSignature[0] ^= 1 }, valid, []string{FieldAccountTokenSignature}},
+		{"tampered token", crypto.SHA256, func(record *ActivationRecord) { record.AccountToken = accountToken(testUDID[1:]) }, valid, []string{FieldAccountTokenSignature}},
+		{"untrusted signer", crypto.SHA1, func(record *ActivationRecord) {
+			record.AccountTokenCertificate, record.AccountTokenSignature = otherSigner, sign(t, otherSignerKey, crypto.SHA1, token)
+		}, valid, []string{FieldAccountTokenCertificate}},
+		{"signed by another key", crypto.SHA1, func(record *ActivationRecord) { record.AccountTokenCertificate = otherSigner }, valid, []string{FieldAccountTokenSignature, FieldAccountTokenCertificate}},
+		{"device certificate for another device", crypto.SHA1, func(record *ActivationRecord) { record.DeviceCertificate = otherDevice }, valid, []string{FieldDeviceCertificate}},
+		{"expired", crypto.SHA1, func(record *ActivationRecord) {}, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC), []string{FieldAccountTokenCertificate, FieldDeviceCertificate}},
+	}
+
+	for _, test := range tests {
+		record := newRecord(test.hash)
+		test.mutate(record)
+
+		verification := record.Verify(authorities, &device.VerifyOptions{CurrentTime: test.now})
+		if len(verification.Errors) != len(test.errors) {
+			t.Errorf("%s: errors %v, expected %d", test.name, verification.Errors, len(test.errors))
+			continue
+		}
+		for index, err := range verification.Errors {
+			field := err.(*ActivationError).Field
+			if field != test.errors[index] {
+				t.Errorf("%s: error %d is for %s, expected %s", test.name, index, field, test.errors[index])
+			}
+		}
+
+		if verification.Valid() {
+			if verification.Hash != test.hash || verification.Signer.Type != device.CertificateTypeActivation {
+				t.Errorf("%s: hash %s, signer %+v", test.name, verification.Hash, verification.Signer)
+			}
+			if record.DeviceCertificate != nil && verification.Device.UDID != testUDID {
+				t.Errorf("%s: device %+v", test.name, verification.Device)
+			}
+		}
+	}
+}
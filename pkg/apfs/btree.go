@@ -0,0 +1,316 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	nodeHeaderSize = 0x38
+	btreeInfoSize = 0x28 // btree_info_t, at the end of root nodes
+
+	NodeFlagRoot = 0x0001
+	NodeFlagLeaf = 0x0002
+	NodeFlagFixedKVSize = 0x0004
+	NodeFlagHashed = 0x0008
+	NodeFlagNoHeader = 0x0010
+
+	TreeFlagUint64Keys = 0x00000001
+	TreeFlagSequentialInsert = 0x00000002
+	TreeFlagAllowGhosts = 0x00000004
+	TreeFlagEphemeral = 0x00000008
+	TreeFlagPhysical = 0x00000010
+	TreeFlagNonPersistent = 0x00000020
+	TreeFlagKVNonAligned = 0x00000040
+	TreeFlagHashed = 0x00000080
+	TreeFlagNoHeader = 0x00000100
+
+	// kvoff_t value offset of a fixed size entry that has no value
+	ghostValueOffset = 0xffff
+	indexValueSize = 8 // the child oid of index node entries
+	hashedIndexValueSize = 8 + HashMaxSize // the child oid and hash of hashed index node entries
+)
+
+type btreeInfo struct {
+	Flags uint32
+	NodeSize uint32
+	KeySize uint32 // of fixed size keys
+	ValueSize uint32 // of fixed size leaf values
+	LongestKey uint32
+	LongestValue uint32
+	KeyCount uint64
+	NodeCount uint64
+}
+
+type btreeEntry struct {
+	Key []byte
+	Value []byte // nil for ghost entries
+}
+
+type btreeNode struct {
+	Header *ObjectHeader
+	Flags uint16
+	Level uint16
+	Data []byte // the whole node block, which is what node hashes cover
+	Entries []btreeEntry
+}
+
+// btree reads a B-tree whose child pointers are physical addresses, or virtual oids that
+// resolve maps to addresses
+type btree struct {
+	container *Container
+	resolve func(oid uint64) (uint64, error)
+	root *btreeNode
+	info btreeInfo
+}
+
+func parseBtreeInfo(data []byte) btreeInfo {
+	return btreeInfo{
+		Flags:        binary.LittleEndian.Uint32(data[0x00:0x04]),
+		NodeSize:     binary.LittleEndian.Uint32(data[0x04:0x08]),
+		KeySize:      binary.LittleEndian.Uint32(data[0x08:0x0c]),
+		ValueSize:    binary.LittleEndian.Uint32(data[0x0c:0x10]),
+		LongestKey:   binary.LittleEndian.Uint32(data[0x10:0x14]),
+		LongestValue: binary.LittleEndian.Uint32(data[0x14:0x18]),
+		KeyCount:     binary.LittleEndian.Uint64(data[0x18:0x20]),
+		NodeCount:    binary.LittleEndian.Uint64(data[0x20:0x28]),
+	}
+}
+
+// slice returns data[start:(start + length)] or an error when that is out of bounds
+func slice(data []byte, start int, length int) ([]byte, error) {
+	if start < 0 || length < 0 || start + length > len(data) {
+		return nil, fmt.Errorf("range 0x%x+0x%x is out of bounds", start, length)
+	}
+
+	return data[start:(start + length)], nil
+}
+
+// parseNode decodes the table of contents of a node. info is nil while the root node is read,
+// whose own btree_info_t is used instead.
+func parseNode(data []byte, header *ObjectHeader, info *btreeInfo) (*btreeNode, error) {
+	if len(data) < nodeHeaderSize {
+		return nil, fmt.Errorf("not enough data for node header")
+	}
+
+	result := &btreeNode{
+		Header: header,
+		Flags:  binary.LittleEndian.Uint16(data[0x20:0x22]),
+		Level:  binary.LittleEndian.Uint16(data[0x22:0x24]),
+		Data:   data,
+	}
+	count := int(binary.LittleEndian.Uint32(data[0x24:0x28]))
+	tableOffset := int(binary.LittleEndian.Uint16(data[0x28:0x2a]))
+	tableLength := int(binary.LittleEndian.Uint16(data[0x2a:0x2c]))
+
+	valuesEnd := len(data)
+	if result.Flags & NodeFlagRoot != 0 {
+		if len(data) < nodeHeaderSize + btreeInfoSize {
+			return nil, fmt.Errorf("not enough data for tree info")
+		}
+		valuesEnd -= btreeInfoSize
+		if info == nil {
+			rootInfo := parseBtreeInfo(data[valuesEnd:])
+			info = &rootInfo
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("node is not a root node")
+	}
+
+	keysStart := nodeHeaderSize + tableOffset + tableLength
+	entrySize := 8
+	if result.Flags & NodeFlagFixedKVSize != 0 {
+		entrySize = 4
+	}
+	if count * entrySize > tableLength || keysStart > valuesEnd {
+		return nil, fmt.Errorf("%d entries do not fit the table of contents", count)
+	}
+
+	result.Entries = make([]btreeEntry, count)
+	for index := 0; index < count; index++ {
+		table := data[(nodeHeaderSize + tableOffset + index * entrySize):]
+		var keyOffset, keyLength, valueOffset, valueLength int
+		if result.Flags & NodeFlagFixedKVSize != 0 {
+			keyOffset = int(binary.LittleEndian.Uint16(table[0:2]))
+			valueOffset = int(binary.LittleEndian.Uint16(table[2:4]))
+			keyLength = int(info.KeySize)
+			valueLength = int(info.ValueSize)
+			if result.Level > 0 {
+				valueLength = indexValueSize
+				if result.Flags & NodeFlagHashed != 0 {
+					valueLength = hashedIndexValueSize
+				}
+			}
+		} else {
+			keyOffset = int(binary.LittleEndian.Uint16(table[0:2]))
+			keyLength = int(binary.LittleEndian.Uint16(table[2:4]))
+			valueOffset = int(binary.LittleEndian.Uint16(table[4:6]))
+			valueLength = int(binary.LittleEndian.Uint16(table[6:8]))
+		}
+
+		key, err := slice(data[:valuesEnd], keysStart + keyOffset, keyLength)
+		if err != nil { return nil, fmt.Errorf("entry %d key: %s", index, err) }
+		result.Entries[index].Key = key
+
+		if valueOffset == ghostValueOffset && result.Flags & NodeFlagFixedKVSize != 0 {
+			continue
+		}
+		value, err := slice(data[:valuesEnd], valuesEnd - valueOffset, valueLength)
+		if err != nil { return nil, fmt.Errorf("entry %d value: %s", index, err) }
+		result.Entries[index].Value = value
+	}
+
+	return result, nil
+}
+
+// readNode reads a node by oid, which is an address unless the tree resolves virtual oids
+func (tree *btree) readNode(oid uint64) (*btreeNode, error) {
+	address := oid
+	if tree.resolve != nil {
+		var err error
+		address, err = tree.resolve(oid)
+		if err != nil { return nil, fmt.Errorf("node 0x%x: %s", oid, err) }
+	}
+
+	data, err := tree.container.readBlock(address)
+	if err != nil { return nil, err }
+
+	header, err := parseObjectHeader(data)
+	if err != nil { return nil, fmt.Errorf("node 0x%x: %s", oid, err) }
+	if header.ObjectType() != ObjectTypeBtree && header.ObjectType() != ObjectTypeBtreeNode {
+		return nil, fmt.Errorf("node 0x%x: object type 0x%x is not a b-tree node", oid, header.ObjectType())
+	}
+
+	var info *btreeInfo
+	if tree.root != nil {
+		info = &tree.info
+	}
+
+	node, err := parseNode(data, header, info)
+	if err != nil { return nil, fmt.Errorf("node 0x%x: %s", oid, err) }
+
+	return node, nil
+}
+
+// openTree reads the root node of a tree
+func (container *Container) openTree(oid uint64, resolve func(uint64) (uint64, error)) (*btree, error) {
+	result := &btree{container: container, resolve: resolve}
+	root, err := result.readNode(oid)
+	if err != nil { return nil, err }
+	if root.Flags & NodeFlagRoot == 0 {
+		return nil, fmt.Errorf("node 0x%x is not a root node", oid)
+	}
+
+	result.root = root
+	result.info = parseBtreeInfo(root.Data[(len(root.Data) - btreeInfoSize):])
+	return result, nil
+}
+
+// child reads the node an index entry points to, which must be one level down
+func (tree *btree) child(parent *btreeNode, entry btreeEntry) (*btreeNode, error) {
+	if len(entry.Value) < indexValueSize {
+		return nil, fmt.Errorf("index entry has no child")
+	}
+
+	node, err := tree.readNode(binary.LittleEndian.Uint64(entry.Value))
+	if err != nil { return nil, err }
+	if node.Level + 1 != parent.Level {
+		return nil, fmt.Errorf("node 0x%x is at level %d under a level %d node", node.Header.OID, node.Level, parent.Level)
+	}
+
+	return node, nil
+}
+
+func (tree *btree) walkNode(node *btreeNode, visit func(key []byte, value []byte) error) error {
+	for _, entry := range node.Entries {
+		if node.Level == 0 {
+			err := visit(entry.Key, entry.Value)
+			if err != nil { return err }
+			continue
+		}
+
+		child, err := tree.child(node, entry)
+		if err != nil { return err }
+
+		err = tree.walkNode(child, visit)
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// walk calls visit for every leaf entry in key order, stopping at the first error
+func (tree *btree) walk(visit func(key []byte, value []byte) error) error {
+	return tree.walkNode(tree.root, visit)
+}
+
+// floor returns the leaf entry with the greatest key at or below a target, as ordered by
+// compare, which returns how a key compares to the target. found is false when every key is
+// above the target.
+func (tree *btree) floor(compare func(key []byte) int) (btreeEntry, bool, error) {
+	node := tree.root
+	for {
+		index := -1
+		for candidate, entry := range node.Entries {
+			if compare(entry.Key) > 0 {
+				break
+			}
+			index = candidate
+		}
+		if index < 0 {
+			return btreeEntry{}, false, nil
+		}
+		if node.Level == 0 {
+			return node.Entries[index], true, nil
+		}
+
+		var err error
+		node, err = tree.child(node, node.Entries[index])
+		if err != nil { return btreeEntry{}, false, err }
+	}
+}
+
+// verifyNode checks a node hashes to expected and recurses into its children, returning the
+// number of nodes checked
+func (tree *btree) verifyNode(node *btreeNode, hashType uint32, expected []byte) (int, error) {
+	hash, err := hashData(hashType, node.Data)
+	if err != nil { return 0, err }
+	if !bytes.Equal(hash, expected) {
+		return 0, fmt.Errorf("node 0x%x hashes to %x, expected %x", node.Header.OID, hash, expected)
+	}
+
+	count := 1
+	if node.Level == 0 {
+		return count, nil
+	}
+	if node.Flags & NodeFlagHashed == 0 {
+		return count, fmt.Errorf("index node 0x%x of a hashed tree has no child hashes", node.Header.OID)
+	}
+
+	for _, entry := range node.Entries {
+		if len(entry.Value) < indexValueSize + len(expected) {
+			return count, fmt.Errorf("index node 0x%x has an entry without a child hash", node.Header.OID)
+		}
+
+		child, err := tree.child(node, entry)
+		if err != nil { return count, err }
+
+		checked, err := tree.verifyNode(child, hashType, entry.Value[indexValueSize:(indexValueSize + len(expected))])
+		count += checked
+		if err != nil { return count, err }
+	}
+
+	return count, nil
+}
+
+// verifyHashes checks the Merkle tree of a hashed B-tree: the root node must hash to rootHash
+// and every index entry's hash must be that of its child. Hashes cover the whole node block.
+func (tree *btree) verifyHashes(hashType uint32, rootHash []byte) (int, error) {
+	if tree.info.Flags & TreeFlagHashed == 0 {
+		return 0, fmt.Errorf("tree is not hashed")
+	}
+
+	return tree.verifyNode(tree.root, hashType, rootHash)
+}
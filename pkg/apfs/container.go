@@ -0,0 +1,159 @@
+package apfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+)
+
+const (
+	NXSuperblockMagic = "NXSB"
+	NXMaxFileSystems = 100
+
+	// Set in nx_xp_desc_blocks when the checkpoint descriptor area is a tree rather than a
+	// contiguous run of blocks
+	checkpointNonContiguous = 0x80000000
+)
+
+type NXSuperblock struct {
+	Header *ObjectHeader
+	BlockSize uint32
+	BlockCount uint64
+	Features uint64
+	ReadOnlyCompatibleFeatures uint64
+	IncompatibleFeatures uint64
+	UUID uuid.UUID
+	NextOID uint64
+	NextXID uint64
+	DescriptorBlocks uint32
+	DescriptorBase uint64
+	OMapOID uint64
+	FileSystemOIDs []uint64 // the nonzero entries of nx_fs_oid
+}
+
+// Container is an APFS container read through an io.ReaderAt, as of its latest checkpoint
+type Container struct {
+	reader io.ReaderAt
+	BlockSize uint32
+	Superblock *NXSuperblock
+	omap *objectMap
+}
+
+func parseNXSuperblock(data []byte) (*NXSuperblock, error) {
+	header, err := parseObjectHeader(data)
+	if err != nil { return nil, err }
+	if header.ObjectType() != ObjectTypeNXSuperblock || string(data[0x20:0x24]) != NXSuperblockMagic {
+		return nil, fmt.Errorf("not a container superblock")
+	}
+
+	result := &NXSuperblock{
+		Header:                     header,
+		BlockSize:                  binary.LittleEndian.Uint32(data[0x24:0x28]),
+		BlockCount:                 binary.LittleEndian.Uint64(data[0x28:0x30]),
+		Features:                   binary.LittleEndian.Uint64(data[0x30:0x38]),
+		ReadOnlyCompatibleFeatures: binary.LittleEndian.Uint64(data[0x38:0x40]),
+		IncompatibleFeatures:       binary.LittleEndian.Uint64(data[0x40:0x48]),
+		NextOID:                    binary.LittleEndian.Uint64(data[0x58:0x60]),
+		NextXID:                    binary.LittleEndian.Uint64(data[0x60:0x68]),
+		DescriptorBlocks:           binary.LittleEndian.Uint32(data[0x68:0x6c]),
+		DescriptorBase:             binary.LittleEndian.Uint64(data[0x70:0x78]),
+		OMapOID:                    binary.LittleEndian.Uint64(data[0xa0:0xa8]),
+		FileSystemOIDs:             make([]uint64, 0),
+	}
+	copy(result.UUID[:], data[0x48:0x58])
+
+	for index := 0; index < NXMaxFileSystems; index++ {
+		oid := binary.LittleEndian.Uint64(data[(0xb8 + index * 8):])
+		if oid != 0 {
+			result.FileSystemOIDs = append(result.FileSystemOIDs, oid)
+		}
+	}
+
+	return result, nil
+}
+
+// Open reads the container superblock at the start of reader and moves to the latest valid
+// checkpoint in the checkpoint descriptor area
+func Open(reader io.ReaderAt) (*Container, error) {
+	data := make([]byte, MinimumBlockSize)
+	_, err := reader.ReadAt(data, 0)
+	if err != nil { return nil, err }
+	if string(data[0x20:0x24]) != NXSuperblockMagic {
+		return nil, fmt.Errorf("not an APFS container, no %s magic", NXSuperblockMagic)
+	}
+
+	blockSize := binary.LittleEndian.Uint32(data[0x24:0x28])
+	if blockSize < MinimumBlockSize || blockSize > MaximumBlockSize || blockSize & (blockSize - 1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	result := &Container{reader: reader, BlockSize: blockSize}
+	data, err = result.readBlock(0)
+	if err != nil { return nil, err }
+
+	result.Superblock, err = parseNXSuperblock(data)
+	if err != nil { return nil, err }
+
+	// Block zero is only a copy made at some checkpoint; the newest valid superblock in the
+	// descriptor area is the current one
+	if result.Superblock.DescriptorBlocks & checkpointNonContiguous == 0 {
+		for index := uint64(0); index < uint64(result.Superblock.DescriptorBlocks); index++ {
+			data, err := result.readBlock(result.Superblock.DescriptorBase + index)
+			if err != nil {
+				break
+			}
+
+			superblock, err := parseNXSuperblock(data)
+			if err == nil && superblock.Header.XID > result.Superblock.Header.XID {
+				result.Superblock = superblock
+			}
+		}
+	}
+
+	result.omap, err = result.readObjectMap(result.Superblock.OMapOID, result.Superblock.Header.XID)
+	if err != nil { return nil, fmt.Errorf("container object map: %s", err) }
+
+	return result, nil
+}
+
+// readBlock reads the block at a physical address
+func (container *Container) readBlock(address uint64) ([]byte, error) {
+	data := make([]byte, container.BlockSize)
+	_, err := container.reader.ReadAt(data, int64(address) * int64(container.BlockSize))
+	if err != nil {
+		return nil, fmt.Errorf("block 0x%x: %s", address, err)
+	}
+
+	return data, nil
+}
+
+// readObject reads the object at a physical address, checking its checksum and type
+func (container *Container) readObject(address uint64, objectType uint32) ([]byte, *ObjectHeader, error) {
+	data, err := container.readBlock(address)
+	if err != nil { return nil, nil, err }
+
+	header, err := parseObjectHeader(data)
+	if err != nil { return nil, nil, fmt.Errorf("block 0x%x: %s", address, err) }
+	if header.ObjectType() != objectType {
+		return nil, nil, fmt.Errorf("block 0x%x: object type 0x%x, expected 0x%x", address, header.ObjectType(), objectType)
+	}
+
+	return data, header, nil
+}
+
+// Volumes returns the container's volumes in nx_fs_oid order
+func (container *Container) Volumes() ([]*Volume, error) {
+	result := make([]*Volume, 0, len(container.Superblock.FileSystemOIDs))
+	for _, oid := range container.Superblock.FileSystemOIDs {
+		address, err := container.omap.lookup(oid)
+		if err != nil { return nil, fmt.Errorf("volume 0x%x: %s", oid, err) }
+
+		volume, err := container.openVolume(address)
+		if err != nil { return nil, fmt.Errorf("volume 0x%x: %s", oid, err) }
+
+		result = append(result, volume)
+	}
+
+	return result, nil
+}
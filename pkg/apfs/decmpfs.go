@@ -0,0 +1,243 @@
+package apfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"go-aapl-integrity/pkg/lzfse"
+	"io"
+	"io/ioutil"
+)
+
+// The decmpfs attribute of a compressed file is a 16 byte header of magic, compression type and
+// uncompressed size. Small files follow it in the attribute, larger ones are kept in the
+// resource fork in chunks of decmpfsChunkSize bytes.
+const (
+	DecmpfsMagic = "fpmc" // 'cmpf' as a little endian uint32
+	decmpfsHeaderSize = 16
+	decmpfsChunkSize = 0x10000
+	MaxDecmpfsAttributeSize = 0x10000 // held in memory along with its decompressed data
+	maxCompressedChunkSize = 2 * decmpfsChunkSize
+
+	CompressionUncompressedAttribute = 1
+	CompressionZlibAttribute = 3
+	CompressionZlibResourceFork = 4
+	CompressionLZVNAttribute = 7
+	CompressionLZVNResourceFork = 8
+	CompressionLZFSEAttribute = 11
+	CompressionLZFSEResourceFork = 12
+
+	// A zlib stream always starts with a low nibble of 8, so 0x0f marks data stored as is
+	zlibUncompressedMask = 0x0f
+	// An LZVN end of stream opcode first marks data stored as is
+	lzvnUncompressed = 0x06
+
+	// The zlib resource fork keeps its chunk table in the resource data, which starts at the
+	// big endian offset at the head of the fork with a big endian length
+	zlibForkHeaderSize = 16
+	zlibChunkEntrySize = 8
+)
+
+// chunkReader decodes a compressed file one chunk at a time, keeping the last chunk decoded
+type chunkReader struct {
+	size uint64
+	chunkSize uint64
+	chunk func(index int, rawBytes int) ([]byte, error)
+
+	index int
+	data []byte
+}
+
+// chunkRawBytes returns the uncompressed size of a chunk
+func (reader *chunkReader) chunkRawBytes(index int) int {
+	remaining := reader.size - uint64(index) * reader.chunkSize
+	if remaining > reader.chunkSize {
+		return int(reader.chunkSize)
+	}
+
+	return int(remaining)
+}
+
+func (reader *chunkReader) ReadAt(buffer []byte, offset int64) (int, error) {
+	return readAt(buffer, offset, reader.size, func(part []byte, start uint64) error {
+		for len(part) > 0 {
+			index := int(start / reader.chunkSize)
+			if reader.data == nil || reader.index != index {
+				rawBytes := reader.chunkRawBytes(index)
+				data, err := reader.chunk(index, rawBytes)
+				if err != nil { return fmt.Errorf("chunk %d: %s", index, err) }
+				if len(data) != rawBytes {
+					return fmt.Errorf("chunk %d decompressed to 0x%x bytes, expected 0x%x", index, len(data), rawBytes)
+				}
+				reader.index, reader.data = index, data
+			}
+
+			copied := copy(part, reader.data[(start - uint64(index) * reader.chunkSize):])
+			part = part[copied:]
+			start += uint64(copied)
+		}
+		return nil
+	})
+}
+
+// readAll reads length bytes at offset, failing on a short read
+func readAll(reader io.ReaderAt, offset uint64, length uint64) ([]byte, error) {
+	result := make([]byte, length)
+	_, err := reader.ReadAt(result, int64(offset))
+	if err == io.EOF {
+		return nil, fmt.Errorf("range 0x%x+0x%x is out of bounds", offset, length)
+	}
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// readXattr returns the data of an extended attribute, embedded or from its stream
+func (fs *FileSystem) readXattr(attribute *xattr) ([]byte, error) {
+	if attribute.Flags & XattrDataStream == 0 {
+		return attribute.Data, nil
+	}
+	if attribute.Size > MaxDecmpfsAttributeSize {
+		return nil, fmt.Errorf("attribute stream 0x%x is 0x%x bytes, more than 0x%x", attribute.StreamID, attribute.Size, MaxDecmpfsAttributeSize)
+	}
+
+	return readAll(fs.stream(attribute.StreamID, attribute.Size), 0, attribute.Size)
+}
+
+// openCompressed returns a reader for a file compressed by decmpfs
+func (fs *FileSystem) openCompressed(inode *Inode) (*File, error) {
+	header, err := fs.readXattr(inode.xattrs[XattrDecmpfs])
+	if err != nil { return nil, fmt.Errorf("inode 0x%x: %s", inode.ID, err) }
+	if len(header) < decmpfsHeaderSize || string(header[0:4]) != DecmpfsMagic {
+		return nil, fmt.Errorf("inode 0x%x: no decmpfs header", inode.ID)
+	}
+
+	compression := binary.LittleEndian.Uint32(header[4:8])
+	reader := &chunkReader{
+		size:      binary.LittleEndian.Uint64(header[8:16]),
+		chunkSize: decmpfsChunkSize,
+	}
+
+	var decode func(data []byte, rawBytes int) ([]byte, error)
+	switch compression {
+	case CompressionUncompressedAttribute:
+		decode = func(data []byte, _ int) ([]byte, error) { return data, nil }
+	case CompressionZlibAttribute, CompressionZlibResourceFork:
+		decode = inflateChunk
+	case CompressionLZVNAttribute, CompressionLZVNResourceFork:
+		decode = lzvnChunk
+	case CompressionLZFSEAttribute, CompressionLZFSEResourceFork:
+		decode = lzfse.DecompressLimit
+	default:
+		return nil, fmt.Errorf("inode 0x%x: unsupported compression type %d", inode.ID, compression)
+	}
+
+	switch compression {
+	case CompressionZlibResourceFork, CompressionLZVNResourceFork, CompressionLZFSEResourceFork:
+		fork := inode.xattrs[XattrResourceFork]
+		if fork == nil || fork.Flags & XattrDataStream == 0 {
+			return nil, fmt.Errorf("inode 0x%x: compression type %d without a resource fork stream", inode.ID, compression)
+		}
+
+		chunks := (reader.size + decmpfsChunkSize - 1) / decmpfsChunkSize
+		stream := fs.stream(fork.StreamID, fork.Size)
+		if compression == CompressionZlibResourceFork {
+			reader.chunk, err = zlibResourceFork(stream, chunks, decode)
+		} else {
+			reader.chunk, err = chunkedResourceFork(stream, chunks, decode)
+		}
+		if err != nil { return nil, fmt.Errorf("inode 0x%x resource fork: %s", inode.ID, err) }
+
+	default:
+		// Data kept in the attribute is a single chunk of the whole file
+		data := header[decmpfsHeaderSize:]
+		reader.chunkSize = reader.size
+		reader.chunk = func(_ int, rawBytes int) ([]byte, error) { return decode(data, rawBytes) }
+	}
+
+	return &File{reader: reader, Size: reader.size}, nil
+}
+
+// inflateChunk decodes one zlib chunk of at most limit bytes
+func inflateChunk(data []byte, limit int) ([]byte, error) {
+	if len(data) > 0 && data[0] & zlibUncompressedMask == zlibUncompressedMask {
+		return data[1:], nil
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil { return nil, err }
+	defer reader.Close()
+
+	result, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit) + 1))
+	if err != nil { return nil, err }
+	if len(result) > limit {
+		return nil, fmt.Errorf("zlib chunk exceeds %d bytes", limit)
+	}
+
+	return result, nil
+}
+
+// lzvnChunk decodes one LZVN chunk of exactly rawBytes bytes
+func lzvnChunk(data []byte, rawBytes int) ([]byte, error) {
+	if len(data) > 0 && data[0] == lzvnUncompressed {
+		return data[1:], nil
+	}
+
+	return lzfse.DecompressLZVN(data, rawBytes)
+}
+
+// chunkedResourceFork reads a resource fork that starts with a table of little endian chunk
+// offsets from the start of the fork, one more than there are chunks so that each chunk ends
+// where the next starts
+func chunkedResourceFork(fork *streamReader, chunks uint64, decode func([]byte, int) ([]byte, error)) (func(int, int) ([]byte, error), error) {
+	if (chunks + 1) * 4 > fork.size {
+		return nil, fmt.Errorf("fork is too short for %d chunk offsets", chunks + 1)
+	}
+
+	return func(index int, rawBytes int) ([]byte, error) {
+		offsets, err := readAll(fork, uint64(index) * 4, 8)
+		if err != nil { return nil, err }
+
+		start := uint64(binary.LittleEndian.Uint32(offsets[0:4]))
+		end := uint64(binary.LittleEndian.Uint32(offsets[4:8]))
+		if start > end || end > fork.size || end - start > maxCompressedChunkSize {
+			return nil, fmt.Errorf("range 0x%x-0x%x is out of bounds", start, end)
+		}
+
+		data, err := readAll(fork, start, end - start)
+		if err != nil { return nil, err }
+
+		return decode(data, rawBytes)
+	}, nil
+}
+
+// zlibResourceFork reads a zlib resource fork. Its resource data holds a big endian length,
+// then a little endian chunk count and a table of offset and size pairs relative to the count.
+func zlibResourceFork(fork *streamReader, chunks uint64, decode func([]byte, int) ([]byte, error)) (func(int, int) ([]byte, error), error) {
+	header, err := readAll(fork, 0, zlibForkHeaderSize)
+	if err != nil { return nil, err }
+
+	dataOffset := uint64(binary.BigEndian.Uint32(header[0:4]))
+	table, err := readAll(fork, dataOffset, 8)
+	if err != nil { return nil, fmt.Errorf("resource data: %s", err) }
+	if uint64(binary.LittleEndian.Uint32(table[4:8])) != chunks {
+		return nil, fmt.Errorf("%d chunks, expected %d", binary.LittleEndian.Uint32(table[4:8]), chunks)
+	}
+	tableOffset := dataOffset + 4
+
+	return func(index int, rawBytes int) ([]byte, error) {
+		entry, err := readAll(fork, tableOffset + 4 + uint64(index) * zlibChunkEntrySize, zlibChunkEntrySize)
+		if err != nil { return nil, err }
+
+		length := uint64(binary.LittleEndian.Uint32(entry[4:8]))
+		if length > maxCompressedChunkSize {
+			return nil, fmt.Errorf("0x%x compressed bytes", length)
+		}
+
+		data, err := readAll(fork, tableOffset + uint64(binary.LittleEndian.Uint32(entry[0:4])), length)
+		if err != nil { return nil, err }
+
+		return decode(data, rawBytes)
+	}, nil
+}
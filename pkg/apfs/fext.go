@@ -0,0 +1,185 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	fextKeySize = 16 // fext_tree_key_t
+	fextValueSize = 16 // fext_tree_val_t
+
+	RecordTypeFileInfo = 13
+
+	// j_file_info_key_t packs the info type into the top byte of the logical block address
+	fileInfoLBAMask = 0x00ffffffffffffff
+	fileInfoTypeShift = 56
+	FileInfoDataHash = 1
+
+	extentLengthMask = 0x00ffffffffffffff
+	extentFlagsShift = 56
+)
+
+// FileExtent maps a run of a file's data to physical blocks. Sealed volumes keep these in the
+// file extent tree rather than the file-system tree.
+type FileExtent struct {
+	PrivateID uint64 // the file's data stream id
+	LogicalAddress uint64 // in bytes from the start of the file
+	Length uint64 // in bytes
+	Flags uint8
+	PhysicalBlock uint64 // zero for a sparse run
+}
+
+// FileDataHash is a j_file_data_hash_val_t record, the hash of HashedBlocks blocks of a file's
+// data starting at LogicalBlock
+type FileDataHash struct {
+	PrivateID uint64
+	LogicalBlock uint64
+	HashedBlocks uint16
+	Hash []byte
+}
+
+// FileExtents lists the file extent tree of a sealed volume in key order
+func (volume *Volume) FileExtents() ([]*FileExtent, error) {
+	if volume.FextTreeOID == 0 {
+		return nil, fmt.Errorf("volume %s has no file extent tree", volume.Name)
+	}
+
+	tree, err := volume.container.openTree(volume.FextTreeOID, nil)
+	if err != nil { return nil, fmt.Errorf("file extent tree: %s", err) }
+	if tree.info.KeySize != fextKeySize || tree.info.ValueSize != fextValueSize {
+		return nil, fmt.Errorf("file extent tree has %d byte keys and %d byte values", tree.info.KeySize, tree.info.ValueSize)
+	}
+
+	result := make([]*FileExtent, 0)
+	err = tree.walk(func(key []byte, value []byte) error {
+		if value == nil {
+			return nil
+		}
+
+		lengthAndFlags := binary.LittleEndian.Uint64(value[0:8])
+		result = append(result, &FileExtent{
+			PrivateID:      binary.LittleEndian.Uint64(key[0:8]),
+			LogicalAddress: binary.LittleEndian.Uint64(key[8:16]),
+			Length:         lengthAndFlags & extentLengthMask,
+			Flags:          uint8(lengthAndFlags >> extentFlagsShift),
+			PhysicalBlock:  binary.LittleEndian.Uint64(value[8:16]),
+		})
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// FileDataHashes lists the file data hash records of the file-system tree
+func (volume *Volume) FileDataHashes() ([]*FileDataHash, error) {
+	tree, err := volume.container.openTree(volume.RootTreeOID, volume.omap.lookup)
+	if err != nil { return nil, fmt.Errorf("file-system tree: %s", err) }
+
+	result := make([]*FileDataHash, 0)
+	err = tree.walk(func(key []byte, value []byte) error {
+		if len(key) < 8 {
+			return fmt.Errorf("file-system record key is too short")
+		}
+
+		oid, recordType := recordKey(key)
+		if recordType != RecordTypeFileInfo {
+			return nil
+		}
+		if len(key) < 16 || len(value) < 3 {
+			return fmt.Errorf("file info record of 0x%x is too short", oid)
+		}
+
+		infoAndLBA := binary.LittleEndian.Uint64(key[8:16])
+		if infoAndLBA >> fileInfoTypeShift != FileInfoDataHash {
+			return nil
+		}
+
+		hash, err := slice(value, 3, int(value[2]))
+		if err != nil { return fmt.Errorf("file data hash of 0x%x: %s", oid, err) }
+
+		result = append(result, &FileDataHash{
+			PrivateID:    oid,
+			LogicalBlock: infoAndLBA & fileInfoLBAMask,
+			HashedBlocks: binary.LittleEndian.Uint16(value[0:2]),
+			Hash:         hash,
+		})
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// readFileData reads length bytes of a file's data from offset through its extents, with sparse
+// runs and anything past the last extent reading as zeros
+func (volume *Volume) readFileData(extents []*FileExtent, offset uint64, length uint64) ([]byte, error) {
+	result := make([]byte, length)
+	err := volume.fillFileData(extents, offset, result)
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// fillFileData reads len(result) bytes of a file's data from offset into result, which must
+// start zeroed for sparse runs to read as zeros
+func (volume *Volume) fillFileData(extents []*FileExtent, offset uint64, result []byte) error {
+	length := uint64(len(result))
+	blockSize := uint64(volume.container.BlockSize)
+	for _, extent := range extents {
+		start, end := extent.LogicalAddress, extent.LogicalAddress + extent.Length
+		if end <= offset || start >= offset + length || extent.PhysicalBlock == 0 {
+			continue
+		}
+		if start < offset {
+			start = offset
+		}
+		if end > offset + length {
+			end = offset + length
+		}
+
+		position := extent.PhysicalBlock * blockSize + (start - extent.LogicalAddress)
+		_, err := volume.container.reader.ReadAt(result[(start - offset):(end - offset)], int64(position))
+		if err != nil {
+			return fmt.Errorf("extent of 0x%x at 0x%x: %s", extent.PrivateID, extent.LogicalAddress, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyFileData recomputes every file data hash of a sealed volume from the blocks its file
+// extents point to, returning the number of records checked and an error for each mismatch.
+// Hashes are taken over whole blocks, the tail of the last one reading as zeros.
+func (volume *Volume) VerifyFileData(integrity *IntegrityMetadata) (int, []error) {
+	extents, err := volume.FileExtents()
+	if err != nil { return 0, []error{err} }
+
+	hashes, err := volume.FileDataHashes()
+	if err != nil { return 0, []error{err} }
+
+	byFile := make(map[uint64][]*FileExtent)
+	for _, extent := range extents {
+		byFile[extent.PrivateID] = append(byFile[extent.PrivateID], extent)
+	}
+
+	errors := make([]error, 0)
+	blockSize := uint64(volume.container.BlockSize)
+	for _, record := range hashes {
+		data, err := volume.readFileData(byFile[record.PrivateID], record.LogicalBlock * blockSize, uint64(record.HashedBlocks) * blockSize)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+
+		hash, err := hashData(integrity.HashType, data)
+		if err != nil { return len(hashes), append(errors, err) }
+		if !bytes.Equal(hash, record.Hash) {
+			errors = append(errors, fmt.Errorf("file 0x%x blocks 0x%x+0x%x hash to %x, expected %x", record.PrivateID, record.LogicalBlock, record.HashedBlocks, hash, record.Hash))
+		}
+	}
+
+	return len(hashes), errors
+}
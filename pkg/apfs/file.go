@@ -0,0 +1,379 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	RecordTypeInode = 3
+	RecordTypeExtendedAttribute = 4
+	RecordTypeFileExtent = 8
+	RecordTypeDirectoryRecord = 9
+
+	RootDirectoryID = 2 // ROOT_DIR_INO_NUM
+
+	inodeValueSize = 0x5c // j_inode_val_t up to its extended fields
+	directoryRecordValueSize = 0x12 // j_drec_val_t up to its extended fields
+	fileExtentValueSize = 24 // j_file_extent_val_t
+
+	// j_drec_hashed_key_t packs the name length, terminator included, under the name hash
+	directoryNameLengthMask = 0x000003ff
+	DirectoryRecordTypeMask = 0x000f
+	DirectoryTypeDirectory = 4 // DT_DIR
+	DirectoryTypeRegular = 8 // DT_REG
+
+	InodeExtendedFieldDataStream = 8 // INO_EXT_TYPE_DSTREAM
+	dataStreamSize = 40 // j_dstream_t
+	xattrDataStreamSize = 8 + dataStreamSize // j_xattr_dstream_t
+
+	XattrDataStream = 0x0001
+	XattrDataEmbedded = 0x0002
+
+	BSDFlagCompressed = 0x00000020 // UF_COMPRESSED
+
+	XattrDecmpfs = "com.apple.decmpfs"
+	XattrResourceFork = "com.apple.ResourceFork"
+)
+
+// Inode holds the parts of a j_inode record needed to find and read a file
+type Inode struct {
+	ID uint64
+	ParentID uint64
+	PrivateID uint64 // the id the file's extents are keyed by
+	BSDFlags uint32
+	Mode uint16
+	UncompressedSize uint64
+	Size uint64 // of the data stream, zero when there is none
+
+	xattrs map[string]*xattr
+}
+
+// xattr is a j_xattr record, its data either embedded or in a stream of its own
+type xattr struct {
+	Flags uint16
+	Data []byte
+	StreamID uint64
+	Size uint64
+}
+
+// DirectoryEntry is a j_drec record, one name in a directory
+type DirectoryEntry struct {
+	ParentID uint64
+	Name string
+	FileID uint64
+	Flags uint16
+}
+
+// FileSystem is the directory hierarchy of a volume as read from its file-system tree. Only
+// the extended attributes that hold compressed file data are kept.
+type FileSystem struct {
+	volume *Volume
+	inodes map[uint64]*Inode
+	children map[uint64][]*DirectoryEntry
+	extents map[uint64][]*FileExtent
+}
+
+// Compressed reports whether the file's data is kept in its decmpfs attribute or resource fork
+func (inode *Inode) Compressed() bool {
+	return inode.BSDFlags & BSDFlagCompressed != 0 && inode.xattrs[XattrDecmpfs] != nil
+}
+
+// hashedNames reports whether directory records use j_drec_hashed_key_t keys
+func (volume *Volume) hashedNames() bool {
+	return volume.IncompatibleFeatures & (IncompatibleCaseInsensitive | IncompatibleNormalizationInsensitive) != 0
+}
+
+// cString returns data up to its first zero byte
+func cString(data []byte) string {
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+
+	return string(data)
+}
+
+func parseInode(id uint64, value []byte) (*Inode, error) {
+	if len(value) < inodeValueSize {
+		return nil, fmt.Errorf("inode 0x%x: record is too short", id)
+	}
+
+	result := &Inode{
+		ID:               id,
+		ParentID:         binary.LittleEndian.Uint64(value[0x00:0x08]),
+		PrivateID:        binary.LittleEndian.Uint64(value[0x08:0x10]),
+		BSDFlags:         binary.LittleEndian.Uint32(value[0x44:0x48]),
+		Mode:             binary.LittleEndian.Uint16(value[0x50:0x52]),
+		UncompressedSize: binary.LittleEndian.Uint64(value[0x54:0x5c]),
+		xattrs:           make(map[string]*xattr),
+	}
+
+	stream, err := extendedField(value[inodeValueSize:], InodeExtendedFieldDataStream)
+	if err != nil { return nil, fmt.Errorf("inode 0x%x: %s", id, err) }
+	if stream != nil {
+		if len(stream) < dataStreamSize {
+			return nil, fmt.Errorf("inode 0x%x: data stream field is too short", id)
+		}
+		result.Size = binary.LittleEndian.Uint64(stream[0:8])
+	}
+
+	return result, nil
+}
+
+// extendedField returns the data of the first field of a type in an xf_blob_t, or nil. Each
+// field's data starts after the x_field_t table, padded to 8 bytes.
+func extendedField(blob []byte, fieldType uint8) ([]byte, error) {
+	if len(blob) < 4 {
+		return nil, nil
+	}
+
+	count := int(binary.LittleEndian.Uint16(blob[0:2]))
+	offset := 4 + count * 4
+	for index := 0; index < count; index++ {
+		field, err := slice(blob, 4 + index * 4, 4)
+		if err != nil { return nil, fmt.Errorf("extended field %d: %s", index, err) }
+
+		size := int(binary.LittleEndian.Uint16(field[2:4]))
+		if field[0] == fieldType {
+			data, err := slice(blob, offset, size)
+			if err != nil { return nil, fmt.Errorf("extended field %d: %s", index, err) }
+			return data, nil
+		}
+		offset += (size + 7) &^ 7
+	}
+
+	return nil, nil
+}
+
+func (volume *Volume) parseDirectoryRecord(parent uint64, key []byte, value []byte) (*DirectoryEntry, error) {
+	var name []byte
+	var err error
+	if volume.hashedNames() {
+		if len(key) < 12 {
+			return nil, fmt.Errorf("directory 0x%x: record key is too short", parent)
+		}
+		name, err = slice(key, 12, int(binary.LittleEndian.Uint32(key[8:12]) & directoryNameLengthMask))
+	} else {
+		if len(key) < 10 {
+			return nil, fmt.Errorf("directory 0x%x: record key is too short", parent)
+		}
+		name, err = slice(key, 10, int(binary.LittleEndian.Uint16(key[8:10])))
+	}
+	if err != nil { return nil, fmt.Errorf("directory 0x%x name: %s", parent, err) }
+	if len(value) < directoryRecordValueSize {
+		return nil, fmt.Errorf("directory 0x%x: record is too short", parent)
+	}
+
+	return &DirectoryEntry{
+		ParentID: parent,
+		Name:     cString(name),
+		FileID:   binary.LittleEndian.Uint64(value[0x00:0x08]),
+		Flags:    binary.LittleEndian.Uint16(value[0x10:0x12]),
+	}, nil
+}
+
+func parseXattr(id uint64, key []byte, value []byte) (string, *xattr, error) {
+	if len(key) < 10 || len(value) < 4 {
+		return "", nil, fmt.Errorf("attribute of 0x%x: record is too short", id)
+	}
+
+	name, err := slice(key, 10, int(binary.LittleEndian.Uint16(key[8:10])))
+	if err != nil { return "", nil, fmt.Errorf("attribute of 0x%x name: %s", id, err) }
+
+	result := &xattr{Flags: binary.LittleEndian.Uint16(value[0:2])}
+	data, err := slice(value, 4, int(binary.LittleEndian.Uint16(value[2:4])))
+	if err != nil { return "", nil, fmt.Errorf("attribute %s of 0x%x: %s", cString(name), id, err) }
+
+	if result.Flags & XattrDataStream != 0 {
+		if len(data) < xattrDataStreamSize {
+			return "", nil, fmt.Errorf("attribute %s of 0x%x: data stream is too short", cString(name), id)
+		}
+		result.StreamID = binary.LittleEndian.Uint64(data[0:8])
+		result.Size = binary.LittleEndian.Uint64(data[8:16])
+	} else {
+		result.Data = data
+		result.Size = uint64(len(data))
+	}
+
+	return cString(name), result, nil
+}
+
+// FileSystem reads the inodes, directory records and file extents of the volume's file-system
+// tree, along with the file extent tree of sealed volumes
+func (volume *Volume) FileSystem() (*FileSystem, error) {
+	tree, err := volume.container.openTree(volume.RootTreeOID, volume.omap.lookup)
+	if err != nil { return nil, fmt.Errorf("file-system tree: %s", err) }
+
+	result := &FileSystem{
+		volume:   volume,
+		inodes:   make(map[uint64]*Inode),
+		children: make(map[uint64][]*DirectoryEntry),
+		extents:  make(map[uint64][]*FileExtent),
+	}
+
+	xattrs := make(map[uint64]map[string]*xattr)
+	err = tree.walk(func(key []byte, value []byte) error {
+		if len(key) < 8 {
+			return fmt.Errorf("file-system record key is too short")
+		}
+
+		oid, recordType := recordKey(key)
+		switch recordType {
+		case RecordTypeInode:
+			inode, err := parseInode(oid, value)
+			if err != nil { return err }
+			result.inodes[oid] = inode
+
+		case RecordTypeDirectoryRecord:
+			entry, err := volume.parseDirectoryRecord(oid, key, value)
+			if err != nil { return err }
+			result.children[oid] = append(result.children[oid], entry)
+
+		case RecordTypeExtendedAttribute:
+			name, attribute, err := parseXattr(oid, key, value)
+			if err != nil { return err }
+			if name != XattrDecmpfs && name != XattrResourceFork {
+				return nil
+			}
+			if xattrs[oid] == nil {
+				xattrs[oid] = make(map[string]*xattr)
+			}
+			xattrs[oid][name] = attribute
+
+		case RecordTypeFileExtent:
+			if len(key) < 16 || len(value) < fileExtentValueSize {
+				return fmt.Errorf("file extent of 0x%x: record is too short", oid)
+			}
+
+			lengthAndFlags := binary.LittleEndian.Uint64(value[0:8])
+			result.extents[oid] = append(result.extents[oid], &FileExtent{
+				PrivateID:      oid,
+				LogicalAddress: binary.LittleEndian.Uint64(key[8:16]),
+				Length:         lengthAndFlags & extentLengthMask,
+				Flags:          uint8(lengthAndFlags >> extentFlagsShift),
+				PhysicalBlock:  binary.LittleEndian.Uint64(value[8:16]),
+			})
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	for oid, attributes := range xattrs {
+		if inode := result.inodes[oid]; inode != nil {
+			inode.xattrs = attributes
+		}
+	}
+
+	if volume.FextTreeOID != 0 {
+		extents, err := volume.FileExtents()
+		if err != nil { return nil, err }
+
+		for _, extent := range extents {
+			result.extents[extent.PrivateID] = append(result.extents[extent.PrivateID], extent)
+		}
+	}
+
+	return result, nil
+}
+
+// Walk calls visit with the path and inode of every regular file below the root directory, in
+// directory record order, stopping at the first error. Files with several links are visited
+// once for each path.
+func (fs *FileSystem) Walk(visit func(path string, inode *Inode) error) error {
+	return fs.walkDirectory(RootDirectoryID, nil, make(map[uint64]bool), visit)
+}
+
+func (fs *FileSystem) walkDirectory(id uint64, path []string, visited map[uint64]bool, visit func(path string, inode *Inode) error) error {
+	if visited[id] {
+		return fmt.Errorf("directory 0x%x is its own ancestor", id)
+	}
+	visited[id] = true
+	defer delete(visited, id)
+
+	for _, entry := range fs.children[id] {
+		entryPath := append(path[:len(path):len(path)], entry.Name)
+		switch entry.Flags & DirectoryRecordTypeMask {
+		case DirectoryTypeDirectory:
+			err := fs.walkDirectory(entry.FileID, entryPath, visited, visit)
+			if err != nil { return err }
+
+		case DirectoryTypeRegular:
+			inode := fs.inodes[entry.FileID]
+			if inode == nil {
+				return fmt.Errorf("%s: no inode 0x%x", "/" + strings.Join(entryPath, "/"), entry.FileID)
+			}
+
+			err := visit("/" + strings.Join(entryPath, "/"), inode)
+			if err != nil { return err }
+		}
+	}
+
+	return nil
+}
+
+// File is the data of a regular file, read on demand. It is not safe for concurrent use.
+type File struct {
+	reader io.ReaderAt
+	Size uint64
+}
+
+// ReadAt reads the file's data, decompressing files kept compressed by decmpfs
+func (file *File) ReadAt(buffer []byte, offset int64) (int, error) {
+	return file.reader.ReadAt(buffer, offset)
+}
+
+// readAt implements io.ReaderAt over size bytes, read filling part from start
+func readAt(buffer []byte, offset int64, size uint64, read func(part []byte, start uint64) error) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	if uint64(offset) >= size {
+		return 0, io.EOF
+	}
+
+	count := len(buffer)
+	if uint64(count) > size - uint64(offset) {
+		count = int(size - uint64(offset))
+	}
+
+	err := read(buffer[:count], uint64(offset))
+	if err != nil { return 0, err }
+	if count < len(buffer) {
+		return count, io.EOF
+	}
+
+	return count, nil
+}
+
+// streamReader reads a data stream through its extents
+type streamReader struct {
+	volume *Volume
+	extents []*FileExtent
+	size uint64
+}
+
+func (reader *streamReader) ReadAt(buffer []byte, offset int64) (int, error) {
+	return readAt(buffer, offset, reader.size, func(part []byte, start uint64) error {
+		for index := range part {
+			part[index] = 0
+		}
+		return reader.volume.fillFileData(reader.extents, start, part)
+	})
+}
+
+// stream returns a reader for a data stream of size bytes
+func (fs *FileSystem) stream(id uint64, size uint64) *streamReader {
+	return &streamReader{volume: fs.volume, extents: fs.extents[id], size: size}
+}
+
+// Open returns the data of a regular file
+func (fs *FileSystem) Open(inode *Inode) (*File, error) {
+	if inode.Compressed() {
+		return fs.openCompressed(inode)
+	}
+
+	return &File{reader: fs.stream(inode.PrivateID, inode.Size), Size: inode.Size}, nil
+}
@@ -0,0 +1,137 @@
+package apfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// Structures and constants follow Apple's File System Reference
+const (
+	ObjectHeaderSize = 32
+	MinimumBlockSize = 4096
+	MaximumBlockSize = 65536
+
+	ObjectTypeMask = 0x0000ffff
+	ObjectStorageTypeMask = 0xc0000000
+	ObjectVirtual = 0x00000000
+	ObjectEphemeral = 0x80000000
+	ObjectPhysical = 0x40000000
+
+	ObjectTypeNXSuperblock = 0x01
+	ObjectTypeBtree = 0x02
+	ObjectTypeBtreeNode = 0x03
+	ObjectTypeOMap = 0x0b
+	ObjectTypeCheckpointMap = 0x0c
+	ObjectTypeFS = 0x0d
+	ObjectTypeFSTree = 0x0e
+	ObjectTypeBlockRefTree = 0x0f
+	ObjectTypeSnapMetaTree = 0x10
+	ObjectTypeOMapSnapshot = 0x13
+	ObjectTypeIntegrityMeta = 0x1e
+	ObjectTypeFextTree = 0x1f
+
+	HashSHA256 = 1
+	HashSHA512_256 = 2
+	HashSHA384 = 3
+	HashSHA512 = 4
+	HashMaxSize = 64
+)
+
+type ObjectHeader struct {
+	Checksum uint64
+	OID uint64
+	XID uint64
+	Type uint32 // with the storage flags
+	Subtype uint32
+}
+
+// fletcher64 computes the object checksum over data after its checksum field
+func fletcher64(data []byte) uint64 {
+	var sum1, sum2 uint64
+	for index := 8; index + 4 <= len(data); index += 4 {
+		sum1 = (sum1 + uint64(binary.LittleEndian.Uint32(data[index:]))) % 0xffffffff
+		sum2 = (sum2 + sum1) % 0xffffffff
+	}
+
+	check1 := 0xffffffff - (sum1 + sum2) % 0xffffffff
+	check2 := 0xffffffff - (sum1 + check1) % 0xffffffff
+	return check2 << 32 | check1
+}
+
+// parseObjectHeader decodes the header of an object block and checks its checksum
+func parseObjectHeader(data []byte) (*ObjectHeader, error) {
+	if len(data) < ObjectHeaderSize {
+		return nil, fmt.Errorf("not enough data for object header")
+	}
+
+	result := &ObjectHeader{
+		Checksum: binary.LittleEndian.Uint64(data[0x00:0x08]),
+		OID:      binary.LittleEndian.Uint64(data[0x08:0x10]),
+		XID:      binary.LittleEndian.Uint64(data[0x10:0x18]),
+		Type:     binary.LittleEndian.Uint32(data[0x18:0x1c]),
+		Subtype:  binary.LittleEndian.Uint32(data[0x1c:0x20]),
+	}
+
+	if fletcher64(data) != result.Checksum {
+		return nil, fmt.Errorf("object 0x%x: bad checksum", result.OID)
+	}
+
+	return result, nil
+}
+
+// ObjectType returns the object type without its storage flags
+func (header *ObjectHeader) ObjectType() uint32 {
+	return header.Type & ObjectTypeMask
+}
+
+// HashTypeName returns a display name for an APFS hash type
+func HashTypeName(hashType uint32) string {
+	switch hashType {
+	case HashSHA256:
+		return "sha256"
+	case HashSHA512_256:
+		return "sha512-256"
+	case HashSHA384:
+		return "sha384"
+	case HashSHA512:
+		return "sha512"
+	}
+
+	return fmt.Sprintf("unknown(%d)", hashType)
+}
+
+// NewHasher returns a hash.Hash for an APFS hash type
+func NewHasher(hashType uint32) (hash.Hash, error) {
+	switch hashType {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512_256:
+		return sha512.New512_256(), nil
+	case HashSHA384:
+		return sha512.New384(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	}
+
+	return nil, fmt.Errorf("unknown hash type %d", hashType)
+}
+
+// HashSize returns the digest length of an APFS hash type
+func HashSize(hashType uint32) (int, error) {
+	hasher, err := NewHasher(hashType)
+	if err != nil { return 0, err }
+
+	return hasher.Size(), nil
+}
+
+// hashData hashes data with an APFS hash type
+func hashData(hashType uint32, data []byte) ([]byte, error) {
+	hasher, err := NewHasher(hashType)
+	if err != nil { return nil, err }
+
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,75 @@
+package apfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	omapKeySize = 16 // omap_key_t
+	omapValueSize = 16 // omap_val_t
+
+	OMapValueDeleted = 0x00000001
+	OMapValueSaved = 0x00000002
+	OMapValueEncrypted = 0x00000004
+	OMapValueNoHeader = 0x00000008
+)
+
+// objectMap resolves virtual oids to physical addresses as of a transaction
+type objectMap struct {
+	tree *btree
+	xid uint64
+}
+
+// readObjectMap reads the omap_phys_t at address, resolving oids as of xid
+func (container *Container) readObjectMap(address uint64, xid uint64) (*objectMap, error) {
+	data, _, err := container.readObject(address, ObjectTypeOMap)
+	if err != nil { return nil, err }
+
+	tree, err := container.openTree(binary.LittleEndian.Uint64(data[0x30:0x38]), nil)
+	if err != nil { return nil, err }
+	if tree.info.KeySize != omapKeySize || tree.info.ValueSize != omapValueSize {
+		return nil, fmt.Errorf("object map tree has %d byte keys and %d byte values", tree.info.KeySize, tree.info.ValueSize)
+	}
+
+	return &objectMap{tree: tree, xid: xid}, nil
+}
+
+// at returns the same object map resolving oids as of an earlier transaction, as snapshots do
+func (omap *objectMap) at(xid uint64) *objectMap {
+	return &objectMap{tree: omap.tree, xid: xid}
+}
+
+// lookup returns the physical address of the newest version of oid at or before the map's
+// transaction
+func (omap *objectMap) lookup(oid uint64) (uint64, error) {
+	entry, found, err := omap.tree.floor(func(key []byte) int {
+		keyOID := binary.LittleEndian.Uint64(key[0:8])
+		keyXID := binary.LittleEndian.Uint64(key[8:16])
+		switch {
+		case keyOID < oid:
+			return -1
+		case keyOID > oid:
+			return 1
+		case keyXID < omap.xid:
+			return -1
+		case keyXID > omap.xid:
+			return 1
+		}
+		return 0
+	})
+	if err != nil { return 0, err }
+	if !found || binary.LittleEndian.Uint64(entry.Key[0:8]) != oid || entry.Value == nil {
+		return 0, fmt.Errorf("oid 0x%x is not in the object map at xid %d", oid, omap.xid)
+	}
+
+	flags := binary.LittleEndian.Uint32(entry.Value[0:4])
+	if flags & OMapValueDeleted != 0 {
+		return 0, fmt.Errorf("oid 0x%x was deleted by xid %d", oid, omap.xid)
+	}
+	if flags & OMapValueEncrypted != 0 {
+		return 0, fmt.Errorf("oid 0x%x is encrypted", oid)
+	}
+
+	return binary.LittleEndian.Uint64(entry.Value[8:16]), nil
+}
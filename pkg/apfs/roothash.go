@@ -0,0 +1,64 @@
+package apfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The payload of the root_hash IM4P (type xsys) that seals a system volume. Its layout is not
+// documented; as observed it is a 16 byte header of version, flags, APFS hash type and hash
+// size, followed by slots of HashMaxSize bytes each holding a hash padded with zeros.
+const RootHashHeaderSize = 16
+
+type RootHash struct {
+	Version uint32
+	Flags uint32
+	HashType uint32
+	Hashes [][]byte
+}
+
+// ParseRootHash decodes a root hash payload
+func ParseRootHash(data []byte) (*RootHash, error) {
+	if len(data) < RootHashHeaderSize {
+		return nil, fmt.Errorf("not enough data for root hash header")
+	}
+
+	result := &RootHash{
+		Version:  binary.LittleEndian.Uint32(data[0:4]),
+		Flags:    binary.LittleEndian.Uint32(data[4:8]),
+		HashType: binary.LittleEndian.Uint32(data[8:12]),
+		Hashes:   make([][]byte, 0),
+	}
+
+	size, err := HashSize(result.HashType)
+	if err != nil { return nil, err }
+	if recorded := binary.LittleEndian.Uint32(data[12:16]); recorded != uint32(size) {
+		return nil, fmt.Errorf("hash size %d does not match %s", recorded, HashTypeName(result.HashType))
+	}
+
+	slots := data[RootHashHeaderSize:]
+	if len(slots) == 0 || len(slots) % HashMaxSize != 0 {
+		return nil, fmt.Errorf("0x%x bytes of hashes is not a whole number of slots", len(slots))
+	}
+
+	for offset := 0; offset < len(slots); offset += HashMaxSize {
+		result.Hashes = append(result.Hashes, slots[offset:(offset + size)])
+	}
+
+	return result, nil
+}
+
+// Match returns the index of the slot holding hash, or -1
+func (rootHash *RootHash) Match(hashType uint32, hash []byte) int {
+	if hashType != rootHash.HashType {
+		return -1
+	}
+
+	for index, candidate := range rootHash.Hashes {
+		if string(candidate) == string(hash) {
+			return index
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,248 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	VolumeSuperblockMagic = "APSB"
+	VolumeNameSize = 256
+
+	IncompatibleCaseInsensitive = 0x00000001
+	IncompatibleDatalessSnapshots = 0x00000002
+	IncompatibleEncryptionRolled = 0x00000004
+	IncompatibleNormalizationInsensitive = 0x00000008
+	IncompatibleIncompleteRestore = 0x00000010
+	IncompatibleSealedVolume = 0x00000020
+
+	RoleSystem = 0x0001
+	RoleUser = 0x0002
+	RoleRecovery = 0x0004
+	RoleVM = 0x0008
+	RolePreboot = 0x0010
+	RoleInstaller = 0x0020
+	RoleData = 0x0040 // roles from here on are stored shifted, as in APFS_VOLUME_ENUM_SHIFT
+	RoleBaseband = 0x0080
+	RoleUpdate = 0x00c0
+	RoleXART = 0x0100
+	RoleHardware = 0x0140
+	RoleBackup = 0x0180
+
+	// j_key_t packs a record type into the top bits of the object id
+	recordOIDMask = 0x0fffffffffffffff
+	recordTypeShift = 60
+
+	RecordTypeSnapshotMetadata = 1
+	RecordTypeSnapshotName = 11
+)
+
+type Volume struct {
+	container *Container
+	omap *objectMap
+
+	Header *ObjectHeader
+	Index uint32
+	Features uint64
+	ReadOnlyCompatibleFeatures uint64
+	IncompatibleFeatures uint64
+	OMapOID uint64
+	RootTreeOID uint64
+	SnapshotMetadataTreeOID uint64
+	NumberOfSnapshots uint64
+	UUID uuid.UUID
+	Name string
+	Role uint16
+	IntegrityMetadataOID uint64
+	FextTreeOID uint64
+	Snapshot *Snapshot // set when the volume is viewed as of a snapshot
+}
+
+type Snapshot struct {
+	XID uint64
+	Name string
+	SuperblockAddress uint64
+	ExtentReferenceTreeOID uint64
+	Created time.Time
+	Changed time.Time
+	Flags uint32
+}
+
+type IntegrityMetadata struct {
+	Header *ObjectHeader
+	Version uint32
+	Flags uint32
+	HashType uint32
+	RootHash []byte
+	BrokenXID uint64 // the transaction that broke the seal, zero while it holds
+}
+
+// IntegrityFlagSealBroken is set in im_flags once the volume has been modified after sealing
+const IntegrityFlagSealBroken = 0x00000001
+
+func parseVolumeSuperblock(data []byte, header *ObjectHeader) (*Volume, error) {
+	if string(data[0x20:0x24]) != VolumeSuperblockMagic {
+		return nil, fmt.Errorf("no %s magic", VolumeSuperblockMagic)
+	}
+	if len(data) < 0x420 {
+		return nil, fmt.Errorf("not enough data for volume superblock")
+	}
+
+	result := &Volume{
+		Header:                     header,
+		Index:                      binary.LittleEndian.Uint32(data[0x24:0x28]),
+		Features:                   binary.LittleEndian.Uint64(data[0x28:0x30]),
+		ReadOnlyCompatibleFeatures: binary.LittleEndian.Uint64(data[0x30:0x38]),
+		IncompatibleFeatures:       binary.LittleEndian.Uint64(data[0x38:0x40]),
+		OMapOID:                    binary.LittleEndian.Uint64(data[0x80:0x88]),
+		RootTreeOID:                binary.LittleEndian.Uint64(data[0x88:0x90]),
+		SnapshotMetadataTreeOID:    binary.LittleEndian.Uint64(data[0x98:0xa0]),
+		NumberOfSnapshots:          binary.LittleEndian.Uint64(data[0xd8:0xe0]),
+		Role:                       binary.LittleEndian.Uint16(data[0x3c4:0x3c6]),
+		IntegrityMetadataOID:       binary.LittleEndian.Uint64(data[0x400:0x408]),
+		FextTreeOID:                binary.LittleEndian.Uint64(data[0x408:0x410]),
+	}
+	copy(result.UUID[:], data[0xf0:0x100])
+
+	name := data[0x2c0:(0x2c0 + VolumeNameSize)]
+	if end := bytes.IndexByte(name, 0); end >= 0 {
+		name = name[:end]
+	}
+	result.Name = string(name)
+
+	return result, nil
+}
+
+// openVolume reads the volume superblock at address along with the volume's object map
+func (container *Container) openVolume(address uint64) (*Volume, error) {
+	data, header, err := container.readObject(address, ObjectTypeFS)
+	if err != nil { return nil, err }
+
+	result, err := parseVolumeSuperblock(data, header)
+	if err != nil { return nil, err }
+
+	result.container = container
+	result.omap, err = container.readObjectMap(result.OMapOID, header.XID)
+	if err != nil { return nil, fmt.Errorf("volume object map: %s", err) }
+
+	return result, nil
+}
+
+// Sealed reports whether the volume is a signed system volume
+func (volume *Volume) Sealed() bool {
+	return volume.IncompatibleFeatures & IncompatibleSealedVolume != 0
+}
+
+// recordKey splits a j_key_t into its object id and record type
+func recordKey(key []byte) (uint64, uint8) {
+	value := binary.LittleEndian.Uint64(key[0:8])
+	return value & recordOIDMask, uint8(value >> recordTypeShift)
+}
+
+func apfsTime(value uint64) time.Time {
+	return time.Unix(0, int64(value)).UTC()
+}
+
+// Snapshots lists the volume's snapshots from its snapshot metadata tree, oldest first
+func (volume *Volume) Snapshots() ([]*Snapshot, error) {
+	result := make([]*Snapshot, 0)
+	if volume.SnapshotMetadataTreeOID == 0 {
+		return result, nil
+	}
+
+	tree, err := volume.container.openTree(volume.SnapshotMetadataTreeOID, nil)
+	if err != nil { return nil, fmt.Errorf("snapshot metadata tree: %s", err) }
+
+	err = tree.walk(func(key []byte, value []byte) error {
+		if len(key) < 8 {
+			return fmt.Errorf("snapshot record key is too short")
+		}
+
+		xid, recordType := recordKey(key)
+		if recordType != RecordTypeSnapshotMetadata {
+			return nil
+		}
+		if len(value) < 0x32 {
+			return fmt.Errorf("snapshot %d: record is too short", xid)
+		}
+
+		nameLength := int(binary.LittleEndian.Uint16(value[0x30:0x32]))
+		name, err := slice(value, 0x32, nameLength)
+		if err != nil { return fmt.Errorf("snapshot %d name: %s", xid, err) }
+
+		result = append(result, &Snapshot{
+			XID:                    xid,
+			Name:                   string(bytes.TrimRight(name, "\x00")),
+			SuperblockAddress:      binary.LittleEndian.Uint64(value[0x08:0x10]),
+			ExtentReferenceTreeOID: binary.LittleEndian.Uint64(value[0x00:0x08]),
+			Created:                apfsTime(binary.LittleEndian.Uint64(value[0x10:0x18])),
+			Changed:                apfsTime(binary.LittleEndian.Uint64(value[0x18:0x20])),
+			Flags:                  binary.LittleEndian.Uint32(value[0x2c:0x30]),
+		})
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	return result, nil
+}
+
+// AtSnapshot returns the volume as it was when a snapshot was taken, reading the snapshot's
+// copy of the volume superblock and resolving oids as of its transaction
+func (volume *Volume) AtSnapshot(snapshot *Snapshot) (*Volume, error) {
+	data, header, err := volume.container.readObject(snapshot.SuperblockAddress, ObjectTypeFS)
+	if err != nil { return nil, fmt.Errorf("snapshot %s: %s", snapshot.Name, err) }
+
+	result, err := parseVolumeSuperblock(data, header)
+	if err != nil { return nil, fmt.Errorf("snapshot %s: %s", snapshot.Name, err) }
+
+	result.container = volume.container
+	result.omap = volume.omap.at(snapshot.XID)
+	result.Snapshot = snapshot
+	return result, nil
+}
+
+// readVirtual reads a virtual object of the volume
+func (volume *Volume) readVirtual(oid uint64, objectType uint32) ([]byte, *ObjectHeader, error) {
+	address, err := volume.omap.lookup(oid)
+	if err != nil { return nil, nil, err }
+
+	return volume.container.readObject(address, objectType)
+}
+
+// IntegrityMetadata reads the integrity_meta_phys_t of a sealed volume, a virtual object
+func (volume *Volume) IntegrityMetadata() (*IntegrityMetadata, error) {
+	if volume.IntegrityMetadataOID == 0 {
+		return nil, fmt.Errorf("volume %s has no integrity metadata", volume.Name)
+	}
+
+	data, header, err := volume.readVirtual(volume.IntegrityMetadataOID, ObjectTypeIntegrityMeta)
+	if err != nil { return nil, fmt.Errorf("integrity metadata: %s", err) }
+
+	result := &IntegrityMetadata{
+		Header:    header,
+		Version:   binary.LittleEndian.Uint32(data[0x20:0x24]),
+		Flags:     binary.LittleEndian.Uint32(data[0x24:0x28]),
+		HashType:  binary.LittleEndian.Uint32(data[0x28:0x2c]),
+		BrokenXID: binary.LittleEndian.Uint64(data[0x30:0x38]),
+	}
+
+	size, err := HashSize(result.HashType)
+	if err != nil { return nil, fmt.Errorf("integrity metadata: %s", err) }
+
+	result.RootHash, err = slice(data, int(binary.LittleEndian.Uint32(data[0x2c:0x30])), size)
+	if err != nil { return nil, fmt.Errorf("integrity metadata root hash: %s", err) }
+
+	return result, nil
+}
+
+// VerifyRootTree checks the file-system tree's Merkle tree against the integrity metadata's
+// root hash, returning the number of nodes checked
+func (volume *Volume) VerifyRootTree(integrity *IntegrityMetadata) (int, error) {
+	tree, err := volume.container.openTree(volume.RootTreeOID, volume.omap.lookup)
+	if err != nil { return 0, fmt.Errorf("file-system tree: %s", err) }
+
+	return tree.verifyHashes(integrity.HashType, integrity.RootHash)
+}
@@ -1,4 +1,4 @@
-package main
+package chunklist
 
 import (
 	"bytes"
@@ -8,8 +8,6 @@ import (
 	"github.com/google/uuid"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
 )
 
 const ChunklistMagic = 0x4C4B4E43
@@ -24,6 +22,7 @@ const ChunklistPubkeyLen = 2048/8
 const ChunklistSignatureLen = 2048/8
 const Sha256DigestLength = 32
 const HashBufferSize = 1024 * 32
+const ChunklistHeaderSize = 0x24
 
 type chunklistSignature interface {
 	verify(bytes []uint8) error
@@ -42,6 +41,17 @@ type Chunklist struct {
 	signature		chunklistSignature
 }
 
+// ChunklistHeader is the header of a chunklist, which describes the chunks of a DMG or package
+type ChunklistHeader struct {
+	HeaderSize uint32
+	FileVersion uint8
+	ChunkMethod uint8
+	SignatureMethod uint8
+	ChunkCount uint64
+	ChunkOffset uint64
+	SignatureOffset uint64
+}
+
 type ChunklistChunk struct {
 	chunkSize uint32
   	chunkHash []byte
@@ -63,6 +73,31 @@ type ChunklistPubkey struct {
 	key          [ChunklistPubkeyLen]byte
 }
 
+// ParseChunklistHeader decodes the header at the start of a chunklist
+func ParseChunklistHeader(data []byte) (*ChunklistHeader, error) {
+	if len(data) < ChunklistHeaderSize {
+		return nil, fmt.Errorf("not enough data for chunklist header")
+	}
+	if binary.LittleEndian.Uint32(data[0:4]) != ChunklistMagic {
+		return nil, fmt.Errorf("bad magic %X", binary.LittleEndian.Uint32(data[0:4]))
+	}
+
+	result := &ChunklistHeader{
+		HeaderSize:      binary.LittleEndian.Uint32(data[0x04:0x08]),
+		FileVersion:     data[0x08],
+		ChunkMethod:     data[0x09],
+		SignatureMethod: data[0x0a],
+		ChunkCount:      binary.LittleEndian.Uint64(data[0x0c:0x14]),
+		ChunkOffset:     binary.LittleEndian.Uint64(data[0x14:0x1c]),
+		SignatureOffset: binary.LittleEndian.Uint64(data[0x1c:0x24]),
+	}
+	if result.HeaderSize != ChunklistHeaderSize || result.ChunkOffset > result.SignatureOffset {
+		return nil, fmt.Errorf("invalid chunklist header")
+	}
+
+	return result, nil
+}
+
 func readChunklistPublicKey(file *os.File) (*ChunklistPubkey, error) {
 	return new(ChunklistPubkey), nil
 }
@@ -165,59 +200,3 @@ func (certificate ChunklistCertificate) verify(bytes []uint8) error {
 	// TODO: verify certificate
 	return nil
 }
-
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Print("File is required")
-		os.Exit(-1)
-	}
-
-	_, err := os.Stat(os.Args[1])
-	if os.IsExist(err) {
-		fmt.Printf("File %s does not exist or it cannot be read", os.Args[1])
-		os.Exit(-2)
-	}
-
-	ext := filepath.Ext(os.Args[1])
-	if ext == "chunklist" {
-		fmt.Print("Specify the name of the file to verify, not the chunklist\n")
-		os.Exit(-3)
-	}
-
-	chunklistPath := fmt.Sprintf("%s.chunklist", strings.TrimSuffix(os.Args[1], ext))
-	_, err = os.Stat(chunklistPath)
-	if os.IsExist(err) {
-		fmt.Printf("Chunklist file %s does not exist\n", chunklistPath)
-		os.Exit(-4)
-	}
-
-	chunklistFile, err := os.Open(chunklistPath)
-	if err != nil {
-		fmt.Printf("Could not open file %s\n", chunklistPath)
-		os.Exit(-5)
-	}
-
-	chunklist, err := readChunklist(chunklistFile)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-6)
-	}
-
-	targetFile, err := os.Open(os.Args[1])
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-7)
-	}
-
-	fmt.Printf("Verifying %d chunks\n", chunklist.chunkCount)
-	verificationErrors := chunklist.verify(targetFile)
-	if len(verificationErrors) == 0 {
-		fmt.Print("File verification successful\n")
-		os.Exit(0)
-	}
-
-	for _, err = range verificationErrors {
-		fmt.Println(err)
-	}
-	os.Exit(len(verificationErrors))
-}
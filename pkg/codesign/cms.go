@@ -0,0 +1,443 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"go-aapl-integrity/pkg/plist"
+	"math/big"
+	"time"
+)
+
+const (
+	CertificateTypeUnknown = 0
+	CertificateTypePlatform = 1
+	CertificateTypeDeveloperID = 2
+	CertificateTypeAppStore = 3
+	CertificateTypeDevelopment = 4
+)
+
+var (
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidAttributeCDHashesPlist = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+	oidAttributeCDHashes = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 2}
+
+	oidDigestSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	// Marker extensions Apple places on code signing leaf certificates
+	oidApplePlatform = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 22}
+	oidAppleDeveloperID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 13}
+	oidAppleiPhoneDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 2}
+	oidAppleiPhoneAppStore = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 3}
+	oidAppleiPhoneDistribution = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 4}
+	oidAppleMacAppStore = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 9}
+	oidAppleMacDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 12}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content asn1.RawValue `asn1:"optional,explicit,tag:0"`
+}
+
+type signedData struct {
+	Version int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo encapsulatedContentInfo
+	Certificates asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos []signerInfo `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version int
+	SID asn1.RawValue
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	SignedAttributes asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature []byte
+	UnsignedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type cdHashAttribute struct {
+	Algorithm asn1.ObjectIdentifier
+	Digest []byte
+}
+
+type VerifyOptions struct {
+	Roots *x509.CertPool
+	// Time to validate the chain at; the signing time, then the current time, when zero
+	CurrentTime time.Time
+}
+
+// Signer describes a verified CMS signature over a code signature
+type Signer struct {
+	Certificate *x509.Certificate
+	Certificates []*x509.Certificate
+	Chains [][]*x509.Certificate
+	SigningTime time.Time
+	TeamID string
+	CertificateType int
+	// CDHashes lists the code directory hashes the signed attributes vouch for
+	CDHashes [][]byte
+}
+
+// CertificateTypeName returns a display name for a certificate type
+func CertificateTypeName(certificateType int) string {
+	switch certificateType {
+	case CertificateTypePlatform:
+		return "apple platform"
+	case CertificateTypeDeveloperID:
+		return "developer id"
+	case CertificateTypeAppStore:
+		return "app store"
+	case CertificateTypeDevelopment:
+		return "development"
+	}
+
+	return "unknown"
+}
+
+func hasExtension(certificate *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// classifyCertificate determines the kind of signing identity from Apple's marker extensions
+func classifyCertificate(certificate *x509.Certificate) int {
+	switch {
+	case hasExtension(certificate, oidApplePlatform):
+		return CertificateTypePlatform
+	case hasExtension(certificate, oidAppleDeveloperID):
+		return CertificateTypeDeveloperID
+	case hasExtension(certificate, oidAppleiPhoneAppStore),
+		hasExtension(certificate, oidAppleiPhoneDistribution),
+		hasExtension(certificate, oidAppleMacAppStore):
+		return CertificateTypeAppStore
+	case hasExtension(certificate, oidAppleiPhoneDevelopment),
+		hasExtension(certificate, oidAppleMacDevelopment):
+		return CertificateTypeDevelopment
+	}
+
+	return CertificateTypeUnknown
+}
+
+func digestHash(algorithm asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case algorithm.Equal(oidDigestSHA1):
+		return crypto.SHA1, nil
+	case algorithm.Equal(oidDigestSHA256):
+		return crypto.SHA256, nil
+	case algorithm.Equal(oidDigestSHA384):
+		return crypto.SHA384, nil
+	case algorithm.Equal(oidDigestSHA512):
+		return crypto.SHA512, nil
+	}
+
+	return 0, fmt.Errorf("unsupported digest algorithm %s", algorithm)
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+func parseAttributes(raw asn1.RawValue) ([]attribute, error) {
+	result := make([]attribute, 0)
+	data := raw.Bytes
+	for len(data) > 0 {
+		var value attribute
+		rest, err := asn1.Unmarshal(data, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, value)
+		data = rest
+	}
+
+	return result, nil
+}
+
+// attributeValues returns the values of the first attribute with the given type
+func attributeValues(attributes []attribute, oid asn1.ObjectIdentifier) ([]asn1.RawValue, bool, error) {
+	for _, value := range attributes {
+		if !value.Type.Equal(oid) {
+			continue
+		}
+
+		result := make([]asn1.RawValue, 0)
+		data := value.Values.Bytes
+		for len(data) > 0 {
+			var element asn1.RawValue
+			rest, err := asn1.Unmarshal(data, &element)
+			if err != nil {
+				return nil, true, err
+			}
+
+			result = append(result, element)
+			data = rest
+		}
+
+		return result, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// findSigner matches a SignerInfo's issuer and serial number against the bundled certificates
+func findSigner(info *signerInfo, certificates []*x509.Certificate) (*x509.Certificate, error) {
+	if info.SID.Class == asn1.ClassContextSpecific && info.SID.Tag == 0 {
+		for _, certificate := range certificates {
+			if bytes.Equal(certificate.SubjectKeyId, info.SID.Bytes) {
+				return certificate, nil
+			}
+		}
+
+		return nil, fmt.Errorf("no certificate matches the signer key identifier")
+	}
+
+	var sid issuerAndSerial
+	_, err := asn1.Unmarshal(info.SID.FullBytes, &sid)
+	if err != nil {
+		return nil, fmt.Errorf("signer identifier: %s", err)
+	}
+
+	for _, certificate := range certificates {
+		if bytes.Equal(certificate.RawIssuer, sid.Issuer.FullBytes) && certificate.SerialNumber.Cmp(sid.Serial) == 0 {
+			return certificate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate matches the signer issuer and serial number")
+}
+
+func checkSignature(certificate *x509.Certificate, hash crypto.Hash, digest []byte, signature []byte) error {
+	switch key := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return fmt.Errorf("ecdsa verification failure")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported signer key type %T", certificate.PublicKey)
+}
+
+// signedCDHashes decodes the CDHashes the signed attributes list, from either the
+// plist attribute (truncated hashes) or the DER attribute (full hashes)
+func signedCDHashes(attributes []attribute) ([][]byte, error) {
+	result := make([][]byte, 0)
+
+	values, found, err := attributeValues(attributes, oidAttributeCDHashesPlist)
+	if err != nil {
+		return nil, fmt.Errorf("cdhashes attribute: %s", err)
+	}
+	if found && len(values) > 0 {
+		dictionary, err := plist.Dictionary(values[0].Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cdhashes attribute: %s", err)
+		}
+
+		hashes, _ := dictionary["cdhashes"].([]interface{})
+		for _, hash := range hashes {
+			if data, ok := hash.([]byte); ok {
+				result = append(result, data)
+			}
+		}
+	}
+
+	values, _, err = attributeValues(attributes, oidAttributeCDHashes)
+	if err != nil {
+		return nil, fmt.Errorf("cdhashes attribute: %s", err)
+	}
+	for _, value := range values {
+		var hash cdHashAttribute
+		_, err := asn1.Unmarshal(value.FullBytes, &hash)
+		if err != nil {
+			return nil, fmt.Errorf("cdhashes attribute: %s", err)
+		}
+
+		result = append(result, hash.Digest)
+	}
+
+	return result, nil
+}
+
+// containsCDHash reports whether a signed CDHash (possibly truncated) matches a code directory hash
+func containsCDHash(signed [][]byte, cdhash []byte) bool {
+	for _, hash := range signed {
+		if len(hash) > 0 && len(hash) <= len(cdhash) && bytes.Equal(hash, cdhash[:len(hash)]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyCMS checks the CMS signature of a code signature: the signed message digest
+// over the primary code directory, the CDHashes attribute covering every code
+// directory, the signature itself, and the signer's chain to options.Roots
+func (signature *Signature) VerifyCMS(options *VerifyOptions) (*Signer, error) {
+	if len(signature.CMS) == 0 {
+		return nil, fmt.Errorf("code signature is ad-hoc and has no CMS signature")
+	}
+
+	primary := signature.Slot(SlotCodeDirectory)
+	if primary == nil {
+		return nil, fmt.Errorf("code signature has no primary code directory")
+	}
+
+	var info contentInfo
+	_, err := asn1.Unmarshal(signature.CMS, &info)
+	if err != nil {
+		return nil, fmt.Errorf("cms: %s", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("cms content type %s is not signed data", info.ContentType)
+	}
+
+	var signed signedData
+	_, err = asn1.Unmarshal(info.Content.Bytes, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("cms signed data: %s", err)
+	}
+	if len(signed.SignerInfos) != 1 {
+		return nil, fmt.Errorf("cms has %d signers, expected 1", len(signed.SignerInfos))
+	}
+
+	certificates, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cms certificates: %s", err)
+	}
+
+	signerInfo := &signed.SignerInfos[0]
+	certificate, err := findSigner(signerInfo, certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := digestHash(signerInfo.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(signerInfo.SignedAttributes.Bytes) == 0 {
+		return nil, fmt.Errorf("cms signer has no signed attributes")
+	}
+
+	attributes, err := parseAttributes(signerInfo.SignedAttributes)
+	if err != nil {
+		return nil, fmt.Errorf("cms signed attributes: %s", err)
+	}
+
+	values, found, err := attributeValues(attributes, oidAttributeMessageDigest)
+	if err != nil || !found || len(values) != 1 {
+		return nil, fmt.Errorf("cms message digest attribute is missing or malformed")
+	}
+	if !bytes.Equal(values[0].Bytes, digest(hash, primary)) {
+		return nil, fmt.Errorf("cms message digest does not match the code directory")
+	}
+
+	// The signature covers the attributes re-encoded with the universal SET tag
+	signedBytes := append([]byte{}, signerInfo.SignedAttributes.FullBytes...)
+	signedBytes[0] = asn1.TagSet | 0x20
+	err = checkSignature(certificate, hash, digest(hash, signedBytes), signerInfo.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("cms signature: %s", err)
+	}
+
+	result := &Signer{
+		Certificate:     certificate,
+		Certificates:    certificates,
+		CertificateType: classifyCertificate(certificate),
+	}
+	if len(certificate.Subject.OrganizationalUnit) > 0 {
+		result.TeamID = certificate.Subject.OrganizationalUnit[0]
+	}
+
+	values, found, err = attributeValues(attributes, oidAttributeSigningTime)
+	if err == nil && found && len(values) == 1 {
+		asn1.Unmarshal(values[0].FullBytes, &result.SigningTime)
+	}
+
+	result.CDHashes, err = signedCDHashes(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, directory := range signature.CodeDirectories {
+		cdhash, err := directory.CDHash()
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a CDHashes attribute only the primary directory is covered, through the message digest
+		if len(result.CDHashes) == 0 && directory.Slot == SlotCodeDirectory {
+			continue
+		}
+		if !containsCDHash(result.CDHashes, cdhash.Data) {
+			return nil, fmt.Errorf("code directory in slot 0x%x is not covered by the cms signature", directory.Slot)
+		}
+	}
+
+	if options == nil || options.Roots == nil {
+		return nil, fmt.Errorf("no root certificates supplied to validate the cms signer")
+	}
+
+	currentTime := options.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = result.SigningTime
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, other := range certificates {
+		if other != certificate {
+			intermediates.AddCert(other)
+		}
+	}
+
+	result.Chains, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         options.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   currentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cms signer chain: %s", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,264 @@
+package codesign
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-aapl-integrity/pkg/core"
+)
+
+const (
+	CodeDirectoryVersionBase = 0x20001
+	CodeDirectoryVersionScatter = 0x20100
+	CodeDirectoryVersionTeamID = 0x20200
+	CodeDirectoryVersionCodeLimit64 = 0x20300
+	CodeDirectoryVersionExecSegment = 0x20400
+	CodeDirectoryVersionRuntime = 0x20500
+	CodeDirectoryVersionLinkage = 0x20600
+
+	CodeDirectoryBaseSize = 44
+	CodeDirectoryScatterSize = 48
+	CodeDirectoryTeamIDSize = 52
+	CodeDirectoryCodeLimit64Size = 64
+	CodeDirectoryExecSegmentSize = 88
+	CodeDirectoryRuntimeSize = 96
+	CodeDirectoryLinkageSize = 108
+
+	FlagAdhoc = 0x00000002
+	FlagHard = 0x00000100
+	FlagKill = 0x00000200
+	FlagRestrict = 0x00000800
+	FlagEnforcement = 0x00001000
+	FlagLibraryValidation = 0x00002000
+	FlagRuntime = 0x00010000
+	FlagLinkerSigned = 0x00020000
+
+	ExecSegMainBinary = 0x1
+	ExecSegAllowUnsigned = 0x10
+	ExecSegDebugger = 0x20
+	ExecSegJIT = 0x40
+	ExecSegSkipLibraryValidation = 0x80
+	ExecSegCanLoadCDHash = 0x100
+	ExecSegCanExecCDHash = 0x200
+)
+
+type CodeDirectory struct {
+	Slot uint32
+
+	Version uint32
+	Flags uint32
+	HashOffset uint32
+	IdentOffset uint32
+	SpecialSlotCount uint32
+	CodeSlotCount uint32
+	CodeLimit uint64
+	HashSize uint8
+	HashType uint8
+	Platform uint8
+	PageSizeLog2 uint8
+	ScatterOffset uint32
+	TeamOffset uint32
+	ExecSegBase uint64
+	ExecSegLimit uint64
+	ExecSegFlags uint64
+	Runtime uint32
+	PreEncryptOffset uint32
+	LinkageHashType uint8
+	LinkageApplicationType uint8
+	LinkageApplicationSubType uint16
+	LinkageOffset uint32
+	LinkageSize uint32
+
+	Identifier string
+	TeamID string
+
+	// SpecialSlots[i] holds the hash of special slot i + 1 (SlotInfo, SlotRequirements, ...)
+	SpecialSlots [][]byte
+	CodeSlots [][]byte
+
+	// The complete blob, which the CDHash is computed over
+	Raw []byte
+}
+
+// hashRank orders hash types by strength, as the kernel does when picking a code directory
+func hashRank(hashType uint8) int {
+	switch hashType {
+	case core.HashSHA1:
+		return 1
+	case core.HashSHA256Truncated:
+		return 2
+	case core.HashSHA256:
+		return 3
+	case core.HashSHA384:
+		return 4
+	}
+
+	return 0
+}
+
+// cString reads a NUL terminated string starting at offset
+func cString(data []byte, offset uint32) (string, error) {
+	if uint64(offset) >= uint64(len(data)) {
+		return "", fmt.Errorf("string offset %d is out of bounds", offset)
+	}
+
+	for end := offset; end < uint32(len(data)); end++ {
+		if data[end] == 0 {
+			return string(data[offset:end]), nil
+		}
+	}
+
+	return "", fmt.Errorf("string at %d is not terminated", offset)
+}
+
+// ParseCodeDirectory decodes a CodeDirectory blob
+func ParseCodeDirectory(data []byte) (*CodeDirectory, error) {
+	if len(data) < CodeDirectoryBaseSize {
+		return nil, fmt.Errorf("not enough data for code directory header")
+	}
+
+	if binary.BigEndian.Uint32(data[0:4]) != MagicCodeDirectory {
+		return nil, fmt.Errorf("bad code directory magic %X", binary.BigEndian.Uint32(data[0:4]))
+	}
+
+	if binary.BigEndian.Uint32(data[4:8]) != uint32(len(data)) {
+		return nil, fmt.Errorf("code directory length %d does not match blob size %d", binary.BigEndian.Uint32(data[4:8]), len(data))
+	}
+
+	result := &CodeDirectory{
+		Version:          binary.BigEndian.Uint32(data[8:12]),
+		Flags:            binary.BigEndian.Uint32(data[12:16]),
+		HashOffset:       binary.BigEndian.Uint32(data[16:20]),
+		IdentOffset:      binary.BigEndian.Uint32(data[20:24]),
+		SpecialSlotCount: binary.BigEndian.Uint32(data[24:28]),
+		CodeSlotCount:    binary.BigEndian.Uint32(data[28:32]),
+		CodeLimit:        uint64(binary.BigEndian.Uint32(data[32:36])),
+		HashSize:         data[36],
+		HashType:         data[37],
+		Platform:         data[38],
+		PageSizeLog2:     data[39],
+		Raw:              data,
+	}
+
+	if result.Version < CodeDirectoryVersionBase {
+		return nil, fmt.Errorf("unsupported code directory version 0x%x", result.Version)
+	}
+
+	expectedSize, err := core.HashSize(int(result.HashType))
+	if err != nil { return nil, err }
+	if int(result.HashSize) != expectedSize {
+		return nil, fmt.Errorf("hash size %d does not match hash type %d", result.HashSize, result.HashType)
+	}
+
+	// Each version only appends fields, so read whichever ones the blob is new enough to carry
+	if result.Version >= CodeDirectoryVersionScatter && len(data) >= CodeDirectoryScatterSize {
+		result.ScatterOffset = binary.BigEndian.Uint32(data[44:48])
+	}
+
+	if result.Version >= CodeDirectoryVersionTeamID && len(data) >= CodeDirectoryTeamIDSize {
+		result.TeamOffset = binary.BigEndian.Uint32(data[48:52])
+	}
+
+	if result.Version >= CodeDirectoryVersionCodeLimit64 && len(data) >= CodeDirectoryCodeLimit64Size {
+		codeLimit64 := binary.BigEndian.Uint64(data[56:64])
+		if codeLimit64 != 0 {
+			result.CodeLimit = codeLimit64
+		}
+	}
+
+	if result.Version >= CodeDirectoryVersionExecSegment && len(data) >= CodeDirectoryExecSegmentSize {
+		result.ExecSegBase = binary.BigEndian.Uint64(data[64:72])
+		result.ExecSegLimit = binary.BigEndian.Uint64(data[72:80])
+		result.ExecSegFlags = binary.BigEndian.Uint64(data[80:88])
+	}
+
+	if result.Version >= CodeDirectoryVersionRuntime && len(data) >= CodeDirectoryRuntimeSize {
+		result.Runtime = binary.BigEndian.Uint32(data[88:92])
+		result.PreEncryptOffset = binary.BigEndian.Uint32(data[92:96])
+	}
+
+	if result.Version >= CodeDirectoryVersionLinkage && len(data) >= CodeDirectoryLinkageSize {
+		result.LinkageHashType = data[96]
+		result.LinkageApplicationType = data[97]
+		result.LinkageApplicationSubType = binary.BigEndian.Uint16(data[98:100])
+		result.LinkageOffset = binary.BigEndian.Uint32(data[100:104])
+		result.LinkageSize = binary.BigEndian.Uint32(data[104:108])
+	}
+
+	result.Identifier, err = cString(data, result.IdentOffset)
+	if err != nil {
+		return nil, fmt.Errorf("identifier: %s", err)
+	}
+
+	if result.TeamOffset != 0 {
+		result.TeamID, err = cString(data, result.TeamOffset)
+		if err != nil {
+			return nil, fmt.Errorf("team identifier: %s", err)
+		}
+	}
+
+	hashSize := uint64(result.HashSize)
+	specialStart := uint64(result.HashOffset) - (uint64(result.SpecialSlotCount) * hashSize)
+	codeEnd := uint64(result.HashOffset) + (uint64(result.CodeSlotCount) * hashSize)
+	if uint64(result.SpecialSlotCount) * hashSize > uint64(result.HashOffset) || specialStart < CodeDirectoryBaseSize || codeEnd > uint64(len(data)) {
+		return nil, fmt.Errorf("hash slots are out of bounds")
+	}
+
+	result.SpecialSlots = make([][]byte, result.SpecialSlotCount)
+	for index := range result.SpecialSlots {
+		start := uint64(result.HashOffset) - (uint64(index + 1) * hashSize)
+		result.SpecialSlots[index] = data[start:(start + hashSize)]
+	}
+
+	result.CodeSlots = make([][]byte, result.CodeSlotCount)
+	for index := range result.CodeSlots {
+		start := uint64(result.HashOffset) + (uint64(index) * hashSize)
+		result.CodeSlots[index] = data[start:(start + hashSize)]
+	}
+
+	return result, nil
+}
+
+// PageSize returns the number of bytes each code slot covers, zero meaning one infinite page
+func (directory *CodeDirectory) PageSize() uint64 {
+	if directory.PageSizeLog2 == 0 {
+		return 0
+	}
+
+	return 1 << directory.PageSizeLog2
+}
+
+// SpecialSlot returns the hash recorded for a special slot, or nil if the directory has none
+func (directory *CodeDirectory) SpecialSlot(slot int) []byte {
+	if slot < 1 || slot > len(directory.SpecialSlots) {
+		return nil
+	}
+
+	return directory.SpecialSlots[slot - 1]
+}
+
+// Hash digests data with the code directory's hash type, truncated to its slot size
+func (directory *CodeDirectory) Hash(data []byte) ([]byte, error) {
+	hasher, err := core.NewHasher(int(directory.HashType))
+	if err != nil {
+		return nil, err
+	}
+
+	hasher.Write(data)
+	return hasher.Sum(nil)[:directory.HashSize], nil
+}
+
+// CDHash computes the digest of the code directory blob with its own hash type. Trust caches
+// and the kernel compare the first 20 bytes of this value.
+func (directory *CodeDirectory) CDHash() (*core.TypedHash, error) {
+	hashType, err := core.HashTypeFromCodeDirectory(directory.HashType)
+	if err != nil {
+		return nil, err
+	}
+
+	// The CDHash is the whole digest even when slots are truncated
+	if hashType == core.HashSHA256Truncated {
+		hashType = core.HashSHA256
+	}
+
+	return core.HashBytes(hashType, directory.Raw)
+}
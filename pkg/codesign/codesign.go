@@ -0,0 +1,300 @@
+package codesign
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	LoadCmdCodeSignature = 0x1d // LC_CODE_SIGNATURE
+
+	MagicRequirement = 0xfade0c00
+	MagicRequirements = 0xfade0c01
+	MagicCodeDirectory = 0xfade0c02
+	MagicEmbeddedSignature = 0xfade0cc0
+	MagicDetachedSignature = 0xfade0cc1
+	MagicBlobWrapper = 0xfade0b01
+	MagicEmbeddedEntitlements = 0xfade7171
+	MagicEmbeddedDEREntitlements = 0xfade7172
+
+	SlotCodeDirectory = 0
+	SlotInfo = 1
+	SlotRequirements = 2
+	SlotResourceDir = 3
+	SlotApplication = 4
+	SlotEntitlements = 5
+	SlotDEREntitlements = 7
+	SlotAlternateCodeDirectories = 0x1000
+	SlotAlternateCodeDirectoryMax = 5
+	SlotSignature = 0x10000
+
+	BlobHeaderSize = 8
+	SuperBlobIndexEntrySize = 8
+)
+
+// Blob is one entry of a SuperBlob index
+type Blob struct {
+	Slot uint32
+	Magic uint32
+	Data []byte // the whole blob, including its magic and length
+}
+
+// Signature is the decoded LC_CODE_SIGNATURE SuperBlob of one Mach-O slice
+type Signature struct {
+	Blobs []*Blob
+	CodeDirectories []*CodeDirectory
+	Requirements *Requirements
+	Entitlements []byte // XML plist
+	DEREntitlements []byte
+	CMS []byte // DER encoded CMS SignedData
+}
+
+// Slice is a single architecture of a thin or fat Mach-O
+type Slice struct {
+	Cpu macho.Cpu
+	SubCpu uint32
+	Offset int64
+	Size int64
+	File *macho.File
+	Signature *Signature // nil when the slice is not signed
+
+	reader io.ReaderAt
+}
+
+type File struct {
+	Fat bool
+	Slices []*Slice
+
+	closer io.Closer
+}
+
+// Open reads the code signatures of a thin or fat Mach-O on disk
+func Open(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	result, err := NewFile(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	result.closer = file
+
+	return result, nil
+}
+
+// NewFile reads the code signatures of a thin or fat Mach-O of the given size
+func NewFile(reader io.ReaderAt, size int64) (*File, error) {
+	fat, err := macho.NewFatFile(reader)
+	if err == nil {
+		result := &File{Fat: true, Slices: make([]*Slice, len(fat.Arches))}
+		for index, arch := range fat.Arches {
+			sliceReader := io.NewSectionReader(reader, int64(arch.Offset), int64(arch.Size))
+			result.Slices[index], err = newSlice(arch.File, sliceReader, int64(arch.Offset), int64(arch.Size))
+			if err != nil {
+				return nil, fmt.Errorf("slice %d: %s", index, err)
+			}
+		}
+
+		return result, nil
+	}
+	if err != macho.ErrNotFat {
+		return nil, err
+	}
+
+	file, err := macho.NewFile(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	slice, err := newSlice(file, io.NewSectionReader(reader, 0, size), 0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Slices: []*Slice{slice}}, nil
+}
+
+func (file *File) Close() error {
+	if file.closer != nil {
+		return file.closer.Close()
+	}
+
+	return nil
+}
+
+func newSlice(file *macho.File, reader io.ReaderAt, offset int64, size int64) (*Slice, error) {
+	result := &Slice{
+		Cpu:    file.Cpu,
+		SubCpu: file.SubCpu,
+		Offset: offset,
+		Size:   size,
+		File:   file,
+		reader: reader,
+	}
+
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		if len(raw) < 16 || file.ByteOrder.Uint32(raw[0:4]) != LoadCmdCodeSignature {
+			continue
+		}
+
+		dataOffset := file.ByteOrder.Uint32(raw[8:12])
+		dataSize := file.ByteOrder.Uint32(raw[12:16])
+		if int64(dataOffset) + int64(dataSize) > size {
+			return nil, fmt.Errorf("code signature at %d size %d is out of bounds", dataOffset, dataSize)
+		}
+
+		data := make([]byte, dataSize)
+		_, err := reader.ReadAt(data, int64(dataOffset))
+		if err != nil {
+			return nil, err
+		}
+
+		result.Signature, err = ParseSignature(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// blobAt returns the blob starting at offset, sized by its own length field
+func blobAt(data []byte, offset uint32) ([]byte, error) {
+	if uint64(offset) + BlobHeaderSize > uint64(len(data)) {
+		return nil, fmt.Errorf("blob at %d is out of bounds", offset)
+	}
+
+	length := binary.BigEndian.Uint32(data[offset + 4:])
+	if length < BlobHeaderSize || uint64(offset) + uint64(length) > uint64(len(data)) {
+		return nil, fmt.Errorf("blob at %d has invalid length %d", offset, length)
+	}
+
+	return data[offset:(offset + length)], nil
+}
+
+// parseSuperBlob decodes the index of a SuperBlob with the expected magic
+func parseSuperBlob(data []byte, magic uint32) ([]*Blob, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("not enough data for superblob header")
+	}
+
+	if binary.BigEndian.Uint32(data[0:4]) != magic {
+		return nil, fmt.Errorf("bad superblob magic %X", binary.BigEndian.Uint32(data[0:4]))
+	}
+
+	data, err := blobAt(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	count := binary.BigEndian.Uint32(data[8:12])
+	if 12 + uint64(count) * SuperBlobIndexEntrySize > uint64(len(data)) {
+		return nil, fmt.Errorf("superblob index of %d entries is out of bounds", count)
+	}
+
+	result := make([]*Blob, count)
+	for index := range result {
+		entry := data[(12 + index * SuperBlobIndexEntrySize):]
+		slot := binary.BigEndian.Uint32(entry[0:4])
+		offset := binary.BigEndian.Uint32(entry[4:8])
+
+		blob, err := blobAt(data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("slot %d: %s", slot, err)
+		}
+
+		result[index] = &Blob{
+			Slot:  slot,
+			Magic: binary.BigEndian.Uint32(blob[0:4]),
+			Data:  blob,
+		}
+	}
+
+	return result, nil
+}
+
+// ParseSignature decodes an embedded signature SuperBlob
+func ParseSignature(data []byte) (*Signature, error) {
+	blobs, err := parseSuperBlob(data, MagicEmbeddedSignature)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Signature{Blobs: blobs}
+	for _, blob := range blobs {
+		switch blob.Magic {
+		case MagicCodeDirectory:
+			directory, err := ParseCodeDirectory(blob.Data)
+			if err != nil {
+				return nil, fmt.Errorf("code directory in slot %d: %s", blob.Slot, err)
+			}
+			directory.Slot = blob.Slot
+
+			result.CodeDirectories = append(result.CodeDirectories, directory)
+
+		case MagicRequirements:
+			result.Requirements, err = ParseRequirements(blob.Data)
+			if err != nil {
+				return nil, err
+			}
+
+		case MagicEmbeddedEntitlements:
+			result.Entitlements = blob.Data[BlobHeaderSize:]
+
+		case MagicEmbeddedDEREntitlements:
+			result.DEREntitlements = blob.Data[BlobHeaderSize:]
+
+		case MagicBlobWrapper:
+			if blob.Slot == SlotSignature {
+				result.CMS = blob.Data[BlobHeaderSize:]
+			}
+		}
+	}
+
+	if len(result.CodeDirectories) == 0 {
+		return nil, fmt.Errorf("signature has no code directory")
+	}
+
+	return result, nil
+}
+
+// Slot returns the raw blob stored in a SuperBlob slot
+func (signature *Signature) Slot(slot uint32) []byte {
+	for _, blob := range signature.Blobs {
+		if blob.Slot == slot {
+			return blob.Data
+		}
+	}
+
+	return nil
+}
+
+// CodeDirectory returns the code directory the kernel prefers: the one with the strongest hash
+func (signature *Signature) CodeDirectory() *CodeDirectory {
+	var result *CodeDirectory
+	for _, directory := range signature.CodeDirectories {
+		if result == nil || hashRank(directory.HashType) > hashRank(result.HashType) {
+			result = directory
+		}
+	}
+
+	return result
+}
+
+// Reader returns the contents of the slice, starting at its Mach-O header
+func (slice *Slice) Reader() io.ReaderAt {
+	return slice.reader
+}
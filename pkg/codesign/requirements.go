@@ -0,0 +1,476 @@
+package codesign
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	RequirementHost = 1
+	RequirementGuest = 2
+	RequirementDesignated = 3
+	RequirementLibrary = 4
+	RequirementPlugin = 5
+
+	RequirementKindExpression = 1
+
+	opFalse = 0
+	opTrue = 1
+	opIdent = 2
+	opAppleAnchor = 3
+	opAnchorHash = 4
+	opInfoKeyValue = 5
+	opAnd = 6
+	opOr = 7
+	opCDHash = 8
+	opNot = 9
+	opInfoKeyField = 10
+	opCertField = 11
+	opTrustedCert = 12
+	opTrustedCerts = 13
+	opCertGeneric = 14
+	opAppleGenericAnchor = 15
+	opEntitlementField = 16
+	opCertPolicy = 17
+	opNamedAnchor = 18
+	opNamedCode = 19
+	opPlatform = 20
+	opNotarized = 21
+	opCertFieldDate = 22
+	opLegacyDevID = 23
+	opFlagMask = 0xff000000
+
+	matchExists = 0
+	matchEqual = 1
+	matchContains = 2
+	matchBeginsWith = 3
+	matchEndsWith = 4
+	matchLessThan = 5
+	matchGreaterThan = 6
+	matchLessEqual = 7
+	matchGreaterEqual = 8
+	matchOn = 9
+	matchBefore = 10
+	matchAfter = 11
+	matchOnOrBefore = 12
+	matchOnOrAfter = 13
+	matchAbsent = 14
+
+	// Nesting limit while decompiling, matching the depth the Security framework accepts
+	maxRequirementDepth = 64
+)
+
+// absoluteTimeEpoch is the reference date of CFAbsoluteTime values used by date matches
+var absoluteTimeEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Requirement struct {
+	Type uint32
+	Kind uint32
+	Expression string // decompiled text form, as printed by csreq
+	Raw []byte
+}
+
+type Requirements struct {
+	Entries []*Requirement
+	Raw []byte
+}
+
+// RequirementTypeName returns the csreq name of a requirement type
+func RequirementTypeName(requirementType uint32) string {
+	switch requirementType {
+	case RequirementHost:
+		return "host"
+	case RequirementGuest:
+		return "guest"
+	case RequirementDesignated:
+		return "designated"
+	case RequirementLibrary:
+		return "library"
+	case RequirementPlugin:
+		return "plugin"
+	}
+
+	return fmt.Sprintf("type%d", requirementType)
+}
+
+// ParseRequirements decodes a requirement set blob
+func ParseRequirements(data []byte) (*Requirements, error) {
+	blobs, err := parseSuperBlob(data, MagicRequirements)
+	if err != nil {
+		return nil, fmt.Errorf("requirements: %s", err)
+	}
+
+	result := &Requirements{Raw: data[:binary.BigEndian.Uint32(data[4:8])]}
+	for _, blob := range blobs {
+		requirement, err := ParseRequirement(blob.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s requirement: %s", RequirementTypeName(blob.Slot), err)
+		}
+		requirement.Type = blob.Slot
+
+		result.Entries = append(result.Entries, requirement)
+	}
+
+	return result, nil
+}
+
+// Designated returns the designated requirement, or nil when the set does not contain one
+func (requirements *Requirements) Designated() *Requirement {
+	for _, requirement := range requirements.Entries {
+		if requirement.Type == RequirementDesignated {
+			return requirement
+		}
+	}
+
+	return nil
+}
+
+// ParseRequirement decodes a single requirement blob and decompiles its expression
+func ParseRequirement(data []byte) (*Requirement, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("not enough data for requirement header")
+	}
+
+	if binary.BigEndian.Uint32(data[0:4]) != MagicRequirement {
+		return nil, fmt.Errorf("bad requirement magic %X", binary.BigEndian.Uint32(data[0:4]))
+	}
+
+	result := &Requirement{
+		Kind: binary.BigEndian.Uint32(data[8:12]),
+		Raw:  data,
+	}
+
+	if result.Kind != RequirementKindExpression {
+		return nil, fmt.Errorf("unsupported requirement kind %d", result.Kind)
+	}
+
+	decoder := &expressionDecoder{data: data, offset: 12}
+	expression, err := decoder.expression(0)
+	if err != nil {
+		return nil, err
+	}
+	result.Expression = expression.text
+
+	return result, nil
+}
+
+func (requirement *Requirement) String() string {
+	return fmt.Sprintf("%s => %s", RequirementTypeName(requirement.Type), requirement.Expression)
+}
+
+// Precedence of decompiled terms, used to decide where parentheses are needed
+const (
+	precedenceOr = 1
+	precedenceAnd = 2
+	precedenceTerm = 3
+)
+
+type term struct {
+	text string
+	precedence int
+}
+
+type expressionDecoder struct {
+	data []byte
+	offset int
+}
+
+func (decoder *expressionDecoder) uint32() (uint32, error) {
+	if decoder.offset + 4 > len(decoder.data) {
+		return 0, fmt.Errorf("requirement truncated at %d", decoder.offset)
+	}
+
+	value := binary.BigEndian.Uint32(decoder.data[decoder.offset:])
+	decoder.offset += 4
+	return value, nil
+}
+
+// bytes reads a length prefixed value padded to a four byte boundary
+func (decoder *expressionDecoder) bytes() ([]byte, error) {
+	length, err := decoder.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	end := uint64(decoder.offset) + uint64(length)
+	if end > uint64(len(decoder.data)) {
+		return nil, fmt.Errorf("requirement data of length %d is out of bounds", length)
+	}
+
+	value := decoder.data[decoder.offset:end]
+	decoder.offset = int((end + 3) &^ 3)
+	return value, nil
+}
+
+func (decoder *expressionDecoder) string() (string, error) {
+	value, err := decoder.bytes()
+	return string(value), err
+}
+
+// quote renders a string the way csreq does: bare when it is purely alphanumeric
+func quote(value string) string {
+	if value == "" {
+		return `""`
+	}
+
+	for _, character := range value {
+		if !(character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' || character >= '0' && character <= '9') {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
+
+func hexData(value []byte) string {
+	return fmt.Sprintf("H\"%s\"", hex.EncodeToString(value))
+}
+
+func certSlot(slot int32) string {
+	switch slot {
+	case 0:
+		return "leaf"
+	case -1:
+		return "root"
+	}
+
+	return strconv.Itoa(int(slot))
+}
+
+func oidString(value []byte) string {
+	var oid asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(append([]byte{asn1.TagOID, byte(len(value))}, value...), &oid)
+	if err != nil || len(value) > 127 {
+		return hexData(value)
+	}
+
+	return oid.String()
+}
+
+func (decoder *expressionDecoder) match() (string, error) {
+	operation, err := decoder.uint32()
+	if err != nil {
+		return "", err
+	}
+
+	switch operation {
+	case matchExists:
+		return "/* exists */", nil
+	case matchAbsent:
+		return "absent", nil
+	case matchEqual, matchContains, matchBeginsWith, matchEndsWith,
+		matchLessThan, matchGreaterThan, matchLessEqual, matchGreaterEqual:
+		value, err := decoder.string()
+		if err != nil {
+			return "", err
+		}
+
+		switch operation {
+		case matchEqual:
+			return "= " + quote(value), nil
+		case matchContains:
+			return "~ " + quote(value), nil
+		case matchBeginsWith:
+			return "= " + quote(value) + "*", nil
+		case matchEndsWith:
+			return "= *" + quote(value), nil
+		case matchLessThan:
+			return "< " + quote(value), nil
+		case matchGreaterThan:
+			return "> " + quote(value), nil
+		case matchLessEqual:
+			return "<= " + quote(value), nil
+		default:
+			return ">= " + quote(value), nil
+		}
+	case matchOn, matchBefore, matchAfter, matchOnOrBefore, matchOnOrAfter:
+		value, err := decoder.bytes()
+		if err != nil {
+			return "", err
+		}
+		if len(value) != 8 {
+			return "", fmt.Errorf("date match has %d bytes", len(value))
+		}
+
+		seconds := int64(binary.BigEndian.Uint64(value))
+		date := "<" + absoluteTimeEpoch.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339) + ">"
+		operators := map[uint32]string{
+			matchOn: "=", matchBefore: "<", matchAfter: ">", matchOnOrBefore: "<=", matchOnOrAfter: ">=",
+		}
+
+		return operators[operation] + " timestamp " + date, nil
+	}
+
+	return "", fmt.Errorf("unknown match operation %d", operation)
+}
+
+// withMatch joins a subject and a decompiled match, eliding the implicit "exists"
+func withMatch(subject string, match string) string {
+	if match == "/* exists */" {
+		return subject + " exists"
+	}
+
+	return subject + " " + match
+}
+
+func parenthesize(value term, precedence int) string {
+	if value.precedence < precedence {
+		return "(" + value.text + ")"
+	}
+
+	return value.text
+}
+
+func (decoder *expressionDecoder) expression(depth int) (term, error) {
+	if depth > maxRequirementDepth {
+		return term{}, fmt.Errorf("requirement nested too deeply")
+	}
+
+	rawOperation, err := decoder.uint32()
+	if err != nil {
+		return term{}, err
+	}
+	operation := rawOperation &^ opFlagMask
+
+	simple := func(text string) (term, error) {
+		return term{text: text, precedence: precedenceTerm}, nil
+	}
+
+	switch operation {
+	case opFalse:
+		return simple("never")
+	case opTrue:
+		return simple("always")
+	case opIdent:
+		value, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("identifier " + quote(value))
+	case opAppleAnchor:
+		return simple("anchor apple")
+	case opAppleGenericAnchor:
+		return simple("anchor apple generic")
+	case opAnchorHash:
+		slot, err := decoder.uint32()
+		if err != nil {
+			return term{}, err
+		}
+		value, err := decoder.bytes()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("certificate " + certSlot(int32(slot)) + " = " + hexData(value))
+	case opInfoKeyValue:
+		key, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		value, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("info[" + key + "] = " + quote(value))
+	case opAnd, opOr:
+		left, err := decoder.expression(depth + 1)
+		if err != nil {
+			return term{}, err
+		}
+		right, err := decoder.expression(depth + 1)
+		if err != nil {
+			return term{}, err
+		}
+
+		if operation == opAnd {
+			return term{text: parenthesize(left, precedenceAnd) + " and " + parenthesize(right, precedenceAnd), precedence: precedenceAnd}, nil
+		}
+		return term{text: parenthesize(left, precedenceOr) + " or " + parenthesize(right, precedenceOr), precedence: precedenceOr}, nil
+	case opNot:
+		inner, err := decoder.expression(depth + 1)
+		if err != nil {
+			return term{}, err
+		}
+		return simple("! " + parenthesize(inner, precedenceTerm))
+	case opCDHash:
+		value, err := decoder.bytes()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("cdhash " + hexData(value))
+	case opInfoKeyField, opEntitlementField:
+		key, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		match, err := decoder.match()
+		if err != nil {
+			return term{}, err
+		}
+
+		subject := "info"
+		if operation == opEntitlementField {
+			subject = "entitlement"
+		}
+		return simple(withMatch(subject + "[" + strconv.Quote(key) + "]", match))
+	case opCertField, opCertGeneric, opCertPolicy, opCertFieldDate:
+		slot, err := decoder.uint32()
+		if err != nil {
+			return term{}, err
+		}
+		key, err := decoder.bytes()
+		if err != nil {
+			return term{}, err
+		}
+		match, err := decoder.match()
+		if err != nil {
+			return term{}, err
+		}
+
+		field := string(key)
+		switch operation {
+		case opCertGeneric:
+			field = "field." + oidString(key)
+		case opCertPolicy:
+			field = "policy." + oidString(key)
+		case opCertFieldDate:
+			field = "timestamp." + oidString(key)
+		}
+		return simple(withMatch("certificate " + certSlot(int32(slot)) + "[" + field + "]", match))
+	case opTrustedCert:
+		slot, err := decoder.uint32()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("certificate " + certSlot(int32(slot)) + " trusted")
+	case opTrustedCerts:
+		return simple("anchor trusted")
+	case opNamedAnchor:
+		name, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("anchor apple " + name)
+	case opNamedCode:
+		name, err := decoder.string()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("(" + name + ")")
+	case opPlatform:
+		platform, err := decoder.uint32()
+		if err != nil {
+			return term{}, err
+		}
+		return simple("platform = " + strconv.Itoa(int(platform)))
+	case opNotarized:
+		return simple("notarized")
+	case opLegacyDevID:
+		return simple("legacy")
+	}
+
+	return term{}, fmt.Errorf("unknown requirement operation 0x%x", rawOperation)
+}
@@ -0,0 +1,83 @@
+package codesign
+
+import (
+	"fmt"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/trustcache"
+)
+
+const (
+	TrustSourceNone = 0
+	TrustSourceTrustCache = 1
+	TrustSourceSignature = 2
+)
+
+// TrustResult records why a slice is, or is not, allowed to run
+type TrustResult struct {
+	Source int
+	CDHash *core.TypedHash
+	Entry trustcache.Entry // set when trusted by a trust cache
+	Signer *Signer // set when trusted by a CMS signature
+	Reports []*Report
+	Errors []error
+}
+
+// TrustSourceName returns a display name for a trust source
+func TrustSourceName(source int) string {
+	switch source {
+	case TrustSourceTrustCache:
+		return "trust cache"
+	case TrustSourceSignature:
+		return "signature"
+	}
+
+	return "none"
+}
+
+// Evaluate decides whether a slice is trusted. Its code pages and special slots must
+// match the code directories; the CDHash is then looked up in the trust caches, and
+// only when absent is the CMS signature checked against options.Roots.
+func (slice *Slice) Evaluate(caches []*trustcache.TrustCache, external *ExternalData, options *VerifyOptions) *TrustResult {
+	result := &TrustResult{Source: TrustSourceNone, Errors: make([]error, 0)}
+	if slice.Signature == nil {
+		result.Errors = append(result.Errors, fmt.Errorf("slice %s is not signed", slice.Cpu))
+		return result
+	}
+
+	var err error
+	result.CDHash, err = slice.Signature.CodeDirectory().CDHash()
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+
+	result.Reports, err = slice.Verify(external)
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+
+	for _, report := range result.Reports {
+		result.Errors = append(result.Errors, report.Errors()...)
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	for _, cache := range caches {
+		result.Entry = cache.Lookup(result.CDHash)
+		if result.Entry != nil {
+			result.Source = TrustSourceTrustCache
+			return result
+		}
+	}
+
+	result.Signer, err = slice.Signature.VerifyCMS(options)
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+
+	result.Source = TrustSourceSignature
+	return result
+}
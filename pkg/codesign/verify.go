@@ -0,0 +1,277 @@
+package codesign
+
+import (
+	"bytes"
+	"fmt"
+	"go-aapl-integrity/pkg/core"
+	"io"
+)
+
+const (
+	SlotStatusValid = 0
+	SlotStatusMismatch = 1
+	SlotStatusAbsent = 2 // no hash recorded and nothing to hash
+	SlotStatusMissing = 3 // a hash is recorded but the signature does not carry the data
+	SlotStatusUnexpected = 4 // the signature carries data that no hash covers
+	SlotStatusNotSupplied = 5 // the data lives outside the binary and was not provided
+
+	HashBufferSize = 1024 * 32
+)
+
+// ExternalData holds the bundle files that special slots cover but that are not part of the Mach-O
+type ExternalData struct {
+	InfoPlist []byte
+	ResourceDirectory []byte // _CodeSignature/CodeResources
+}
+
+type PageResult struct {
+	Index int
+	Offset uint64
+	Size uint64
+	Expected []byte
+	Actual []byte
+}
+
+type SlotResult struct {
+	Slot int
+	Status int
+	Expected []byte
+	Actual []byte
+}
+
+type Report struct {
+	CodeDirectory *CodeDirectory
+	Pages []*PageResult
+	Slots []*SlotResult
+}
+
+// SlotName returns a display name for a special slot
+func SlotName(slot int) string {
+	switch slot {
+	case SlotInfo:
+		return "Info.plist"
+	case SlotRequirements:
+		return "requirements"
+	case SlotResourceDir:
+		return "resource directory"
+	case SlotApplication:
+		return "application specific"
+	case SlotEntitlements:
+		return "entitlements"
+	case SlotDEREntitlements:
+		return "DER entitlements"
+	}
+
+	return fmt.Sprintf("special slot %d", slot)
+}
+
+// SlotStatusName returns a display name for a slot status
+func SlotStatusName(status int) string {
+	switch status {
+	case SlotStatusValid:
+		return "valid"
+	case SlotStatusMismatch:
+		return "mismatch"
+	case SlotStatusAbsent:
+		return "absent"
+	case SlotStatusMissing:
+		return "missing"
+	case SlotStatusUnexpected:
+		return "unexpected"
+	case SlotStatusNotSupplied:
+		return "not supplied"
+	}
+
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+func (page *PageResult) Valid() bool {
+	return bytes.Equal(page.Expected, page.Actual)
+}
+
+func (slot *SlotResult) Valid() bool {
+	return slot.Status != SlotStatusMismatch && slot.Status != SlotStatusMissing && slot.Status != SlotStatusUnexpected
+}
+
+// Valid reports whether every page and special slot matched the code directory
+func (report *Report) Valid() bool {
+	return len(report.Errors()) == 0
+}
+
+// Errors describes each page and special slot that failed verification
+func (report *Report) Errors() []error {
+	errors := make([]error, 0)
+	for _, page := range report.Pages {
+		if !page.Valid() {
+			errors = append(errors, fmt.Errorf("invalid page %d at offset 0x%x", page.Index, page.Offset))
+		}
+	}
+
+	for _, slot := range report.Slots {
+		if !slot.Valid() {
+			errors = append(errors, fmt.Errorf("%s: %s", SlotName(slot.Slot), SlotStatusName(slot.Status)))
+		}
+	}
+
+	return errors
+}
+
+// isEmptyHash reports whether a slot hash is all zeros, which marks an unused special slot
+func isEmptyHash(hash []byte) bool {
+	for _, value := range hash {
+		if value != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashRange digests length bytes of reader starting at offset
+func (directory *CodeDirectory) hashRange(reader io.ReaderAt, offset uint64, length uint64) ([]byte, error) {
+	hasher, err := core.NewHasher(int(directory.HashType))
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, HashBufferSize)
+	for length > 0 {
+		chunk := buffer
+		if uint64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+
+		count, err := reader.ReadAt(chunk, int64(offset))
+		if count != len(chunk) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("short read at offset 0x%x", offset)
+			}
+			return nil, err
+		}
+
+		hasher.Write(chunk)
+		offset += uint64(count)
+		length -= uint64(count)
+	}
+
+	return hasher.Sum(nil)[:directory.HashSize], nil
+}
+
+// VerifyPages re-hashes every code page of the slice contents up to the code limit
+func (directory *CodeDirectory) VerifyPages(reader io.ReaderAt) ([]*PageResult, error) {
+	pageSize := directory.PageSize()
+	if pageSize == 0 {
+		pageSize = directory.CodeLimit
+	}
+
+	expectedPages := uint64(0)
+	if pageSize != 0 {
+		expectedPages = (directory.CodeLimit + pageSize - 1) / pageSize
+	}
+	if expectedPages != uint64(len(directory.CodeSlots)) {
+		return nil, fmt.Errorf("code limit 0x%x needs %d pages, directory has %d", directory.CodeLimit, expectedPages, len(directory.CodeSlots))
+	}
+
+	result := make([]*PageResult, len(directory.CodeSlots))
+	for index, expected := range directory.CodeSlots {
+		offset := uint64(index) * pageSize
+		size := pageSize
+		if offset + size > directory.CodeLimit {
+			size = directory.CodeLimit - offset
+		}
+
+		actual, err := directory.hashRange(reader, offset, size)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %s", index, err)
+		}
+
+		result[index] = &PageResult{
+			Index:    index,
+			Offset:   offset,
+			Size:     size,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+
+	return result, nil
+}
+
+// VerifySpecialSlots checks each special slot hash against the blob it covers
+func (directory *CodeDirectory) VerifySpecialSlots(signature *Signature, external *ExternalData) ([]*SlotResult, error) {
+	if external == nil {
+		external = &ExternalData{}
+	}
+
+	result := make([]*SlotResult, len(directory.SpecialSlots))
+	for index, expected := range directory.SpecialSlots {
+		slot := index + 1
+		outside := slot == SlotInfo || slot == SlotResourceDir
+
+		var data []byte
+		switch slot {
+		case SlotInfo:
+			data = external.InfoPlist
+		case SlotResourceDir:
+			data = external.ResourceDirectory
+		default:
+			data = signature.Slot(uint32(slot))
+		}
+
+		slotResult := &SlotResult{Slot: slot, Expected: expected}
+		result[index] = slotResult
+
+		switch {
+		case data == nil && isEmptyHash(expected):
+			slotResult.Status = SlotStatusAbsent
+		case data == nil && outside:
+			slotResult.Status = SlotStatusNotSupplied
+		case data == nil:
+			slotResult.Status = SlotStatusMissing
+		default:
+			actual, err := directory.Hash(data)
+			if err != nil {
+				return nil, err
+			}
+			slotResult.Actual = actual
+
+			if bytes.Equal(actual, expected) {
+				slotResult.Status = SlotStatusValid
+			} else if isEmptyHash(expected) {
+				slotResult.Status = SlotStatusUnexpected
+			} else {
+				slotResult.Status = SlotStatusMismatch
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Verify checks the code pages and special slots of a slice against each of its code directories
+func (slice *Slice) Verify(external *ExternalData) ([]*Report, error) {
+	if slice.Signature == nil {
+		return nil, fmt.Errorf("slice %s is not signed", slice.Cpu)
+	}
+
+	result := make([]*Report, 0, len(slice.Signature.CodeDirectories))
+	for _, directory := range slice.Signature.CodeDirectories {
+		pages, err := directory.VerifyPages(slice.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		slots, err := directory.VerifySpecialSlots(slice.Signature, external)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, &Report{
+			CodeDirectory: directory,
+			Pages:         pages,
+			Slots:         slots,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const EFIGUIDSize = 16
+
+// EFIGUID decodes a GUID as EFI stores it, with its first three fields little endian
+func EFIGUID(data []byte) (uuid.UUID, error) {
+	var result uuid.UUID
+	if len(data) < EFIGUIDSize {
+		return result, fmt.Errorf("not enough data for a GUID")
+	}
+
+	copy(result[:], data[:EFIGUIDSize])
+	result[0], result[1], result[2], result[3] = data[3], data[2], data[1], data[0]
+	result[4], result[5] = data[5], data[4]
+	result[6], result[7] = data[7], data[6]
+
+	return result, nil
+}
+
+// EFIGUIDBytes encodes a GUID the way EFI stores it
+func EFIGUIDBytes(guid uuid.UUID) []byte {
+	result := make([]byte, EFIGUIDSize)
+	copy(result, guid[:])
+	result[0], result[1], result[2], result[3] = guid[3], guid[2], guid[1], guid[0]
+	result[4], result[5] = guid[5], guid[4]
+	result[6], result[7] = guid[7], guid[6]
+
+	return result
+}
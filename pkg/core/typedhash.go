@@ -2,9 +2,20 @@ package core
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
+	"strings"
 )
 
+// Hash types share their values with the CS_HASHTYPE_* constants, which is what both
+// CodeDirectories and trust cache entries store
 const (
 	HashSHA1 = 1
 	HashSHA1Size = 20
@@ -14,55 +25,253 @@ const (
 	HashSHA256TruncatedSize = 20
 	HashSHA384 = 4
 	HashSHA384Size = 48
+
+	// CDHashes are compared on their first 20 bytes whatever the digest
+	CDHashSize = 20
 )
 
-type TypedHash struct {
-	Type int
-	Data []byte
+// HashTypeName returns a display name for a hash type constant
+func HashTypeName(hashType int) string {
+	switch hashType {
+	case HashSHA1:
+		return "sha1"
+	case HashSHA256:
+		return "sha256"
+	case HashSHA256Truncated:
+		return "sha256-truncated"
+	case HashSHA384:
+		return "sha384"
+	}
+
+	return fmt.Sprintf("unknown(%d)", hashType)
 }
 
-func (th TypedHash) size() int {
-	switch th.Type {
+// HashTypeFromName is the inverse of HashTypeName
+func HashTypeFromName(name string) (int, error) {
+	for _, hashType := range []int{HashSHA1, HashSHA256, HashSHA256Truncated, HashSHA384} {
+		if strings.EqualFold(name, HashTypeName(hashType)) {
+			return hashType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown hash type %s", name)
+}
+
+// HashSize returns the digest length of a hash type
+func HashSize(hashType int) (int, error) {
+	switch hashType {
+	case HashSHA1:
+		return HashSHA1Size, nil
 	case HashSHA256:
-		return 32
+		return HashSHA256Size, nil
+	case HashSHA256Truncated:
+		return HashSHA256TruncatedSize, nil
 	case HashSHA384:
-		return 48
+		return HashSHA384Size, nil
+	}
+
+	return 0, fmt.Errorf("unknown hash type %d", hashType)
+}
+
+// CryptoHash returns the crypto.Hash computing a hash type, before any truncation
+func CryptoHash(hashType int) (crypto.Hash, error) {
+	switch hashType {
 	case HashSHA1:
-	case HashSHA256Truncated:
-		return 20
+		return crypto.SHA1, nil
+	case HashSHA256, HashSHA256Truncated:
+		return crypto.SHA256, nil
+	case HashSHA384:
+		return crypto.SHA384, nil
 	}
 
-	return 20
+	return 0, fmt.Errorf("unknown hash type %d", hashType)
+}
+
+// HashTypeFromCrypto returns the untruncated hash type computed by a crypto.Hash
+func HashTypeFromCrypto(cryptoHash crypto.Hash) (int, error) {
+	switch cryptoHash {
+	case crypto.SHA1:
+		return HashSHA1, nil
+	case crypto.SHA256:
+		return HashSHA256, nil
+	case crypto.SHA384:
+		return HashSHA384, nil
+	}
+
+	return 0, fmt.Errorf("unsupported hash %s", cryptoHash)
+}
+
+// NewHasher returns a hash.Hash for a hash type; its Sum must still be truncated to HashSize
+func NewHasher(hashType int) (hash.Hash, error) {
+	switch hashType {
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256, HashSHA256Truncated:
+		return sha256.New(), nil
+	case HashSHA384:
+		return sha512.New384(), nil
+	}
+
+	return nil, fmt.Errorf("unknown hash type %d", hashType)
+}
+
+// HashTypeFromCodeDirectory maps a CodeDirectory hashType field to a hash type
+func HashTypeFromCodeDirectory(value uint8) (int, error) {
+	_, err := HashSize(int(value))
+	return int(value), err
+}
+
+// CodeDirectoryHashType maps a hash type to the CodeDirectory hashType field
+func CodeDirectoryHashType(hashType int) (uint8, error) {
+	_, err := HashSize(hashType)
+	return uint8(hashType), err
+}
+
+// HashTypeFromTrustCache maps a trust cache entry hash type to a hash type
+func HashTypeFromTrustCache(value uint8) (int, error) {
+	return HashTypeFromCodeDirectory(value)
+}
+
+// TrustCacheHashType maps a hash type to the value trust cache entries store
+func TrustCacheHashType(hashType int) (uint8, error) {
+	return CodeDirectoryHashType(hashType)
+}
+
+type TypedHash struct {
+	Type int
+	Data []byte
 }
 
-func (th *TypedHash) toSHA256Truncated() (*TypedHash, error) {
+// NewTypedHash wraps a digest, checking its length against the hash type
+func NewTypedHash(hashType int, data []byte) (*TypedHash, error) {
+	result := &TypedHash{Type: hashType, Data: data}
+	err := result.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// HashReader digests everything read from reader
+func HashReader(hashType int, reader io.Reader) (*TypedHash, error) {
+	hasher, err := NewHasher(hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	size, _ := HashSize(hashType)
+	return &TypedHash{
+		Type: hashType,
+		Data: hasher.Sum(nil)[:size],
+	}, nil
+}
+
+// HashBytes digests data
+func HashBytes(hashType int, data []byte) (*TypedHash, error) {
+	return HashReader(hashType, bytes.NewReader(data))
+}
+
+// ParseHex decodes a hex digest of the given type
+func ParseHex(hashType int, value string) (*TypedHash, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTypedHash(hashType, data)
+}
+
+// ParseBase64 decodes a standard base64 digest of the given type
+func ParseBase64(hashType int, value string) (*TypedHash, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTypedHash(hashType, data)
+}
+
+// Size returns the digest length of the hash type
+func (th *TypedHash) Size() int {
+	size, _ := HashSize(th.Type)
+	return size
+}
+
+// Validate checks the type is known and the data has its length
+func (th *TypedHash) Validate() error {
+	size, err := HashSize(th.Type)
+	if err != nil {
+		return err
+	}
+
+	if len(th.Data) != size {
+		return fmt.Errorf("%s hash has length %d, expected %d", HashTypeName(th.Type), len(th.Data), size)
+	}
+
+	return nil
+}
+
+func (th *TypedHash) Hex() string {
+	return hex.EncodeToString(th.Data)
+}
+
+func (th *TypedHash) Base64() string {
+	return base64.StdEncoding.EncodeToString(th.Data)
+}
+
+func (th *TypedHash) String() string {
+	return fmt.Sprintf("%s:%s", HashTypeName(th.Type), th.Hex())
+}
+
+// CDHash returns the leading CDHashSize bytes, the form trust caches and CMS plists store
+func (th *TypedHash) CDHash() []byte {
+	if len(th.Data) < CDHashSize {
+		return th.Data
+	}
+
+	return th.Data[:CDHashSize]
+}
+
+// ToSHA256Truncated converts a SHA256 digest to its truncated form
+func (th *TypedHash) ToSHA256Truncated() (*TypedHash, error) {
 	if th.Type == HashSHA256Truncated {
 		return th, nil
 	}
 
 	if th.Type == HashSHA256 {
+		if len(th.Data) < HashSHA256TruncatedSize {
+			return nil, fmt.Errorf("sha256 hash has length %d", len(th.Data))
+		}
+
 		return &TypedHash{
 			Type: HashSHA256Truncated,
-			Data: th.Data[0:HashSHA1Size],
+			Data: th.Data[0:HashSHA256TruncatedSize],
 		}, nil
 	}
 
 	return nil, fmt.Errorf("cannot truncate unrelated hash type %d", th.Type)
 }
 
-func (th *TypedHash) equalTo(other *TypedHash) (bool, error) {
+// Equal compares two digests, treating SHA256 and truncated SHA256 as comparable
+func (th *TypedHash) Equal(other *TypedHash) (bool, error) {
 	if th.Type == HashSHA256Truncated || other.Type == HashSHA256Truncated {
-		thTruncated, err := th.toSHA256Truncated()
+		thTruncated, err := th.ToSHA256Truncated()
 		if err != nil {
 			return false, err
 		}
 
-		otherTruncated, err := other.toSHA256Truncated()
+		otherTruncated, err := other.ToSHA256Truncated()
 		if err != nil {
 			return false, err
 		}
 
-		return thTruncated.equalTo(otherTruncated)
+		return bytes.Equal(thTruncated.Data, otherTruncated.Data), nil
 	}
 
 	if th.Type != other.Type {
@@ -74,4 +283,13 @@ func (th *TypedHash) equalTo(other *TypedHash) (bool, error) {
 	}
 
 	return bytes.Equal(th.Data, other.Data), nil
-}
\ No newline at end of file
+}
+
+// EqualCDHash compares two CDHashes on their leading CDHashSize bytes, as the kernel does
+func (th *TypedHash) EqualCDHash(other *TypedHash) bool {
+	if len(th.Data) < CDHashSize || len(other.Data) < CDHashSize {
+		return false
+	}
+
+	return bytes.Equal(th.CDHash(), other.CDHash())
+}
@@ -0,0 +1,288 @@
+package detect
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"go-aapl-integrity/pkg/apfs"
+	"go-aapl-integrity/pkg/chunklist"
+	"go-aapl-integrity/pkg/ealf"
+	"go-aapl-integrity/pkg/fdr"
+	"go-aapl-integrity/pkg/img4"
+	"go-aapl-integrity/pkg/plist"
+	"go-aapl-integrity/pkg/trustcache"
+	"go-aapl-integrity/pkg/udif"
+	"io"
+)
+
+const (
+	KindUnknown = 0
+	KindImage4 = 1
+	KindImage4Payload = 2
+	KindImage4Manifest = 3
+	KindChunklist = 4
+	KindTrustCache = 5
+	KindTrustObject = 6
+	KindMachO = 7
+	KindFat = 8
+	KindFileset = 9
+	KindUDIF = 10
+	KindEALF = 11
+	KindPlist = 12
+	KindAPFS = 13
+
+	machOFileTypeFileset = 0xc // MH_FILESET
+
+	// ReadLimit bounds how much of a file is read into memory for the formats that are parsed
+	// whole. Mach-O files and disk images are read through the reader instead.
+	ReadLimit = 256 << 20
+	sniffSize = 64
+)
+
+// Artifact is what a file turned out to be. The field matching Kind, when there is one, holds
+// its parsed form.
+type Artifact struct {
+	Kind int
+	Size int64
+	Wrapped bool // set for a trust cache inside an IM4P
+	FourCC string // the payload type of IM4P files, wrapped or not
+	Image4 *img4.Image4
+	Chunklist *chunklist.ChunklistHeader
+	TrustCache *trustcache.TrustCache
+	TrustObject *fdr.TrustObject
+	MachO *macho.File // of Mach-O and fileset files
+	Fat *macho.FatFile
+	UDIF *udif.Image
+	Plist interface{}
+	APFS *apfs.Container
+}
+
+// KindName returns a display name for an artifact kind
+func KindName(kind int) string {
+	switch kind {
+	case KindUnknown:
+		return "unknown"
+	case KindImage4:
+		return "img4"
+	case KindImage4Payload:
+		return "im4p"
+	case KindImage4Manifest:
+		return "im4m"
+	case KindChunklist:
+		return "chunklist"
+	case KindTrustCache:
+		return "trust cache"
+	case KindTrustObject:
+		return "fdr trust object"
+	case KindMachO:
+		return "mach-o"
+	case KindFat:
+		return "fat mach-o"
+	case KindFileset:
+		return "mach-o fileset"
+	case KindUDIF:
+		return "udif disk image"
+	case KindEALF:
+		return "efi allow list"
+	case KindPlist:
+		return "plist"
+	case KindAPFS:
+		return "apfs container"
+	}
+
+	return fmt.Sprintf("unknown(%d)", kind)
+}
+
+// Summary describes an artifact in one line
+func (artifact *Artifact) Summary() string {
+	result := KindName(artifact.Kind)
+	switch artifact.Kind {
+	case KindImage4, KindImage4Payload:
+		result += fmt.Sprintf(" %s", artifact.FourCC)
+		if payload := artifact.Image4.Payload; payload != nil {
+			result += fmt.Sprintf(" %q 0x%x bytes", payload.Description, len(payload.Data))
+		}
+	case KindImage4Manifest:
+		if leaf, err := artifact.Image4.Manifest.Leaf(); err == nil {
+			result += fmt.Sprintf(" signed by %s", leaf.Subject.CommonName)
+		}
+	case KindChunklist:
+		result += fmt.Sprintf(" version %d signature method %d %d chunks", artifact.Chunklist.FileVersion, artifact.Chunklist.SignatureMethod, artifact.Chunklist.ChunkCount)
+	case KindTrustCache:
+		cache := artifact.TrustCache
+		result += fmt.Sprintf(" version %d %s %d entries", cache.Version, cache.UUID, cache.Count)
+		if artifact.Wrapped {
+			result += fmt.Sprintf(" in %s im4p", artifact.FourCC)
+		}
+	case KindMachO, KindFileset:
+		result += fmt.Sprintf(" %s", artifact.MachO.Cpu)
+	case KindFat:
+		for _, arch := range artifact.Fat.Arches {
+			result += fmt.Sprintf(" %s", arch.Cpu)
+		}
+	case KindUDIF:
+		result += fmt.Sprintf(" %d sectors %d partitions", artifact.UDIF.Trailer.SectorCount, len(artifact.UDIF.Tables))
+	case KindPlist:
+		result += fmt.Sprintf(" %T", artifact.Plist)
+	case KindAPFS:
+		result += fmt.Sprintf(" %s %d volumes", artifact.APFS.Superblock.UUID, len(artifact.APFS.Superblock.FileSystemOIDs))
+	}
+
+	return result
+}
+
+// detectMachO reads thin, fat and fileset Mach-O files through the reader
+func detectMachO(reader io.ReaderAt, artifact *Artifact) bool {
+	fat, err := macho.NewFatFile(reader)
+	if err == nil {
+		artifact.Kind, artifact.Fat = KindFat, fat
+		return true
+	}
+
+	file, err := macho.NewFile(reader)
+	if err != nil {
+		return false
+	}
+
+	artifact.Kind, artifact.MachO = KindMachO, file
+	if file.Type == machOFileTypeFileset {
+		artifact.Kind = KindFileset
+	}
+	return true
+}
+
+// detectDER tells the DER formats apart: IMG4 containers, payloads and manifests, trust caches
+// wrapped in payloads, and FDR trust objects
+func detectDER(data []byte, artifact *Artifact) bool {
+	image, err := img4.Parse(data)
+	if err == nil {
+		artifact.Image4 = image
+		switch image.Type {
+		case img4.Image4TypeComplete:
+			artifact.Kind, artifact.FourCC = KindImage4, image.Payload.Name
+		case img4.Image4TypeManifest:
+			artifact.Kind = KindImage4Manifest
+		case img4.Image4TypePayload:
+			artifact.Kind, artifact.FourCC = KindImage4Payload, image.Payload.Name
+			for _, payloadType := range trustcache.PayloadTypes {
+				if image.Payload.Name != payloadType {
+					continue
+				}
+
+				cache, err := trustcache.Parse(image.Payload.Data)
+				if err == nil {
+					artifact.Kind, artifact.TrustCache, artifact.Wrapped = KindTrustCache, cache, true
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+
+	trustObject, err := fdr.ParseTrustObject(data)
+	if err == nil {
+		artifact.Kind, artifact.TrustObject = KindTrustObject, trustObject
+		return true
+	}
+
+	return false
+}
+
+// isPlist reports whether data starts like a binary or XML property list
+func isPlist(data []byte) bool {
+	if bytes.HasPrefix(data, []byte(plist.BinaryMagic)) {
+		return true
+	}
+
+	text := bytes.TrimLeft(data, "\xef\xbb\xbf \t\r\n")
+	return bytes.HasPrefix(text, []byte(plist.XMLMagic)) || bytes.HasPrefix(text, []byte("<!DOCTYPE plist")) || bytes.HasPrefix(text, []byte("<plist"))
+}
+
+// Detect identifies the Apple integrity artifact in the size bytes of reader. Files that are
+// not recognized come back as KindUnknown rather than an error; errors are for failed reads.
+func Detect(reader io.ReaderAt, size int64) (*Artifact, error) {
+	artifact := &Artifact{Kind: KindUnknown, Size: size}
+
+	head := make([]byte, sniffSize)
+	if size < int64(len(head)) {
+		head = head[:size]
+	}
+	_, err := reader.ReadAt(head, 0)
+	if err != nil && err != io.EOF { return nil, err }
+
+	// Formats read through the reader, which may be too large to hold
+	if udif.IsImage(reader, size) {
+		image, err := udif.Open(reader, size)
+		if err == nil {
+			artifact.Kind, artifact.UDIF = KindUDIF, image
+			return artifact, nil
+		}
+	}
+
+	if len(head) >= 4 {
+		switch binary.BigEndian.Uint32(head[0:4]) {
+		case macho.Magic32, macho.Magic64, macho.MagicFat, 0xcefaedfe, 0xcffaedfe:
+			if detectMachO(reader, artifact) {
+				return artifact, nil
+			}
+		}
+	}
+
+	if len(head) >= 0x24 && string(head[0x20:0x24]) == apfs.NXSuperblockMagic {
+		container, err := apfs.Open(reader)
+		if err == nil {
+			artifact.Kind, artifact.APFS = KindAPFS, container
+			return artifact, nil
+		}
+	}
+
+	if size > ReadLimit {
+		return artifact, nil
+	}
+
+	data := make([]byte, size)
+	_, err = reader.ReadAt(data, 0)
+	if err != nil && err != io.EOF { return nil, err }
+
+	return detectBytes(data, artifact), nil
+}
+
+// detectBytes identifies the formats that are parsed from memory
+func detectBytes(data []byte, artifact *Artifact) *Artifact {
+	if header, err := chunklist.ParseChunklistHeader(data); err == nil {
+		artifact.Kind, artifact.Chunklist = KindChunklist, header
+		return artifact
+	}
+
+	// Only the magic of allow lists is known, see pkg/ealf
+	if ealf.IsAllowList(data) {
+		artifact.Kind = KindEALF
+		return artifact
+	}
+
+	if isPlist(data) {
+		value, err := plist.Unmarshal(data)
+		if err == nil {
+			artifact.Kind, artifact.Plist = KindPlist, value
+			return artifact
+		}
+	}
+
+	if len(data) > 0 && data[0] == 0x30 && detectDER(data, artifact) {
+		return artifact
+	}
+
+	// Raw trust caches have no magic, only a version and a size that must match exactly
+	if cache, err := trustcache.Parse(data); err == nil {
+		artifact.Kind, artifact.TrustCache = KindTrustCache, cache
+	}
+
+	return artifact
+}
+
+// DetectBytes identifies the artifact held in data
+func DetectBytes(data []byte) (*Artifact, error) {
+	return Detect(bytes.NewReader(data), int64(len(data)))
+}
@@ -0,0 +1,255 @@
+package device
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+const (
+	CertificateTypeUnknown = 0
+	CertificateTypeDevice = 1 // issued by the iPhone Device CA, e.g. DeviceCertificate
+	CertificateTypeActivation = 2 // issued by the iPhone CA, e.g. AccountTokenCertificate
+	CertificateTypeSoftwareUpdate = 3
+
+	DeviceCAName = "Apple iPhone Device CA"
+	IPhoneCAName = "Apple iPhone Certification Authority"
+	SoftwareUpdateName = "Software Update"
+)
+
+// AuthorityFiles are the device CAs shipped in testdata, relative to that directory
+var AuthorityFiles = []string{"iPhoneCA.pem", "iPhoneDeviceCA.pem"}
+
+var (
+	// Classic UDIDs are 40 hex digits, newer ones are 8 and 16 hex digits split by a dash
+	udidPattern = regexp.MustCompile(`^([0-9a-fA-F]{40}|[0-9a-fA-F]{8}-[0-9a-fA-F]{16})$`)
+)
+
+type Authorities struct {
+	Certificates []*x509.Certificate
+	roots map[*x509.Certificate]bool
+}
+
+type VerifyOptions struct {
+	// Time to validate the chain at, the current time when zero. The bundled CAs have expired,
+	// so certificates of older devices are checked at a time inside their validity instead.
+	CurrentTime time.Time
+}
+
+// Identity is what a device certificate says about the device it was issued to
+type Identity struct {
+	Certificate *x509.Certificate
+	Chains [][]*x509.Certificate
+	Type int
+	UDID string
+	SerialNumber string
+}
+
+// CertificateTypeName returns a display name for a certificate type
+func CertificateTypeName(certificateType int) string {
+	switch certificateType {
+	case CertificateTypeDevice:
+		return "device"
+	case CertificateTypeActivation:
+		return "activation"
+	case CertificateTypeSoftwareUpdate:
+		return "software update"
+	default:
+		return "unknown"
+	}
+}
+
+// NewAuthorities trusts certificates whose issuer is not among them as roots, and uses the rest
+// as intermediates
+func NewAuthorities(certificates []*x509.Certificate) *Authorities {
+	result := &Authorities{
+		Certificates: certificates,
+		roots:        make(map[*x509.Certificate]bool),
+	}
+
+	for _, certificate := range certificates {
+		issued := false
+		for _, issuer := range certificates {
+			if issuer != certificate && bytes.Equal(certificate.RawIssuer, issuer.RawSubject) {
+				issued = true
+				break
+			}
+		}
+
+		if !issued {
+			result.roots[certificate] = true
+		}
+	}
+
+	return result
+}
+
+// Roots returns the authorities that anchor chains
+func (authorities *Authorities) Roots() []*x509.Certificate {
+	result := make([]*x509.Certificate, 0)
+	for _, certificate := range authorities.Certificates {
+		if authorities.roots[certificate] {
+			result = append(result, certificate)
+		}
+	}
+
+	return result
+}
+
+func (authorities *Authorities) isRoot(certificate *x509.Certificate) bool {
+	return authorities.roots[certificate]
+}
+
+// ParseCertificates decodes every certificate in PEM data, or a single DER certificate
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certificate, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*x509.Certificate{certificate}, nil
+	}
+
+	result := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, certificate)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return result, nil
+}
+
+// LoadAuthorities reads CA certificates from PEM or DER files
+func LoadAuthorities(paths ...string) (*Authorities, error) {
+	certificates := make([]*x509.Certificate, 0)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		certificates = append(certificates, parsed...)
+	}
+
+	return NewAuthorities(certificates), nil
+}
+
+// classify tells device, activation and software update certificates apart by their issuer
+func classify(certificate *x509.Certificate) int {
+	if certificate.Subject.CommonName == SoftwareUpdateName {
+		return CertificateTypeSoftwareUpdate
+	}
+
+	switch certificate.Issuer.CommonName {
+	case DeviceCAName:
+		return CertificateTypeDevice
+	case IPhoneCAName:
+		return CertificateTypeActivation
+	default:
+		return CertificateTypeUnknown
+	}
+}
+
+// ParseIdentity decodes the UDID and serial number from a certificate subject without verifying it
+func ParseIdentity(certificate *x509.Certificate) *Identity {
+	result := &Identity{
+		Certificate:  certificate,
+		Type:         classify(certificate),
+		SerialNumber: certificate.Subject.SerialNumber,
+	}
+
+	if udidPattern.MatchString(certificate.Subject.CommonName) {
+		result.UDID = certificate.Subject.CommonName
+	}
+
+	return result
+}
+
+// issuer finds the authority that signed a certificate
+func (authorities *Authorities) issuer(certificate *x509.Certificate) (*x509.Certificate, error) {
+	for _, candidate := range authorities.Certificates {
+		if candidate == certificate || !bytes.Equal(certificate.RawIssuer, candidate.RawSubject) {
+			continue
+		}
+
+		// CheckSignature, unlike x509.Verify, still accepts the SHA-1 signatures of the device CAs
+		if candidate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature) == nil {
+			return candidate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("not issued by a trusted device CA (issuer %s)", certificate.Issuer)
+}
+
+// checkValidity checks the validity window of a chain member, and that issuers are CAs
+func checkValidity(certificate *x509.Certificate, issuer bool, currentTime time.Time) error {
+	if currentTime.Before(certificate.NotBefore) || currentTime.After(certificate.NotAfter) {
+		return fmt.Errorf("%s is only valid from %s to %s", certificate.Subject, certificate.NotBefore.UTC(), certificate.NotAfter.UTC())
+	}
+	if issuer && (!certificate.BasicConstraintsValid || !certificate.IsCA) {
+		return fmt.Errorf("%s is not a CA", certificate.Subject)
+	}
+	if issuer && certificate.KeyUsage != 0 && certificate.KeyUsage & x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("%s may not sign certificates", certificate.Subject)
+	}
+
+	return nil
+}
+
+// Verify checks that a certificate chains to the device CAs and decodes its identity. The
+// chain is built here rather than with x509.Verify, which no longer accepts SHA-1 signatures.
+func (authorities *Authorities) Verify(certificate *x509.Certificate, options *VerifyOptions) (*Identity, error) {
+	currentTime := time.Now()
+	if options != nil && !options.CurrentTime.IsZero() {
+		currentTime = options.CurrentTime
+	}
+
+	chain := []*x509.Certificate{certificate}
+	for current := certificate; ; {
+		err := checkValidity(current, current != certificate, currentTime)
+		if err != nil {
+			return nil, err
+		}
+		if authorities.isRoot(current) && current != certificate {
+			break
+		}
+		if len(chain) > len(authorities.Certificates) {
+			return nil, fmt.Errorf("%s: chain loops", certificate.Subject)
+		}
+
+		current, err = authorities.issuer(current)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", chain[len(chain) - 1].Subject, err)
+		}
+		chain = append(chain, current)
+	}
+
+	result := ParseIdentity(certificate)
+	result.Chains = [][]*x509.Certificate{chain}
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package device
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// issueCertificate creates a certificate for subject signed by parent, or self signed without one
+func issueCertificate(t *testing.T, subject pkix.Name, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               subject,
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+func TestVerifyBundled(t *testing.T) {
+	authorities, err := LoadAuthorities("../../testdata/iPhoneCA.pem", "../../testdata/iPhoneDeviceCA.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := authorities.Roots()
+	if len(roots) != 1 || roots[0].Subject.CommonName != IPhoneCAName {
+		t.Fatalf("roots %v", roots)
+	}
+
+	updates, err := LoadAuthorities("../../testdata/iPhoneSoftwareUpdate.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	softwareUpdate := updates.Certificates[0]
+	deviceCA := authorities.Certificates[1]
+
+	tests := []struct {
+		name        string
+		certificate *x509.Certificate
+		time        time.Time
+		certType    int
+		err         bool
+	}{
+		{"software update", softwareUpdate, time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC), CertificateTypeSoftwareUpdate, false},
+		{"device CA", deviceCA, time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC), CertificateTypeActivation, false},
+		{"software update expired", softwareUpdate, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), 0, true},
+		{"before the CAs", softwareUpdate, time.Date(2007, 4, 13, 0, 0, 0, 0, time.UTC), 0, true},
+	}
+
+	for _, test := range tests {
+		identity, err := authorities.Verify(test.certificate, &VerifyOptions{CurrentTime: test.time})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: verified, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if identity.Type != test.certType || len(identity.Chains) != 1 || len(identity.Chains[0]) != 2 {
+			t.Errorf("%s: type %d, chains %v", test.name, identity.Type, identity.Chains)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root, rootKey := issueCertificate(t, pkix.Name{CommonName: IPhoneCAName}, true, nil, nil)
+	deviceCA, deviceCAKey := issueCertificate(t, pkix.Name{CommonName: DeviceCAName}, true, root, rootKey)
+	notCA, notCAKey := issueCertificate(t, pkix.Name{CommonName: "Not a CA"}, false, root, rootKey)
+	forgedRoot, forgedRootKey := issueCertificate(t, pkix.Name{CommonName: IPhoneCAName}, true, nil, nil)
+	authorities := NewAuthorities([]*x509.Certificate{root, deviceCA, notCA})
+
+	udid := "0123456789abcdef0123456789abcdef01234567"
+	device, _ := issueCertificate(t, pkix.Name{CommonName: udid, SerialNumber: "C39ABCDEFGHJ"}, false, deviceCA, deviceCAKey)
+	newDevice, _ := issueCertificate(t, pkix.Name{CommonName: "00008030-001A2B3C4D5E6F70"}, false, deviceCA, deviceCAKey)
+	activation, _ := issueCertificate(t, pkix.Name{CommonName: "Activation"}, false, root, rootKey)
+	forged, _ := issueCertificate(t, pkix.Name{CommonName: udid}, false, forgedRoot, forgedRootKey)
+	underNotCA, _ := issueCertificate(t, pkix.Name{CommonName: udid}, false, notCA, notCAKey)
+
+	valid := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		certificate *x509.Certificate
+		time        time.Time
+		certType    int
+		udid        string
+		chain       int
+		err         bool
+	}{
+		{"device", device, valid, CertificateTypeDevice, udid, 3, false},
+		{"dashed UDID", newDevice, valid, CertificateTypeDevice, "00008030-001A2B3C4D5E6F70", 3, false},
+		{"activation", activation, valid, CertificateTypeActivation, "", 2, false},
+		{"expired", device, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC), 0, "", 0, true},
+		{"not yet valid", device, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), 0, "", 0, true},
+		{"forged root", forged, valid, 0, "", 0, true},
+		{"issued by a leaf", underNotCA, valid, 0, "", 0, true},
+	}
+
+	for _, test := range tests {
+		identity, err := authorities.Verify(test.certificate, &VerifyOptions{CurrentTime: test.time})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: verified, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if identity.Type != test.certType || identity.UDID != test.udid || len(identity.Chains[0]) != test.chain {
+			t.Errorf("%s: type %d, UDID %q, chain of %d", test.name, identity.Type, identity.UDID, len(identity.Chains[0]))
+		}
+		if identity.Chains[0][len(identity.Chains[0]) - 1] != root {
+			t.Errorf("%s: chain does not end at the root", test.name)
+		}
+	}
+
+	identity, err := authorities.Verify(device, &VerifyOptions{CurrentTime: valid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.SerialNumber != "C39ABCDEFGHJ" {
+		t.Errorf("serial number %q", identity.SerialNumber)
+	}
+}
+
+func TestParseCertificates(t *testing.T) {
+	root, rootKey := issueCertificate(t, pkix.Name{CommonName: IPhoneCAName}, true, nil, nil)
+	deviceCA, _ := issueCertificate(t, pkix.Name{CommonName: DeviceCAName}, true, root, rootKey)
+
+	both := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: deviceCA.Raw})...)
+	withKey := append(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{0}}), both...)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		count int
+		err   bool
+	}{
+		{"PEM", both, 2, false},
+		{"PEM with other blocks", withKey, 2, false},
+		{"DER", root.Raw, 1, false},
+		{"no certificates", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{0}}), 0, true},
+		{"malformed PEM certificate", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0}}), 0, true},
+		{"malformed DER", root.Raw[:16], 0, true},
+	}
+
+	for _, test := range tests {
+		certificates, err := ParseCertificates(test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: parsed, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if len(certificates) != test.count {
+			t.Errorf("%s: parsed %d certificates, expected %d", test.name, len(certificates), test.count)
+		}
+	}
+}
@@ -1,7 +1,102 @@
 package ealf
 
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+	"io/ioutil"
+)
+
 // Based on the work of https://github.com/rickmark/efivalidate
+//
+// eficheck's allow lists are not documented by Apple. Their on-disk layout has to come from
+// efivalidate's structures and be checked against a list shipped with eficheck; until both are
+// in the tree Parse only recognizes the magic and refuses to guess at the rest. The types below
+// are what Verify checks an image against, whatever the file they are read from.
+
+const (
+	Magic = "EALF"
+
+	EntryTypeRegion = 1
+	EntryTypeVolume = 2
+	EntryTypeFile = 3
+
+	// Entries that may be missing from an image, such as volumes only some boards have
+	EntryFlagOptional = 0x01
+	// Entries whose contents change at runtime, such as NVRAM, so only their presence is checked
+	EntryFlagMutable = 0x02
+)
 
 type EFIValidationFile struct {
+	ImageSize uint64 // size of the flash image the list describes, zero when not known
+	Entries []*Entry
+}
+
+type Entry struct {
+	Type uint32
+	Flags uint32
+	Offset uint64
+	Size uint64
+	GUID uuid.UUID // of volumes and files
+	Hash *core.TypedHash
+}
+
+// EntryTypeName returns a display name for an entry type
+func EntryTypeName(entryType uint32) string {
+	switch entryType {
+	case EntryTypeRegion:
+		return "region"
+	case EntryTypeVolume:
+		return "volume"
+	case EntryTypeFile:
+		return "file"
+	}
+
+	return fmt.Sprintf("unknown(%d)", entryType)
+}
+
+// Optional reports whether the entry may be absent from an image
+func (entry *Entry) Optional() bool {
+	return entry.Flags & EntryFlagOptional != 0
+}
+
+// Mutable reports whether the entry's contents are left unhashed
+func (entry *Entry) Mutable() bool {
+	return entry.Flags & EntryFlagMutable != 0
+}
+
+// IsAllowList reports whether data starts with the allow list magic
+func IsAllowList(data []byte) bool {
+	return len(data) >= len(Magic) && string(data[0:len(Magic)]) == Magic
+}
+
+// Parse decodes an allow list. The layout after the magic is not implemented yet, see above.
+func Parse(data []byte) (*EFIValidationFile, error) {
+	if !IsAllowList(data) {
+		return nil, fmt.Errorf("no %s magic", Magic)
+	}
+
+	return nil, fmt.Errorf("%s layout is not implemented, it needs efivalidate's structures and a shipped list to check them against", Magic)
+}
+
+// Open reads and decodes an allow list file
+func Open(path string) (*EFIValidationFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Lookup returns the entries for a volume or file GUID
+func (file *EFIValidationFile) Lookup(guid uuid.UUID) []*Entry {
+	result := make([]*Entry, 0)
+	for _, entry := range file.Entries {
+		if entry.Type != EntryTypeRegion && entry.GUID == guid {
+			result = append(result, entry)
+		}
+	}
 
-}
\ No newline at end of file
+	return result
+}
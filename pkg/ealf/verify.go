@@ -0,0 +1,228 @@
+package ealf
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/uefi"
+)
+
+const (
+	StatusMatch = 0
+	StatusModified = 1
+	StatusMissing = 2
+	StatusPresent = 3 // a mutable entry that was found, whose contents are not compared
+	StatusAbsent = 4 // an optional entry that was not found
+)
+
+// EntryResult is the outcome of one allow list entry
+type EntryResult struct {
+	Entry *Entry
+	Status int
+	Offset uint64 // where the entry was found, which may differ from the listed offset
+	Hash *core.TypedHash // nil unless the contents were hashed
+}
+
+// Module is a volume or FFS file in the image that the allow list does not mention
+type Module struct {
+	Type uint32
+	GUID uuid.UUID
+	Offset uint64
+	Size uint64
+}
+
+// Report lists the result of every entry and every module the image has that the list does not
+type Report struct {
+	Results []*EntryResult
+	Unexpected []*Module
+	Errors []error
+}
+
+// StatusName returns a display name for an entry status
+func StatusName(status int) string {
+	switch status {
+	case StatusMatch:
+		return "match"
+	case StatusModified:
+		return "modified"
+	case StatusMissing:
+		return "missing"
+	case StatusPresent:
+		return "present"
+	case StatusAbsent:
+		return "absent"
+	}
+
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// Valid reports whether every entry matched and nothing unexpected was found
+func (report *Report) Valid() bool {
+	if len(report.Errors) != 0 || len(report.Unexpected) != 0 {
+		return false
+	}
+
+	for _, result := range report.Results {
+		if result.Status == StatusModified || result.Status == StatusMissing {
+			return false
+		}
+	}
+
+	return true
+}
+
+// locate finds the bytes an entry covers, preferring a volume or file at the listed offset
+// when the GUID appears more than once
+func locate(entry *Entry, image []byte, volumes []*uefi.FirmwareVolume) ([]byte, uint64, bool) {
+	var data []byte
+	var offset uint64
+	found := false
+	prefer := func(candidate []byte, candidateOffset uint64) {
+		if !found || candidateOffset == entry.Offset {
+			data, offset, found = candidate, candidateOffset, true
+		}
+	}
+
+	switch entry.Type {
+	case EntryTypeRegion:
+		if entry.Offset <= uint64(len(image)) && entry.Size <= uint64(len(image)) - entry.Offset {
+			prefer(image[entry.Offset:(entry.Offset + entry.Size)], entry.Offset)
+		}
+
+	case EntryTypeVolume:
+		for _, volume := range volumes {
+			if volume.GUID() == entry.GUID || volume.FileSystem == entry.GUID && volume.Offset == entry.Offset {
+				prefer(volume.Data, volume.Offset)
+			}
+		}
+
+	case EntryTypeFile:
+		for _, volume := range volumes {
+			for _, file := range volume.Files {
+				if file.Name == entry.GUID {
+					prefer(file.Data, file.Offset)
+				}
+			}
+		}
+	}
+
+	return data, offset, found
+}
+
+// unexpected lists volumes, and files outside listed volumes when the list has file entries,
+// that no entry covers
+func (file *EFIValidationFile) unexpected(volumes []*uefi.FirmwareVolume, results []*EntryResult) []*Module {
+	covered := make(map[uint64]bool)
+	listedFiles := false
+	for _, result := range results {
+		if result.Status != StatusMissing && result.Status != StatusAbsent {
+			covered[result.Offset] = true
+		}
+		if result.Entry.Type == EntryTypeFile {
+			listedFiles = true
+		}
+	}
+
+	inRegion := func(offset uint64) bool {
+		for _, entry := range file.Entries {
+			if entry.Type == EntryTypeRegion && offset >= entry.Offset && offset - entry.Offset < entry.Size {
+				return true
+			}
+		}
+		return false
+	}
+
+	holdsCovered := func(volume *uefi.FirmwareVolume) bool {
+		for _, ffsFile := range volume.Files {
+			if covered[ffsFile.Offset] {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := make([]*Module, 0)
+	for _, volume := range volumes {
+		if !covered[volume.Offset] && !inRegion(volume.Offset) && !holdsCovered(volume) {
+			result = append(result, &Module{Type: EntryTypeVolume, GUID: volume.GUID(), Offset: volume.Offset, Size: uint64(len(volume.Data))})
+		}
+		if !listedFiles || covered[volume.Offset] {
+			continue
+		}
+
+		for _, ffsFile := range volume.Files {
+			if ffsFile.Type != uefi.FileTypePad && !covered[ffsFile.Offset] && !inRegion(ffsFile.Offset) {
+				result = append(result, &Module{Type: EntryTypeFile, GUID: ffsFile.Name, Offset: ffsFile.Offset, Size: uint64(len(ffsFile.Data))})
+			}
+		}
+	}
+
+	return result
+}
+
+// Verify hashes what each entry covers in a raw flash image: regions by offset, volumes and
+// files wherever their GUID is found. eficheck's exact coverage rules are not documented, so
+// volumes and files are hashed whole, headers included, as efivalidate does.
+func (file *EFIValidationFile) Verify(image []byte) *Report {
+	report := &Report{
+		Results:    make([]*EntryResult, len(file.Entries)),
+		Unexpected: make([]*Module, 0),
+		Errors:     make([]error, 0),
+	}
+
+	if file.ImageSize != 0 && uint64(len(image)) != file.ImageSize {
+		report.Errors = append(report.Errors, fmt.Errorf("image is 0x%x bytes, the allow list expects 0x%x", len(image), file.ImageSize))
+	}
+
+	volumes := uefi.FindVolumes(image)
+	for index, entry := range file.Entries {
+		result := &EntryResult{Entry: entry, Offset: entry.Offset}
+		report.Results[index] = result
+
+		data, offset, found := locate(entry, image, volumes)
+		if !found {
+			result.Status = StatusMissing
+			if entry.Optional() {
+				result.Status = StatusAbsent
+			}
+			continue
+		}
+
+		result.Offset = offset
+		if entry.Mutable() {
+			result.Status = StatusPresent
+			continue
+		}
+
+		// An entry that cannot be compared is not taken as a match
+		if entry.Hash == nil {
+			result.Status = StatusModified
+			report.Errors = append(report.Errors, fmt.Errorf("entry %d: no hash", index))
+			continue
+		}
+
+		hash, err := core.HashBytes(entry.Hash.Type, data)
+		if err != nil {
+			result.Status = StatusModified
+			report.Errors = append(report.Errors, fmt.Errorf("entry %d: %s", index, err))
+			continue
+		}
+
+		result.Hash = hash
+		equal, _ := hash.Equal(entry.Hash)
+		if equal {
+			result.Status = StatusMatch
+		} else {
+			result.Status = StatusModified
+		}
+	}
+
+	for _, volume := range volumes {
+		if volume.FileError != nil {
+			report.Errors = append(report.Errors, volume.FileError)
+		}
+	}
+
+	report.Unexpected = file.unexpected(volumes, report.Results)
+	return report
+}
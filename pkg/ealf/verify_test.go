@@ -0,0 +1,56 @@
+package ealf
+
+import (
+	"go-aapl-integrity/pkg/core"
+	"testing"
+)
+
+func regionHash(t *testing.T, data []byte) *core.TypedHash {
+	hash, err := core.HashBytes(core.HashSHA256, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+func TestVerifyRegions(t *testing.T) {
+	image := make([]byte, 0x100)
+	for index := range image {
+		image[index] = byte(index)
+	}
+
+	tests := []struct {
+		name   string
+		entry  *Entry
+		status int
+		errors int
+	}{
+		{"match", &Entry{Type: EntryTypeRegion, Offset: 0x10, Size: 0x20, Hash: regionHash(t, image[0x10:0x30])}, StatusMatch, 0},
+		{"modified", &Entry{Type: EntryTypeRegion, Offset: 0x10, Size: 0x20, Hash: regionHash(t, image[0x20:0x40])}, StatusModified, 0},
+		{"missing", &Entry{Type: EntryTypeRegion, Offset: 0xf0, Size: 0x20, Hash: regionHash(t, nil)}, StatusMissing, 0},
+		{"absent", &Entry{Type: EntryTypeRegion, Flags: EntryFlagOptional, Offset: 0xf0, Size: 0x20}, StatusAbsent, 0},
+		{"mutable", &Entry{Type: EntryTypeRegion, Flags: EntryFlagMutable, Offset: 0x10, Size: 0x20}, StatusPresent, 0},
+		{"no hash", &Entry{Type: EntryTypeRegion, Offset: 0x10, Size: 0x20}, StatusModified, 1},
+		{"unknown hash type", &Entry{Type: EntryTypeRegion, Offset: 0x10, Size: 0x20, Hash: &core.TypedHash{Type: 0xff}}, StatusModified, 1},
+	}
+
+	for _, test := range tests {
+		file := &EFIValidationFile{Entries: []*Entry{test.entry}}
+		report := file.Verify(image)
+		if report.Results[0].Status != test.status {
+			t.Errorf("%s: status %s, expected %s", test.name, StatusName(report.Results[0].Status), StatusName(test.status))
+		}
+		if len(report.Errors) != test.errors {
+			t.Errorf("%s: errors %v, expected %d", test.name, report.Errors, test.errors)
+		}
+	}
+}
+
+func TestVerifyImageSize(t *testing.T) {
+	file := &EFIValidationFile{ImageSize: 0x200}
+	report := file.Verify(make([]byte, 0x100))
+	if report.Valid() || len(report.Errors) != 1 {
+		t.Errorf("errors %v, expected a size mismatch", report.Errors)
+	}
+}
@@ -1,7 +1,13 @@
 package fdr
 
-import "crypto/x509"
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
 
+// A trust object is SEQUENCE { IA5String "secb", element... } where each element is
+// SEQUENCE { IA5String tag, OCTET STRING value OPTIONAL }
 const (
 	TrustObjectMagic = "secb"
 	TrustObjectSigning = "trst"
@@ -12,9 +18,228 @@ const (
 type TrustObject struct {
 	SigningCertificate *x509.Certificate
 	TransportCertificate *x509.Certificate
-	Revocation *x509.RevocationList
+	Revocation *x509.RevocationList // nil when rvok carries no list
+	Unknown []*TrustObjectElement
+}
+
+// TrustObjectElement is a tagged element of a trust object, kept as is when its tag is unknown
+type TrustObjectElement struct {
+	Tag string
+	Value []byte // nil when the element has no value
+	Raw []byte
+}
+
+// TrustObjectError reports the part of a trust object that is malformed. Field is the element
+// tag, or TrustObjectMagic for the enclosing sequence.
+type TrustObjectError struct {
+	Field string
+	Err error
+}
+
+func (err *TrustObjectError) Error() string {
+	return fmt.Sprintf("trust object %s: %s", err.Field, err.Err)
+}
+
+func (err *TrustObjectError) Unwrap() error {
+	return err.Err
+}
+
+func fieldError(field string, format string, args ...interface{}) error {
+	return &TrustObjectError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// parseTag decodes the IA5String that starts a trust object or element
+func parseTag(data []byte) (string, []byte, error) {
+	var tag asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &tag)
+	if err != nil {
+		return "", nil, err
+	}
+	if tag.Class != asn1.ClassUniversal || tag.Tag != asn1.TagIA5String {
+		return "", nil, fmt.Errorf("expected IA5String tag, got tag %d", tag.Tag)
+	}
+
+	return string(tag.Bytes), rest, nil
+}
+
+// parseElement decodes one tagged element
+func parseElement(data []byte) (*TrustObjectElement, []byte, error) {
+	var sequence asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &sequence)
+	if err != nil {
+		return nil, nil, fieldError(TrustObjectMagic, "element: %s", err)
+	}
+	if sequence.Class != asn1.ClassUniversal || sequence.Tag != asn1.TagSequence {
+		return nil, nil, fieldError(TrustObjectMagic, "element is tag %d, not a sequence", sequence.Tag)
+	}
+
+	tag, value, err := parseTag(sequence.Bytes)
+	if err != nil {
+		return nil, nil, fieldError(TrustObjectMagic, "element tag: %s", err)
+	}
+
+	element := &TrustObjectElement{Tag: tag, Raw: sequence.FullBytes}
+	if len(value) == 0 {
+		return element, rest, nil
+	}
+
+	var octets asn1.RawValue
+	trailing, err := asn1.Unmarshal(value, &octets)
+	if err != nil {
+		return nil, nil, fieldError(tag, "value: %s", err)
+	}
+	if octets.Class != asn1.ClassUniversal || octets.Tag != asn1.TagOctetString {
+		return nil, nil, fieldError(tag, "value is tag %d, not an octet string", octets.Tag)
+	}
+	if len(trailing) != 0 {
+		return nil, nil, fieldError(tag, "%d bytes after the value", len(trailing))
+	}
+
+	element.Value = octets.Bytes
+	return element, rest, nil
+}
+
+func parseCertificate(element *TrustObjectElement) (*x509.Certificate, error) {
+	if len(element.Value) == 0 {
+		return nil, fieldError(element.Tag, "no certificate")
+	}
+
+	certificate, err := x509.ParseCertificate(element.Value)
+	if err != nil {
+		return nil, &TrustObjectError{Field: element.Tag, Err: err}
+	}
+
+	return certificate, nil
+}
+
+// ParseTrustObject decodes a DER secb trust object
+func ParseTrustObject(data []byte) (*TrustObject, error) {
+	var sequence asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &sequence)
+	if err != nil {
+		return nil, &TrustObjectError{Field: TrustObjectMagic, Err: err}
+	}
+	if sequence.Class != asn1.ClassUniversal || sequence.Tag != asn1.TagSequence {
+		return nil, fieldError(TrustObjectMagic, "expected sequence, got tag %d", sequence.Tag)
+	}
+	if len(rest) != 0 {
+		return nil, fieldError(TrustObjectMagic, "%d bytes of trailing data", len(rest))
+	}
+
+	magic, elements, err := parseTag(sequence.Bytes)
+	if err != nil {
+		return nil, &TrustObjectError{Field: TrustObjectMagic, Err: err}
+	}
+	if magic != TrustObjectMagic {
+		return nil, fieldError(TrustObjectMagic, "bad magic %s", magic)
+	}
+
+	result := &TrustObject{Unknown: make([]*TrustObjectElement, 0)}
+	seen := make(map[string]bool)
+	for len(elements) > 0 {
+		var element *TrustObjectElement
+		element, elements, err = parseElement(elements)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[element.Tag] {
+			return nil, fieldError(element.Tag, "appears more than once")
+		}
+		seen[element.Tag] = true
+
+		switch element.Tag {
+		case TrustObjectSigning:
+			result.SigningCertificate, err = parseCertificate(element)
+		case TrustObjectTransport:
+			result.TransportCertificate, err = parseCertificate(element)
+		case TrustObjectRevocation:
+			if len(element.Value) != 0 {
+				result.Revocation, err = x509.ParseRevocationList(element.Value)
+				if err != nil {
+					err = &TrustObjectError{Field: element.Tag, Err: err}
+				}
+			}
+		default:
+			result.Unknown = append(result.Unknown, element)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if result.SigningCertificate == nil {
+		return nil, fieldError(TrustObjectSigning, "missing")
+	}
+	if result.TransportCertificate == nil {
+		return nil, fieldError(TrustObjectTransport, "missing")
+	}
+
+	return result, nil
 }
 
-func parseTrustObject(data []byte) (*TrustObject, error) {
+// marshalElement encodes a tagged element, leaving out the value when it is nil
+func marshalElement(tag string, value []byte) (asn1.RawValue, error) {
+	tagBytes, err := asn1.MarshalWithParams(tag, "ia5")
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
 
-}
\ No newline at end of file
+	content := tagBytes
+	if value != nil {
+		valueBytes, err := asn1.Marshal(value)
+		if err != nil {
+			return asn1.RawValue{}, err
+		}
+		content = append(content, valueBytes...)
+	}
+
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: content}, nil
+}
+
+// Marshal encodes the trust object as DER with its elements in trst, rssl, rvok order, followed
+// by any unknown elements. rvok is written without a value when there is no revocation list.
+func (object *TrustObject) Marshal() ([]byte, error) {
+	if object.SigningCertificate == nil {
+		return nil, fieldError(TrustObjectSigning, "missing")
+	}
+	if object.TransportCertificate == nil {
+		return nil, fieldError(TrustObjectTransport, "missing")
+	}
+
+	var revocation []byte
+	if object.Revocation != nil {
+		revocation = object.Revocation.Raw
+	}
+
+	magic, err := asn1.MarshalWithParams(TrustObjectMagic, "ia5")
+	if err != nil { return nil, err }
+	content := magic
+
+	values := []struct {
+		tag string
+		value []byte
+	}{
+		{TrustObjectSigning, object.SigningCertificate.Raw},
+		{TrustObjectTransport, object.TransportCertificate.Raw},
+		{TrustObjectRevocation, revocation},
+	}
+	for _, entry := range values {
+		element, err := marshalElement(entry.tag, entry.value)
+		if err != nil {
+			return nil, &TrustObjectError{Field: entry.tag, Err: err}
+		}
+
+		encoded, err := asn1.Marshal(element)
+		if err != nil {
+			return nil, &TrustObjectError{Field: entry.tag, Err: err}
+		}
+		content = append(content, encoded...)
+	}
+
+	for _, element := range object.Unknown {
+		content = append(content, element.Raw...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+}
@@ -0,0 +1,114 @@
+package fdr
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"io/ioutil"
+	"testing"
+)
+
+// encodeObject builds a trust object sequence from a magic and already encoded elements
+func encodeObject(t *testing.T, magic string, elements ...[]byte) []byte {
+	content, err := asn1.MarshalWithParams(magic, "ia5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, element := range elements {
+		content = append(content, element...)
+	}
+
+	result, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func encodeElement(t *testing.T, tag string, value []byte) []byte {
+	element, err := marshalElement(tag, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := asn1.Marshal(element)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testdata/fdrtrustobject")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := ParseTrustObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.SigningCertificate.Subject.CommonName != "FDR Sealing Server CA 1" {
+		t.Errorf("signing certificate %s", object.SigningCertificate.Subject)
+	}
+	if object.TransportCertificate.Subject.CommonName != "FDR-DC-SSL-ROOT" {
+		t.Errorf("transport certificate %s", object.TransportCertificate.Subject)
+	}
+	if object.Revocation != nil || len(object.Unknown) != 0 {
+		t.Errorf("revocation %v and %d unknown elements, expected none", object.Revocation, len(object.Unknown))
+	}
+
+	marshaled, err := object.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshaled, data) {
+		t.Errorf("marshaled trust object differs from the fixture")
+	}
+}
+
+func TestParseTrustObject(t *testing.T) {
+	fixture := readTrustObject(t)
+	signing := encodeElement(t, TrustObjectSigning, fixture.SigningCertificate.Raw)
+	transport := encodeElement(t, TrustObjectTransport, fixture.TransportCertificate.Raw)
+	emptyRevocation := encodeElement(t, TrustObjectRevocation, nil)
+	unknown := encodeElement(t, "abcd", []byte{1, 2, 3})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		field   string // of the expected error, empty when the object parses
+		unknown int
+	}{
+		{"minimal", encodeObject(t, TrustObjectMagic, signing, transport), "", 0},
+		{"empty revocation", encodeObject(t, TrustObjectMagic, signing, transport, emptyRevocation), "", 0},
+		{"unknown element kept", encodeObject(t, TrustObjectMagic, unknown, signing, transport), "", 1},
+		{"bad magic", encodeObject(t, "secc", signing, transport), TrustObjectMagic, 0},
+		{"trailing data", append(encodeObject(t, TrustObjectMagic, signing, transport), 0), TrustObjectMagic, 0},
+		{"missing signing", encodeObject(t, TrustObjectMagic, transport), TrustObjectSigning, 0},
+		{"missing transport", encodeObject(t, TrustObjectMagic, signing), TrustObjectTransport, 0},
+		{"duplicate", encodeObject(t, TrustObjectMagic, signing, signing, transport), TrustObjectSigning, 0},
+		{"bad certificate", encodeObject(t, TrustObjectMagic, encodeElement(t, TrustObjectSigning, []byte{0x30, 0x00}), transport), TrustObjectSigning, 0},
+		{"bad revocation", encodeObject(t, TrustObjectMagic, signing, transport, encodeElement(t, TrustObjectRevocation, []byte{0x30, 0x00})), TrustObjectRevocation, 0},
+	}
+
+	for _, test := range tests {
+		object, err := ParseTrustObject(test.data)
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if len(object.Unknown) != test.unknown {
+				t.Errorf("%s: %d unknown elements, expected %d", test.name, len(object.Unknown), test.unknown)
+			}
+			continue
+		}
+
+		objectErr, ok := err.(*TrustObjectError)
+		if !ok {
+			t.Errorf("%s: error %v, expected a trust object error", test.name, err)
+		} else if objectErr.Field != test.field {
+			t.Errorf("%s: error %s, expected one for %s", test.name, err, test.field)
+		}
+	}
+}
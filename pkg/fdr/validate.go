@@ -0,0 +1,109 @@
+package fdr
+
+import (
+	"bytes"
+	"crypto/x509"
+	"time"
+)
+
+// Validation explains whether a trust object can be trusted. Each error is a TrustObjectError
+// naming the element it concerns.
+type Validation struct {
+	SigningChains [][]*x509.Certificate
+	TransportChains [][]*x509.Certificate
+	Errors []error
+}
+
+func (validation *Validation) Valid() bool {
+	return len(validation.Errors) == 0
+}
+
+func (validation *Validation) add(field string, format string, args ...interface{}) {
+	validation.Errors = append(validation.Errors, fieldError(field, format, args...))
+}
+
+// validateCertificate checks one certificate's validity window and its chain to roots, through
+// the intermediates when needed
+func (validation *Validation) validateCertificate(field string, certificate *x509.Certificate, roots *x509.CertPool, intermediates *x509.CertPool, now time.Time) [][]*x509.Certificate {
+	chainTime := now
+	if now.Before(certificate.NotBefore) {
+		validation.add(field, "%s is not valid before %s", certificate.Subject, certificate.NotBefore.UTC())
+		chainTime = certificate.NotBefore
+	} else if now.After(certificate.NotAfter) {
+		validation.add(field, "%s expired at %s", certificate.Subject, certificate.NotAfter.UTC())
+		chainTime = certificate.NotBefore
+	}
+
+	if roots == nil {
+		validation.add(field, "no roots to chain %s to", certificate.Subject)
+		return nil
+	}
+
+	// A certificate outside its own window was reported above, so only look for chain problems
+	chains, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   chainTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		validation.add(field, "%s does not chain to a trusted root: %s", certificate.Subject, err)
+		return nil
+	}
+
+	return chains
+}
+
+// validateRevocation checks the revocation list issuer, signature and freshness, and that
+// neither certificate of the trust object is revoked
+func (validation *Validation) validateRevocation(object *TrustObject, now time.Time) {
+	list := object.Revocation
+	issuer := object.SigningCertificate
+
+	if !bytes.Equal(list.RawIssuer, issuer.RawSubject) {
+		validation.add(TrustObjectRevocation, "issued by %s, expected %s", list.Issuer, issuer.Subject)
+	} else if err := list.CheckSignatureFrom(issuer); err != nil {
+		validation.add(TrustObjectRevocation, "signature does not verify with %s: %s", issuer.Subject, err)
+	}
+
+	if now.Before(list.ThisUpdate) {
+		validation.add(TrustObjectRevocation, "not valid before %s", list.ThisUpdate.UTC())
+	}
+	if !list.NextUpdate.IsZero() && now.After(list.NextUpdate) {
+		validation.add(TrustObjectRevocation, "stale since %s", list.NextUpdate.UTC())
+	}
+
+	certificates := map[string]*x509.Certificate{
+		TrustObjectSigning:   object.SigningCertificate,
+		TrustObjectTransport: object.TransportCertificate,
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		for field, certificate := range certificates {
+			if bytes.Equal(certificate.RawIssuer, list.RawIssuer) && certificate.SerialNumber.Cmp(entry.SerialNumber) == 0 {
+				validation.add(field, "%s serial %x was revoked at %s", certificate.Subject, certificate.SerialNumber, entry.RevocationTime.UTC())
+			}
+		}
+	}
+}
+
+// Validate checks that the signing and transport certificates chain to roots, which should
+// hold the FDR Sealing Server CA, that both are inside their validity windows at now, and
+// that the revocation list, when present, is signed by the signing certificate and lists
+// neither of them. Each certificate of the trust object may serve as an intermediate for the
+// other.
+func (object *TrustObject) Validate(roots *x509.CertPool, now time.Time) *Validation {
+	result := &Validation{Errors: make([]error, 0)}
+
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(object.SigningCertificate)
+	intermediates.AddCert(object.TransportCertificate)
+
+	result.SigningChains = result.validateCertificate(TrustObjectSigning, object.SigningCertificate, roots, intermediates, now)
+	result.TransportChains = result.validateCertificate(TrustObjectTransport, object.TransportCertificate, roots, intermediates, now)
+
+	if object.Revocation != nil {
+		result.validateRevocation(object, now)
+	}
+
+	return result
+}
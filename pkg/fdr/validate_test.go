@@ -0,0 +1,115 @@
+package fdr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func readTrustObject(t *testing.T) *TrustObject {
+	data, err := ioutil.ReadFile("../../testdata/fdrtrustobject")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := ParseTrustObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return object
+}
+
+// issueCertificate creates a certificate for name signed by parent, or self signed without one
+func issueCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+func TestValidateFixture(t *testing.T) {
+	object := readTrustObject(t)
+
+	allRoots := x509.NewCertPool()
+	allRoots.AddCert(object.SigningCertificate)
+	allRoots.AddCert(object.TransportCertificate)
+	signingRoot := x509.NewCertPool()
+	signingRoot.AddCert(object.SigningCertificate)
+
+	tests := []struct {
+		name   string
+		roots  *x509.CertPool
+		now    time.Time
+		errors []string
+	}{
+		{"valid", allRoots, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil},
+		{"signing expired", allRoots, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), []string{TrustObjectSigning}},
+		{"not yet valid", allRoots, time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC), []string{TrustObjectTransport}},
+		{"transport root missing", signingRoot, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), []string{TrustObjectTransport}},
+		{"no roots", nil, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), []string{TrustObjectSigning, TrustObjectTransport}},
+	}
+
+	for _, test := range tests {
+		validation := object.Validate(test.roots, test.now)
+		if len(validation.Errors) != len(test.errors) {
+			t.Errorf("%s: errors %v, expected %d", test.name, validation.Errors, len(test.errors))
+			continue
+		}
+		for index, err := range validation.Errors {
+			field := err.(*TrustObjectError).Field
+			if field != test.errors[index] {
+				t.Errorf("%s: error %d is for %s, expected %s", test.name, index, field, test.errors[index])
+			}
+		}
+	}
+}
+
+func TestValidateIntermediates(t *testing.T) {
+	root, rootKey := issueCertificate(t, "root", true, nil, nil)
+	signing, signingKey := issueCertificate(t, "signing", true, root, rootKey)
+	transport, _ := issueCertificate(t, "transport", false, signing, signingKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	object := &TrustObject{SigningCertificate: signing, TransportCertificate: transport}
+
+	validation := object.Validate(roots, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !validation.Valid() {
+		t.Fatalf("errors %v", validation.Errors)
+	}
+	if len(validation.TransportChains) != 1 || len(validation.TransportChains[0]) != 3 {
+		t.Errorf("transport chains %v, expected one through the signing certificate", validation.TransportChains)
+	}
+}
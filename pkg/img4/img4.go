@@ -15,17 +15,21 @@ const (
 	Image4MagicComplete = "IMG4"
 	Image4MagicPayload = "IM4P"
 	Image4MagicManifest = "IM4M"
+
+	Image4ManifestTag = 0 // [0] EXPLICIT IM4M inside an IMG4
+	Image4RestoreInfoTag = 1 // [1] EXPLICIT IM4R inside an IMG4
 )
 
 type Image4 struct {
+	Type int
 	Payload *Image4Payload
 	Manifest *Image4Manifest
 }
 
 type Image4KeyBagItem struct {
 	Index int
-	Key string
-	Value []byte
+	IV []byte
+	Key []byte
 }
 
 type Image4Payload struct {
@@ -38,36 +42,205 @@ type Image4Payload struct {
 type Image4Manifest struct {
 	Version int
 
+	Body []byte
 	Signature []byte
 	Certificates []*x509.Certificate
 }
 
-func parsePayload(data []interface{}) (*Image4Payload, error) {
+// parseSequence decodes a DER SEQUENCE and returns its elements without interpreting them
+func parseSequence(data []byte) ([]asn1.RawValue, error) {
+	var sequence asn1.RawValue
+	rest, err := asn1.Unmarshal(data, &sequence)
+	if err != nil { return nil, err }
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d bytes of trailing data", len(rest))
+	}
+
+	return parseElements(sequence)
+}
+
+func parseElements(container asn1.RawValue) ([]asn1.RawValue, error) {
+	if !container.IsCompound {
+		return nil, fmt.Errorf("expected constructed value, got tag %d", container.Tag)
+	}
+
+	elements := make([]asn1.RawValue, 0)
+	data := container.Bytes
+	for len(data) > 0 {
+		var element asn1.RawValue
+		rest, err := asn1.Unmarshal(data, &element)
+		if err != nil { return nil, err }
+
+		elements = append(elements, element)
+		data = rest
+	}
+
+	return elements, nil
+}
+
+func parseString(value asn1.RawValue) (string, error) {
+	if value.Class != asn1.ClassUniversal || value.Tag != asn1.TagIA5String {
+		return "", fmt.Errorf("expected IA5String, got tag %d", value.Tag)
+	}
+
+	return string(value.Bytes), nil
+}
+
+func parseOctetString(value asn1.RawValue) ([]byte, error) {
+	if value.Class != asn1.ClassUniversal || value.Tag != asn1.TagOctetString {
+		return nil, fmt.Errorf("expected OCTET STRING, got tag %d", value.Tag)
+	}
+
+	return value.Bytes, nil
+}
+
+func parseKeyBag(data []byte) ([]*Image4KeyBagItem, error) {
+	bags, err := parseSequence(data)
+	if err != nil { return nil, err }
+
+	result := make([]*Image4KeyBagItem, len(bags))
+	for index, bag := range bags {
+		item := struct {
+			Index int
+			IV    []byte
+			Key   []byte
+		}{}
+
+		_, err := asn1.Unmarshal(bag.FullBytes, &item)
+		if err != nil { return nil, fmt.Errorf("keybag %d: %s", index, err) }
+
+		result[index] = &Image4KeyBagItem{
+			Index: item.Index,
+			IV:    item.IV,
+			Key:   item.Key,
+		}
+	}
+
+	return result, nil
+}
+
+func parsePayload(elements []asn1.RawValue) (*Image4Payload, error) {
+	if len(elements) < 4 {
+		return nil, fmt.Errorf("payload has %d elements, expected at least 4", len(elements))
+	}
+
+	name, err := parseString(elements[1])
+	if err != nil { return nil, fmt.Errorf("payload type: %s", err) }
+
+	description, err := parseString(elements[2])
+	if err != nil { return nil, fmt.Errorf("payload description: %s", err) }
+
+	data, err := parseOctetString(elements[3])
+	if err != nil { return nil, fmt.Errorf("payload data: %s", err) }
+
+	result := &Image4Payload{
+		Name:        name,
+		Description: description,
+		Data:        data,
+	}
+
+	if len(elements) > 4 && elements[4].Tag == asn1.TagOctetString {
+		result.KeyBag, err = parseKeyBag(elements[4].Bytes)
+		if err != nil { return nil, err }
+	}
+
+	return result, nil
+}
+
+func parseManifest(elements []asn1.RawValue) (*Image4Manifest, error) {
+	if len(elements) < 4 {
+		return nil, fmt.Errorf("manifest has %d elements, expected at least 4", len(elements))
+	}
+
+	var version int
+	_, err := asn1.Unmarshal(elements[1].FullBytes, &version)
+	if err != nil { return nil, fmt.Errorf("manifest version: %s", err) }
+
+	if elements[2].Tag != asn1.TagSet {
+		return nil, fmt.Errorf("manifest body: expected SET, got tag %d", elements[2].Tag)
+	}
+
+	signature, err := parseOctetString(elements[3])
+	if err != nil { return nil, fmt.Errorf("manifest signature: %s", err) }
+
+	result := &Image4Manifest{
+		Version:   version,
+		Body:      elements[2].FullBytes,
+		Signature: signature,
+	}
+
+	if len(elements) > 4 {
+		certificates, err := parseElements(elements[4])
+		if err != nil { return nil, fmt.Errorf("manifest certificates: %s", err) }
+
+		for _, certificate := range certificates {
+			parsed, err := x509.ParseCertificate(certificate.FullBytes)
+			if err != nil { return nil, fmt.Errorf("manifest certificate: %s", err) }
 
+			result.Certificates = append(result.Certificates, parsed)
+		}
+	}
+
+	return result, nil
 }
 
-func parse(data []byte) (*Image4, error) {
-	root := make([]interface{}, 0)
-	result := &Image4{}
+func parseComplete(elements []asn1.RawValue) (*Image4, error) {
+	if len(elements) < 2 {
+		return nil, fmt.Errorf("image has %d elements, expected at least 2", len(elements))
+	}
 
-	_, err := asn1.Unmarshal(data, root)
+	payloadElements, err := parseElements(elements[1])
 	if err != nil { return nil, err }
 
-	magic, ok := root[0].(string)
-	if ok == false {
+	result := &Image4{Type: Image4TypeComplete}
+	result.Payload, err = parsePayload(payloadElements)
+	if err != nil { return nil, err }
+
+	for _, element := range elements[2:] {
+		if element.Class != asn1.ClassContextSpecific || element.Tag != Image4ManifestTag {
+			continue
+		}
+
+		manifest, err := parseSequence(element.Bytes)
+		if err != nil { return nil, err }
+
+		result.Manifest, err = parseManifest(manifest)
+		if err != nil { return nil, err }
+	}
+
+	return result, nil
+}
+
+// Parse decodes an IMG4 container, a bare IM4P payload or a bare IM4M manifest
+func Parse(data []byte) (*Image4, error) {
+	root, err := parseSequence(data)
+	if err != nil { return nil, err }
+	if len(root) == 0 {
+		return nil, fmt.Errorf("invalid data, empty sequence")
+	}
+
+	magic, err := parseString(root[0])
+	if err != nil {
 		return nil, fmt.Errorf("invalid data, no magic (maybe bare?)")
 	}
 
 	switch magic {
 	case Image4MagicComplete:
+		return parseComplete(root)
 
 	case Image4MagicManifest:
+		manifest, err := parseManifest(root)
+		if err != nil { return nil, err }
+
+		return &Image4{Type: Image4TypeManifest, Manifest: manifest}, nil
 
 	case Image4MagicPayload:
+		payload, err := parsePayload(root)
+		if err != nil { return nil, err }
+
+		return &Image4{Type: Image4TypePayload, Payload: payload}, nil
 
 	default:
 		return nil, fmt.Errorf("unknown magic %s", magic)
 	}
-
-	return result, nil
-}
\ No newline at end of file
+}
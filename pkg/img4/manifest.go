@@ -0,0 +1,378 @@
+package img4
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"time"
+)
+
+const (
+	ManifestBodyTag = "MANB"
+	ManifestPropertiesTag = "MANP"
+	ObjectPropertiesTag = "OBJP" // certificate constraints that apply to every object
+	DigestTag = "DGST"
+
+	// Constraint values other than a literal: [0] NULL for a property that must be present
+	// with any value, [1] NULL for one that must be absent
+	constraintPresentTag = 0
+	constraintAbsentTag = 1
+)
+
+// ManifestConstraintsOID marks the critical extension limiting what a manifest signing
+// certificate may sign, a MANP and an OBJP set of property constraints
+var ManifestConstraintsOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 15}
+
+// Image4Object is a set of properties the manifest signs for one image, or for the manifest
+// itself. Values are uint64 for integers, bool, []byte for octet strings and string for
+// IA5 strings.
+type Image4Object struct {
+	Tag string
+	Properties map[string]interface{}
+}
+
+// Image4ManifestBody is the decoded MANB of a manifest
+type Image4ManifestBody struct {
+	Properties *Image4Object // MANP
+	Objects map[string]*Image4Object
+}
+
+// parseTagged decodes a [PRIVATE tag] SEQUENCE { IA5String tag, value } as used throughout
+// manifest bodies, checking the private tag number spells the IA5String
+func parseTagged(value asn1.RawValue) (string, asn1.RawValue, error) {
+	if value.Class != asn1.ClassPrivate {
+		return "", asn1.RawValue{}, fmt.Errorf("expected private tag, got class %d", value.Class)
+	}
+
+	elements, err := parseSequence(value.Bytes)
+	if err != nil { return "", asn1.RawValue{}, err }
+	if len(elements) != 2 {
+		return "", asn1.RawValue{}, fmt.Errorf("tagged value has %d elements, expected 2", len(elements))
+	}
+
+	tag, err := parseString(elements[0])
+	if err != nil { return "", asn1.RawValue{}, err }
+	if len(tag) != 4 || uint32(value.Tag) != uint32(tag[0]) << 24 | uint32(tag[1]) << 16 | uint32(tag[2]) << 8 | uint32(tag[3]) {
+		return "", asn1.RawValue{}, fmt.Errorf("tag %q does not match private tag %d", tag, value.Tag)
+	}
+
+	return tag, elements[1], nil
+}
+
+func parsePropertyValue(value asn1.RawValue) (interface{}, error) {
+	if value.Class != asn1.ClassUniversal {
+		return nil, fmt.Errorf("unexpected class %d", value.Class)
+	}
+
+	switch value.Tag {
+	case asn1.TagInteger:
+		var result uint64
+		if len(value.Bytes) == 0 || len(value.Bytes) > 9 || (len(value.Bytes) == 9 && value.Bytes[0] != 0) || value.Bytes[0] & 0x80 != 0 {
+			return nil, fmt.Errorf("integer out of range")
+		}
+		for _, octet := range value.Bytes {
+			result = result << 8 | uint64(octet)
+		}
+		return result, nil
+	case asn1.TagBoolean:
+		var result bool
+		_, err := asn1.Unmarshal(value.FullBytes, &result)
+		return result, err
+	case asn1.TagOctetString:
+		return value.Bytes, nil
+	case asn1.TagIA5String:
+		return string(value.Bytes), nil
+	}
+
+	return nil, fmt.Errorf("unsupported tag %d", value.Tag)
+}
+
+// parseConstraintValue decodes a constraint, returning a nil value for the context specific
+// present and absent markers
+func parseConstraintValue(value asn1.RawValue) (interface{}, error) {
+	if value.Class == asn1.ClassContextSpecific && (value.Tag == constraintPresentTag || value.Tag == constraintAbsentTag) {
+		return nil, nil
+	}
+
+	return parsePropertyValue(value)
+}
+
+func parseObject(tag string, set asn1.RawValue) (*Image4Object, error) {
+	return parseObjectValues(tag, set, parsePropertyValue)
+}
+
+func parseObjectValues(tag string, set asn1.RawValue, parseValue func(asn1.RawValue) (interface{}, error)) (*Image4Object, error) {
+	if set.Tag != asn1.TagSet {
+		return nil, fmt.Errorf("%s: expected SET, got tag %d", tag, set.Tag)
+	}
+
+	elements, err := parseElements(set)
+	if err != nil { return nil, fmt.Errorf("%s: %s", tag, err) }
+
+	result := &Image4Object{Tag: tag, Properties: make(map[string]interface{})}
+	for _, element := range elements {
+		name, value, err := parseTagged(element)
+		if err != nil { return nil, fmt.Errorf("%s: %s", tag, err) }
+
+		result.Properties[name], err = parseValue(value)
+		if err != nil { return nil, fmt.Errorf("%s.%s: %s", tag, name, err) }
+	}
+
+	return result, nil
+}
+
+// ParseBody decodes the manifest properties and the objects describing each image
+func (manifest *Image4Manifest) ParseBody() (*Image4ManifestBody, error) {
+	var set asn1.RawValue
+	_, err := asn1.Unmarshal(manifest.Body, &set)
+	if err != nil { return nil, err }
+
+	elements, err := parseElements(set)
+	if err != nil { return nil, err }
+	if len(elements) != 1 {
+		return nil, fmt.Errorf("manifest body has %d elements, expected 1", len(elements))
+	}
+
+	tag, objects, err := parseTagged(elements[0])
+	if err != nil { return nil, err }
+	if tag != ManifestBodyTag || objects.Tag != asn1.TagSet {
+		return nil, fmt.Errorf("expected %s SET, got %s", ManifestBodyTag, tag)
+	}
+
+	elements, err = parseElements(objects)
+	if err != nil { return nil, err }
+
+	result := &Image4ManifestBody{Objects: make(map[string]*Image4Object)}
+	for _, element := range elements {
+		tag, set, err := parseTagged(element)
+		if err != nil { return nil, err }
+
+		object, err := parseObject(tag, set)
+		if err != nil { return nil, err }
+
+		if tag == ManifestPropertiesTag {
+			result.Properties = object
+		} else {
+			result.Objects[tag] = object
+		}
+	}
+
+	return result, nil
+}
+
+// Digest returns the DGST property of an object
+func (body *Image4ManifestBody) Digest(tag string) ([]byte, error) {
+	object, ok := body.Objects[tag]
+	if !ok {
+		return nil, fmt.Errorf("manifest has no %s object", tag)
+	}
+
+	digest, ok := object.Properties[DigestTag].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("manifest %s object has no digest", tag)
+	}
+
+	return digest, nil
+}
+
+// digestHash picks the hash of a manifest digest from its length, SHA-1 for older devices
+// and SHA-384 for newer ones
+func digestHash(digest []byte) (crypto.Hash, error) {
+	switch len(digest) {
+	case crypto.SHA1.Size():
+		return crypto.SHA1, nil
+	case crypto.SHA384.Size():
+		return crypto.SHA384, nil
+	}
+
+	return 0, fmt.Errorf("unsupported %d byte digest", len(digest))
+}
+
+// VerifyDigest checks that data, a whole IM4P, is the image the manifest signs for tag
+func (body *Image4ManifestBody) VerifyDigest(tag string, data []byte) error {
+	digest, err := body.Digest(tag)
+	if err != nil { return err }
+
+	cryptoHash, err := digestHash(digest)
+	if err != nil { return err }
+
+	hasher := cryptoHash.New()
+	hasher.Write(data)
+	if !bytes.Equal(hasher.Sum(nil), digest) {
+		return fmt.Errorf("%s digest does not match the manifest", tag)
+	}
+
+	return nil
+}
+
+// Leaf returns the manifest's signing certificate, the one that is not a CA
+func (manifest *Image4Manifest) Leaf() (*x509.Certificate, error) {
+	for _, certificate := range manifest.Certificates {
+		if !certificate.IsCA {
+			return certificate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("manifest has no signing certificate")
+}
+
+// VerifySignature checks the manifest signature over its body with the leaf certificate's
+// RSA key, trying SHA-384 then SHA-1
+func (manifest *Image4Manifest) VerifySignature() error {
+	leaf, err := manifest.Leaf()
+	if err != nil { return err }
+
+	key, ok := leaf.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported manifest key %T", leaf.PublicKey)
+	}
+
+	for _, cryptoHash := range []crypto.Hash{crypto.SHA384, crypto.SHA1} {
+		hasher := cryptoHash.New()
+		hasher.Write(manifest.Body)
+		if rsa.VerifyPKCS1v15(key, cryptoHash, hasher.Sum(nil), manifest.Signature) == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("manifest signature does not verify with %s", leaf.Subject.CommonName)
+}
+
+// equalValues compares two property values
+func equalValues(a interface{}, b interface{}) bool {
+	aBytes, aIsBytes := a.([]byte)
+	bBytes, bIsBytes := b.([]byte)
+	if aIsBytes || bIsBytes {
+		return aIsBytes && bIsBytes && bytes.Equal(aBytes, bBytes)
+	}
+
+	return a == b
+}
+
+// checkConstraints matches an object's properties against a set of constraints, whose raw
+// values tell the present and absent markers apart
+func checkConstraints(object *Image4Object, constraints *Image4Object, raw map[string]asn1.RawValue) error {
+	for name, constraint := range constraints.Properties {
+		value, present := object.Properties[name]
+		if constraint == nil {
+			if raw[name].Tag == constraintAbsentTag && present {
+				return fmt.Errorf("%s.%s must be absent", object.Tag, name)
+			}
+			if raw[name].Tag == constraintPresentTag && !present {
+				return fmt.Errorf("%s.%s must be present", object.Tag, name)
+			}
+			continue
+		}
+
+		if !present || !equalValues(value, constraint) {
+			return fmt.Errorf("%s.%s is %v, the certificate allows %v", object.Tag, name, value, constraint)
+		}
+	}
+
+	return nil
+}
+
+// parseConstraints decodes the constraints extension into constraint sets by tag, along with
+// the raw values of each set
+func parseConstraints(data []byte) (map[string]*Image4Object, map[string]map[string]asn1.RawValue, error) {
+	var set asn1.RawValue
+	_, err := asn1.Unmarshal(data, &set)
+	if err != nil { return nil, nil, err }
+
+	elements, err := parseElements(set)
+	if err != nil { return nil, nil, err }
+
+	result := make(map[string]*Image4Object)
+	raw := make(map[string]map[string]asn1.RawValue)
+	for _, element := range elements {
+		tag, values, err := parseTagged(element)
+		if err != nil { return nil, nil, err }
+
+		result[tag], err = parseObjectValues(tag, values, parseConstraintValue)
+		if err != nil { return nil, nil, err }
+
+		raw[tag] = make(map[string]asn1.RawValue)
+		properties, _ := parseElements(values)
+		for _, property := range properties {
+			name, value, _ := parseTagged(property)
+			raw[tag][name] = value
+		}
+	}
+
+	return result, raw, nil
+}
+
+// VerifyConstraints checks the manifest body against the constraints extension of the signing
+// certificate: MANP constrains the manifest properties and OBJP every object. A certificate
+// without the extension constrains nothing.
+func (manifest *Image4Manifest) VerifyConstraints(body *Image4ManifestBody) error {
+	leaf, err := manifest.Leaf()
+	if err != nil { return err }
+
+	for _, extension := range leaf.Extensions {
+		if !extension.Id.Equal(ManifestConstraintsOID) {
+			continue
+		}
+
+		constraints, raw, err := parseConstraints(extension.Value)
+		if err != nil { return fmt.Errorf("manifest constraints: %s", err) }
+
+		if properties, ok := constraints[ManifestPropertiesTag]; ok {
+			if body.Properties == nil {
+				return fmt.Errorf("manifest has no %s", ManifestPropertiesTag)
+			}
+			err = checkConstraints(body.Properties, properties, raw[ManifestPropertiesTag])
+			if err != nil { return err }
+		}
+
+		if objectProperties, ok := constraints[ObjectPropertiesTag]; ok {
+			for _, object := range body.Objects {
+				err = checkConstraints(object, objectProperties, raw[ObjectPropertiesTag])
+				if err != nil { return err }
+			}
+		}
+	}
+
+	return nil
+}
+
+// withoutConstraints returns a copy of a certificate that no longer reports the constraints
+// extension as unhandled, since VerifyConstraints handles it
+func withoutConstraints(certificate *x509.Certificate) *x509.Certificate {
+	result := *certificate
+	result.UnhandledCriticalExtensions = nil
+	for _, id := range certificate.UnhandledCriticalExtensions {
+		if !id.Equal(ManifestConstraintsOID) {
+			result.UnhandledCriticalExtensions = append(result.UnhandledCriticalExtensions, id)
+		}
+	}
+
+	return &result
+}
+
+// VerifyCertificates chains the manifest certificates to roots. Manifest signing certificates
+// are only valid for a day or so around signing, so the chain is checked at the leaf's
+// NotBefore rather than now. The constraints extension is left to VerifyConstraints.
+func (manifest *Image4Manifest) VerifyCertificates(roots *x509.CertPool) error {
+	leaf, err := manifest.Leaf()
+	if err != nil { return err }
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range manifest.Certificates {
+		if certificate != leaf {
+			intermediates.AddCert(withoutConstraints(certificate))
+		}
+	}
+
+	_, err = withoutConstraints(leaf).Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore.Add(time.Second),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err
+}
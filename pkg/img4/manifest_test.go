@@ -0,0 +1,147 @@
+package img4
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+)
+
+const (
+	manifestPath = "../../testdata/OS.dmg.root_hash.j132ap.im4m"
+	payloadPath = "../../testdata/OS.dmg.root_hash.im4p"
+)
+
+func readManifest(t *testing.T) *Image4Manifest {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Type != Image4TypeManifest || image.Manifest == nil {
+		t.Fatalf("type %d, expected a manifest", image.Type)
+	}
+
+	return image.Manifest
+}
+
+func TestParsePayload(t *testing.T) {
+	data, err := ioutil.ReadFile(payloadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Type != Image4TypePayload || image.Payload == nil {
+		t.Fatalf("type %d, expected a payload", image.Type)
+	}
+	if image.Payload.Name != "xsys" || len(image.Payload.Data) != 0xd0 {
+		t.Errorf("payload %s of 0x%x bytes, expected xsys of 0xd0 bytes", image.Payload.Name, len(image.Payload.Data))
+	}
+}
+
+func TestManifestBody(t *testing.T) {
+	manifest := readManifest(t)
+	body, err := manifest.ParseBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body.Objects) != 10 {
+		t.Errorf("%d objects, expected 10", len(body.Objects))
+	}
+	if body.Properties.Properties["CHIP"] != uint64(0x8012) {
+		t.Errorf("CHIP is %v, expected 0x8012", body.Properties.Properties["CHIP"])
+	}
+	if production, _ := body.Properties.Properties["mpro"].(bool); !production {
+		t.Errorf("mpro is %v, expected true", body.Properties.Properties["mpro"])
+	}
+	if err := manifest.VerifyConstraints(body); err != nil {
+		t.Errorf("constraints: %s", err)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	payload, err := ioutil.ReadFile(payloadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := readManifest(t).ParseBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, payload...)
+	tampered[len(tampered) - 1] ^= 1
+
+	tests := []struct {
+		name  string
+		tag   string
+		data  []byte
+		valid bool
+	}{
+		{"payload", "xsys", payload, true},
+		{"tampered payload", "xsys", tampered, false},
+		{"other object", "mkrn", payload, false},
+		{"missing object", "abcd", payload, false},
+	}
+
+	for _, test := range tests {
+		err := body.VerifyDigest(test.tag, test.data)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: verified, expected an error", test.name)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(manifest *Image4Manifest)
+		valid  bool
+	}{
+		{"manifest", func(manifest *Image4Manifest) {}, true},
+		{"tampered body", func(manifest *Image4Manifest) { manifest.Body[len(manifest.Body) - 1] ^= 1 }, false},
+		{"tampered signature", func(manifest *Image4Manifest) { manifest.Signature[0] ^= 1 }, false},
+		{"no certificates", func(manifest *Image4Manifest) { manifest.Certificates = nil }, false},
+	}
+
+	for _, test := range tests {
+		manifest := readManifest(t)
+		test.tamper(manifest)
+
+		err := manifest.VerifySignature()
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: verified, expected an error", test.name)
+		}
+	}
+}
+
+func TestVerifyCertificates(t *testing.T) {
+	manifest := readManifest(t)
+	leaf, err := manifest.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "T8012Mac-TssLive-ManifestKeyGlobal-RevB-DataCenter" {
+		t.Errorf("leaf %s", leaf.Subject)
+	}
+
+	// The Apple X86 Secure Boot Root CA that issued the leaf is not bundled
+	err = manifest.VerifyCertificates(x509.NewCertPool())
+	if err == nil {
+		t.Errorf("chained without its root")
+	}
+}
@@ -0,0 +1,214 @@
+package kernelcache
+
+import (
+	"crypto/rsa"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// XNU keeps the keys that may sign chunklists in constant arrays, each entry a 4 byte header
+// whose first byte is the isprod flag followed by a 2048 bit big endian modulus. Only the rev1
+// symbols are known, other tables can be found by scanning but not told apart by revision.
+const (
+	ChunklistRev1KeyCountSymbol = "_rev1_chunklist_num_pubkeys"
+	ChunklistRev1KeysSymbol = "_rev1_chunklist_pubkeys"
+
+	ChunklistKeyCountSize = 8
+	ChunklistKeyHeaderSize = 4
+	ChunklistKeySize = 2048/8
+	ChunklistKeyEntrySize = ChunklistKeyHeaderSize + ChunklistKeySize
+	ChunklistDefaultExponent = 0x010001
+	MaxChunklistKeys = 256
+
+	MaxScannedChunklistKeys = 16
+	ChunklistKeyScanAlignment = 4
+	MinModulusDistinctBytes = 64
+
+	sectionTypeMask = 0xff
+	sectionTypeZeroFill = 0x1 // S_ZEROFILL
+)
+
+// ChunklistKey is one public key from a chunklist key table
+type ChunklistKey struct {
+	Revision int
+	Index int
+	Header uint32
+	Production bool
+	Key *rsa.PublicKey
+	FileOffset uint64 // offset of the entry header in the kernelcache, when known
+}
+
+// parseChunklistKey decodes one key table entry
+func parseChunklistKey(revision int, index int, entry []byte, exponent int) *ChunklistKey {
+	return &ChunklistKey{
+		Revision:   revision,
+		Index:      index,
+		Header:     binary.LittleEndian.Uint32(entry[0:ChunklistKeyHeaderSize]),
+		Production: entry[0] != 0,
+		Key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(entry[ChunklistKeyHeaderSize:ChunklistKeyEntrySize]),
+			E: exponent,
+		},
+	}
+}
+
+// chunklistKeyTable reads the key table of one revision through its symbols
+func (kernel *Kernel) chunklistKeyTable(revision int, countSymbol string, keysSymbol string, exponent int) ([]*ChunklistKey, error) {
+	countBytes, err := kernel.ReadSymbol(countSymbol, ChunklistKeyCountSize)
+	if err != nil {
+		return nil, err
+	}
+
+	count := binary.LittleEndian.Uint64(countBytes)
+	if count > MaxChunklistKeys {
+		return nil, fmt.Errorf("%s is %d, more than %d keys", countSymbol, count, MaxChunklistKeys)
+	}
+
+	keys, err := kernel.ReadSymbol(keysSymbol, count * ChunklistKeyEntrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := kernel.SymbolFileOffset(keysSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*ChunklistKey, count)
+	for index := range result {
+		start := index * ChunklistKeyEntrySize
+		result[index] = parseChunklistKey(revision, index, keys[start:(start + ChunklistKeyEntrySize)], exponent)
+		result[index].FileOffset = offset + uint64(start)
+	}
+
+	return result, nil
+}
+
+// ChunklistKeys reads the rev1 chunklist keys through their symbols
+func (kernel *Kernel) ChunklistKeys(exponent int) ([]*ChunklistKey, error) {
+	if exponent == 0 {
+		exponent = ChunklistDefaultExponent
+	}
+
+	return kernel.chunklistKeyTable(1, ChunklistRev1KeyCountSymbol, ChunklistRev1KeysSymbol, exponent)
+}
+
+// chunklistSmallPrimes is the product of the odd primes below 1000, which no real modulus shares
+// a factor with
+var chunklistSmallPrimes = func() *big.Int {
+	result := big.NewInt(1)
+	for candidate := int64(3); candidate < 1000; candidate += 2 {
+		if big.NewInt(candidate).ProbablyPrime(0) {
+			result.Mul(result, big.NewInt(candidate))
+		}
+	}
+	return result
+}()
+
+// validateChunklistEntry checks that a key table entry has a plausible header and a well formed
+// 2048 bit RSA modulus
+func validateChunklistEntry(entry []byte) error {
+	header := entry[0:ChunklistKeyHeaderSize]
+	if header[0] > 1 || header[1] != 0 || header[2] != 0 || header[3] != 0 {
+		return fmt.Errorf("invalid key header %x", header)
+	}
+
+	modulus := entry[ChunklistKeyHeaderSize:ChunklistKeyEntrySize]
+	if modulus[0] & 0x80 == 0 {
+		return fmt.Errorf("modulus is shorter than 2048 bits")
+	}
+	if modulus[len(modulus) - 1] & 1 == 0 {
+		return fmt.Errorf("modulus is even")
+	}
+
+	// Random looking data uses most byte values, tables of code or strings do not
+	var seen [256]bool
+	distinct := 0
+	for _, value := range modulus {
+		if !seen[value] {
+			seen[value] = true
+			distinct++
+		}
+	}
+	if distinct < MinModulusDistinctBytes {
+		return fmt.Errorf("modulus only has %d distinct bytes", distinct)
+	}
+
+	divisor := new(big.Int).GCD(nil, nil, new(big.Int).SetBytes(modulus), chunklistSmallPrimes)
+	if divisor.Cmp(big.NewInt(1)) != 0 {
+		return fmt.Errorf("modulus has small factor %s", divisor)
+	}
+
+	return nil
+}
+
+// isScanSection reports whether a section may hold chunklist key tables
+func isScanSection(section *macho.Section) bool {
+	return section.Seg == "__DATA_CONST" && section.Name == "__const"
+}
+
+// ScanChunklistKeys finds chunklist key tables without symbols, for stripped kernelcaches, by
+// looking in the __DATA_CONST,__const sections for a 64 bit count followed by that many valid
+// entries. The revision of keys found this way is unknown and left as zero.
+func (kernel *Kernel) ScanChunklistKeys(exponent int) ([]*ChunklistKey, error) {
+	if exponent == 0 {
+		exponent = ChunklistDefaultExponent
+	}
+
+	result := make([]*ChunklistKey, 0)
+	for _, file := range kernel.Files() {
+		for _, section := range file.Sections {
+			if !isScanSection(section) || section.Flags & sectionTypeMask == sectionTypeZeroFill {
+				continue
+			}
+
+			data, err := section.Data()
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", section.Seg, section.Name, err)
+			}
+
+			result = append(result, scanChunklistKeys(data, uint64(section.Offset), exponent)...)
+		}
+	}
+
+	return result, nil
+}
+
+func scanChunklistKeys(data []byte, fileOffset uint64, exponent int) []*ChunklistKey {
+	result := make([]*ChunklistKey, 0)
+	for offset := 0; offset + ChunklistKeyCountSize + ChunklistKeyEntrySize <= len(data); offset += ChunklistKeyScanAlignment {
+		count := binary.LittleEndian.Uint64(data[offset:(offset + ChunklistKeyCountSize)])
+		if count == 0 || count > MaxScannedChunklistKeys {
+			continue
+		}
+
+		start := offset + ChunklistKeyCountSize
+		end := start + int(count) * ChunklistKeyEntrySize
+		if end > len(data) {
+			continue
+		}
+
+		valid := true
+		for index := 0; index < int(count) && valid; index++ {
+			entryStart := start + index * ChunklistKeyEntrySize
+			valid = validateChunklistEntry(data[entryStart:(entryStart + ChunklistKeyEntrySize)]) == nil
+		}
+		if !valid {
+			continue
+		}
+
+		for index := 0; index < int(count); index++ {
+			entryStart := start + index * ChunklistKeyEntrySize
+			key := parseChunklistKey(0, index, data[entryStart:(entryStart + ChunklistKeyEntrySize)], exponent)
+			key.FileOffset = fileOffset + uint64(entryStart)
+			result = append(result, key)
+		}
+
+		// Entries keep the alignment, so continue right after the table
+		offset = end - ChunklistKeyScanAlignment
+	}
+
+	return result
+}
@@ -0,0 +1,332 @@
+package kernelcache
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"go-aapl-integrity/pkg/img4"
+	"go-aapl-integrity/pkg/lzfse"
+	"go-aapl-integrity/pkg/lzss"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	FileTypeFileset = 0xc // MH_FILESET
+	LoadCmdFilesetEntry = 0x80000035 // LC_FILESET_ENTRY
+	FilesetEntryHeaderSize = 32
+
+	MaxContainerDepth = 4
+	cpuArch64 = 0x01000000 // CPU_ARCH_ABI64
+)
+
+// Image4 payload types that carry a kernelcache
+var PayloadTypes = []string{"krnl", "rkrn"}
+
+type Kernel struct {
+	File *macho.File
+	Entries []*FilesetEntry
+
+	reader io.ReaderAt
+	closer io.Closer
+}
+
+// FilesetEntry is one Mach-O (the kernel itself or a kext) inside an MH_FILESET kernelcache
+type FilesetEntry struct {
+	ID string
+	VMAddr uint64
+	FileOffset uint64
+	File *macho.File
+}
+
+// overlayReader presents a fileset entry's Mach-O header at offset zero while every
+// other offset reads the containing kernelcache, since fileset entries record their
+// segment and link-edit offsets relative to the whole fileset
+type overlayReader struct {
+	header []byte
+	base io.ReaderAt
+}
+
+func (reader *overlayReader) ReadAt(buffer []byte, offset int64) (int, error) {
+	if offset >= int64(len(reader.header)) {
+		return reader.base.ReadAt(buffer, offset)
+	}
+
+	count := copy(buffer, reader.header[offset:])
+	if count == len(buffer) {
+		return count, nil
+	}
+
+	rest, err := reader.base.ReadAt(buffer[count:], offset + int64(count))
+	return count + rest, err
+}
+
+// Open loads a kernelcache from disk. Thin and fat Mach-O files are read in place, while
+// IM4P wrapped or compressed kernelcaches are unpacked into memory first.
+func Open(path string) (*Kernel, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(file, magic)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !isMachO(magic) {
+		file.Close()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return Load(data)
+	}
+
+	kernel, err := NewKernel(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	kernel.closer = file
+
+	return kernel, nil
+}
+
+// Load parses a kernelcache held in memory, unwrapping IM4P and compression first
+func Load(data []byte) (*Kernel, error) {
+	unwrapped, err := Unwrap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKernel(bytes.NewReader(unwrapped))
+}
+
+// isMachO reports whether magic is a thin or fat Mach-O magic in either byte order
+func isMachO(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+
+	switch binary.LittleEndian.Uint32(magic) {
+	case macho.Magic32, macho.Magic64, macho.MagicFat:
+		return true
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case macho.Magic32, macho.Magic64, macho.MagicFat:
+		return true
+	}
+
+	return false
+}
+
+// Unwrap strips IM4P and compression containers until a Mach-O remains
+func Unwrap(data []byte) ([]byte, error) {
+	for depth := 0; depth < MaxContainerDepth; depth++ {
+		switch {
+		case isMachO(data):
+			return data, nil
+
+		case lzss.IsCompressed(data):
+			result, err := lzss.Decompress(data)
+			if err != nil {
+				return nil, fmt.Errorf("lzss: %s", err)
+			}
+			data = result
+
+		case lzfse.IsCompressed(data):
+			result, err := lzfse.Decompress(data)
+			if err != nil {
+				return nil, fmt.Errorf("lzfse: %s", err)
+			}
+			data = result
+
+		case len(data) > 0 && data[0] == 0x30:
+			payload, err := kernelPayload(data)
+			if err != nil {
+				return nil, err
+			}
+			data = payload
+
+		default:
+			return nil, fmt.Errorf("unrecognized kernelcache container")
+		}
+	}
+
+	return nil, fmt.Errorf("kernelcache containers nested more than %d deep", MaxContainerDepth)
+}
+
+// kernelPayload returns the still compressed contents of an IM4P or IMG4 kernelcache
+func kernelPayload(data []byte) ([]byte, error) {
+	image, err := img4.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if image.Payload == nil {
+		return nil, fmt.Errorf("image4 has no payload")
+	}
+	if len(image.Payload.KeyBag) != 0 {
+		return nil, fmt.Errorf("image4 payload %s is encrypted", image.Payload.Name)
+	}
+
+	for _, payloadType := range PayloadTypes {
+		if image.Payload.Name == payloadType {
+			return image.Payload.Data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("image4 payload type %s is not a kernelcache", image.Payload.Name)
+}
+
+// NewKernel parses a decompressed kernelcache, including the entries of an MH_FILESET.
+// Fat files use their first 64 bit slice.
+func NewKernel(reader io.ReaderAt) (*Kernel, error) {
+	return NewKernelForCpu(reader, 0)
+}
+
+// NewKernelForCpu parses a decompressed kernelcache, picking the slice for cpu out of a fat
+// file. A zero cpu picks the first 64 bit slice.
+func NewKernelForCpu(reader io.ReaderAt, cpu macho.Cpu) (*Kernel, error) {
+	fat, err := macho.NewFatFile(reader)
+	if err == nil {
+		return newFatKernel(reader, fat, cpu)
+	}
+	if err != macho.ErrNotFat {
+		return nil, err
+	}
+
+	file, err := macho.NewFile(reader)
+	if err != nil {
+		return nil, err
+	}
+	if cpu != 0 && file.Cpu != cpu {
+		return nil, fmt.Errorf("kernel is %s, not %s", file.Cpu, cpu)
+	}
+
+	result := &Kernel{
+		File:   file,
+		reader: reader,
+	}
+
+	if file.Type == FileTypeFileset {
+		result.Entries, err = readFilesetEntries(file, reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func newFatKernel(reader io.ReaderAt, fat *macho.FatFile, cpu macho.Cpu) (*Kernel, error) {
+	for _, arch := range fat.Arches {
+		if (cpu == 0 && arch.Cpu & cpuArch64 != 0) || (cpu != 0 && arch.Cpu == cpu) {
+			// Re-parse the slice on its own so that fileset offsets are slice relative
+			slice := io.NewSectionReader(reader, int64(arch.Offset), int64(arch.Size))
+			return NewKernelForCpu(slice, arch.Cpu)
+		}
+	}
+
+	if cpu == 0 {
+		return nil, fmt.Errorf("fat kernel has no 64 bit slice")
+	}
+
+	return nil, fmt.Errorf("fat kernel has no %s slice", cpu)
+}
+
+func (kernel *Kernel) Close() error {
+	if kernel.closer != nil {
+		return kernel.closer.Close()
+	}
+
+	return nil
+}
+
+func readFilesetEntries(file *macho.File, reader io.ReaderAt) ([]*FilesetEntry, error) {
+	result := make([]*FilesetEntry, 0)
+	for _, load := range file.Loads {
+		raw := load.Raw()
+		if len(raw) < FilesetEntryHeaderSize || file.ByteOrder.Uint32(raw[0:4]) != LoadCmdFilesetEntry {
+			continue
+		}
+
+		entry := &FilesetEntry{
+			VMAddr:     file.ByteOrder.Uint64(raw[8:16]),
+			FileOffset: file.ByteOrder.Uint64(raw[16:24]),
+		}
+
+		nameOffset := file.ByteOrder.Uint32(raw[24:28])
+		if nameOffset >= uint32(len(raw)) {
+			return nil, fmt.Errorf("fileset entry name offset %d is out of bounds", nameOffset)
+		}
+		entry.ID = string(bytes.TrimRight(raw[nameOffset:], "\x00"))
+
+		header, err := readEntryHeader(reader, int64(entry.FileOffset))
+		if err != nil {
+			return nil, fmt.Errorf("fileset entry %s: %s", entry.ID, err)
+		}
+
+		entry.File, err = macho.NewFile(&overlayReader{header: header, base: reader})
+		if err != nil {
+			return nil, fmt.Errorf("fileset entry %s: %s", entry.ID, err)
+		}
+
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// readEntryHeader reads the Mach-O header and load commands of a fileset entry
+func readEntryHeader(reader io.ReaderAt, offset int64) ([]byte, error) {
+	var header macho.FileHeader
+	fixed := make([]byte, 32)
+	_, err := reader.ReadAt(fixed, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	err = binary.Read(bytes.NewReader(fixed), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Magic != macho.Magic64 {
+		return nil, fmt.Errorf("bad magic %X", header.Magic)
+	}
+
+	result := make([]byte, 32 + int64(header.Cmdsz))
+	_, err = reader.ReadAt(result, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Files returns the kernelcache itself followed by each of its fileset entries
+func (kernel *Kernel) Files() []*macho.File {
+	result := []*macho.File{kernel.File}
+	for _, entry := range kernel.Entries {
+		result = append(result, entry.File)
+	}
+
+	return result
+}
+
+// Entry returns the fileset entry with the given bundle identifier
+func (kernel *Kernel) Entry(id string) *FilesetEntry {
+	for _, entry := range kernel.Entries {
+		if entry.ID == id {
+			return entry
+		}
+	}
+
+	return nil
+}
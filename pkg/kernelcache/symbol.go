@@ -0,0 +1,84 @@
+package kernelcache
+
+import (
+	"debug/macho"
+	"fmt"
+)
+
+// SymbolNotFoundError is returned when no file in the kernelcache defines a symbol, which is
+// usual for stripped release kernelcaches
+type SymbolNotFoundError struct {
+	Name string
+}
+
+func (err *SymbolNotFoundError) Error() string {
+	return fmt.Sprintf("symbol %s not found, the kernelcache may be stripped", err.Name)
+}
+
+// Symbol finds a symbol in the kernelcache or any of its fileset entries, returning the
+// Mach-O that defines it
+func (kernel *Kernel) Symbol(name string) (*macho.Symbol, *macho.File, error) {
+	for _, file := range kernel.Files() {
+		if file.Symtab == nil {
+			continue
+		}
+
+		for index := range file.Symtab.Syms {
+			symbol := &file.Symtab.Syms[index]
+			if symbol.Name == name && symbol.Sect != 0 {
+				return symbol, file, nil
+			}
+		}
+	}
+
+	return nil, nil, &SymbolNotFoundError{Name: name}
+}
+
+// symbolSection returns the section holding a symbol and the symbol's offset within it,
+// checking that length bytes from the symbol stay inside the section
+func (kernel *Kernel) symbolSection(name string, length uint64) (*macho.Section, uint64, error) {
+	symbol, file, err := kernel.Symbol(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if int(symbol.Sect) > len(file.Sections) {
+		return nil, 0, fmt.Errorf("symbol %s has invalid section %d", name, symbol.Sect)
+	}
+
+	section := file.Sections[symbol.Sect - 1]
+	if symbol.Value < section.Addr || symbol.Value - section.Addr > section.Size || length > section.Size - (symbol.Value - section.Addr) {
+		return nil, 0, fmt.Errorf("symbol %s at 0x%x with length 0x%x is outside %s.%s", name, symbol.Value, length, section.Seg, section.Name)
+	}
+
+	return section, symbol.Value - section.Addr, nil
+}
+
+// SymbolFileOffset returns the offset of a symbol's data in the kernelcache file
+func (kernel *Kernel) SymbolFileOffset(name string) (uint64, error) {
+	section, offset, err := kernel.symbolSection(name, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(section.Offset) + offset, nil
+}
+
+// ReadSymbol reads length bytes of section data starting at a symbol
+func (kernel *Kernel) ReadSymbol(name string, length uint64) ([]byte, error) {
+	section, offset, err := kernel.symbolSection(name, length)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, length)
+	count, err := section.ReadAt(result, int64(offset))
+	if uint64(count) != length {
+		if err == nil {
+			err = fmt.Errorf("could not read 0x%x bytes", length)
+		}
+		return nil, fmt.Errorf("symbol %s: %s", name, err)
+	}
+
+	return result, nil
+}
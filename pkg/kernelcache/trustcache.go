@@ -0,0 +1,170 @@
+package kernelcache
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"go-aapl-integrity/pkg/trustcache"
+	"strings"
+)
+
+const (
+	// Upper bound on modules in a serialized static trust cache, used to reject noise while scanning
+	MaxTrustCacheModules = 16
+)
+
+type TrustCacheLocation struct {
+	Segment string
+	Section string
+	Offset uint64 // file offset of the serialized container
+	TrustCaches []*trustcache.TrustCache
+}
+
+// isTrustCacheSection reports whether a section is named as holding trust caches
+func isTrustCacheSection(section *macho.Section) bool {
+	name := strings.ToLower(section.Seg + section.Name)
+	return strings.Contains(name, "trust")
+}
+
+// isScannableSection reports whether a section has file contents worth scanning
+func isScannableSection(section *macho.Section) bool {
+	const sectionTypeMask = 0xff
+	const zeroFill = 0x1
+
+	return section.Offset != 0 && section.Size != 0 && section.Flags & sectionTypeMask != zeroFill
+}
+
+// trustCachesAt attempts to decode a serialized trust cache container at start
+func trustCachesAt(data []byte, start int) []*trustcache.TrustCache {
+	if start + 8 > len(data) {
+		return nil
+	}
+
+	count := binary.LittleEndian.Uint32(data[start:])
+	if count == 0 || count > MaxTrustCacheModules {
+		return nil
+	}
+
+	headerSize := 4 + (int(count) * 4)
+	if start + headerSize > len(data) {
+		return nil
+	}
+
+	previous := uint32(0)
+	for index := 0; index < int(count); index++ {
+		offset := binary.LittleEndian.Uint32(data[(start + 4 + index * 4):])
+		if offset < uint32(headerSize) || offset <= previous || uint64(start) + uint64(offset) + 24 > uint64(len(data)) {
+			return nil
+		}
+		previous = offset
+	}
+
+	caches, err := trustcache.ParseSerialized(data[start:])
+	if err != nil {
+		return nil
+	}
+
+	for _, cache := range caches {
+		if cache.Count == 0 || !cache.IsSorted() {
+			return nil
+		}
+	}
+
+	return caches
+}
+
+// scanSection looks for serialized trust caches anywhere in a section's contents
+func scanSection(section *macho.Section, data []byte) []*TrustCacheLocation {
+	result := make([]*TrustCacheLocation, 0)
+	for start := 0; start + 8 <= len(data); start += 4 {
+		caches := trustCachesAt(data, start)
+		if caches == nil {
+			continue
+		}
+
+		result = append(result, &TrustCacheLocation{
+			Segment:     section.Seg,
+			Section:     section.Name,
+			Offset:      uint64(section.Offset) + uint64(start),
+			TrustCaches: caches,
+		})
+	}
+
+	return result
+}
+
+// FindTrustCaches locates the static trust caches embedded in a kernelcache. Sections
+// named for trust caches are checked first; when none decode, every section with file
+// contents is scanned for a serialized container whose modules parse and are sorted.
+func (kernel *Kernel) FindTrustCaches() ([]*TrustCacheLocation, error) {
+	result := make([]*TrustCacheLocation, 0)
+	scanned := make(map[uint32]bool)
+
+	for _, file := range kernel.Files() {
+		for _, section := range file.Sections {
+			if !isTrustCacheSection(section) || !isScannableSection(section) || scanned[section.Offset] {
+				continue
+			}
+			scanned[section.Offset] = true
+
+			data, err := section.Data()
+			if err != nil {
+				return nil, fmt.Errorf("%s,%s: %s", section.Seg, section.Name, err)
+			}
+
+			caches := trustCachesAt(data, 0)
+			if caches == nil {
+				continue
+			}
+
+			result = append(result, &TrustCacheLocation{
+				Segment:     section.Seg,
+				Section:     section.Name,
+				Offset:      uint64(section.Offset),
+				TrustCaches: caches,
+			})
+		}
+	}
+
+	if len(result) > 0 {
+		return result, nil
+	}
+
+	scanned = make(map[uint32]bool)
+	for _, file := range kernel.Files() {
+		for _, section := range file.Sections {
+			if !isScannableSection(section) || scanned[section.Offset] {
+				continue
+			}
+			scanned[section.Offset] = true
+
+			data, err := section.Data()
+			if err != nil {
+				return nil, fmt.Errorf("%s,%s: %s", section.Seg, section.Name, err)
+			}
+
+			result = append(result, scanSection(section, data)...)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no static trust cache found in kernelcache")
+	}
+
+	return result, nil
+}
+
+// TrustCaches returns every static trust cache module embedded in a kernelcache
+func (kernel *Kernel) TrustCaches() ([]*trustcache.TrustCache, error) {
+	locations, err := kernel.FindTrustCaches()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*trustcache.TrustCache, 0)
+	for _, location := range locations {
+		result = append(result, location.TrustCaches...)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,213 @@
+package lzfse
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// decoderEntry decodes one literal state: the next state is delta plus k bits of input
+type decoderEntry struct {
+	k uint8
+	symbol uint8
+	delta int32
+}
+
+// valueDecoderEntry decodes one L, M or D state along with the value's extra bits
+type valueDecoderEntry struct {
+	totalBits uint8
+	valueBits uint8
+	delta int32
+	base int32
+}
+
+// checkFrequencies makes sure a frequency table cannot overflow the states it describes
+func checkFrequencies(frequencies []uint16, states int) error {
+	sum := 0
+	for _, frequency := range frequencies {
+		sum += int(frequency)
+	}
+
+	if sum > states {
+		return fmt.Errorf("frequencies sum to %d, more than %d states", sum, states)
+	}
+
+	return nil
+}
+
+// stateShift returns the k for which states <= (frequency << k) < 2 * states
+func stateShift(frequency int, states int) int {
+	return bits.LeadingZeros32(uint32(frequency)) - bits.LeadingZeros32(uint32(states))
+}
+
+func newDecoderTable(states int, frequencies []uint16) ([]decoderEntry, error) {
+	err := checkFrequencies(frequencies, states)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]decoderEntry, states)
+	index := 0
+	for symbol, value := range frequencies {
+		frequency := int(value)
+		if frequency == 0 {
+			continue
+		}
+
+		k := stateShift(frequency, states)
+		j0 := ((2 * states) >> uint(k)) - frequency
+		for j := 0; j < frequency; j++ {
+			entry := decoderEntry{symbol: uint8(symbol)}
+			if j < j0 {
+				entry.k = uint8(k)
+				entry.delta = int32(((frequency + j) << uint(k)) - states)
+			} else {
+				entry.k = uint8(k - 1)
+				entry.delta = int32((j - j0) << uint(k - 1))
+			}
+
+			result[index] = entry
+			index++
+		}
+	}
+
+	return result, nil
+}
+
+func newValueDecoderTable(states int, frequencies []uint16, extraBits []uint8, baseValues []int32) ([]valueDecoderEntry, error) {
+	err := checkFrequencies(frequencies, states)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]valueDecoderEntry, states)
+	index := 0
+	for symbol, value := range frequencies {
+		frequency := int(value)
+		if frequency == 0 {
+			continue
+		}
+
+		k := stateShift(frequency, states)
+		j0 := ((2 * states) >> uint(k)) - frequency
+		for j := 0; j < frequency; j++ {
+			entry := valueDecoderEntry{
+				valueBits: extraBits[symbol],
+				base:      baseValues[symbol],
+			}
+			if j < j0 {
+				entry.totalBits = uint8(k) + entry.valueBits
+				entry.delta = int32(((frequency + j) << uint(k)) - states)
+			} else {
+				entry.totalBits = uint8(k - 1) + entry.valueBits
+				entry.delta = int32((j - j0) << uint(k - 1))
+			}
+
+			result[index] = entry
+			index++
+		}
+	}
+
+	return result, nil
+}
+
+// bitReader consumes an FSE bit stream backwards from the end of its payload, taking
+// the most significant bits of the accumulator first
+type bitReader struct {
+	data []byte
+	position int // bytes before position have not been loaded yet
+	accumulator uint64
+	count uint
+}
+
+// loadBytes reads count bytes ending at position as a little endian value
+func (reader *bitReader) loadBytes(count int) uint64 {
+	result := uint64(0)
+	for index := count - 1; index >= 0; index-- {
+		result = (result << 8) | uint64(reader.data[reader.position + index])
+	}
+
+	return result
+}
+
+// newBitReader starts a stream ending at end. data is everything before the stream too,
+// since the first load may reach back past the start of a short payload
+func newBitReader(data []byte, end int, initialBits int) (*bitReader, error) {
+	reader := &bitReader{data: data, position: end}
+
+	if initialBits < -7 || initialBits > 0 {
+		return nil, fmt.Errorf("invalid initial bit count %d", initialBits)
+	}
+
+	if initialBits != 0 {
+		if reader.position < 8 {
+			return nil, fmt.Errorf("bit stream is out of bounds")
+		}
+		reader.position -= 8
+		reader.accumulator = reader.loadBytes(8)
+		reader.count = uint(64 + initialBits)
+	} else {
+		if reader.position < 7 {
+			return nil, fmt.Errorf("bit stream is out of bounds")
+		}
+		reader.position -= 7
+		reader.accumulator = reader.loadBytes(7)
+		reader.count = 56
+	}
+
+	if reader.count < 64 && reader.accumulator >> reader.count != 0 {
+		return nil, fmt.Errorf("bit stream has stray leading bits")
+	}
+
+	return reader, nil
+}
+
+// refill tops the accumulator up to at least 56 bits
+func (reader *bitReader) refill() error {
+	count := (63 - reader.count) &^ 7
+	if count == 0 {
+		return nil
+	}
+
+	byteCount := int(count >> 3)
+	if reader.position < byteCount {
+		return fmt.Errorf("bit stream is out of bounds")
+	}
+
+	reader.position -= byteCount
+	reader.accumulator = (reader.accumulator << count) | reader.loadBytes(byteCount)
+	reader.count += count
+	return nil
+}
+
+func (reader *bitReader) pull(count uint) (uint64, error) {
+	if count > reader.count {
+		return 0, fmt.Errorf("bit stream is exhausted")
+	}
+
+	reader.count -= count
+	result := reader.accumulator >> reader.count
+	reader.accumulator &= (uint64(1) << reader.count) - 1
+	return result, nil
+}
+
+func decodeSymbol(state *uint16, table []decoderEntry, reader *bitReader) (uint8, error) {
+	entry := table[*state]
+	value, err := reader.pull(uint(entry.k))
+	if err != nil {
+		return 0, err
+	}
+
+	*state = uint16(entry.delta + int32(value))
+	return entry.symbol, nil
+}
+
+func decodeValue(state *uint16, table []valueDecoderEntry, reader *bitReader) (int32, error) {
+	entry := table[*state]
+	value, err := reader.pull(uint(entry.totalBits))
+	if err != nil {
+		return 0, err
+	}
+
+	*state = uint16(entry.delta + int32(value >> entry.valueBits))
+	return entry.base + int32(value & ((uint64(1) << entry.valueBits) - 1)), nil
+}
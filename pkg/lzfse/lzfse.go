@@ -0,0 +1,368 @@
+package lzfse
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Block magics, each followed by a block specific header
+const (
+	MagicEndOfStream = "bvx$"
+	MagicUncompressed = "bvx-"
+	MagicCompressedV1 = "bvx1"
+	MagicCompressedV2 = "bvx2"
+	MagicCompressedLZVN = "bvxn"
+
+	LSymbols = 20
+	MSymbols = 20
+	DSymbols = 64
+	LiteralSymbols = 256
+	LStates = 64
+	MStates = 64
+	DStates = 256
+	LiteralStates = 1024
+
+	MatchesPerBlock = 10000
+	LiteralsPerBlock = 4 * MatchesPerBlock
+
+	V2HeaderSize = 32 // magic, raw size and three packed fields, before the frequency tables
+	LZVNHeaderSize = 12
+	UncompressedHeaderSize = 8
+)
+
+var lExtraBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8}
+var lBaseValues = []int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 20, 28, 60}
+var mExtraBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11}
+var mBaseValues = []int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 24, 56, 312}
+var dExtraBits = []uint8{
+	0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3,
+	4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7,
+	8, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10, 10, 11, 11, 11, 11,
+	12, 12, 12, 12, 13, 13, 13, 13, 14, 14, 14, 14, 15, 15, 15, 15,
+}
+var dBaseValues = []int32{
+	0, 1, 2, 3, 4, 6, 8, 10, 12, 16,
+	20, 24, 28, 36, 44, 52, 60, 76, 92, 108,
+	124, 156, 188, 220, 252, 316, 380, 444, 508, 636,
+	764, 892, 1020, 1276, 1532, 1788, 2044, 2556, 3068, 3580,
+	4092, 5116, 6140, 7164, 8188, 10236, 12284, 14332, 16380, 20476,
+	24572, 28668, 32764, 40956, 49148, 57340, 65532, 81916, 98300, 114684,
+	131068, 163836, 196604, 229372,
+}
+
+// freqBits and freqValues decode the fixed prefix code of v2 frequency tables, indexed
+// by the low five bits of the input
+var freqBits = []uint{
+	2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+	2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+}
+var freqValues = []uint16{
+	0, 2, 1, 4, 0, 3, 1, 0, 0, 2, 1, 5, 0, 3, 1, 0,
+	0, 2, 1, 6, 0, 3, 1, 0, 0, 2, 1, 7, 0, 3, 1, 0,
+}
+
+// compressedHeader is the decoded header of an FSE block
+type compressedHeader struct {
+	rawBytes uint32
+	literals uint32
+	literalPayloadBytes uint32
+	matches uint32
+	literalBits int
+	literalStates [4]uint16
+	lmdPayloadBytes uint32
+	lmdBits int
+	headerSize uint32
+	lState uint16
+	mState uint16
+	dState uint16
+	frequencies [LSymbols + MSymbols + DSymbols + LiteralSymbols]uint16
+}
+
+// IsCompressed reports whether data starts with an LZFSE block
+func IsCompressed(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
+	switch string(data[0:4]) {
+	case MagicUncompressed, MagicCompressedV1, MagicCompressedV2, MagicCompressedLZVN:
+		return true
+	}
+
+	return false
+}
+
+// Decompress decodes an LZFSE stream up to its end of stream block
+func Decompress(data []byte) ([]byte, error) {
+	return DecompressLimit(data, -1)
+}
+
+// DecompressLimit decodes an LZFSE stream, failing once the output would exceed limit
+// bytes. A negative limit means no limit.
+func DecompressLimit(data []byte, limit int) ([]byte, error) {
+	result := make([]byte, 0)
+	offset := 0
+	for {
+		if offset + 4 > len(data) {
+			return nil, fmt.Errorf("stream ends without an end of stream block")
+		}
+
+		magic := string(data[offset:(offset + 4)])
+		if magic == MagicEndOfStream {
+			return result, nil
+		}
+
+		if offset + 8 > len(data) {
+			return nil, fmt.Errorf("not enough data for block header at offset %d", offset)
+		}
+		rawBytes := binary.LittleEndian.Uint32(data[(offset + 4):(offset + 8)])
+		if limit >= 0 && uint64(len(result)) + uint64(rawBytes) > uint64(limit) {
+			return nil, fmt.Errorf("output exceeds %d bytes", limit)
+		}
+
+		var err error
+		switch magic {
+		case MagicUncompressed:
+			end := uint64(offset) + UncompressedHeaderSize + uint64(rawBytes)
+			if end > uint64(len(data)) {
+				return nil, fmt.Errorf("uncompressed block at offset %d is out of bounds", offset)
+			}
+			result = append(result, data[(offset + UncompressedHeaderSize):end]...)
+			offset = int(end)
+
+		case MagicCompressedLZVN:
+			if offset + LZVNHeaderSize > len(data) {
+				return nil, fmt.Errorf("not enough data for lzvn header at offset %d", offset)
+			}
+			payloadBytes := binary.LittleEndian.Uint32(data[(offset + 8):(offset + 12)])
+			end := uint64(offset) + LZVNHeaderSize + uint64(payloadBytes)
+			if end > uint64(len(data)) {
+				return nil, fmt.Errorf("lzvn block at offset %d is out of bounds", offset)
+			}
+
+			result, err = decodeLZVN(result, data[(offset + LZVNHeaderSize):end], int(rawBytes))
+			if err != nil {
+				return nil, fmt.Errorf("lzvn block at offset %d: %s", offset, err)
+			}
+			offset = int(end)
+
+		case MagicCompressedV2:
+			header, err := parseV2Header(data[offset:])
+			if err != nil {
+				return nil, fmt.Errorf("block at offset %d: %s", offset, err)
+			}
+
+			var end int
+			result, end, err = decodeBlock(result, data, offset, header)
+			if err != nil {
+				return nil, fmt.Errorf("block at offset %d: %s", offset, err)
+			}
+			offset = end
+
+		case MagicCompressedV1:
+			// The reference encoder only writes v2 headers
+			return nil, fmt.Errorf("unsupported v1 block at offset %d", offset)
+
+		default:
+			return nil, fmt.Errorf("unknown block magic %q at offset %d", magic, offset)
+		}
+	}
+}
+
+func field(value uint64, offset uint, size uint) uint64 {
+	return (value >> offset) & ((uint64(1) << size) - 1)
+}
+
+func parseV2Header(data []byte) (*compressedHeader, error) {
+	if len(data) < V2HeaderSize {
+		return nil, fmt.Errorf("not enough data for v2 header")
+	}
+
+	packed0 := binary.LittleEndian.Uint64(data[8:16])
+	packed1 := binary.LittleEndian.Uint64(data[16:24])
+	packed2 := binary.LittleEndian.Uint64(data[24:32])
+
+	header := &compressedHeader{
+		rawBytes:            binary.LittleEndian.Uint32(data[4:8]),
+		literals:            uint32(field(packed0, 0, 20)),
+		literalPayloadBytes: uint32(field(packed0, 20, 20)),
+		matches:             uint32(field(packed0, 40, 20)),
+		literalBits:         int(field(packed0, 60, 3)) - 7,
+		lmdPayloadBytes:     uint32(field(packed1, 40, 20)),
+		lmdBits:             int(field(packed1, 60, 3)) - 7,
+		headerSize:          uint32(field(packed2, 0, 32)),
+		lState:              uint16(field(packed2, 32, 10)),
+		mState:              uint16(field(packed2, 42, 10)),
+		dState:              uint16(field(packed2, 52, 10)),
+	}
+	for index := range header.literalStates {
+		header.literalStates[index] = uint16(field(packed1, uint(index * 10), 10))
+	}
+
+	if header.headerSize < V2HeaderSize || uint64(header.headerSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("header size %d is out of bounds", header.headerSize)
+	}
+
+	err := decodeFrequencies(data[V2HeaderSize:header.headerSize], header.frequencies[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if header.literals > LiteralsPerBlock || header.matches > MatchesPerBlock {
+		return nil, fmt.Errorf("block has %d literals and %d matches", header.literals, header.matches)
+	}
+	for _, state := range header.literalStates {
+		if state >= LiteralStates {
+			return nil, fmt.Errorf("literal state %d is out of range", state)
+		}
+	}
+	if header.lState >= LStates || header.mState >= MStates || header.dState >= DStates {
+		return nil, fmt.Errorf("initial state is out of range")
+	}
+
+	return header, nil
+}
+
+// decodeFrequencies reads the prefix coded frequency tables, whose bits are read from the LSB
+func decodeFrequencies(data []byte, frequencies []uint16) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	accumulator := uint32(0)
+	count := uint(0)
+	source := 0
+	for index := range frequencies {
+		for source < len(data) && count + 8 <= 32 {
+			accumulator |= uint32(data[source]) << count
+			count += 8
+			source++
+		}
+
+		code := accumulator & 31
+		size := freqBits[code]
+		switch size {
+		case 8:
+			frequencies[index] = uint16(8 + ((accumulator >> 4) & 0xf))
+		case 14:
+			frequencies[index] = uint16(24 + ((accumulator >> 4) & 0x3ff))
+		default:
+			frequencies[index] = freqValues[code]
+		}
+
+		if size > count {
+			return fmt.Errorf("frequency table is truncated")
+		}
+		accumulator >>= size
+		count -= size
+	}
+
+	if count >= 8 || source != len(data) {
+		return fmt.Errorf("frequency table has trailing data")
+	}
+
+	return nil
+}
+
+// decodeBlock decodes an FSE block starting at offset, returning the output and the offset after it
+func decodeBlock(result []byte, data []byte, offset int, header *compressedHeader) ([]byte, int, error) {
+	literalsStart := uint64(offset) + uint64(header.headerSize)
+	lmdStart := literalsStart + uint64(header.literalPayloadBytes)
+	end := lmdStart + uint64(header.lmdPayloadBytes)
+	if end > uint64(len(data)) {
+		return nil, 0, fmt.Errorf("payload is out of bounds")
+	}
+
+	frequencies := header.frequencies[:]
+	lFrequencies := frequencies[0:LSymbols]
+	mFrequencies := frequencies[LSymbols:(LSymbols + MSymbols)]
+	dFrequencies := frequencies[(LSymbols + MSymbols):(LSymbols + MSymbols + DSymbols)]
+	literalFrequencies := frequencies[(LSymbols + MSymbols + DSymbols):]
+
+	literalTable, err := newDecoderTable(LiteralStates, literalFrequencies)
+	if err != nil { return nil, 0, err }
+	lTable, err := newValueDecoderTable(LStates, lFrequencies, lExtraBits, lBaseValues)
+	if err != nil { return nil, 0, err }
+	mTable, err := newValueDecoderTable(MStates, mFrequencies, mExtraBits, mBaseValues)
+	if err != nil { return nil, 0, err }
+	dTable, err := newValueDecoderTable(DStates, dFrequencies, dExtraBits, dBaseValues)
+	if err != nil { return nil, 0, err }
+
+	// Literals are interleaved across four states and always padded to a multiple of four
+	literals := make([]byte, (header.literals + 3) &^ 3)
+	reader, err := newBitReader(data[:lmdStart], int(lmdStart), header.literalBits)
+	if err != nil {
+		return nil, 0, fmt.Errorf("literals: %s", err)
+	}
+
+	states := header.literalStates
+	for index := 0; index < len(literals); index += 4 {
+		err = reader.refill()
+		if err != nil {
+			return nil, 0, fmt.Errorf("literals: %s", err)
+		}
+
+		for lane := 0; lane < 4; lane++ {
+			literals[index + lane], err = decodeSymbol(&states[lane], literalTable, reader)
+			if err != nil {
+				return nil, 0, fmt.Errorf("literals: %s", err)
+			}
+		}
+	}
+
+	reader, err = newBitReader(data[:end], int(end), header.lmdBits)
+	if err != nil {
+		return nil, 0, fmt.Errorf("matches: %s", err)
+	}
+
+	blockStart := len(result)
+	lState, mState, dState := header.lState, header.mState, header.dState
+	literal := 0
+	distance := int32(-1)
+	for match := uint32(0); match < header.matches; match++ {
+		err = reader.refill()
+		if err != nil {
+			return nil, 0, fmt.Errorf("matches: %s", err)
+		}
+
+		literalCount, err := decodeValue(&lState, lTable, reader)
+		if err != nil { return nil, 0, err }
+		matchLength, err := decodeValue(&mState, mTable, reader)
+		if err != nil { return nil, 0, err }
+		newDistance, err := decodeValue(&dState, dTable, reader)
+		if err != nil { return nil, 0, err }
+
+		if newDistance != 0 {
+			distance = newDistance
+		}
+
+		if literal + int(literalCount) > len(literals) {
+			return nil, 0, fmt.Errorf("match %d uses more literals than decoded", match)
+		}
+		if len(result) - blockStart + int(literalCount) + int(matchLength) > int(header.rawBytes) {
+			return nil, 0, fmt.Errorf("match %d overflows the block", match)
+		}
+
+		result = append(result, literals[literal:(literal + int(literalCount))]...)
+		literal += int(literalCount)
+
+		if matchLength == 0 {
+			continue
+		}
+		if distance <= 0 || int(distance) > len(result) {
+			return nil, 0, fmt.Errorf("match %d distance %d is out of range", match, distance)
+		}
+
+		// Copy byte by byte, since a match may overlap the bytes it produces
+		source := len(result) - int(distance)
+		for index := 0; index < int(matchLength); index++ {
+			result = append(result, result[source + index])
+		}
+	}
+
+	if len(result) - blockStart != int(header.rawBytes) {
+		return nil, 0, fmt.Errorf("decoded %d bytes, expected %d", len(result) - blockStart, header.rawBytes)
+	}
+
+	return result, int(end), nil
+}
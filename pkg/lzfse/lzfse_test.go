@@ -0,0 +1,102 @@
+package lzfse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// withoutEnd strips the end of stream block so that blocks can be chained
+func withoutEnd(data []byte) []byte {
+	return data[:(len(data) - len(MagicEndOfStream))]
+}
+
+func uncompressedBlock(data []byte) []byte {
+	header := make([]byte, UncompressedHeaderSize)
+	copy(header, MagicUncompressed)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+	return append(header, data...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDecompress(t *testing.T) {
+	text := readFixture(t, "compress.txt")
+	v2 := readFixture(t, "compress.txt.lzfse")
+	lzvn := readFixture(t, "compress.txt.lzvn")
+	raw := []byte("stored as is")
+	end := []byte(MagicEndOfStream)
+
+	v1 := append([]byte{}, v2...)
+	copy(v1, MagicCompressedV1)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		limit    int
+		expected []byte
+		err      bool
+	}{
+		{"v2 blocks", v2, -1, text, false},
+		{"lzvn blocks", lzvn, -1, text, false},
+		{"uncompressed block", join(uncompressedBlock(raw), end), -1, raw, false},
+		{"mixed blocks", join(withoutEnd(v2), uncompressedBlock(raw), lzvn), -1, join(text, raw, text), false},
+		{"empty stream", end, -1, []byte{}, false},
+		{"exact limit", v2, len(text), text, false},
+		{"past limit", v2, len(text) - 1, nil, true},
+		{"no end of stream", withoutEnd(v2), -1, nil, true},
+		{"truncated v2 block", v2[:(V2HeaderSize - 1)], -1, nil, true},
+		{"truncated lzvn block", lzvn[:(LZVNHeaderSize + 4)], -1, nil, true},
+		{"truncated uncompressed block", uncompressedBlock(raw)[:8], -1, nil, true},
+		{"v1 block", v1, -1, nil, true},
+		{"unknown magic", []byte("bvxzxxxx"), -1, nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := DecompressLimit(test.data, test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(result, test.expected) {
+			t.Errorf("%s: decompressed %d bytes that differ from the %d expected", test.name, len(result), len(test.expected))
+		}
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected bool
+	}{
+		{[]byte(MagicCompressedV2), true},
+		{[]byte(MagicCompressedLZVN), true},
+		{[]byte(MagicUncompressed), true},
+		{[]byte(MagicEndOfStream), false},
+		{[]byte("bvx"), false},
+		{[]byte("comp"), false},
+	}
+
+	for _, test := range tests {
+		if IsCompressed(test.data) != test.expected {
+			t.Errorf("%q: IsCompressed is %t", test.data, !test.expected)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package lzfse
+
+import "fmt"
+
+// LZVN opcodes, named after the reference decoder:
+//   sml_d  LLMMMDDD DDDDDDDD          literals, match and an 11 bit distance
+//   med_d  101LLMMM DDDDDDMM DDDDDDDD literals, a longer match and a 14 bit distance
+//   lrg_d  LLMMM111 DDDDDDDD DDDDDDDD literals, match and a 16 bit distance
+//   pre_d  LLMMM110                   literals and match at the previous distance
+//   sml_m  1111MMMM                   match at the previous distance
+//   lrg_m  11110000 MMMMMMMM          longer match at the previous distance
+//   sml_l  1110LLLL                   literals only
+//   lrg_l  11100000 LLLLLLLL          more literals only
+const (
+	lzvnEndOfStream = 0x06
+	lzvnNop1 = 0x0e
+	lzvnNop2 = 0x16
+)
+
+// DecompressLZVN decodes rawBytes of output from a bare LZVN stream, one without LZFSE block
+// headers as APFS compressed files store them
+func DecompressLZVN(data []byte, rawBytes int) ([]byte, error) {
+	return decodeLZVN(make([]byte, 0), data, rawBytes)
+}
+
+// decodeLZVN appends exactly rawBytes of decoded output to result
+func decodeLZVN(result []byte, data []byte, rawBytes int) ([]byte, error) {
+	blockStart := len(result)
+	distance := 0
+	source := 0
+
+	need := func(count int) error {
+		if source + count > len(data) {
+			return fmt.Errorf("opcode at offset %d is truncated", source)
+		}
+		return nil
+	}
+
+	for {
+		if err := need(1); err != nil {
+			return nil, err
+		}
+
+		opcode := data[source]
+		literals, match, length := 0, 0, 1
+		switch {
+		case opcode == lzvnEndOfStream:
+			if len(result) - blockStart != rawBytes {
+				return nil, fmt.Errorf("decoded %d bytes, expected %d", len(result) - blockStart, rawBytes)
+			}
+			return result, nil
+
+		case opcode == lzvnNop1 || opcode == lzvnNop2:
+			source++
+			continue
+
+		case opcode >= 0xf0:
+			if opcode == 0xf0 {
+				if err := need(2); err != nil {
+					return nil, err
+				}
+				match = int(data[source + 1]) + 16
+				length = 2
+			} else {
+				match = int(opcode & 0x0f)
+			}
+
+		case opcode >= 0xe0:
+			if opcode == 0xe0 {
+				if err := need(2); err != nil {
+					return nil, err
+				}
+				literals = int(data[source + 1]) + 16
+				length = 2
+			} else {
+				literals = int(opcode & 0x0f)
+			}
+
+		case (opcode >= 0x70 && opcode < 0x80) || (opcode >= 0xd0 && opcode < 0xe0):
+			return nil, fmt.Errorf("undefined opcode 0x%02x at offset %d", opcode, source)
+
+		case opcode >= 0xa0 && opcode < 0xc0:
+			if err := need(3); err != nil {
+				return nil, err
+			}
+			extra := int(data[source + 1]) | (int(data[source + 2]) << 8)
+			literals = int(opcode >> 3) & 3
+			match = ((int(opcode & 7) << 2) | (extra & 3)) + 3
+			distance = extra >> 2
+			length = 3
+
+		case opcode & 7 == 7:
+			if err := need(3); err != nil {
+				return nil, err
+			}
+			literals = int(opcode >> 6)
+			match = int((opcode >> 3) & 7) + 3
+			distance = int(data[source + 1]) | (int(data[source + 2]) << 8)
+			length = 3
+
+		case opcode & 7 == 6:
+			if opcode < 0x40 {
+				return nil, fmt.Errorf("undefined opcode 0x%02x at offset %d", opcode, source)
+			}
+			literals = int(opcode >> 6)
+			match = int((opcode >> 3) & 7) + 3
+
+		default:
+			if err := need(2); err != nil {
+				return nil, err
+			}
+			literals = int(opcode >> 6)
+			match = int((opcode >> 3) & 7) + 3
+			distance = (int(opcode & 7) << 8) | int(data[source + 1])
+			length = 2
+		}
+
+		source += length
+		if err := need(literals); err != nil {
+			return nil, err
+		}
+		if len(result) - blockStart + literals + match > rawBytes {
+			return nil, fmt.Errorf("opcode at offset %d overflows the block", source - length)
+		}
+
+		result = append(result, data[source:(source + literals)]...)
+		source += literals
+
+		if match == 0 {
+			continue
+		}
+		if distance == 0 || distance > len(result) {
+			return nil, fmt.Errorf("match distance %d at offset %d is out of range", distance, source)
+		}
+
+		start := len(result) - distance
+		for index := 0; index < match; index++ {
+			result = append(result, result[start + index])
+		}
+	}
+}
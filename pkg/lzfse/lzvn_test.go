@@ -0,0 +1,46 @@
+package lzfse
+
+import (
+	"testing"
+)
+
+func TestDecompressLZVN(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		rawBytes int
+		expected string
+		err      bool
+	}{
+		{"sml_l", []byte{0xe3, 'a', 'b', 'c', lzvnEndOfStream}, 3, "abc", false},
+		{"lrg_l", append(append([]byte{0xe0, 0x00}, []byte("0123456789abcdef")...), lzvnEndOfStream), 16, "0123456789abcdef", false},
+		{"sml_d overlapping", []byte{0x98, 0x02, 'a', 'b', lzvnEndOfStream}, 8, "abababab", false},
+		{"pre_d", []byte{0x98, 0x02, 'a', 'b', 0x46, 'c', lzvnEndOfStream}, 12, "ababababcbcb", false},
+		{"sml_m", []byte{0x98, 0x02, 'a', 'b', 0xf2, lzvnEndOfStream}, 10, "ababababab", false},
+		{"lrg_d", []byte{0x47, 0x01, 0x00, 'a', lzvnEndOfStream}, 4, "aaaa", false},
+		{"med_d", []byte{0xe2, 'a', 'b', 0xa0, 0x09, 0x00, lzvnEndOfStream}, 6, "ababab", false},
+		{"nops", []byte{lzvnNop1, 0xe1, 'a', lzvnNop2, lzvnEndOfStream}, 1, "a", false},
+		{"short output", []byte{0xe3, 'a', 'b', 'c', lzvnEndOfStream}, 4, "", true},
+		{"overflow", []byte{0xe3, 'a', 'b', 'c', lzvnEndOfStream}, 2, "", true},
+		{"distance out of range", []byte{0x98, 0x09, 'a', 'b', lzvnEndOfStream}, 8, "", true},
+		{"undefined opcode", []byte{0x70, lzvnEndOfStream}, 0, "", true},
+		{"no end of stream", []byte{0xe3, 'a', 'b', 'c'}, 3, "", true},
+		{"truncated literals", []byte{0xe3, 'a'}, 3, "", true},
+	}
+
+	for _, test := range tests {
+		result, err := DecompressLZVN(test.data, test.rawBytes)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed %q, expected an error", test.name, result)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(result) != test.expected {
+			t.Errorf("%s: decompressed %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
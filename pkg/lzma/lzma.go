@@ -0,0 +1,466 @@
+package lzma
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LZMA as written by the LZMA SDK's "alone" format, which EDK2's LzmaCompress produces for
+// firmware sections: five bytes of properties, a 64 bit uncompressed size, then the stream
+const (
+	HeaderSize = 13
+	UnknownSize = 0xffffffffffffffff // the stream ends with an end marker instead
+
+	states = 12
+	posBitsMax = 4
+	lenToPosStates = 4
+	alignBits = 4
+	startPosModelIndex = 4
+	endPosModelIndex = 14
+	fullDistances = 1 << (endPosModelIndex >> 1)
+	matchMinLen = 2
+	posSlotBits = 6
+
+	probabilityBits = 11
+	probabilityInit = 1 << (probabilityBits - 1)
+	moveBits = 5
+	topValue = 1 << 24
+)
+
+// Header is the properties and size that start an LZMA alone stream
+type Header struct {
+	LiteralContextBits uint
+	LiteralPositionBits uint
+	PositionBits uint
+	DictionarySize uint32
+	UncompressedSize uint64
+}
+
+// ParseHeader decodes the header at the start of data
+func ParseHeader(data []byte) (*Header, error) {
+	if len(data) < HeaderSize {
+		return nil, fmt.Errorf("not enough data for lzma header")
+	}
+
+	properties := uint(data[0])
+	if properties >= 9 * 5 * 5 {
+		return nil, fmt.Errorf("invalid lzma properties 0x%02x", properties)
+	}
+
+	return &Header{
+		LiteralContextBits:  properties % 9,
+		LiteralPositionBits: (properties / 9) % 5,
+		PositionBits:        properties / 45,
+		DictionarySize:      binary.LittleEndian.Uint32(data[1:5]),
+		UncompressedSize:    binary.LittleEndian.Uint64(data[5:13]),
+	}, nil
+}
+
+type rangeDecoder struct {
+	data []byte
+	position int
+	rangeValue uint32
+	code uint32
+	overrun bool
+}
+
+func newRangeDecoder(data []byte) (*rangeDecoder, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("not enough data for lzma range coder")
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("lzma stream does not start with a zero byte")
+	}
+
+	decoder := &rangeDecoder{
+		data:       data,
+		position:   5,
+		rangeValue: 0xffffffff,
+		code:       binary.BigEndian.Uint32(data[1:5]),
+	}
+	if decoder.code == decoder.rangeValue {
+		return nil, fmt.Errorf("corrupt lzma range coder")
+	}
+
+	return decoder, nil
+}
+
+func (decoder *rangeDecoder) nextByte() uint32 {
+	if decoder.position >= len(decoder.data) {
+		decoder.overrun = true
+		return 0
+	}
+
+	value := decoder.data[decoder.position]
+	decoder.position++
+	return uint32(value)
+}
+
+func (decoder *rangeDecoder) normalize() {
+	if decoder.rangeValue < topValue {
+		decoder.rangeValue <<= 8
+		decoder.code = (decoder.code << 8) | decoder.nextByte()
+	}
+}
+
+// finishedOK reports whether the coder ended cleanly, as it does after an end marker
+func (decoder *rangeDecoder) finishedOK() bool {
+	return decoder.code == 0
+}
+
+func (decoder *rangeDecoder) decodeBit(probability *uint16) uint32 {
+	value := uint32(*probability)
+	bound := (decoder.rangeValue >> probabilityBits) * value
+
+	var symbol uint32
+	if decoder.code < bound {
+		value += ((1 << probabilityBits) - value) >> moveBits
+		decoder.rangeValue = bound
+		symbol = 0
+	} else {
+		value -= value >> moveBits
+		decoder.code -= bound
+		decoder.rangeValue -= bound
+		symbol = 1
+	}
+
+	*probability = uint16(value)
+	decoder.normalize()
+	return symbol
+}
+
+func (decoder *rangeDecoder) decodeDirectBits(count uint) uint32 {
+	result := uint32(0)
+	for ; count > 0; count-- {
+		decoder.rangeValue >>= 1
+		decoder.code -= decoder.rangeValue
+		mask := 0 - (decoder.code >> 31)
+		decoder.code += decoder.rangeValue & mask
+		decoder.normalize()
+		result = (result << 1) + (mask + 1)
+	}
+
+	return result
+}
+
+func newProbabilities(count int) []uint16 {
+	result := make([]uint16, count)
+	for index := range result {
+		result[index] = probabilityInit
+	}
+
+	return result
+}
+
+// bitTreeDecode reads a bits wide symbol most significant bit first
+func (decoder *rangeDecoder) bitTreeDecode(probabilities []uint16, bits uint) uint32 {
+	symbol := uint32(1)
+	for index := uint(0); index < bits; index++ {
+		symbol = (symbol << 1) + decoder.decodeBit(&probabilities[symbol])
+	}
+
+	return symbol - (1 << bits)
+}
+
+// bitTreeReverseDecode reads a bits wide symbol least significant bit first
+func (decoder *rangeDecoder) bitTreeReverseDecode(probabilities []uint16, bits uint) uint32 {
+	symbol := uint32(0)
+	index := uint32(1)
+	for bit := uint(0); bit < bits; bit++ {
+		value := decoder.decodeBit(&probabilities[index])
+		index = (index << 1) + value
+		symbol |= value << bit
+	}
+
+	return symbol
+}
+
+type lengthDecoder struct {
+	choice uint16
+	choice2 uint16
+	low [][]uint16
+	mid [][]uint16
+	high []uint16
+}
+
+func newLengthDecoder() *lengthDecoder {
+	result := &lengthDecoder{
+		choice:  probabilityInit,
+		choice2: probabilityInit,
+		low:     make([][]uint16, 1 << posBitsMax),
+		mid:     make([][]uint16, 1 << posBitsMax),
+		high:    newProbabilities(1 << 8),
+	}
+	for index := range result.low {
+		result.low[index] = newProbabilities(1 << 3)
+		result.mid[index] = newProbabilities(1 << 3)
+	}
+
+	return result
+}
+
+func (length *lengthDecoder) decode(decoder *rangeDecoder, posState uint32) uint32 {
+	if decoder.decodeBit(&length.choice) == 0 {
+		return decoder.bitTreeDecode(length.low[posState], 3)
+	}
+	if decoder.decodeBit(&length.choice2) == 0 {
+		return 8 + decoder.bitTreeDecode(length.mid[posState], 3)
+	}
+
+	return 16 + decoder.bitTreeDecode(length.high, 8)
+}
+
+type decoder struct {
+	header *Header
+	ranges *rangeDecoder
+	output []byte
+	limit uint64
+
+	literals []uint16
+	posSlots [][]uint16
+	posDecoders []uint16
+	align []uint16
+	lengths *lengthDecoder
+	repLengths *lengthDecoder
+
+	isMatch []uint16
+	isRep []uint16
+	isRepG0 []uint16
+	isRepG1 []uint16
+	isRepG2 []uint16
+	isRep0Long []uint16
+}
+
+func (state *decoder) decodeLiteral(machineState uint32, rep0 uint32) {
+	previous := uint32(0)
+	if len(state.output) > 0 {
+		previous = uint32(state.output[len(state.output) - 1])
+	}
+
+	header := state.header
+	literalState := ((uint32(len(state.output)) & ((1 << header.LiteralPositionBits) - 1)) << header.LiteralContextBits) + (previous >> (8 - header.LiteralContextBits))
+	probabilities := state.literals[(0x300 * literalState):]
+
+	symbol := uint32(1)
+	if machineState >= 7 {
+		matchByte := uint32(state.output[len(state.output) - int(rep0) - 1])
+		for symbol < 0x100 {
+			matchBit := (matchByte >> 7) & 1
+			matchByte <<= 1
+			bit := state.ranges.decodeBit(&probabilities[((1 + matchBit) << 8) + symbol])
+			symbol = (symbol << 1) | bit
+			if matchBit != bit {
+				break
+			}
+		}
+	}
+	for symbol < 0x100 {
+		symbol = (symbol << 1) | state.ranges.decodeBit(&probabilities[symbol])
+	}
+
+	state.output = append(state.output, byte(symbol - 0x100))
+}
+
+func (state *decoder) decodeDistance(length uint32) uint32 {
+	lengthState := length
+	if lengthState > lenToPosStates - 1 {
+		lengthState = lenToPosStates - 1
+	}
+
+	posSlot := state.ranges.bitTreeDecode(state.posSlots[lengthState], posSlotBits)
+	if posSlot < 4 {
+		return posSlot
+	}
+
+	directBits := uint((posSlot >> 1) - 1)
+	distance := (2 | (posSlot & 1)) << directBits
+	if posSlot < endPosModelIndex {
+		return distance + state.ranges.bitTreeReverseDecode(state.posDecoders[(distance - posSlot):], directBits)
+	}
+
+	distance += state.ranges.decodeDirectBits(directBits - alignBits) << alignBits
+	return distance + state.ranges.bitTreeReverseDecode(state.align, alignBits)
+}
+
+func literalStateUpdate(machineState uint32) uint32 {
+	if machineState < 4 {
+		return 0
+	}
+	if machineState < 10 {
+		return machineState - 3
+	}
+
+	return machineState - 6
+}
+
+func (state *decoder) overflow() error {
+	if state.header.UncompressedSize == UnknownSize {
+		return fmt.Errorf("lzma output exceeds %d bytes", state.limit)
+	}
+
+	return fmt.Errorf("lzma stream continues past its %d byte size", state.limit)
+}
+
+func (state *decoder) run() error {
+	header := state.header
+	// Without a recorded size, remaining counts down the caller's limit instead
+	sizeKnown := header.UncompressedSize != UnknownSize
+	remaining := state.limit
+
+	var machineState, rep0, rep1, rep2, rep3 uint32
+	for {
+		if state.ranges.overrun {
+			return fmt.Errorf("lzma stream is truncated")
+		}
+		if sizeKnown && remaining == 0 && state.ranges.finishedOK() {
+			return nil
+		}
+
+		posState := uint32(len(state.output)) & ((1 << header.PositionBits) - 1)
+		if state.ranges.decodeBit(&state.isMatch[(machineState << posBitsMax) + posState]) == 0 {
+			if remaining == 0 {
+				return state.overflow()
+			}
+
+			state.decodeLiteral(machineState, rep0)
+			machineState = literalStateUpdate(machineState)
+			remaining--
+			continue
+		}
+
+		var length uint32
+		if state.ranges.decodeBit(&state.isRep[machineState]) != 0 {
+			if remaining == 0 {
+				return state.overflow()
+			}
+			if len(state.output) == 0 {
+				return fmt.Errorf("lzma repeat before any output")
+			}
+
+			if state.ranges.decodeBit(&state.isRepG0[machineState]) == 0 {
+				if state.ranges.decodeBit(&state.isRep0Long[(machineState << posBitsMax) + posState]) == 0 {
+					if machineState < 7 {
+						machineState = 9
+					} else {
+						machineState = 11
+					}
+					state.output = append(state.output, state.output[len(state.output) - int(rep0) - 1])
+					remaining--
+					continue
+				}
+			} else {
+				var distance uint32
+				if state.ranges.decodeBit(&state.isRepG1[machineState]) == 0 {
+					distance = rep1
+				} else {
+					if state.ranges.decodeBit(&state.isRepG2[machineState]) == 0 {
+						distance = rep2
+					} else {
+						distance = rep3
+						rep3 = rep2
+					}
+					rep2 = rep1
+				}
+				rep1 = rep0
+				rep0 = distance
+			}
+
+			length = state.repLengths.decode(state.ranges, posState)
+			if machineState < 7 {
+				machineState = 8
+			} else {
+				machineState = 11
+			}
+		} else {
+			rep3, rep2, rep1 = rep2, rep1, rep0
+			length = state.lengths.decode(state.ranges, posState)
+			if machineState < 7 {
+				machineState = 7
+			} else {
+				machineState = 10
+			}
+
+			rep0 = state.decodeDistance(length)
+			if rep0 == 0xffffffff {
+				if state.ranges.finishedOK() {
+					if sizeKnown && remaining != 0 {
+						return fmt.Errorf("lzma end marker %d bytes early", remaining)
+					}
+					return nil
+				}
+				return fmt.Errorf("corrupt lzma end marker")
+			}
+			if remaining == 0 {
+				return state.overflow()
+			}
+			if rep0 >= header.DictionarySize && header.DictionarySize != 0 || int(rep0) >= len(state.output) {
+				return fmt.Errorf("lzma match distance %d is out of range", rep0 + 1)
+			}
+		}
+
+		length += matchMinLen
+		if uint64(length) > remaining {
+			return state.overflow()
+		}
+		if int(rep0) >= len(state.output) {
+			return fmt.Errorf("lzma match distance %d is out of range", rep0 + 1)
+		}
+
+		start := len(state.output) - int(rep0) - 1
+		for index := 0; index < int(length); index++ {
+			state.output = append(state.output, state.output[start + index])
+		}
+		remaining -= uint64(length)
+	}
+}
+
+// Decompress unpacks an LZMA alone stream, producing at most limit bytes when the stream
+// does not record its size
+func Decompress(data []byte, limit uint64) ([]byte, error) {
+	header, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	capacity := 0
+	if header.UncompressedSize != UnknownSize {
+		if header.UncompressedSize > limit {
+			return nil, fmt.Errorf("lzma uncompressed size %d exceeds %d bytes", header.UncompressedSize, limit)
+		}
+		limit = header.UncompressedSize
+		capacity = int(limit)
+	}
+
+	ranges, err := newRangeDecoder(data[HeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	state := &decoder{
+		header:      header,
+		ranges:      ranges,
+		output:      make([]byte, 0, capacity),
+		limit:       limit,
+		literals:    newProbabilities(0x300 << (header.LiteralContextBits + header.LiteralPositionBits)),
+		posSlots:    make([][]uint16, lenToPosStates),
+		posDecoders: newProbabilities(1 + fullDistances - endPosModelIndex),
+		align:       newProbabilities(1 << alignBits),
+		lengths:     newLengthDecoder(),
+		repLengths:  newLengthDecoder(),
+		isMatch:     newProbabilities(states << posBitsMax),
+		isRep:       newProbabilities(states),
+		isRepG0:     newProbabilities(states),
+		isRepG1:     newProbabilities(states),
+		isRepG2:     newProbabilities(states),
+		isRep0Long:  newProbabilities(states << posBitsMax),
+	}
+	for index := range state.posSlots {
+		state.posSlots[index] = newProbabilities(1 << posSlotBits)
+	}
+
+	err = state.run()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.output, nil
+}
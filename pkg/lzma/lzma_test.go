@@ -0,0 +1,95 @@
+package lzma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	text := readFixture(t, "compress.txt")
+	known := readFixture(t, "compress.txt.lzma")
+
+	header, err := ParseHeader(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.LiteralContextBits != 3 || header.LiteralPositionBits != 0 || header.PositionBits != 2 || header.UncompressedSize != uint64(len(text)) {
+		t.Errorf("header %+v", header)
+	}
+
+	// The stream also ends with an end marker, so it decodes without its size
+	unknown := append([]byte{}, known...)
+	binary.LittleEndian.PutUint64(unknown[5:13], UnknownSize)
+
+	badProperties := append([]byte{}, known...)
+	badProperties[0] = 9 * 5 * 5
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit uint64
+		err   bool
+	}{
+		{"known size", known, uint64(len(text)), false},
+		{"unknown size", unknown, uint64(len(text)), false},
+		{"known size past limit", known, uint64(len(text)) - 1, true},
+		{"unknown size past limit", unknown, uint64(len(text)) - 1, true},
+		{"truncated", known[:(len(known) / 2)], uint64(len(text)), true},
+		{"bad properties", badProperties, uint64(len(text)), true},
+		{"short header", known[:(HeaderSize - 1)], uint64(len(text)), true},
+	}
+
+	for _, test := range tests {
+		result, err := Decompress(test.data, test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(result, text) {
+			t.Errorf("%s: decompressed data differs", test.name)
+		}
+	}
+}
+
+func TestX86Decode(t *testing.T) {
+	// Encoded by the LZMA SDK x86 filter: relative CALL and JMP targets were made absolute,
+	// the CALL whose target has a high byte other than 0x00 or 0xff was left alone
+	tests := []struct {
+		name     string
+		encoded  string
+		expected string
+	}{
+		{"calls and jumps", "9090e81700000090e9fdffffffe800000012909090909090", "9090e81000000090e9f0ffffffe800000012909090909090"},
+		{"no branches", "9090909090909090", "9090909090909090"},
+		{"shorter than an instruction", "e8010203", "e8010203"},
+	}
+
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		X86Decode(data)
+		if hex.EncodeToString(data) != test.expected {
+			t.Errorf("%s: decoded %x, expected %s", test.name, data, test.expected)
+		}
+	}
+}
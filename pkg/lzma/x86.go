@@ -0,0 +1,67 @@
+package lzma
+
+// test86MSByte reports whether a byte is 0x00 or 0xff, the top byte of a near relative target
+func test86MSByte(value byte) bool {
+	return (value + 1) & 0xfe == 0
+}
+
+// X86Decode undoes the LZMA SDK's x86 BCJ filter in place, turning the absolute CALL and JMP
+// targets the encoder wrote back into relative ones. EDK2's LZMA F86 sections apply it with a
+// start address of zero.
+func X86Decode(data []byte) {
+	if len(data) < 5 {
+		return
+	}
+
+	var mask uint32
+	ip := uint32(5)
+	size := len(data) - 4
+	position := 0
+	for {
+		pointer := position
+		for pointer < size && data[pointer] & 0xfe != 0xe8 {
+			pointer++
+		}
+
+		distance := pointer - position
+		position = pointer
+		if pointer >= size {
+			return
+		}
+
+		if distance > 2 {
+			mask = 0
+		} else {
+			mask >>= uint(distance)
+			if mask != 0 && (mask > 4 || mask == 3 || test86MSByte(data[pointer + int(mask >> 1) + 1])) {
+				mask = (mask >> 1) | 4
+				position++
+				continue
+			}
+		}
+
+		if !test86MSByte(data[pointer + 4]) {
+			mask = (mask >> 1) | 4
+			position++
+			continue
+		}
+
+		value := uint32(data[pointer + 4]) << 24 | uint32(data[pointer + 3]) << 16 | uint32(data[pointer + 2]) << 8 | uint32(data[pointer + 1])
+		current := ip + uint32(position)
+		position += 5
+		value -= current
+		if mask != 0 {
+			shift := (mask & 6) << 2
+			if test86MSByte(byte(value >> shift)) {
+				value ^= (uint32(0x100) << shift) - 1
+				value -= current
+			}
+			mask = 0
+		}
+
+		data[pointer + 1] = byte(value)
+		data[pointer + 2] = byte(value >> 8)
+		data[pointer + 3] = byte(value >> 16)
+		data[pointer + 4] = byte(0 - ((value >> 24) & 1))
+	}
+}
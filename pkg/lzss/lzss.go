@@ -0,0 +1,140 @@
+package lzss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+)
+
+// Okumura style LZSS as used by XNU and iBoot for "complzss" kernelcaches
+const (
+	WindowSize = 4096
+	MaxMatch = 18
+	Threshold = 2
+
+	CompressionMagic = "comp"
+	CompressionType = "lzss"
+	HeaderSize = 0x180
+)
+
+// Header is the big endian container prepended to compressed kernelcaches
+type Header struct {
+	Checksum uint32 // Adler-32 of the decompressed data
+	UncompressedSize uint32
+	CompressedSize uint32
+	PlatformName string
+	RootPath string
+}
+
+// IsCompressed reports whether data starts with a complzss header
+func IsCompressed(data []byte) bool {
+	return len(data) >= 8 && string(data[0:4]) == CompressionMagic && string(data[4:8]) == CompressionType
+}
+
+// ParseHeader decodes the complzss header at the start of data
+func ParseHeader(data []byte) (*Header, error) {
+	if len(data) < HeaderSize {
+		return nil, fmt.Errorf("not enough data for lzss header")
+	}
+	if !IsCompressed(data) {
+		return nil, fmt.Errorf("bad lzss magic %q", data[0:8])
+	}
+
+	return &Header{
+		Checksum:         binary.BigEndian.Uint32(data[8:12]),
+		UncompressedSize: binary.BigEndian.Uint32(data[12:16]),
+		CompressedSize:   binary.BigEndian.Uint32(data[16:20]),
+		PlatformName:     string(bytes.TrimRight(data[64:128], "\x00")),
+		RootPath:         string(bytes.TrimRight(data[128:384], "\x00")),
+	}, nil
+}
+
+// Decompress unpacks a complzss container and checks its checksum
+func Decompress(data []byte) ([]byte, error) {
+	header, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(HeaderSize) + uint64(header.CompressedSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("compressed size %d exceeds the %d bytes available", header.CompressedSize, len(data) - HeaderSize)
+	}
+
+	result, err := DecompressRaw(data[HeaderSize:(HeaderSize + header.CompressedSize)], int(header.UncompressedSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) != int(header.UncompressedSize) {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(result), header.UncompressedSize)
+	}
+
+	if adler32.Checksum(result) != header.Checksum {
+		return nil, fmt.Errorf("checksum %08x does not match %08x", adler32.Checksum(result), header.Checksum)
+	}
+
+	return result, nil
+}
+
+// DecompressRaw unpacks a headerless LZSS stream, producing at most limit bytes
+func DecompressRaw(data []byte, limit int) ([]byte, error) {
+	var window [WindowSize]byte
+	for index := 0; index < WindowSize - MaxMatch; index++ {
+		window[index] = ' '
+	}
+
+	result := make([]byte, 0, limit)
+	position := WindowSize - MaxMatch
+	flags := uint(0)
+	source := 0
+
+	for {
+		flags >>= 1
+		if flags & 0x100 == 0 {
+			if source >= len(data) {
+				break
+			}
+			// The high byte counts down the eight flag bits of each group
+			flags = uint(data[source]) | 0xff00
+			source++
+		}
+
+		if flags & 1 != 0 {
+			if source >= len(data) {
+				break
+			}
+			if len(result) >= limit {
+				return nil, fmt.Errorf("lzss output exceeds %d bytes", limit)
+			}
+
+			value := data[source]
+			source++
+			result = append(result, value)
+			window[position] = value
+			position = (position + 1) & (WindowSize - 1)
+			continue
+		}
+
+		if source + 1 >= len(data) {
+			break
+		}
+
+		offset := int(data[source]) | (int(data[source + 1] & 0xf0) << 4)
+		length := int(data[source + 1] & 0x0f) + Threshold + 1
+		source += 2
+
+		if len(result) + length > limit {
+			return nil, fmt.Errorf("lzss output exceeds %d bytes", limit)
+		}
+
+		for index := 0; index < length; index++ {
+			value := window[(offset + index) & (WindowSize - 1)]
+			result = append(result, value)
+			window[position] = value
+			position = (position + 1) & (WindowSize - 1)
+		}
+	}
+
+	return result, nil
+}
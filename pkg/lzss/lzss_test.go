@@ -0,0 +1,97 @@
+package lzss
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	expected := readFixture(t, "compress.txt")
+	compressed := readFixture(t, "compress.txt.lzss")
+
+	header, err := ParseHeader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.UncompressedSize != uint32(len(expected)) || header.PlatformName != "MacBookPro" || header.RootPath != "/" {
+		t.Errorf("header %+v", header)
+	}
+
+	badChecksum := append([]byte{}, compressed...)
+	badChecksum[8] ^= 1
+	badMagic := append([]byte{}, compressed...)
+	copy(badMagic[4:8], "lzvn")
+
+	tests := []struct {
+		name string
+		data []byte
+		err  bool
+	}{
+		{"complzss", compressed, false},
+		{"bad checksum", badChecksum, true},
+		{"bad magic", badMagic, true},
+		{"truncated", compressed[:(len(compressed) - 1)], true},
+		{"short header", compressed[:(HeaderSize - 1)], true},
+	}
+
+	for _, test := range tests {
+		result, err := Decompress(test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(result, expected) {
+			t.Errorf("%s: decompressed data differs", test.name)
+		}
+	}
+}
+
+func TestDecompressRaw(t *testing.T) {
+	// A match's 12 bit window position splits over the low byte and the high nibble of the
+	// second byte, whose low nibble is the length less three
+	tests := []struct {
+		name     string
+		data     []byte
+		limit    int
+		expected string
+		err      bool
+	}{
+		{"literals", []byte{0xff, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, 16, "abcdefgh", false},
+		{"match in the initial window", []byte{0x00, 0x00, 0x01}, 16, "    ", false},
+		{"match of earlier output", []byte{0x07, 'a', 'b', 'c', 0xee, 0xf3}, 16, "abcabcabc", false},
+		{"partial flag group", []byte{0x01, 'a'}, 16, "a", false},
+		{"literal past limit", []byte{0xff, 'a', 'b', 'c'}, 2, "", true},
+		{"match past limit", []byte{0x00, 0x00, 0x0f}, 16, "", true},
+	}
+
+	for _, test := range tests {
+		result, err := DecompressRaw(test.data, test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed %q, expected an error", test.name, result)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(result) != test.expected {
+			t.Errorf("%s: decompressed %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
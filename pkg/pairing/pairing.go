@@ -0,0 +1,296 @@
+package pairing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"go-aapl-integrity/pkg/device"
+	"go-aapl-integrity/pkg/plist"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	FieldDeviceCertificate = "DeviceCertificate"
+	FieldHostCertificate = "HostCertificate"
+	FieldRootCertificate = "RootCertificate"
+	FieldHostPrivateKey = "HostPrivateKey"
+	FieldRootPrivateKey = "RootPrivateKey"
+	FieldDevicePublicKey = "DevicePublicKey"
+	FieldSystemBUID = "SystemBUID"
+	FieldHostID = "HostID"
+	FieldWiFiMACAddress = "WiFiMACAddress"
+	FieldEscrowBag = "EscrowBag"
+)
+
+// PairingRecord is a lockdown pairing record as stored by the host
+type PairingRecord struct {
+	DeviceCertificate *x509.Certificate
+	HostCertificate *x509.Certificate
+	RootCertificate *x509.Certificate
+	HostPrivateKey crypto.Signer
+	RootPrivateKey crypto.Signer // nil when the record does not keep it
+	DevicePublicKey crypto.PublicKey // nil when the record does not keep it
+	SystemBUID string
+	HostID string
+	WiFiMACAddress string
+	EscrowBag []byte
+}
+
+// PairingError reports the pairing record field that is malformed or inconsistent
+type PairingError struct {
+	Field string
+	Err error
+}
+
+func (err *PairingError) Error() string {
+	return fmt.Sprintf("pairing record %s: %s", err.Field, err.Err)
+}
+
+func (err *PairingError) Unwrap() error {
+	return err.Err
+}
+
+func fieldError(field string, format string, args ...interface{}) error {
+	return &PairingError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+type publicKey interface {
+	Equal(crypto.PublicKey) bool
+}
+
+// pemData returns the data of a field, which must be present
+func pemData(record map[string]interface{}, field string) ([]byte, error) {
+	value, ok := record[field]
+	if !ok {
+		return nil, fieldError(field, "missing")
+	}
+
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, fieldError(field, "is %T, not data", value)
+	}
+
+	return data, nil
+}
+
+func parseCertificate(record map[string]interface{}, field string) (*x509.Certificate, error) {
+	data, err := pemData(record, field)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates, err := device.ParseCertificates(data)
+	if err != nil {
+		return nil, &PairingError{Field: field, Err: err}
+	}
+
+	return certificates[0], nil
+}
+
+func parsePrivateKey(record map[string]interface{}, field string) (crypto.Signer, error) {
+	data, err := pemData(record, field)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fieldError(field, "no PEM block")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fieldError(field, "unknown key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, &PairingError{Field: field, Err: err}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fieldError(field, "unsupported key %T", key)
+	}
+
+	return signer, nil
+}
+
+func parsePublicKey(record map[string]interface{}, field string) (crypto.PublicKey, error) {
+	data, err := pemData(record, field)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fieldError(field, "no PEM block")
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fieldError(field, "unknown key type %s", block.Type)
+	}
+	if err != nil {
+		return nil, &PairingError{Field: field, Err: err}
+	}
+
+	return key, nil
+}
+
+func parseString(record map[string]interface{}, field string) (string, error) {
+	value, ok := record[field]
+	if !ok {
+		return "", nil
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return "", fieldError(field, "is %T, not a string", value)
+	}
+
+	return text, nil
+}
+
+// Parse decodes an XML or binary pairing record. DeviceCertificate, HostCertificate,
+// RootCertificate and HostPrivateKey are required, the other fields are optional.
+func Parse(data []byte) (*PairingRecord, error) {
+	record, err := plist.Dictionary(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(PairingRecord)
+	result.DeviceCertificate, err = parseCertificate(record, FieldDeviceCertificate)
+	if err != nil { return nil, err }
+	result.HostCertificate, err = parseCertificate(record, FieldHostCertificate)
+	if err != nil { return nil, err }
+	result.RootCertificate, err = parseCertificate(record, FieldRootCertificate)
+	if err != nil { return nil, err }
+	result.HostPrivateKey, err = parsePrivateKey(record, FieldHostPrivateKey)
+	if err != nil { return nil, err }
+
+	if _, ok := record[FieldRootPrivateKey]; ok {
+		result.RootPrivateKey, err = parsePrivateKey(record, FieldRootPrivateKey)
+		if err != nil { return nil, err }
+	}
+	if _, ok := record[FieldDevicePublicKey]; ok {
+		result.DevicePublicKey, err = parsePublicKey(record, FieldDevicePublicKey)
+		if err != nil { return nil, err }
+	}
+
+	result.SystemBUID, err = parseString(record, FieldSystemBUID)
+	if err != nil { return nil, err }
+	result.HostID, err = parseString(record, FieldHostID)
+	if err != nil { return nil, err }
+	result.WiFiMACAddress, err = parseString(record, FieldWiFiMACAddress)
+	if err != nil { return nil, err }
+
+	if value, ok := record[FieldEscrowBag]; ok {
+		result.EscrowBag, ok = value.([]byte)
+		if !ok {
+			return nil, fieldError(FieldEscrowBag, "is %T, not data", value)
+		}
+	}
+
+	return result, nil
+}
+
+// Validation lists every reason a pairing record is expired or inconsistent
+type Validation struct {
+	Errors []error
+}
+
+func (validation *Validation) Valid() bool {
+	return len(validation.Errors) == 0
+}
+
+func (validation *Validation) add(field string, format string, args ...interface{}) {
+	validation.Errors = append(validation.Errors, fieldError(field, format, args...))
+}
+
+// checkIssued checks that the root signed a certificate. CheckSignature is used directly since
+// older hosts sign pairing certificates with SHA-1, which CheckSignatureFrom rejects.
+func (validation *Validation) checkIssued(field string, certificate *x509.Certificate, root *x509.Certificate) {
+	if !bytes.Equal(certificate.RawIssuer, root.RawSubject) {
+		validation.add(field, "issued by %s, not the record's root %s", certificate.Issuer, root.Subject)
+		return
+	}
+
+	err := root.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature)
+	if err != nil {
+		validation.add(field, "not signed by the record's root: %s", err)
+	}
+}
+
+func (validation *Validation) checkValidity(field string, certificate *x509.Certificate, now time.Time) {
+	if now.Before(certificate.NotBefore) {
+		validation.add(field, "not valid before %s", certificate.NotBefore.UTC())
+	} else if now.After(certificate.NotAfter) {
+		validation.add(field, "expired at %s", certificate.NotAfter.UTC())
+	}
+}
+
+func (validation *Validation) checkKey(field string, key crypto.PublicKey, certificate *x509.Certificate, certificateField string) {
+	comparable, ok := key.(publicKey)
+	if !ok || !comparable.Equal(certificate.PublicKey) {
+		validation.add(field, "does not match the %s public key", certificateField)
+	}
+}
+
+func (validation *Validation) checkUUID(field string, value string) {
+	if value == "" {
+		validation.add(field, "missing")
+		return
+	}
+
+	_, err := uuid.Parse(value)
+	if err != nil {
+		validation.add(field, "%s is not a UUID", value)
+	}
+}
+
+// Validate checks that the host and device certificates chain to the record's own root and
+// are valid at now, and that the keys the record keeps match its certificates
+func (record *PairingRecord) Validate(now time.Time) *Validation {
+	result := &Validation{Errors: make([]error, 0)}
+
+	root := record.RootCertificate
+	result.checkIssued(FieldRootCertificate, root, root)
+	if !root.IsCA {
+		result.add(FieldRootCertificate, "is not a CA")
+	}
+	result.checkIssued(FieldHostCertificate, record.HostCertificate, root)
+	result.checkIssued(FieldDeviceCertificate, record.DeviceCertificate, root)
+
+	result.checkValidity(FieldRootCertificate, root, now)
+	result.checkValidity(FieldHostCertificate, record.HostCertificate, now)
+	result.checkValidity(FieldDeviceCertificate, record.DeviceCertificate, now)
+
+	result.checkKey(FieldHostPrivateKey, record.HostPrivateKey.Public(), record.HostCertificate, FieldHostCertificate)
+	if record.RootPrivateKey != nil {
+		result.checkKey(FieldRootPrivateKey, record.RootPrivateKey.Public(), root, FieldRootCertificate)
+	}
+	if record.DevicePublicKey != nil {
+		result.checkKey(FieldDevicePublicKey, record.DevicePublicKey, record.DeviceCertificate, FieldDeviceCertificate)
+	}
+
+	result.checkUUID(FieldHostID, record.HostID)
+	result.checkUUID(FieldSystemBUID, record.SystemBUID)
+
+	return result
+}
@@ -0,0 +1,215 @@
+package pairing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	testHostID = "4B4F1E2C-8A33-4D29-9E0B-7C1A5F6D2E10"
+	testSystemBUID = "0F2D6E8A-1B3C-4E5F-8A7B-9C0D1E2F3A4B"
+)
+
+// issueCertificate creates an RSA certificate for name signed by parent, or self signed without one
+func issueCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+func encodePEM(blockType string, data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+}
+
+// encodeRecord writes fields as an XML plist dictionary of data and string values
+func encodeRecord(fields map[string]interface{}) []byte {
+	keys := make([]string, 0)
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<plist version=\"1.0\">\n<dict>\n")
+	for _, key := range keys {
+		buffer.WriteString("\t<key>")
+		xml.EscapeText(&buffer, []byte(key))
+		buffer.WriteString("</key>\n")
+
+		switch value := fields[key].(type) {
+		case []byte:
+			buffer.WriteString("\t<data>" + base64.StdEncoding.EncodeToString(value) + "</data>\n")
+		case string:
+			buffer.WriteString("\t<string>")
+			xml.EscapeText(&buffer, []byte(value))
+			buffer.WriteString("</string>\n")
+		}
+	}
+	buffer.WriteString("</dict>\n</plist>\n")
+
+	return buffer.Bytes()
+}
+
+// testRecord returns the fields of a pairing record in the format lockdown hosts store them
+func testRecord(t *testing.T) map[string]interface{} {
+	root, rootKey := issueCertificate(t, "Root", true, nil, nil)
+	host, hostKey := issueCertificate(t, "Host", false, root, rootKey)
+	device, deviceKey := issueCertificate(t, "Device", false, root, rootKey)
+
+	return map[string]interface{}{
+		FieldRootCertificate: encodePEM("CERTIFICATE", root.Raw),
+		FieldHostCertificate: encodePEM("CERTIFICATE", host.Raw),
+		FieldDeviceCertificate: encodePEM("CERTIFICATE", device.Raw),
+		FieldRootPrivateKey: encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rootKey)),
+		FieldHostPrivateKey: encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(hostKey)),
+		FieldDevicePublicKey: encodePEM("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&deviceKey.PublicKey)),
+		FieldHostID: testHostID,
+		FieldSystemBUID: testSystemBUID,
+		FieldWiFiMACAddress: "a4:83:e7:00:11:22",
+		FieldEscrowBag: []byte{1, 2, 3, 4},
+	}
+}
+
+func TestParse(t *testing.T) {
+	fields := testRecord(t)
+	record, err := Parse(encodeRecord(fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HostCertificate.Subject.CommonName != "Host" || record.DeviceCertificate.Subject.CommonName != "Device" || record.RootCertificate.Subject.CommonName != "Root" {
+		t.Errorf("certificates %s, %s, %s", record.HostCertificate.Subject, record.DeviceCertificate.Subject, record.RootCertificate.Subject)
+	}
+	if record.RootPrivateKey == nil || record.DevicePublicKey == nil || record.HostID != testHostID || record.SystemBUID != testSystemBUID || !bytes.Equal(record.EscrowBag, []byte{1, 2, 3, 4}) {
+		t.Errorf("record %+v", record)
+	}
+
+	tests := []struct {
+		name   string
+		field  string
+		value  interface{} // nil removes the field
+	}{
+		{"missing device certificate", FieldDeviceCertificate, nil},
+		{"missing host private key", FieldHostPrivateKey, nil},
+		{"certificate as a string", FieldHostCertificate, "certificate"},
+		{"malformed certificate", FieldRootCertificate, encodePEM("CERTIFICATE", []byte{0})},
+		{"private key without PEM", FieldHostPrivateKey, []byte("key")},
+		{"unknown private key type", FieldHostPrivateKey, encodePEM("DSA PRIVATE KEY", []byte{0})},
+		{"malformed root private key", FieldRootPrivateKey, encodePEM("RSA PRIVATE KEY", []byte{0})},
+		{"unknown public key type", FieldDevicePublicKey, encodePEM("CERTIFICATE", []byte{0})},
+		{"system BUID as data", FieldSystemBUID, []byte(testSystemBUID)},
+		{"escrow bag as a string", FieldEscrowBag, "bag"},
+	}
+
+	for _, test := range tests {
+		fields := testRecord(t)
+		if test.value == nil {
+			delete(fields, test.field)
+		} else {
+			fields[test.field] = test.value
+		}
+
+		_, err := Parse(encodeRecord(fields))
+		pairingErr, ok := err.(*PairingError)
+		if !ok {
+			t.Errorf("%s: error %v, expected a pairing error", test.name, err)
+		} else if pairingErr.Field != test.field {
+			t.Errorf("%s: error is for %s, expected %s", test.name, pairingErr.Field, test.field)
+		}
+	}
+
+	// Fields a record may leave out
+	delete(fields, FieldRootPrivateKey)
+	delete(fields, FieldDevicePublicKey)
+	delete(fields, FieldEscrowBag)
+	record, err = Parse(encodeRecord(fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RootPrivateKey != nil || record.DevicePublicKey != nil || record.EscrowBag != nil {
+		t.Errorf("record %+v", record)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	otherRoot, otherRootKey := issueCertificate(t, "Other root", true, nil, nil)
+	otherHost, _ := issueCertificate(t, "Host", false, otherRoot, otherRootKey)
+	notCA, _ := issueCertificate(t, "Root", false, nil, nil)
+	_, otherKey := issueCertificate(t, "Other key", false, otherRoot, otherRootKey)
+
+	valid := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		mutate func(record *PairingRecord)
+		now    time.Time
+		errors []string
+	}{
+		{"valid", func(record *PairingRecord) {}, valid, nil},
+		{"expired", func(record *PairingRecord) {}, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC), []string{FieldRootCertificate, FieldHostCertificate, FieldDeviceCertificate}},
+		{"not yet valid", func(record *PairingRecord) {}, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), []string{FieldRootCertificate, FieldHostCertificate, FieldDeviceCertificate}},
+		{"host from another root", func(record *PairingRecord) { record.HostCertificate = otherHost }, valid, []string{FieldHostCertificate, FieldHostPrivateKey}},
+		{"root is not a CA", func(record *PairingRecord) { record.RootCertificate = notCA }, valid, []string{FieldRootCertificate, FieldHostCertificate, FieldDeviceCertificate, FieldRootPrivateKey}},
+		{"other host private key", func(record *PairingRecord) { record.HostPrivateKey = otherKey }, valid, []string{FieldHostPrivateKey}},
+		{"other root private key", func(record *PairingRecord) { record.RootPrivateKey = otherKey }, valid, []string{FieldRootPrivateKey}},
+		{"other device public key", func(record *PairingRecord) { record.DevicePublicKey = otherKey.Public() }, valid, []string{FieldDevicePublicKey}},
+		{"no optional keys", func(record *PairingRecord) { record.RootPrivateKey, record.DevicePublicKey = nil, nil }, valid, nil},
+		{"missing host ID", func(record *PairingRecord) { record.HostID = "" }, valid, []string{FieldHostID}},
+		{"system BUID not a UUID", func(record *PairingRecord) { record.SystemBUID = "host" }, valid, []string{FieldSystemBUID}},
+	}
+
+	data := encodeRecord(testRecord(t))
+	for _, test := range tests {
+		record, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.mutate(record)
+
+		validation := record.Validate(test.now)
+		if len(validation.Errors) != len(test.errors) {
+			t.Errorf("%s: errors %v, expected %d", test.name, validation.Errors, len(test.errors))
+			continue
+		}
+		for index, err := range validation.Errors {
+			field := err.(*PairingError).Field
+			if field != test.errors[index] {
+				t.Errorf("%s: error %d is for %s, expected %s", test.name, index, field, test.errors[index])
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package plist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	BinaryTrailerSize = 32
+
+	// Nesting limit that stops reference cycles in malformed files
+	maxBinaryDepth = 512
+)
+
+// binaryEpoch is the reference date of binary plist dates
+var binaryEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type binaryDecoder struct {
+	data []byte
+	offsetSize int
+	referenceSize int
+	offsets []uint64
+}
+
+func readSized(data []byte, size int) uint64 {
+	result := uint64(0)
+	for _, value := range data[:size] {
+		result = (result << 8) | uint64(value)
+	}
+
+	return result
+}
+
+func unmarshalBinary(data []byte) (interface{}, error) {
+	if len(data) < len(BinaryMagic) + BinaryTrailerSize {
+		return nil, fmt.Errorf("not enough data for binary plist trailer")
+	}
+
+	trailer := data[(len(data) - BinaryTrailerSize):]
+	decoder := &binaryDecoder{
+		data:          data,
+		offsetSize:    int(trailer[6]),
+		referenceSize: int(trailer[7]),
+	}
+
+	objectCount := binary.BigEndian.Uint64(trailer[8:16])
+	rootObject := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+
+	if decoder.offsetSize < 1 || decoder.offsetSize > 8 || decoder.referenceSize < 1 || decoder.referenceSize > 8 {
+		return nil, fmt.Errorf("invalid binary plist integer sizes %d and %d", decoder.offsetSize, decoder.referenceSize)
+	}
+
+	tableEnd := tableOffset + (objectCount * uint64(decoder.offsetSize))
+	if objectCount > uint64(len(data)) || tableEnd > uint64(len(data) - BinaryTrailerSize) || tableEnd < tableOffset {
+		return nil, fmt.Errorf("binary plist offset table is out of bounds")
+	}
+
+	decoder.offsets = make([]uint64, objectCount)
+	for index := range decoder.offsets {
+		start := tableOffset + uint64(index * decoder.offsetSize)
+		decoder.offsets[index] = readSized(data[start:], decoder.offsetSize)
+	}
+
+	return decoder.object(rootObject, 0)
+}
+
+// length reads the size of a variable length object, which may spill into a following integer
+func (decoder *binaryDecoder) length(marker byte, offset uint64) (uint64, uint64, error) {
+	length := uint64(marker & 0x0f)
+	offset++
+	if length != 0x0f {
+		return length, offset, nil
+	}
+
+	if offset >= uint64(len(decoder.data)) || decoder.data[offset] & 0xf0 != 0x10 {
+		return 0, 0, fmt.Errorf("invalid length at offset %d", offset)
+	}
+
+	size := uint64(1) << (decoder.data[offset] & 0x0f)
+	if size > 8 || offset + 1 + size > uint64(len(decoder.data)) {
+		return 0, 0, fmt.Errorf("invalid length at offset %d", offset)
+	}
+
+	return readSized(decoder.data[(offset + 1):], int(size)), offset + 1 + size, nil
+}
+
+func (decoder *binaryDecoder) bytes(offset uint64, length uint64) ([]byte, error) {
+	if offset + length > uint64(len(decoder.data)) || offset + length < offset {
+		return nil, fmt.Errorf("object at offset %d is out of bounds", offset)
+	}
+
+	return decoder.data[offset:(offset + length)], nil
+}
+
+func (decoder *binaryDecoder) references(offset uint64, count uint64) ([]uint64, error) {
+	if count > uint64(len(decoder.data)) {
+		return nil, fmt.Errorf("reference count %d at offset %d is out of bounds", count, offset)
+	}
+
+	raw, err := decoder.bytes(offset, count * uint64(decoder.referenceSize))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]uint64, count)
+	for index := range result {
+		result[index] = readSized(raw[(index * decoder.referenceSize):], decoder.referenceSize)
+	}
+
+	return result, nil
+}
+
+func (decoder *binaryDecoder) object(reference uint64, depth int) (interface{}, error) {
+	if depth > maxBinaryDepth {
+		return nil, fmt.Errorf("binary plist nested too deeply")
+	}
+
+	if reference >= uint64(len(decoder.offsets)) {
+		return nil, fmt.Errorf("object reference %d is out of bounds", reference)
+	}
+
+	offset := decoder.offsets[reference]
+	if offset >= uint64(len(decoder.data)) {
+		return nil, fmt.Errorf("object %d offset %d is out of bounds", reference, offset)
+	}
+
+	marker := decoder.data[offset]
+	switch marker >> 4 {
+	case 0x0:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+		return nil, nil
+
+	case 0x1:
+		size := uint64(1) << (marker & 0x0f)
+		raw, err := decoder.bytes(offset + 1, size)
+		if err != nil {
+			return nil, err
+		}
+
+		switch size {
+		case 8:
+			return int64(binary.BigEndian.Uint64(raw)), nil
+		case 16:
+			if binary.BigEndian.Uint64(raw[0:8]) != 0 {
+				return nil, fmt.Errorf("integer at offset %d does not fit in 64 bits", offset)
+			}
+			return binary.BigEndian.Uint64(raw[8:16]), nil
+		}
+		if size > 16 {
+			return nil, fmt.Errorf("integer at offset %d has invalid size %d", offset, size)
+		}
+		return int64(readSized(raw, int(size))), nil
+
+	case 0x2:
+		size := uint64(1) << (marker & 0x0f)
+		raw, err := decoder.bytes(offset + 1, size)
+		if err != nil {
+			return nil, err
+		}
+
+		switch size {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(raw)), nil
+		}
+		return nil, fmt.Errorf("real at offset %d has invalid size %d", offset, size)
+
+	case 0x3:
+		raw, err := decoder.bytes(offset + 1, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		seconds := math.Float64frombits(binary.BigEndian.Uint64(raw))
+		return binaryEpoch.Add(time.Duration(seconds * float64(time.Second))), nil
+
+	case 0x4, 0x5, 0x6:
+		length, start, err := decoder.length(marker, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if marker >> 4 == 0x6 {
+			if length > uint64(len(decoder.data)) {
+				return nil, fmt.Errorf("string at offset %d is out of bounds", offset)
+			}
+
+			raw, err := decoder.bytes(start, length * 2)
+			if err != nil {
+				return nil, err
+			}
+
+			units := make([]uint16, length)
+			for index := range units {
+				units[index] = binary.BigEndian.Uint16(raw[(index * 2):])
+			}
+			return string(utf16.Decode(units)), nil
+		}
+
+		raw, err := decoder.bytes(start, length)
+		if err != nil {
+			return nil, err
+		}
+		if marker >> 4 == 0x4 {
+			return append([]byte{}, raw...), nil
+		}
+		return string(raw), nil
+
+	case 0x8:
+		size := uint64(marker & 0x0f) + 1
+		raw, err := decoder.bytes(offset + 1, size)
+		if err != nil {
+			return nil, err
+		}
+		return UID(readSized(raw, int(size))), nil
+
+	case 0xa, 0xc:
+		count, start, err := decoder.length(marker, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		references, err := decoder.references(start, count)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]interface{}, count)
+		for index, child := range references {
+			result[index], err = decoder.object(child, depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+
+	case 0xd:
+		count, start, err := decoder.length(marker, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		references, err := decoder.references(start, count * 2)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make(map[string]interface{}, count)
+		for index := uint64(0); index < count; index++ {
+			key, err := decoder.object(references[index], depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key at offset %d is %T, not a string", offset, key)
+			}
+
+			result[keyString], err = decoder.object(references[count + index], depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("unknown object marker 0x%02x at offset %d", marker, offset)
+}
@@ -0,0 +1,301 @@
+package plist
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	byteOrderMark = "\ufeff"
+
+	// Nesting limit for OpenStep plists, matching binary plists
+	maxOpenStepDepth = maxBinaryDepth
+)
+
+// openStepDecoder reads the OpenStep (ASCII) format, where dictionaries are { key = value; },
+// arrays are ( value, ), data is <hex> and every scalar is a string
+type openStepDecoder struct {
+	data []byte
+	offset int
+}
+
+// isOpenStep reports whether data starts like an OpenStep plist rather than XML
+func isOpenStep(data []byte) bool {
+	text := strings.TrimLeft(strings.TrimPrefix(string(data), byteOrderMark), " \t\r\n")
+	return strings.HasPrefix(text, "{") || strings.HasPrefix(text, "(") || strings.HasPrefix(text, "\"")
+}
+
+func unmarshalOpenStep(data []byte) (interface{}, error) {
+	decoder := &openStepDecoder{data: data}
+	if strings.HasPrefix(string(data), byteOrderMark) {
+		decoder.offset = len(byteOrderMark)
+	}
+
+	result, err := decoder.value(0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.skipSpace()
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(data) {
+		return nil, decoder.errorf("trailing data")
+	}
+
+	return result, nil
+}
+
+func (decoder *openStepDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("openstep plist offset %d: %s", decoder.offset, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips whitespace and comments
+func (decoder *openStepDecoder) skipSpace() error {
+	for decoder.offset < len(decoder.data) {
+		rest := decoder.data[decoder.offset:]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r' || rest[0] == '\n':
+			decoder.offset++
+		case strings.HasPrefix(string(rest), "//"):
+			end := strings.IndexByte(string(rest), '\n')
+			if end < 0 {
+				decoder.offset = len(decoder.data)
+			} else {
+				decoder.offset += end + 1
+			}
+		case strings.HasPrefix(string(rest), "/*"):
+			end := strings.Index(string(rest[2:]), "*/")
+			if end < 0 {
+				return decoder.errorf("unterminated comment")
+			}
+			decoder.offset += end + 4
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// next skips space and returns the next character without consuming it
+func (decoder *openStepDecoder) next() (byte, error) {
+	err := decoder.skipSpace()
+	if err != nil {
+		return 0, err
+	}
+	if decoder.offset >= len(decoder.data) {
+		return 0, decoder.errorf("unexpected end of data")
+	}
+
+	return decoder.data[decoder.offset], nil
+}
+
+func (decoder *openStepDecoder) expect(character byte) error {
+	next, err := decoder.next()
+	if err != nil {
+		return err
+	}
+	if next != character {
+		return decoder.errorf("expected %q, got %q", character, next)
+	}
+
+	decoder.offset++
+	return nil
+}
+
+func (decoder *openStepDecoder) value(depth int) (interface{}, error) {
+	if depth > maxOpenStepDepth {
+		return nil, decoder.errorf("nested too deeply")
+	}
+
+	next, err := decoder.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch next {
+	case '{':
+		return decoder.dictionary(depth)
+	case '(':
+		return decoder.array(depth)
+	case '<':
+		return decoder.hexData()
+	case '"':
+		return decoder.quotedString()
+	default:
+		return decoder.unquotedString()
+	}
+}
+
+func (decoder *openStepDecoder) dictionary(depth int) (interface{}, error) {
+	decoder.offset++
+	result := make(map[string]interface{})
+	for {
+		next, err := decoder.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == '}' {
+			decoder.offset++
+			return result, nil
+		}
+
+		key, err := decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		keyString, ok := key.(string)
+		if !ok {
+			return nil, decoder.errorf("dictionary key is %T, not a string", key)
+		}
+
+		err = decoder.expect('=')
+		if err != nil {
+			return nil, err
+		}
+
+		result[keyString], err = decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		err = decoder.expect(';')
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (decoder *openStepDecoder) array(depth int) (interface{}, error) {
+	decoder.offset++
+	result := make([]interface{}, 0)
+	for {
+		next, err := decoder.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == ')' {
+			decoder.offset++
+			return result, nil
+		}
+
+		value, err := decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+
+		next, err = decoder.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == ',' {
+			decoder.offset++
+		} else if next != ')' {
+			return nil, decoder.errorf("expected ',' or ')', got %q", next)
+		}
+	}
+}
+
+func (decoder *openStepDecoder) hexData() (interface{}, error) {
+	decoder.offset++
+	end := strings.IndexByte(string(decoder.data[decoder.offset:]), '>')
+	if end < 0 {
+		return nil, decoder.errorf("unterminated data")
+	}
+
+	digits := strings.Map(func(character rune) rune {
+		if character == ' ' || character == '\t' || character == '\n' || character == '\r' {
+			return -1
+		}
+		return character
+	}, string(decoder.data[decoder.offset:decoder.offset + end]))
+
+	result, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, decoder.errorf("data: %s", err)
+	}
+
+	decoder.offset += end + 1
+	return result, nil
+}
+
+func isUnquotedCharacter(character byte) bool {
+	return (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z') ||
+		(character >= '0' && character <= '9') || strings.IndexByte("_$+/:.-", character) >= 0
+}
+
+func (decoder *openStepDecoder) unquotedString() (interface{}, error) {
+	start := decoder.offset
+	for decoder.offset < len(decoder.data) && isUnquotedCharacter(decoder.data[decoder.offset]) {
+		decoder.offset++
+	}
+	if decoder.offset == start {
+		return nil, decoder.errorf("unexpected %q", decoder.data[start])
+	}
+
+	return string(decoder.data[start:decoder.offset]), nil
+}
+
+func (decoder *openStepDecoder) quotedString() (interface{}, error) {
+	decoder.offset++
+	var builder strings.Builder
+	for decoder.offset < len(decoder.data) {
+		character := decoder.data[decoder.offset]
+		decoder.offset++
+
+		switch character {
+		case '"':
+			return builder.String(), nil
+
+		case '\\':
+			if decoder.offset >= len(decoder.data) {
+				return nil, decoder.errorf("unterminated escape")
+			}
+			escape := decoder.data[decoder.offset]
+			decoder.offset++
+
+			switch escape {
+			case 'a': builder.WriteByte('\a')
+			case 'b': builder.WriteByte('\b')
+			case 'f': builder.WriteByte('\f')
+			case 'n': builder.WriteByte('\n')
+			case 'r': builder.WriteByte('\r')
+			case 't': builder.WriteByte('\t')
+			case 'v': builder.WriteByte('\v')
+			case 'U', 'u':
+				if decoder.offset + 4 > len(decoder.data) {
+					return nil, decoder.errorf("short unicode escape")
+				}
+				value, err := strconv.ParseUint(string(decoder.data[decoder.offset:decoder.offset + 4]), 16, 16)
+				if err != nil {
+					return nil, decoder.errorf("unicode escape: %s", err)
+				}
+				builder.WriteRune(rune(value))
+				decoder.offset += 4
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				value := int(escape - '0')
+				for count := 1; count < 3 && decoder.offset < len(decoder.data); count++ {
+					digit := decoder.data[decoder.offset]
+					if digit < '0' || digit > '7' {
+						break
+					}
+					value = value * 8 + int(digit - '0')
+					decoder.offset++
+				}
+				builder.WriteRune(rune(value))
+			default:
+				builder.WriteByte(escape)
+			}
+
+		default:
+			builder.WriteByte(character)
+		}
+	}
+
+	return nil, decoder.errorf("unterminated string")
+}
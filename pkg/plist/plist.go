@@ -0,0 +1,207 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values decode to map[string]interface{}, []interface{}, string, []byte, int64,
+// uint64 (integers above the int64 range), float64, bool, time.Time and UID. OpenStep
+// plists only have dictionaries, arrays, strings and data.
+
+const (
+	BinaryMagic = "bplist00"
+	XMLMagic = "<?xml"
+)
+
+// UID is a keyed archiver object reference, only found in binary plists
+type UID uint64
+
+// Unmarshal decodes an XML, binary or OpenStep property list
+func Unmarshal(data []byte) (interface{}, error) {
+	if bytes.HasPrefix(data, []byte(BinaryMagic)) {
+		return unmarshalBinary(data)
+	}
+	if isOpenStep(data) {
+		return unmarshalOpenStep(data)
+	}
+
+	return unmarshalXML(data)
+}
+
+// Dictionary decodes a property list whose root must be a dictionary
+func Dictionary(data []byte) (map[string]interface{}, error) {
+	root, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("plist root is %T, not a dictionary", root)
+	}
+
+	return result, nil
+}
+
+func unmarshalXML(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("plist has no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if start.Name.Local == "plist" {
+			continue
+		}
+
+		return decodeXMLValue(decoder, start)
+	}
+}
+
+// textContent collects the character data of the current element up to its end tag
+func textContent(decoder *xml.Decoder) (string, error) {
+	var builder strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch value := token.(type) {
+		case xml.CharData:
+			builder.Write(value)
+		case xml.EndElement:
+			return builder.String(), nil
+		case xml.StartElement:
+			return "", fmt.Errorf("unexpected element <%s> in text", value.Name.Local)
+		}
+	}
+}
+
+// nextElement returns the next start element, or nil when the enclosing element ends
+func nextElement(decoder *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch value := token.(type) {
+		case xml.StartElement:
+			return &value, nil
+		case xml.EndElement:
+			return nil, nil
+		}
+	}
+}
+
+func decodeXMLValue(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		result := make(map[string]interface{})
+		for {
+			keyElement, err := nextElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if keyElement == nil {
+				return result, nil
+			}
+			if keyElement.Name.Local != "key" {
+				return nil, fmt.Errorf("expected <key> in dict, got <%s>", keyElement.Name.Local)
+			}
+
+			key, err := textContent(decoder)
+			if err != nil {
+				return nil, err
+			}
+
+			valueElement, err := nextElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if valueElement == nil {
+				return nil, fmt.Errorf("dict key %s has no value", key)
+			}
+
+			result[key], err = decodeXMLValue(decoder, *valueElement)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case "array":
+		result := make([]interface{}, 0)
+		for {
+			element, err := nextElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if element == nil {
+				return result, nil
+			}
+
+			value, err := decodeXMLValue(decoder, *element)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+
+	case "true", "false":
+		err := decoder.Skip()
+		return start.Name.Local == "true", err
+	}
+
+	text, err := textContent(decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+
+	case "data":
+		cleaned := strings.Map(func(character rune) rune {
+			if character == ' ' || character == '\t' || character == '\n' || character == '\r' {
+				return -1
+			}
+			return character
+		}, text)
+		return base64.StdEncoding.DecodeString(cleaned)
+
+	case "integer":
+		text = strings.TrimSpace(text)
+		if value, err := strconv.ParseInt(text, 0, 64); err == nil {
+			return value, nil
+		}
+		return strconv.ParseUint(text, 0, 64)
+
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(text))
+	}
+
+	return nil, fmt.Errorf("unknown plist element <%s>", start.Name.Local)
+}
@@ -0,0 +1,242 @@
+package seal
+
+import (
+	"crypto/x509"
+	"fmt"
+	"go-aapl-integrity/pkg/apfs"
+	"go-aapl-integrity/pkg/img4"
+	"io"
+)
+
+const (
+	StepManifest = "manifest"
+	StepRootHash = "root hash"
+	StepVolume = "volume"
+	StepIntegrity = "integrity metadata"
+	StepTree = "file-system tree"
+	StepFileData = "file data"
+)
+
+// SealError reports the step of seal verification that failed
+type SealError struct {
+	Step string
+	Err error
+}
+
+func (err *SealError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Step, err.Err)
+}
+
+func (err *SealError) Unwrap() error {
+	return err.Err
+}
+
+func stepError(step string, format string, args ...interface{}) error {
+	return &SealError{Step: step, Err: fmt.Errorf(format, args...)}
+}
+
+type Options struct {
+	Roots *x509.CertPool // the manifest chain is only checked when set
+	Volume string // name of the volume to check, the first sealed one when empty
+	Snapshot string // name of the snapshot to check, the newest when empty
+	Full bool // also check the Merkle tree of the file-system tree and the file data hashes
+}
+
+// Verification is the outcome of checking a sealed system volume against its signed root hash
+type Verification struct {
+	Payload *img4.Image4Payload
+	Manifest *img4.Image4Manifest
+	RootHash *apfs.RootHash
+	ChainVerified bool
+	Volume *apfs.Volume // as of the snapshot that was checked, nil without an image
+	Integrity *apfs.IntegrityMetadata
+	Slot int // index of the root hash slot the volume matched, -1 when none did
+	NodesVerified int
+	FileHashesVerified int
+	Errors []error
+}
+
+func (verification *Verification) Valid() bool {
+	return len(verification.Errors) == 0
+}
+
+func (verification *Verification) add(step string, format string, args ...interface{}) {
+	verification.Errors = append(verification.Errors, stepError(step, format, args...))
+}
+
+// verifyManifest checks the manifest signs the root hash IM4P
+func (verification *Verification) verifyManifest(payloadData []byte, manifestData []byte, roots *x509.CertPool) {
+	image, err := img4.Parse(manifestData)
+	if err != nil {
+		verification.add(StepManifest, "%s", err)
+		return
+	}
+	if image.Manifest == nil {
+		verification.add(StepManifest, "not a manifest")
+		return
+	}
+	verification.Manifest = image.Manifest
+
+	body, err := image.Manifest.ParseBody()
+	if err != nil {
+		verification.add(StepManifest, "%s", err)
+		return
+	}
+
+	err = image.Manifest.VerifySignature()
+	if err != nil {
+		verification.add(StepManifest, "%s", err)
+	}
+
+	err = image.Manifest.VerifyConstraints(body)
+	if err != nil {
+		verification.add(StepManifest, "%s", err)
+	}
+
+	if roots != nil {
+		err = image.Manifest.VerifyCertificates(roots)
+		if err != nil {
+			verification.add(StepManifest, "%s", err)
+		} else {
+			verification.ChainVerified = true
+		}
+	}
+
+	err = body.VerifyDigest(verification.Payload.Name, payloadData)
+	if err != nil {
+		verification.add(StepManifest, "%s", err)
+	}
+}
+
+// selectVolume picks the named volume, or the first sealed one
+func selectVolume(container *apfs.Container, name string) (*apfs.Volume, error) {
+	volumes, err := container.Volumes()
+	if err != nil { return nil, err }
+
+	for _, volume := range volumes {
+		if name != "" && volume.Name == name {
+			return volume, nil
+		}
+		if name == "" && volume.Sealed() {
+			return volume, nil
+		}
+	}
+
+	if name != "" {
+		return nil, fmt.Errorf("no volume named %s", name)
+	}
+	return nil, fmt.Errorf("no sealed volume")
+}
+
+// selectSnapshot returns the volume as of the named snapshot, or the newest one. A volume
+// without snapshots is checked as it is.
+func selectSnapshot(volume *apfs.Volume, name string) (*apfs.Volume, error) {
+	snapshots, err := volume.Snapshots()
+	if err != nil { return nil, err }
+
+	var selected *apfs.Snapshot
+	for _, snapshot := range snapshots {
+		if name != "" && snapshot.Name == name {
+			selected = snapshot
+		}
+		if name == "" && (selected == nil || snapshot.XID > selected.XID) {
+			selected = snapshot
+		}
+	}
+
+	if selected == nil {
+		if name != "" {
+			return nil, fmt.Errorf("no snapshot named %s", name)
+		}
+		return volume, nil
+	}
+
+	return volume.AtSnapshot(selected)
+}
+
+// verifyImage checks the volume's integrity metadata holds a root hash the payload signs for
+func (verification *Verification) verifyImage(image io.ReaderAt, options *Options) {
+	container, err := apfs.Open(image)
+	if err != nil {
+		verification.add(StepVolume, "%s", err)
+		return
+	}
+
+	volume, err := selectVolume(container, options.Volume)
+	if err != nil {
+		verification.add(StepVolume, "%s", err)
+		return
+	}
+
+	snapshot, err := selectSnapshot(volume, options.Snapshot)
+	if err != nil {
+		verification.add(StepVolume, "%s: %s", volume.Name, err)
+		return
+	}
+	volume = snapshot
+	verification.Volume = volume
+
+	integrity, err := volume.IntegrityMetadata()
+	if err != nil {
+		verification.add(StepIntegrity, "%s", err)
+		return
+	}
+	verification.Integrity = integrity
+
+	if integrity.Flags & apfs.IntegrityFlagSealBroken != 0 {
+		verification.add(StepIntegrity, "seal was broken by xid %d", integrity.BrokenXID)
+	}
+
+	if verification.RootHash != nil {
+		verification.Slot = verification.RootHash.Match(integrity.HashType, integrity.RootHash)
+		if verification.Slot < 0 {
+			verification.add(StepIntegrity, "%s root hash %x is not signed", apfs.HashTypeName(integrity.HashType), integrity.RootHash)
+		}
+	}
+
+	if options.Full {
+		verification.NodesVerified, err = volume.VerifyRootTree(integrity)
+		if err != nil {
+			verification.add(StepTree, "%s", err)
+		}
+
+		var errors []error
+		verification.FileHashesVerified, errors = volume.VerifyFileData(integrity)
+		for _, err := range errors {
+			verification.add(StepFileData, "%s", err)
+		}
+	}
+}
+
+// Verify checks a root hash IM4P against its manifest and, when an image of the APFS container
+// is given, that the sealed volume in it carries a root hash the payload signs for
+func Verify(payloadData []byte, manifestData []byte, image io.ReaderAt, options *Options) *Verification {
+	if options == nil {
+		options = &Options{}
+	}
+
+	result := &Verification{Slot: -1, Errors: make([]error, 0)}
+	payload, err := img4.Parse(payloadData)
+	if err != nil {
+		result.add(StepRootHash, "%s", err)
+		return result
+	}
+	if payload.Payload == nil || payload.Type != img4.Image4TypePayload {
+		result.add(StepRootHash, "not a bare payload")
+		return result
+	}
+	result.Payload = payload.Payload
+
+	result.verifyManifest(payloadData, manifestData, options.Roots)
+
+	result.RootHash, err = apfs.ParseRootHash(payload.Payload.Data)
+	if err != nil {
+		result.add(StepRootHash, "%s", err)
+	}
+
+	if image != nil {
+		result.verifyImage(image, options)
+	}
+
+	return result
+}
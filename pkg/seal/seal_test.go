@@ -0,0 +1,69 @@
+package seal
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestVerifyManifest(t *testing.T) {
+	payload := readFixture(t, "OS.dmg.root_hash.im4p")
+	manifest := readFixture(t, "OS.dmg.root_hash.j132ap.im4m")
+
+	tamperedPayload := append([]byte{}, payload...)
+	tamperedPayload[len(tamperedPayload) - 1] ^= 1
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		manifest []byte
+		options  *Options
+		steps    []string // of the expected errors
+	}{
+		{"signed", payload, manifest, nil, nil},
+		{"tampered payload", tamperedPayload, manifest, nil, []string{StepManifest}},
+		{"manifest as payload", manifest, manifest, nil, []string{StepRootHash}},
+		{"payload as manifest", payload, payload, nil, []string{StepManifest}},
+		{"no roots for the chain", payload, manifest, &Options{Roots: x509.NewCertPool()}, []string{StepManifest}},
+	}
+
+	for _, test := range tests {
+		verification := Verify(test.payload, test.manifest, nil, test.options)
+		if len(verification.Errors) != len(test.steps) {
+			t.Errorf("%s: errors %v, expected %d", test.name, verification.Errors, len(test.steps))
+			continue
+		}
+		for index, err := range verification.Errors {
+			if step := err.(*SealError).Step; step != test.steps[index] {
+				t.Errorf("%s: error %d is for %s, expected %s", test.name, index, step, test.steps[index])
+			}
+		}
+		if verification.ChainVerified {
+			t.Errorf("%s: chain verified without the Apple root", test.name)
+		}
+	}
+}
+
+func TestVerifyRootHash(t *testing.T) {
+	verification := Verify(readFixture(t, "OS.dmg.root_hash.im4p"), readFixture(t, "OS.dmg.root_hash.j132ap.im4m"), nil, nil)
+	if !verification.Valid() {
+		t.Fatalf("errors %v", verification.Errors)
+	}
+
+	rootHash := verification.RootHash
+	if rootHash == nil || rootHash.Version != 2 || len(rootHash.Hashes) != 3 {
+		t.Fatalf("root hash %+v, expected version 2 with 3 hashes", rootHash)
+	}
+	if verification.Volume != nil || verification.Slot != -1 {
+		t.Errorf("volume %v slot %d without an image", verification.Volume, verification.Slot)
+	}
+}
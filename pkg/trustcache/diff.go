@@ -0,0 +1,82 @@
+package trustcache
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+type EntryChange struct {
+	Old Entry
+	New Entry
+}
+
+type Diff struct {
+	Added []Entry
+	Removed []Entry
+	Changed []EntryChange
+}
+
+// entryKey identifies an entry by its CDHash, which is unique within a trust cache
+func entryKey(entry Entry) string {
+	return hex.EncodeToString(entry.GetHash().Data)
+}
+
+func indexEntries(cache *TrustCache) map[string]Entry {
+	result := make(map[string]Entry, len(cache.Entries))
+	for _, entry := range cache.Entries {
+		result[entryKey(entry)] = entry
+	}
+
+	return result
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entryKey(entries[i]) < entryKey(entries[j])
+	})
+}
+
+// IsEmpty reports whether the two trust caches had identical entries
+func (diff *Diff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+// Compare reports the entries added, removed and modified between two trust caches
+func Compare(oldCache *TrustCache, newCache *TrustCache) *Diff {
+	result := &Diff{
+		Added:   make([]Entry, 0),
+		Removed: make([]Entry, 0),
+		Changed: make([]EntryChange, 0),
+	}
+
+	oldEntries := indexEntries(oldCache)
+	newEntries := indexEntries(newCache)
+
+	for key, oldEntry := range oldEntries {
+		newEntry, ok := newEntries[key]
+		if !ok {
+			result.Removed = append(result.Removed, oldEntry)
+			continue
+		}
+
+		if oldEntry.GetType() != newEntry.GetType() ||
+			oldEntry.GetFlags() != newEntry.GetFlags() ||
+			oldEntry.GetCategory() != newEntry.GetCategory() {
+			result.Changed = append(result.Changed, EntryChange{Old: oldEntry, New: newEntry})
+		}
+	}
+
+	for key, newEntry := range newEntries {
+		if _, ok := oldEntries[key]; !ok {
+			result.Added = append(result.Added, newEntry)
+		}
+	}
+
+	sortEntries(result.Added)
+	sortEntries(result.Removed)
+	sort.Slice(result.Changed, func(i, j int) bool {
+		return entryKey(result.Changed[i].Old) < entryKey(result.Changed[j].Old)
+	})
+
+	return result
+}
@@ -0,0 +1,66 @@
+package trustcache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	entry := func(value byte, hashType uint8, flags uint8) Entry {
+		result := &Rev1Entry{HashType: hashType, Flags: flags}
+		copy(result.HashData[:], testHash(value))
+		return result
+	}
+	cache := func(entries ...Entry) *TrustCache {
+		return &TrustCache{Version: TrustCacheV1, Count: uint32(len(entries)), Entries: entries}
+	}
+
+	tests := []struct {
+		name    string
+		old     *TrustCache
+		new     *TrustCache
+		added   []byte
+		removed []byte
+		changed []byte
+	}{
+		{"identical", cache(entry(1, 2, 0), entry(2, 2, 0)), cache(entry(2, 2, 0), entry(1, 2, 0)), nil, nil, nil},
+		{"added", cache(entry(1, 2, 0)), cache(entry(3, 2, 0), entry(1, 2, 0), entry(2, 2, 0)), []byte{2, 3}, nil, nil},
+		{"removed", cache(entry(2, 2, 0), entry(1, 2, 0)), cache(), nil, []byte{1, 2}, nil},
+		{"hash type changed", cache(entry(1, 2, 0)), cache(entry(1, 1, 0)), nil, nil, []byte{1}},
+		{"flags changed", cache(entry(1, 2, 0), entry(2, 2, 0)), cache(entry(1, 2, 0), entry(2, 2, FlagAMFI)), nil, nil, []byte{2}},
+		{"mixed", cache(entry(1, 2, 0), entry(2, 2, 0)), cache(entry(2, 2, FlagANE), entry(3, 2, 0)), []byte{3}, []byte{1}, []byte{2}},
+	}
+
+	hashValues := func(entries []Entry) []byte {
+		result := make([]byte, 0)
+		for _, entry := range entries {
+			result = append(result, entry.GetHash().Data[0])
+		}
+		return result
+	}
+
+	for _, test := range tests {
+		diff := Compare(test.old, test.new)
+
+		changed := make([]Entry, len(diff.Changed))
+		for index, change := range diff.Changed {
+			changed[index] = change.New
+			if !bytes.Equal(change.Old.GetHash().Data, change.New.GetHash().Data) {
+				t.Errorf("%s: change %d pairs different hashes", test.name, index)
+			}
+		}
+
+		if added := hashValues(diff.Added); !bytes.Equal(added, test.added) {
+			t.Errorf("%s: added %v, expected %v", test.name, added, test.added)
+		}
+		if removed := hashValues(diff.Removed); !bytes.Equal(removed, test.removed) {
+			t.Errorf("%s: removed %v, expected %v", test.name, removed, test.removed)
+		}
+		if values := hashValues(changed); !bytes.Equal(values, test.changed) {
+			t.Errorf("%s: changed %v, expected %v", test.name, values, test.changed)
+		}
+		if diff.IsEmpty() != (len(test.added) + len(test.removed) + len(test.changed) == 0) {
+			t.Errorf("%s: IsEmpty is %t", test.name, diff.IsEmpty())
+		}
+	}
+}
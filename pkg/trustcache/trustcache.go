@@ -1,9 +1,11 @@
 package trustcache
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/google/uuid"
 	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/img4"
 	"encoding/binary"
 )
 
@@ -14,16 +16,24 @@ const (
 	TrustCacheV1 = 1
 	TrustCacheV1HeaderSize = 24
 	TrustCacheV1EntrySize = core.HashSHA1Size + 2
+	TrustCacheV2 = 2
+	TrustCacheV2HeaderSize = 24
+	TrustCacheV2EntrySize = core.HashSHA1Size + 4
 
-	HashLength = 20
+	HashLength = core.CDHashSize
 
 	FlagAMFI = 0x01
+	FlagANE = 0x02
 )
 
+// Image4 payload types that carry a trust cache
+var PayloadTypes = []string{"trst", "ltrs", "rtsc"}
+
 type Entry interface {
-	getHash() *core.TypedHash
-	getType() int
-	getFlags() int
+	GetHash() *core.TypedHash
+	GetType() int
+	GetFlags() int
+	GetCategory() int
 }
 
 type TrustCache struct {
@@ -37,7 +47,7 @@ type Rev0Entry struct {
 	HashData [HashLength]byte
 }
 
-func (entry Rev0Entry) getHash() *core.TypedHash {
+func (entry Rev0Entry) GetHash() *core.TypedHash {
 	return &core.TypedHash{
 		Type: core.HashSHA1,
 		Data: entry.HashData[:],
@@ -50,31 +60,105 @@ type Rev1Entry struct {
 	Flags uint8
 }
 
-func (entry Rev1Entry) getHash() *core.TypedHash {
+func (entry Rev1Entry) GetHash() *core.TypedHash {
 	return &core.TypedHash{
 		Type: int(entry.HashType),
 		Data: entry.HashData[:],
 	}
 }
 
-func (entry Rev0Entry) getType() int {
+func (entry Rev0Entry) GetType() int {
 	return core.HashSHA1
 }
 
-func (entry Rev0Entry) getFlags() int {
+func (entry Rev0Entry) GetFlags() int {
 	return FlagAMFI
 }
 
-func (entry Rev1Entry) getType() int {
+func (entry Rev1Entry) GetType() int {
+	return int(entry.HashType)
+}
+
+func (entry Rev1Entry) GetFlags() int {
+	return int(entry.Flags)
+}
+
+func (entry Rev0Entry) GetCategory() int {
+	return 0
+}
+
+func (entry Rev1Entry) GetCategory() int {
+	return 0
+}
+
+type Rev2Entry struct {
+	HashData [HashLength]byte
+	HashType uint8
+	Flags uint8
+	Category uint8
+}
+
+func (entry Rev2Entry) GetHash() *core.TypedHash {
+	return &core.TypedHash{
+		Type: int(entry.HashType),
+		Data: entry.HashData[:],
+	}
+}
+
+func (entry Rev2Entry) GetType() int {
 	return int(entry.HashType)
 }
 
-func (entry Rev1Entry) getFlags() int {
+func (entry Rev2Entry) GetFlags() int {
 	return int(entry.Flags)
 }
 
-func parse(data []byte) (*TrustCache, error) {
-	if len(data) < 24 { return nil, fmt.Errorf("not enough data for header") }
+func (entry Rev2Entry) GetCategory() int {
+	return int(entry.Category)
+}
+
+// FlagNames returns the names of the flags set on an entry
+func FlagNames(flags int) []string {
+	names := make([]string, 0)
+	if flags & FlagAMFI != 0 {
+		names = append(names, "amfi")
+	}
+	if flags & FlagANE != 0 {
+		names = append(names, "ane")
+	}
+	if unknown := flags &^ (FlagAMFI | FlagANE); unknown != 0 {
+		names = append(names, fmt.Sprintf("0x%02x", unknown))
+	}
+
+	return names
+}
+
+// ModuleSize returns the encoded size of the trust cache whose header starts data
+func ModuleSize(data []byte) (int, error) {
+	if len(data) < 24 { return 0, fmt.Errorf("not enough data for header") }
+
+	version := binary.LittleEndian.Uint32(data[0:4])
+	count := int64(binary.LittleEndian.Uint32(data[20:24]))
+
+	switch version {
+	case TrustCacheV0:
+		return int(TrustCacheV0HeaderSize + (count * TrustCacheV0EntrySize)), nil
+	case TrustCacheV1:
+		return int(TrustCacheV1HeaderSize + (count * TrustCacheV1EntrySize)), nil
+	case TrustCacheV2:
+		return int(TrustCacheV2HeaderSize + (count * TrustCacheV2EntrySize)), nil
+	}
+
+	return 0, fmt.Errorf("invalid trustcache version %d", version)
+}
+
+// Parse decodes a raw (unwrapped) trust cache
+func Parse(data []byte) (*TrustCache, error) {
+	expectedSize, err := ModuleSize(data)
+	if err != nil { return nil, err }
+	if len(data) != expectedSize {
+		return nil, fmt.Errorf("data size %d does not match expected size %d", len(data), expectedSize)
+	}
 
 	version := binary.LittleEndian.Uint32(data[0:4])
 	count := binary.LittleEndian.Uint32(data[20:24])
@@ -86,12 +170,7 @@ func parse(data []byte) (*TrustCache, error) {
 
 	switch version {
 	case TrustCacheV0:
-		expectedSize := int(TrustCacheV0HeaderSize + (count * TrustCacheV0EntrySize))
-		if len(data) != expectedSize {
-			return nil, fmt.Errorf("data size %d does not match expected size %d", len(data), expectedSize)
-		}
-
-		for index, _ := range entries {
+		for index := range entries {
 			start := TrustCacheV0HeaderSize + (index * TrustCacheV0EntrySize)
 
 			entry := &Rev0Entry{}
@@ -102,12 +181,7 @@ func parse(data []byte) (*TrustCache, error) {
 		}
 
 	case TrustCacheV1:
-		expectedSize := int(TrustCacheV1HeaderSize + (count * TrustCacheV1EntrySize))
-		if len(data) != expectedSize {
-			return nil, fmt.Errorf("data size %d does not match expected size %d", len(data), expectedSize)
-		}
-
-		for index, _ := range entries {
+		for index := range entries {
 			start := TrustCacheV1HeaderSize + (index * TrustCacheV1EntrySize)
 
 			entry := &Rev1Entry{
@@ -120,8 +194,20 @@ func parse(data []byte) (*TrustCache, error) {
 			entries[index] = entry
 		}
 
-	default:
-		return nil, fmt.Errorf("invalid trustcache version %d", version)
+	case TrustCacheV2:
+		for index := range entries {
+			start := TrustCacheV2HeaderSize + (index * TrustCacheV2EntrySize)
+
+			entry := &Rev2Entry{
+				HashType: data[(start + core.HashSHA1Size)],
+				Flags: data[(start + core.HashSHA1Size + 1)],
+				Category: data[(start + core.HashSHA1Size + 2)],
+			}
+
+			copy(entry.HashData[:], data[start:(start + core.HashSHA1Size)])
+
+			entries[index] = entry
+		}
 	}
 
 	return &TrustCache{
@@ -130,4 +216,82 @@ func parse(data []byte) (*TrustCache, error) {
 		Count:   count,
 		Entries: entries,
 	}, nil
-}
\ No newline at end of file
+}
+
+// ParseSerialized decodes the container XNU uses for static trust caches: a
+// module count followed by the offset of each module from the start of data
+func ParseSerialized(data []byte) ([]*TrustCache, error) {
+	if len(data) < 4 { return nil, fmt.Errorf("not enough data for module count") }
+
+	count := binary.LittleEndian.Uint32(data[0:4])
+	if int64(len(data)) < 4 + (int64(count) * 4) {
+		return nil, fmt.Errorf("not enough data for %d module offsets", count)
+	}
+
+	result := make([]*TrustCache, count)
+	for index := range result {
+		offset := binary.LittleEndian.Uint32(data[(4 + index * 4):])
+		if uint64(offset) >= uint64(len(data)) {
+			return nil, fmt.Errorf("module %d offset %d is out of bounds", index, offset)
+		}
+
+		module := data[offset:]
+		size, err := ModuleSize(module)
+		if err != nil { return nil, fmt.Errorf("module %d: %s", index, err) }
+		if size > len(module) {
+			return nil, fmt.Errorf("module %d size %d is out of bounds", index, size)
+		}
+
+		result[index], err = Parse(module[:size])
+		if err != nil { return nil, fmt.Errorf("module %d: %s", index, err) }
+	}
+
+	return result, nil
+}
+
+// IsSorted reports whether the entries are in the ascending CDHash order the kernel
+// requires for its binary search
+func (cache *TrustCache) IsSorted() bool {
+	for index := 1; index < len(cache.Entries); index++ {
+		previous := cache.Entries[index - 1].GetHash().Data
+		current := cache.Entries[index].GetHash().Data
+		if bytes.Compare(previous, current) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lookup returns the entry for a CDHash, which trust caches store truncated to
+// HashLength bytes, or nil when the hash is not present
+func (cache *TrustCache) Lookup(hash *core.TypedHash) Entry {
+	for _, entry := range cache.Entries {
+		if entry.GetHash().EqualCDHash(hash) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Load decodes a trust cache that is either raw or wrapped in an IM4P payload
+func Load(data []byte) (*TrustCache, error) {
+	if len(data) == 0 || data[0] != 0x30 {
+		return Parse(data)
+	}
+
+	image, err := img4.Parse(data)
+	if err != nil { return nil, err }
+	if image.Payload == nil {
+		return nil, fmt.Errorf("image4 has no payload")
+	}
+
+	for _, payloadType := range PayloadTypes {
+		if image.Payload.Name == payloadType {
+			return Parse(image.Payload.Data)
+		}
+	}
+
+	return nil, fmt.Errorf("image4 payload type %s is not a trust cache", image.Payload.Name)
+}
@@ -0,0 +1,155 @@
+package trustcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"go-aapl-integrity/pkg/core"
+	"io/ioutil"
+	"testing"
+)
+
+const fixturePath = "../../testdata/038-67277-007.dmg.trustcache"
+
+// testHash returns a CDHash whose bytes are all value
+func testHash(value byte) []byte {
+	return bytes.Repeat([]byte{value}, HashLength)
+}
+
+// buildTrustCache encodes a trust cache of the given version, the entry fields after the hash
+// taken from extra
+func buildTrustCache(version uint32, hashes [][]byte, extra []byte) []byte {
+	header := make([]byte, TrustCacheV0HeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], version)
+	copy(header[4:20], bytes.Repeat([]byte{0xaa}, 16))
+	binary.LittleEndian.PutUint32(header[20:24], uint32(len(hashes)))
+
+	result := header
+	for _, hash := range hashes {
+		result = append(result, hash...)
+		result = append(result, extra...)
+	}
+
+	return result
+}
+
+func TestParse(t *testing.T) {
+	hashes := [][]byte{testHash(1), testHash(2)}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		version  uint32
+		hashType int
+		flags    int
+		category int
+		err      bool
+	}{
+		{"v0", buildTrustCache(TrustCacheV0, hashes, nil), TrustCacheV0, 0, 0, 0, false},
+		{"v1", buildTrustCache(TrustCacheV1, hashes, []byte{2, FlagAMFI}), TrustCacheV1, 2, FlagAMFI, 0, false},
+		{"v2", buildTrustCache(TrustCacheV2, hashes, []byte{2, FlagANE, 3, 0}), TrustCacheV2, 2, FlagANE, 3, false},
+		{"short header", make([]byte, 20), 0, 0, 0, 0, true},
+		{"unknown version", buildTrustCache(3, hashes, nil), 0, 0, 0, 0, true},
+		{"truncated", buildTrustCache(TrustCacheV1, hashes, []byte{2, 0})[:60], 0, 0, 0, 0, true},
+		{"trailing data", append(buildTrustCache(TrustCacheV0, hashes, nil), 0), 0, 0, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		cache, err := Parse(test.data)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: parsed, expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if cache.Version != test.version || cache.Count != 2 || len(cache.Entries) != 2 {
+			t.Errorf("%s: version %d count %d, expected version %d count 2", test.name, cache.Version, cache.Count, test.version)
+			continue
+		}
+		for index, entry := range cache.Entries {
+			if !bytes.Equal(entry.GetHash().Data, hashes[index]) {
+				t.Errorf("%s: entry %d hash %s", test.name, index, entry.GetHash().Hex())
+			}
+			if test.version != TrustCacheV0 && (entry.GetType() != test.hashType || entry.GetFlags() != test.flags || entry.GetCategory() != test.category) {
+				t.Errorf("%s: entry %d type %d flags %d category %d", test.name, index, entry.GetType(), entry.GetFlags(), entry.GetCategory())
+			}
+		}
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	data, err := ioutil.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Version != TrustCacheV1 || cache.Count != 187 || len(cache.Entries) != 187 {
+		t.Errorf("version %d count %d, expected version 1 count 187", cache.Version, cache.Count)
+	}
+	if cache.UUID.String() != "41f1b0c3-189f-45eb-965a-ff8d141587c6" {
+		t.Errorf("uuid %s", cache.UUID)
+	}
+	if !cache.IsSorted() {
+		t.Errorf("entries are not sorted")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data, err := ioutil.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullSHA256 := mustDecode(t, "005848d0898f0483fa21086ffa41896cdfa0d441" + "000102030405060708090a0b")
+
+	tests := []struct {
+		name  string
+		hash  *core.TypedHash
+		found string
+	}{
+		{"first", &core.TypedHash{Type: core.HashSHA1, Data: mustDecode(t, "005848d0898f0483fa21086ffa41896cdfa0d441")}, "005848d0898f0483fa21086ffa41896cdfa0d441"},
+		{"last", &core.TypedHash{Type: core.HashSHA1, Data: mustDecode(t, "fffb878fe428071ee0e18af52445788b2c9907b1")}, "fffb878fe428071ee0e18af52445788b2c9907b1"},
+		{"truncated sha256", &core.TypedHash{Type: core.HashSHA256, Data: fullSHA256}, "005848d0898f0483fa21086ffa41896cdfa0d441"},
+		{"absent", &core.TypedHash{Type: core.HashSHA1, Data: testHash(0x42)}, ""},
+	}
+
+	for _, test := range tests {
+		entry := cache.Lookup(test.hash)
+		if test.found == "" {
+			if entry != nil {
+				t.Errorf("%s: found %s", test.name, entry.GetHash().Hex())
+			}
+			continue
+		}
+
+		if entry == nil {
+			t.Errorf("%s: not found", test.name)
+		} else if entry.GetHash().Hex() != test.found {
+			t.Errorf("%s: found %s, expected %s", test.name, entry.GetHash().Hex(), test.found)
+		}
+	}
+}
+
+func mustDecode(t *testing.T, text string) []byte {
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
@@ -0,0 +1,56 @@
+package udif
+
+import (
+	"fmt"
+)
+
+// decompressADC decodes Apple Data Compression, an LZ77 variant with one byte literal run
+// headers and two or three byte back references
+func decompressADC(data []byte, limit int) ([]byte, error) {
+	result := make([]byte, 0, limit)
+	for offset := 0; offset < len(data); {
+		header := data[offset]
+		var length, distance int
+		switch {
+		case header & 0x80 != 0:
+			length = int(header & 0x7f) + 1
+			if offset + 1 + length > len(data) {
+				return nil, fmt.Errorf("adc literal run at 0x%x is truncated", offset)
+			}
+			if len(result) + length > limit {
+				return nil, fmt.Errorf("adc output exceeds 0x%x bytes", limit)
+			}
+			result = append(result, data[(offset + 1):(offset + 1 + length)]...)
+			offset += 1 + length
+			continue
+		case header & 0x40 != 0:
+			if offset + 3 > len(data) {
+				return nil, fmt.Errorf("adc match at 0x%x is truncated", offset)
+			}
+			length = int(header & 0x3f) + 4
+			distance = int(data[offset + 1]) << 8 | int(data[offset + 2])
+			offset += 3
+		default:
+			if offset + 2 > len(data) {
+				return nil, fmt.Errorf("adc match at 0x%x is truncated", offset)
+			}
+			length = int(header & 0x3c) >> 2 + 3
+			distance = int(header & 0x03) << 8 | int(data[offset + 1])
+			offset += 2
+		}
+
+		start := len(result) - distance - 1
+		if start < 0 {
+			return nil, fmt.Errorf("adc match before the start of the output")
+		}
+		if len(result) + length > limit {
+			return nil, fmt.Errorf("adc output exceeds 0x%x bytes", limit)
+		}
+		// Matches may overlap the bytes they produce
+		for index := 0; index < length; index++ {
+			result = append(result, result[start + index])
+		}
+	}
+
+	return result, nil
+}
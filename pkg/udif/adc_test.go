@@ -0,0 +1,43 @@
+package udif
+
+import (
+	"testing"
+)
+
+func TestDecompressADC(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		limit    int
+		expected string
+		err      bool
+	}{
+		{"literals", []byte{0x82, 'a', 'b', 'c'}, 16, "abc", false},
+		{"two byte match", []byte{0x82, 'a', 'b', 'c', 0x00, 0x02}, 16, "abcabc", false},
+		{"three byte match", []byte{0x82, 'a', 'b', 'c', 0x42, 0x00, 0x00}, 16, "abccccccc", false},
+		{"overlapping match", []byte{0x81, 'a', 'b', 0x04, 0x01}, 16, "ababab", false},
+		{"exact limit", []byte{0x82, 'a', 'b', 'c', 0x00, 0x02}, 6, "abcabc", false},
+		{"literals past limit", []byte{0x82, 'a', 'b', 'c'}, 2, "", true},
+		{"match past limit", []byte{0x82, 'a', 'b', 'c', 0x00, 0x02}, 5, "", true},
+		{"truncated literals", []byte{0x83, 'a', 'b', 'c'}, 16, "", true},
+		{"truncated two byte match", []byte{0x80, 'a', 0x00}, 16, "", true},
+		{"truncated three byte match", []byte{0x80, 'a', 0x40, 0x00}, 16, "", true},
+		{"match before the start", []byte{0x80, 'a', 0x00, 0x01}, 16, "", true},
+	}
+
+	for _, test := range tests {
+		result, err := decompressADC(test.data, test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed %q, expected an error", test.name, result)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(result) != test.expected {
+			t.Errorf("%s: decompressed %q, expected %q", test.name, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package udif
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/lzfse"
+	"go-aapl-integrity/pkg/plist"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Structures follow the UDIF layout that hdiutil writes: the data fork, then an XML plist of
+// resources, then a 512 byte koly trailer at the very end of the file
+const (
+	TrailerMagic = "koly"
+	TrailerSize = 512
+	BlockTableMagic = "mish"
+	BlockTableHeaderSize = 0xcc
+	ChunkSize = 40
+	SectorSize = 512
+
+	ChecksumTypeNone = 0
+	ChecksumTypeCRC32 = 2
+
+	ChunkTypeZeroFill = 0x00000000
+	ChunkTypeRaw = 0x00000001
+	ChunkTypeIgnore = 0x00000002 // unallocated, reads as zeros
+	ChunkTypeADC = 0x80000004
+	ChunkTypeZlib = 0x80000005
+	ChunkTypeBzip2 = 0x80000006
+	ChunkTypeLZFSE = 0x80000007
+	ChunkTypeLZMA = 0x80000008
+	ChunkTypeComment = 0x7ffffffe
+	ChunkTypeTerminator = 0xffffffff
+
+	// APFSPartitionName is how hdiutil names the block table of an APFS container
+	APFSPartitionName = "Apple_APFS"
+
+	// ChunkLimit bounds the decompressed size of any one chunk
+	ChunkLimit = 64 << 20
+	// MaxSectors keeps every byte offset in the image within an int64
+	MaxSectors = (1 << 63 - 1) / SectorSize
+)
+
+type Checksum struct {
+	Type uint32
+	Bits uint32
+	Data []byte
+}
+
+type Trailer struct {
+	Version uint32
+	Flags uint32
+	RunningDataForkOffset uint64
+	DataForkOffset uint64
+	DataForkLength uint64
+	ResourceForkOffset uint64
+	ResourceForkLength uint64
+	SegmentNumber uint32
+	SegmentCount uint32
+	SegmentID uuid.UUID
+	DataChecksum *Checksum
+	XMLOffset uint64
+	XMLLength uint64
+	MasterChecksum *Checksum
+	ImageVariant uint32
+	SectorCount uint64
+}
+
+// Chunk is one run of sectors in a block table, stored as CompressedLength bytes at
+// CompressedOffset in the file
+type Chunk struct {
+	Type uint32
+	Comment uint32
+	Sector uint64 // from the start of the image
+	SectorCount uint64
+	CompressedOffset uint64
+	CompressedLength uint64
+}
+
+// BlockTable is a blkx resource, the mish table of one partition of the image
+type BlockTable struct {
+	Name string
+	ID string
+	FirstSector uint64
+	SectorCount uint64
+	DataOffset uint64
+	BuffersNeeded uint32
+	Checksum *Checksum
+	Chunks []*Chunk
+}
+
+// Image is a UDIF disk image whose decompressed contents read through ReadAt
+type Image struct {
+	reader io.ReaderAt
+	Trailer *Trailer
+	Tables []*BlockTable
+	chunks []*Chunk // every chunk holding data, sorted by sector
+
+	lock sync.Mutex
+	cached *Chunk
+	cachedData []byte
+}
+
+// ChunkTypeName returns a display name for a chunk type
+func ChunkTypeName(chunkType uint32) string {
+	switch chunkType {
+	case ChunkTypeZeroFill:
+		return "zero"
+	case ChunkTypeRaw:
+		return "raw"
+	case ChunkTypeIgnore:
+		return "ignore"
+	case ChunkTypeADC:
+		return "adc"
+	case ChunkTypeZlib:
+		return "zlib"
+	case ChunkTypeBzip2:
+		return "bzip2"
+	case ChunkTypeLZFSE:
+		return "lzfse"
+	case ChunkTypeLZMA:
+		return "lzma"
+	case ChunkTypeComment:
+		return "comment"
+	case ChunkTypeTerminator:
+		return "terminator"
+	}
+
+	return fmt.Sprintf("unknown(0x%08x)", chunkType)
+}
+
+// fits reports whether length bytes or sectors at offset stay within limit, without overflowing
+func fits(offset uint64, length uint64, limit uint64) bool {
+	return offset <= limit && length <= limit - offset
+}
+
+func parseChecksum(data []byte) *Checksum {
+	result := &Checksum{
+		Type: binary.BigEndian.Uint32(data[0:4]),
+		Bits: binary.BigEndian.Uint32(data[4:8]),
+	}
+
+	size := int(result.Bits / 8)
+	if size > 128 {
+		size = 128
+	}
+	result.Data = data[8:(8 + size)]
+	return result
+}
+
+// newHasher returns a hash for a checksum type. Only CRC-32 checksums, which is what hdiutil
+// writes, are supported.
+func (checksum *Checksum) newHasher() (hash.Hash32, error) {
+	if checksum.Type != ChecksumTypeCRC32 {
+		return nil, fmt.Errorf("unsupported checksum type %d", checksum.Type)
+	}
+	if len(checksum.Data) < 4 {
+		return nil, fmt.Errorf("crc32 checksum has %d bits", checksum.Bits)
+	}
+
+	return crc32.NewIEEE(), nil
+}
+
+// check compares a finished hash against the checksum
+func (checksum *Checksum) check(hasher hash.Hash32) error {
+	if hasher.Sum32() != binary.BigEndian.Uint32(checksum.Data) {
+		return fmt.Errorf("crc32 is %08x, expected %x", hasher.Sum32(), checksum.Data)
+	}
+
+	return nil
+}
+
+// ParseTrailer decodes a koly trailer
+func ParseTrailer(data []byte) (*Trailer, error) {
+	if len(data) < TrailerSize {
+		return nil, fmt.Errorf("not enough data for trailer")
+	}
+	if string(data[0:4]) != TrailerMagic {
+		return nil, fmt.Errorf("no %s magic", TrailerMagic)
+	}
+	if headerSize := binary.BigEndian.Uint32(data[8:12]); headerSize != TrailerSize {
+		return nil, fmt.Errorf("trailer size %d, expected %d", headerSize, TrailerSize)
+	}
+
+	result := &Trailer{
+		Version:               binary.BigEndian.Uint32(data[0x04:0x08]),
+		Flags:                 binary.BigEndian.Uint32(data[0x0c:0x10]),
+		RunningDataForkOffset: binary.BigEndian.Uint64(data[0x10:0x18]),
+		DataForkOffset:        binary.BigEndian.Uint64(data[0x18:0x20]),
+		DataForkLength:        binary.BigEndian.Uint64(data[0x20:0x28]),
+		ResourceForkOffset:    binary.BigEndian.Uint64(data[0x28:0x30]),
+		ResourceForkLength:    binary.BigEndian.Uint64(data[0x30:0x38]),
+		SegmentNumber:         binary.BigEndian.Uint32(data[0x38:0x3c]),
+		SegmentCount:          binary.BigEndian.Uint32(data[0x3c:0x40]),
+		DataChecksum:          parseChecksum(data[0x50:0xd8]),
+		XMLOffset:             binary.BigEndian.Uint64(data[0xd8:0xe0]),
+		XMLLength:             binary.BigEndian.Uint64(data[0xe0:0xe8]),
+		MasterChecksum:        parseChecksum(data[0x160:0x1e8]),
+		ImageVariant:          binary.BigEndian.Uint32(data[0x1e8:0x1ec]),
+		SectorCount:           binary.BigEndian.Uint64(data[0x1ec:0x1f4]),
+	}
+	copy(result.SegmentID[:], data[0x40:0x50])
+
+	if result.SectorCount > MaxSectors {
+		return nil, fmt.Errorf("sector count %d is too large", result.SectorCount)
+	}
+
+	return result, nil
+}
+
+// ParseBlockTable decodes a mish block table, making chunk sectors absolute
+func ParseBlockTable(data []byte) (*BlockTable, error) {
+	if len(data) < BlockTableHeaderSize {
+		return nil, fmt.Errorf("not enough data for block table")
+	}
+	if string(data[0:4]) != BlockTableMagic {
+		return nil, fmt.Errorf("no %s magic", BlockTableMagic)
+	}
+
+	result := &BlockTable{
+		FirstSector:   binary.BigEndian.Uint64(data[0x08:0x10]),
+		SectorCount:   binary.BigEndian.Uint64(data[0x10:0x18]),
+		DataOffset:    binary.BigEndian.Uint64(data[0x18:0x20]),
+		BuffersNeeded: binary.BigEndian.Uint32(data[0x20:0x24]),
+		Checksum:      parseChecksum(data[0x40:0xc8]),
+	}
+
+	if !fits(result.FirstSector, result.SectorCount, MaxSectors) {
+		return nil, fmt.Errorf("sectors %d+%d are out of range", result.FirstSector, result.SectorCount)
+	}
+
+	count := int(binary.BigEndian.Uint32(data[0xc8:0xcc]))
+	if BlockTableHeaderSize + count * ChunkSize > len(data) {
+		return nil, fmt.Errorf("%d chunks do not fit 0x%x bytes", count, len(data))
+	}
+
+	result.Chunks = make([]*Chunk, count)
+	for index := range result.Chunks {
+		entry := data[(BlockTableHeaderSize + index * ChunkSize):]
+		chunk := &Chunk{
+			Type:             binary.BigEndian.Uint32(entry[0x00:0x04]),
+			Comment:          binary.BigEndian.Uint32(entry[0x04:0x08]),
+			Sector:           binary.BigEndian.Uint64(entry[0x08:0x10]),
+			SectorCount:      binary.BigEndian.Uint64(entry[0x10:0x18]),
+			CompressedOffset: binary.BigEndian.Uint64(entry[0x18:0x20]),
+			CompressedLength: binary.BigEndian.Uint64(entry[0x20:0x28]),
+		}
+		if !fits(chunk.Sector, chunk.SectorCount, result.SectorCount) {
+			return nil, fmt.Errorf("chunk %d runs past the end of the table", index)
+		}
+		chunk.Sector += result.FirstSector
+		result.Chunks[index] = chunk
+	}
+
+	return result, nil
+}
+
+// parseResources reads the blkx tables out of the XML resource plist
+func parseResources(data []byte) ([]*BlockTable, error) {
+	root, err := plist.Dictionary(data)
+	if err != nil { return nil, err }
+
+	resources, ok := root["resource-fork"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("resources have no resource-fork")
+	}
+	entries, ok := resources["blkx"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("resources have no blkx tables")
+	}
+
+	result := make([]*BlockTable, 0, len(entries))
+	for index, entry := range entries {
+		dictionary, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("blkx %d is not a dictionary", index)
+		}
+		data, ok := dictionary["Data"].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("blkx %d has no data", index)
+		}
+
+		table, err := ParseBlockTable(data)
+		if err != nil { return nil, fmt.Errorf("blkx %d: %s", index, err) }
+
+		table.Name, _ = dictionary["Name"].(string)
+		table.ID, _ = dictionary["ID"].(string)
+		result = append(result, table)
+	}
+
+	return result, nil
+}
+
+// IsImage reports whether a file of size bytes ends with a koly trailer
+func IsImage(reader io.ReaderAt, size int64) bool {
+	if size < TrailerSize {
+		return false
+	}
+
+	magic := make([]byte, 4)
+	_, err := reader.ReadAt(magic, size - TrailerSize)
+	return err == nil && string(magic) == TrailerMagic
+}
+
+// Open reads the trailer and block tables of a UDIF image of size bytes
+func Open(reader io.ReaderAt, size int64) (*Image, error) {
+	if size < TrailerSize {
+		return nil, fmt.Errorf("not enough data for trailer")
+	}
+
+	data := make([]byte, TrailerSize)
+	_, err := reader.ReadAt(data, size - TrailerSize)
+	if err != nil { return nil, err }
+
+	trailer, err := ParseTrailer(data)
+	if err != nil { return nil, err }
+	if trailer.XMLLength == 0 {
+		return nil, fmt.Errorf("image has no XML resources")
+	}
+	if !fits(trailer.XMLOffset, trailer.XMLLength, uint64(size)) || !fits(trailer.DataForkOffset, trailer.DataForkLength, uint64(size)) {
+		return nil, fmt.Errorf("trailer points past the end of the file")
+	}
+
+	resources := make([]byte, trailer.XMLLength)
+	_, err = reader.ReadAt(resources, int64(trailer.XMLOffset))
+	if err != nil { return nil, err }
+
+	tables, err := parseResources(resources)
+	if err != nil { return nil, err }
+
+	result := &Image{reader: reader, Trailer: trailer, Tables: tables, chunks: make([]*Chunk, 0)}
+	for _, table := range tables {
+		// Chunks are within their table, so a table within the image keeps them there too
+		if !fits(table.FirstSector, table.SectorCount, trailer.SectorCount) {
+			return nil, fmt.Errorf("%s runs past the end of the image", table.Name)
+		}
+
+		for _, chunk := range table.Chunks {
+			if chunk.SectorCount == 0 || chunk.Type == ChunkTypeComment || chunk.Type == ChunkTypeTerminator {
+				continue
+			}
+			result.chunks = append(result.chunks, chunk)
+		}
+	}
+
+	sort.Slice(result.chunks, func(i, j int) bool {
+		return result.chunks[i].Sector < result.chunks[j].Sector
+	})
+	for index := 1; index < len(result.chunks); index++ {
+		previous := result.chunks[index - 1]
+		if previous.Sector + previous.SectorCount > result.chunks[index].Sector {
+			return nil, fmt.Errorf("chunks at sectors %d and %d overlap", previous.Sector, result.chunks[index].Sector)
+		}
+	}
+
+	return result, nil
+}
+
+// Size returns the size of the decompressed image
+func (image *Image) Size() int64 {
+	return int64(image.Trailer.SectorCount) * SectorSize
+}
+
+// decodeChunk returns the decompressed sectors of a chunk
+func (image *Image) decodeChunk(chunk *Chunk, table *BlockTable) ([]byte, error) {
+	if chunk.SectorCount > ChunkLimit / SectorSize {
+		return nil, fmt.Errorf("chunk at sector %d is larger than 0x%x bytes", chunk.Sector, ChunkLimit)
+	}
+	size := int(chunk.SectorCount) * SectorSize
+
+	switch chunk.Type {
+	case ChunkTypeZeroFill, ChunkTypeIgnore:
+		return make([]byte, size), nil
+	}
+
+	if chunk.CompressedLength > ChunkLimit {
+		return nil, fmt.Errorf("chunk at sector %d: compressed length 0x%x is too large", chunk.Sector, chunk.CompressedLength)
+	}
+	// Compressed data is within the data fork, after the table's data offset
+	forkLength := image.Trailer.DataForkLength
+	offset := chunk.CompressedOffset
+	if table != nil {
+		if table.DataOffset > forkLength {
+			return nil, fmt.Errorf("%s: data offset 0x%x is past the data fork", table.Name, table.DataOffset)
+		}
+		forkLength -= table.DataOffset
+		offset += table.DataOffset
+	}
+	if !fits(chunk.CompressedOffset, chunk.CompressedLength, forkLength) {
+		return nil, fmt.Errorf("chunk at sector %d: compressed data is outside the data fork", chunk.Sector)
+	}
+	offset += image.Trailer.DataForkOffset
+	compressed := make([]byte, chunk.CompressedLength)
+	_, err := image.reader.ReadAt(compressed, int64(offset))
+	if err != nil { return nil, fmt.Errorf("chunk at sector %d: %s", chunk.Sector, err) }
+
+	var result []byte
+	switch chunk.Type {
+	case ChunkTypeRaw:
+		result = compressed
+	case ChunkTypeADC:
+		result, err = decompressADC(compressed, size)
+	case ChunkTypeZlib:
+		var stream io.ReadCloser
+		stream, err = zlib.NewReader(bytes.NewReader(compressed))
+		if err == nil {
+			result, err = ioutil.ReadAll(io.LimitReader(stream, int64(size) + 1))
+		}
+	case ChunkTypeBzip2:
+		result, err = ioutil.ReadAll(io.LimitReader(bzip2.NewReader(bytes.NewReader(compressed)), int64(size) + 1))
+	case ChunkTypeLZFSE:
+		result, err = lzfse.DecompressLimit(compressed, size)
+	default:
+		err = fmt.Errorf("unsupported %s chunk", ChunkTypeName(chunk.Type))
+	}
+	if err != nil { return nil, fmt.Errorf("chunk at sector %d: %s", chunk.Sector, err) }
+	if len(result) != size {
+		return nil, fmt.Errorf("chunk at sector %d: 0x%x bytes, expected 0x%x", chunk.Sector, len(result), size)
+	}
+
+	return result, nil
+}
+
+// tableOf returns the block table holding a chunk
+func (image *Image) tableOf(chunk *Chunk) *BlockTable {
+	for _, table := range image.Tables {
+		if chunk.Sector >= table.FirstSector && chunk.Sector < table.FirstSector + table.SectorCount {
+			return table
+		}
+	}
+
+	return nil
+}
+
+// chunkData decodes a chunk, keeping the last one since reads tend to be sequential
+func (image *Image) chunkData(chunk *Chunk) ([]byte, error) {
+	image.lock.Lock()
+	defer image.lock.Unlock()
+
+	if image.cached == chunk {
+		return image.cachedData, nil
+	}
+
+	data, err := image.decodeChunk(chunk, image.tableOf(chunk))
+	if err != nil { return nil, err }
+
+	image.cached, image.cachedData = chunk, data
+	return data, nil
+}
+
+// ReadAt reads the decompressed image. Sectors no chunk covers read as zeros.
+func (image *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	size := image.Size()
+	count := 0
+	for count < len(p) {
+		position := off + int64(count)
+		if position >= size {
+			return count, io.EOF
+		}
+
+		sector := uint64(position / SectorSize)
+		index := sort.Search(len(image.chunks), func(index int) bool {
+			chunk := image.chunks[index]
+			return chunk.Sector + chunk.SectorCount > sector
+		})
+
+		// Up to the next chunk or the end of the image
+		end := size
+		if index < len(image.chunks) {
+			end = int64(image.chunks[index].Sector) * SectorSize
+		}
+
+		if index < len(image.chunks) && image.chunks[index].Sector <= sector {
+			chunk := image.chunks[index]
+			data, err := image.chunkData(chunk)
+			if err != nil { return count, err }
+
+			start := int64(chunk.Sector) * SectorSize
+			count += copy(p[count:], data[(position - start):])
+			continue
+		}
+
+		length := end - position
+		if length > int64(len(p) - count) {
+			length = int64(len(p) - count)
+		}
+		for index := int64(0); index < length; index++ {
+			p[count + int(index)] = 0
+		}
+		count += int(length)
+	}
+
+	return count, nil
+}
+
+// Table returns the first block table whose name contains name, such as APFSPartitionName
+func (image *Image) Table(name string) *BlockTable {
+	for _, table := range image.Tables {
+		if strings.Contains(table.Name, name) {
+			return table
+		}
+	}
+
+	return nil
+}
+
+// Partition returns a reader over the sectors of a block table
+func (image *Image) Partition(table *BlockTable) *io.SectionReader {
+	return io.NewSectionReader(image, int64(table.FirstSector) * SectorSize, int64(table.SectorCount) * SectorSize)
+}
+
+// VerifyDataChecksum checks the trailer checksum over the data fork
+func (image *Image) VerifyDataChecksum() error {
+	checksum := image.Trailer.DataChecksum
+	if checksum.Type == ChecksumTypeNone {
+		return nil
+	}
+
+	hasher, err := checksum.newHasher()
+	if err != nil { return fmt.Errorf("data fork: %s", err) }
+
+	_, err = io.Copy(hasher, io.NewSectionReader(image.reader, int64(image.Trailer.DataForkOffset), int64(image.Trailer.DataForkLength)))
+	if err != nil { return fmt.Errorf("data fork: %s", err) }
+
+	err = checksum.check(hasher)
+	if err != nil { return fmt.Errorf("data fork: %s", err) }
+
+	return nil
+}
+
+// VerifyMasterChecksum checks the trailer checksum over the block table checksums, which covers
+// the first 32 bits of each table's checksum in table order
+func (image *Image) VerifyMasterChecksum() error {
+	checksum := image.Trailer.MasterChecksum
+	if checksum.Type == ChecksumTypeNone {
+		return nil
+	}
+
+	hasher, err := checksum.newHasher()
+	if err != nil { return fmt.Errorf("master: %s", err) }
+
+	for _, table := range image.Tables {
+		if len(table.Checksum.Data) < 4 {
+			return fmt.Errorf("master: %s has a %d bit checksum", table.Name, table.Checksum.Bits)
+		}
+		hasher.Write(table.Checksum.Data[0:4])
+	}
+
+	err = checksum.check(hasher)
+	if err != nil { return fmt.Errorf("master: %s", err) }
+
+	return nil
+}
+
+// writeZeros hashes count zero bytes without holding them all at once
+func writeZeros(hasher hash.Hash32, count uint64) {
+	zeros := make([]byte, 1 << 16)
+	for count > 0 {
+		length := uint64(len(zeros))
+		if count < length {
+			length = count
+		}
+		hasher.Write(zeros[:length])
+		count -= length
+	}
+}
+
+// VerifyTable decompresses every chunk of a block table and checks the table's checksum over
+// the result
+func (image *Image) VerifyTable(table *BlockTable) error {
+	if table.Checksum.Type == ChecksumTypeNone {
+		return nil
+	}
+
+	hasher, err := table.Checksum.newHasher()
+	if err != nil { return fmt.Errorf("%s: %s", table.Name, err) }
+
+	// Gaps between chunks read as zeros
+	position := table.FirstSector
+	for _, chunk := range table.Chunks {
+		if chunk.SectorCount == 0 || chunk.Type == ChunkTypeComment || chunk.Type == ChunkTypeTerminator {
+			continue
+		}
+		if chunk.Sector < position {
+			return fmt.Errorf("%s: chunk at sector %d is out of order", table.Name, chunk.Sector)
+		}
+		writeZeros(hasher, (chunk.Sector - position) * SectorSize)
+
+		data, err := image.decodeChunk(chunk, table)
+		if err != nil { return fmt.Errorf("%s: %s", table.Name, err) }
+
+		hasher.Write(data)
+		position = chunk.Sector + chunk.SectorCount
+	}
+	writeZeros(hasher, (table.FirstSector + table.SectorCount - position) * SectorSize)
+
+	err = table.Checksum.check(hasher)
+	if err != nil { return fmt.Errorf("%s: %s", table.Name, err) }
+
+	return nil
+}
+
+// ChecksumTypeName returns a display name for a checksum type
+func ChecksumTypeName(checksumType uint32) string {
+	switch checksumType {
+	case ChecksumTypeNone:
+		return "none"
+	case ChecksumTypeCRC32:
+		return "crc32"
+	}
+
+	return fmt.Sprintf("unknown(%d)", checksumType)
+}
+
+// OpenAPFSPartition returns a reader over the APFS container in the size bytes of reader: the
+// Apple_APFS partition of a UDIF image, or reader itself when it is not one, as with raw images
+func OpenAPFSPartition(reader io.ReaderAt, size int64) (io.ReaderAt, error) {
+	if !IsImage(reader, size) {
+		return reader, nil
+	}
+
+	image, err := Open(reader, size)
+	if err != nil { return nil, err }
+
+	table := image.Table(APFSPartitionName)
+	if table == nil {
+		return nil, fmt.Errorf("disk image has no %s partition", APFSPartitionName)
+	}
+
+	return image.Partition(table), nil
+}
@@ -0,0 +1,233 @@
+package udif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// testImage is a one table UDIF image, built from its parts so that tests can break them
+type testImage struct {
+	content []byte // the decompressed sectors of the table
+	fork []byte
+	chunks []*Chunk
+	tableSectors uint64
+	imageSectors uint64
+	tableChecksum uint32
+	dataChecksum uint32
+	masterChecksum uint32
+	xmlLength uint64 // written as is when set
+}
+
+func compressZlib(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// adcLiterals encodes data as ADC literal runs only
+func adcLiterals(data []byte) []byte {
+	result := make([]byte, 0)
+	for len(data) > 0 {
+		length := len(data)
+		if length > 0x80 {
+			length = 0x80
+		}
+		result = append(result, 0x80 | byte(length - 1))
+		result = append(result, data[:length]...)
+		data = data[length:]
+	}
+
+	return result
+}
+
+// newTestImage lays out six sectors as zlib, raw, ADC, zero fill and LZFSE chunks
+func newTestImage(t *testing.T) *testImage {
+	content := make([]byte, 6 * SectorSize)
+	for index := range content {
+		content[index] = byte(index * 7 + index / SectorSize)
+	}
+	for index := 4 * SectorSize; index < 5 * SectorSize; index++ {
+		content[index] = 0
+	}
+
+	lzfseBlock := append([]byte("bvx-\x00\x02\x00\x00"), content[(5 * SectorSize):]...)
+	lzfseBlock = append(lzfseBlock, "bvx$"...)
+
+	image := &testImage{content: content, fork: make([]byte, 0), tableSectors: 6, imageSectors: 6}
+	add := func(chunkType uint32, sector uint64, count uint64, data []byte) {
+		chunk := &Chunk{Type: chunkType, Sector: sector, SectorCount: count}
+		if len(data) > 0 {
+			chunk.CompressedOffset, chunk.CompressedLength = uint64(len(image.fork)), uint64(len(data))
+			image.fork = append(image.fork, data...)
+		}
+		image.chunks = append(image.chunks, chunk)
+	}
+	add(ChunkTypeZlib, 0, 2, compressZlib(t, content[0:(2 * SectorSize)]))
+	add(ChunkTypeRaw, 2, 1, content[(2 * SectorSize):(3 * SectorSize)])
+	add(ChunkTypeADC, 3, 1, adcLiterals(content[(3 * SectorSize):(4 * SectorSize)]))
+	add(ChunkTypeZeroFill, 4, 1, nil)
+	add(ChunkTypeLZFSE, 5, 1, lzfseBlock)
+	add(ChunkTypeTerminator, 6, 0, nil)
+
+	image.tableChecksum = crc32.ChecksumIEEE(content)
+	image.dataChecksum = crc32.ChecksumIEEE(image.fork)
+	image.updateMaster()
+	return image
+}
+
+func (image *testImage) updateMaster() {
+	var tableChecksum [4]byte
+	binary.BigEndian.PutUint32(tableChecksum[:], image.tableChecksum)
+	image.masterChecksum = crc32.ChecksumIEEE(tableChecksum[:])
+}
+
+func putChecksum(data []byte, value uint32) {
+	binary.BigEndian.PutUint32(data[0:4], ChecksumTypeCRC32)
+	binary.BigEndian.PutUint32(data[4:8], 32)
+	binary.BigEndian.PutUint32(data[8:12], value)
+}
+
+func (image *testImage) blockTable() []byte {
+	result := make([]byte, BlockTableHeaderSize + len(image.chunks) * ChunkSize)
+	copy(result, BlockTableMagic)
+	binary.BigEndian.PutUint32(result[0x04:0x08], 1)
+	binary.BigEndian.PutUint64(result[0x10:0x18], image.tableSectors)
+	putChecksum(result[0x40:0xc8], image.tableChecksum)
+	binary.BigEndian.PutUint32(result[0xc8:0xcc], uint32(len(image.chunks)))
+
+	for index, chunk := range image.chunks {
+		entry := result[(BlockTableHeaderSize + index * ChunkSize):]
+		binary.BigEndian.PutUint32(entry[0x00:0x04], chunk.Type)
+		binary.BigEndian.PutUint64(entry[0x08:0x10], chunk.Sector)
+		binary.BigEndian.PutUint64(entry[0x10:0x18], chunk.SectorCount)
+		binary.BigEndian.PutUint64(entry[0x18:0x20], chunk.CompressedOffset)
+		binary.BigEndian.PutUint64(entry[0x20:0x28], chunk.CompressedLength)
+	}
+
+	return result
+}
+
+func (image *testImage) bytes() []byte {
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>resource-fork</key><dict><key>blkx</key><array>
+<dict><key>Data</key><data>%s</data><key>ID</key><string>0</string><key>Name</key><string>disk image (%s : 1)</string></dict>
+</array></dict></dict></plist>
+`, base64.StdEncoding.EncodeToString(image.blockTable()), APFSPartitionName)
+
+	xmlLength := uint64(len(xml))
+	if image.xmlLength != 0 {
+		xmlLength = image.xmlLength
+	}
+
+	trailer := make([]byte, TrailerSize)
+	copy(trailer, TrailerMagic)
+	binary.BigEndian.PutUint32(trailer[0x04:0x08], 4)
+	binary.BigEndian.PutUint32(trailer[0x08:0x0c], TrailerSize)
+	binary.BigEndian.PutUint64(trailer[0x20:0x28], uint64(len(image.fork)))
+	putChecksum(trailer[0x50:0xd8], image.dataChecksum)
+	binary.BigEndian.PutUint64(trailer[0xd8:0xe0], uint64(len(image.fork)))
+	binary.BigEndian.PutUint64(trailer[0xe0:0xe8], xmlLength)
+	putChecksum(trailer[0x160:0x1e8], image.masterChecksum)
+	binary.BigEndian.PutUint64(trailer[0x1ec:0x1f4], image.imageSectors)
+
+	return bytes.Join([][]byte{image.fork, []byte(xml), trailer}, nil)
+}
+
+func TestImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(image *testImage)
+		open     bool // whether Open fails
+		read     bool // whether reading or verifying the table fails
+		data     bool // whether the data fork checksum fails
+		master   bool // whether the master checksum fails
+	}{
+		{"valid", func(image *testImage) {}, false, false, false, false},
+		{"tampered raw chunk", func(image *testImage) { image.fork[image.chunks[1].CompressedOffset] ^= 1 }, false, true, true, false},
+		{"wrong table checksum", func(image *testImage) { image.tableChecksum ^= 1 }, false, true, false, true},
+		{"wrong data checksum", func(image *testImage) { image.dataChecksum ^= 1 }, false, false, true, false},
+		{"chunk past the table", func(image *testImage) { image.chunks[4].SectorCount = 2 }, true, false, false, false},
+		{"chunk sector overflow", func(image *testImage) { image.chunks[4].Sector = 1 << 63 }, true, false, false, false},
+		{"overlapping chunks", func(image *testImage) { image.chunks[1].Sector = 1 }, true, false, false, false},
+		{"table past the image", func(image *testImage) { image.imageSectors = 5 }, true, false, false, false},
+		{"xml past the file", func(image *testImage) { image.xmlLength = 1 << 20 }, true, false, false, false},
+		{"compressed data past the fork", func(image *testImage) { image.chunks[1].CompressedOffset = uint64(len(image.fork)) }, false, true, false, false},
+		{"compressed length overflow", func(image *testImage) { image.chunks[1].CompressedLength = 1 << 63 }, false, true, false, false},
+		{"short chunk", func(image *testImage) { image.chunks[0].SectorCount, image.chunks[1].Sector = 3, 3 }, true, false, false, false},
+		{"chunk decodes short", func(image *testImage) { image.chunks[2].CompressedLength -= 0x81 }, false, true, false, false},
+	}
+
+	for _, test := range tests {
+		parts := newTestImage(t)
+		test.mutate(parts)
+		data := parts.bytes()
+
+		image, err := Open(bytes.NewReader(data), int64(len(data)))
+		if test.open {
+			if err == nil {
+				t.Errorf("%s: opened, expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		content := make([]byte, image.Size())
+		_, readErr := io.ReadFull(io.NewSectionReader(image, 0, image.Size()), content)
+		tableErr := image.VerifyTable(image.Tables[0])
+		if test.read != (tableErr != nil) {
+			t.Errorf("%s: table checksum error %v", test.name, tableErr)
+		}
+		if readErr == nil && !test.read && !bytes.Equal(content, parts.content) {
+			t.Errorf("%s: read data differs", test.name)
+		}
+		if err := image.VerifyDataChecksum(); test.data != (err != nil) {
+			t.Errorf("%s: data checksum error %v", test.name, err)
+		}
+		if err := image.VerifyMasterChecksum(); test.master != (err != nil) {
+			t.Errorf("%s: master checksum error %v", test.name, err)
+		}
+	}
+}
+
+func TestOpenAPFSPartition(t *testing.T) {
+	parts := newTestImage(t)
+	data := parts.bytes()
+
+	reader, err := OpenAPFSPartition(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, len(parts.content))
+	_, err = reader.ReadAt(content, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, parts.content) {
+		t.Errorf("partition data differs")
+	}
+
+	// Anything that is not a UDIF image is read as it is
+	raw := bytes.NewReader(parts.content)
+	reader, err = OpenAPFSPartition(raw, int64(len(parts.content)))
+	if err != nil || reader != raw {
+		t.Errorf("raw image opened as %T, %v", reader, err)
+	}
+}
@@ -0,0 +1,94 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+)
+
+// Mac firmware updates ship as SCAP files: an EFI_CAPSULE_HEADER followed by the flash image.
+// Apple does not document what its longer headers hold, and SCAP files are not FMP capsules, so
+// whatever signs them is not checked here. Header holds the extra bytes as they are.
+const (
+	CapsuleHeaderSize = 0x1c // EFI_CAPSULE_HEADER
+
+	CapsuleFlagPersistAcrossReset = 0x00010000
+	CapsuleFlagPopulateSystemTable = 0x00020000
+	CapsuleFlagInitiateReset = 0x00040000
+)
+
+// EFICapsuleGUID is the capsule GUID of SCAP files
+var EFICapsuleGUID = uuid.MustParse("3b6686bd-0d76-4030-b70e-b5519e2fc5a0")
+
+// capsuleGUIDs are the capsule GUIDs whose payload is a flash image
+var capsuleGUIDs = map[uuid.UUID]bool{
+	EFICapsuleGUID: true,
+}
+
+type Capsule struct {
+	GUID uuid.UUID
+	HeaderSize uint32
+	Flags uint32
+	CapsuleImageSize uint32 // the whole capsule, header included
+	Header []byte
+	Image []byte // the flash image after the header
+}
+
+// IsCapsule reports whether data starts with a known capsule GUID
+func IsCapsule(data []byte) bool {
+	if len(data) < CapsuleHeaderSize {
+		return false
+	}
+
+	guid, err := core.EFIGUID(data[0:16])
+	return err == nil && capsuleGUIDs[guid]
+}
+
+// ParseCapsule checks an EFI capsule header and splits off the image it wraps
+func ParseCapsule(data []byte) (*Capsule, error) {
+	if len(data) < CapsuleHeaderSize {
+		return nil, fmt.Errorf("not enough data for capsule header")
+	}
+
+	guid, err := core.EFIGUID(data[0:16])
+	if err != nil { return nil, err }
+	if !capsuleGUIDs[guid] {
+		return nil, fmt.Errorf("unknown capsule guid %s", guid)
+	}
+
+	result := &Capsule{
+		GUID:             guid,
+		HeaderSize:       binary.LittleEndian.Uint32(data[0x10:0x14]),
+		Flags:            binary.LittleEndian.Uint32(data[0x14:0x18]),
+		CapsuleImageSize: binary.LittleEndian.Uint32(data[0x18:0x1c]),
+	}
+
+	if result.HeaderSize < CapsuleHeaderSize || uint64(result.HeaderSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid capsule header size 0x%x", result.HeaderSize)
+	}
+	if result.CapsuleImageSize < result.HeaderSize || uint64(result.CapsuleImageSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("capsule image size 0x%x does not fit 0x%x bytes", result.CapsuleImageSize, len(data))
+	}
+	if result.Flags & (CapsuleFlagPopulateSystemTable | CapsuleFlagInitiateReset) != 0 && result.Flags & CapsuleFlagPersistAcrossReset == 0 {
+		return nil, fmt.Errorf("capsule flags 0x%08x need persist across reset", result.Flags)
+	}
+
+	result.Header = data[:result.HeaderSize]
+	result.Image = data[result.HeaderSize:result.CapsuleImageSize]
+
+	return result, nil
+}
+
+// Unwrap returns the flash image inside a capsule along with the capsule, or data itself and
+// a nil capsule when data is not a capsule, as with raw .fd images
+func Unwrap(data []byte) ([]byte, *Capsule, error) {
+	if !IsCapsule(data) {
+		return data, nil, nil
+	}
+
+	capsule, err := ParseCapsule(data)
+	if err != nil { return nil, nil, err }
+
+	return capsule.Image, capsule, nil
+}
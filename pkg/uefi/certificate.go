@@ -0,0 +1,59 @@
+package uefi
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+	"math/big"
+)
+
+const (
+	RSA2048KeySize = 256
+	RSA2048SHA256CertificateSize = 16 + 2 * RSA2048KeySize
+	RSA2048PublicExponent = 0x10001 // the exponent is not stored, EDK2 assumes this one
+)
+
+// RSA2048SHA256Certificate is an EFI_CERT_BLOCK_RSA_2048_SHA256: a hash type, the key modulus
+// and a PKCS#1 v1.5 signature
+type RSA2048SHA256Certificate struct {
+	HashType uuid.UUID
+	PublicKey *rsa.PublicKey
+	Signature []byte
+}
+
+// ParseRSA2048SHA256Certificate decodes the certificate block at the start of data
+func ParseRSA2048SHA256Certificate(data []byte) (*RSA2048SHA256Certificate, error) {
+	if len(data) < RSA2048SHA256CertificateSize {
+		return nil, fmt.Errorf("not enough data for rsa2048 sha256 certificate")
+	}
+
+	hashType, err := core.EFIGUID(data[0:16])
+	if err != nil { return nil, err }
+
+	return &RSA2048SHA256Certificate{
+		HashType: hashType,
+		PublicKey: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(data[16:(16 + RSA2048KeySize)]),
+			E: RSA2048PublicExponent,
+		},
+		Signature: data[(16 + RSA2048KeySize):RSA2048SHA256CertificateSize],
+	}, nil
+}
+
+// Verify checks the signature over data with the certificate's own key
+func (certificate *RSA2048SHA256Certificate) Verify(data []byte) error {
+	if certificate.HashType != HashTypeSHA256GUID {
+		return fmt.Errorf("unsupported hash type %s", certificate.HashType)
+	}
+
+	digest := sha256.Sum256(data)
+	err := rsa.VerifyPKCS1v15(certificate.PublicKey, crypto.SHA256, digest[:], certificate.Signature)
+	if err != nil {
+		return fmt.Errorf("rsa2048 sha256 signature does not verify")
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The EFI 1.1 and Tiano compression formats, a Huffman coded LZ77 variant. Both share the
+// decoder below and differ only in the bits used to send the position code lengths. This is
+// a port of EDK2's BaseUefiDecompressLib.
+const (
+	CompressHeaderSize = 8 // compressed size and original size, both u32
+
+	EFICompressPositionBits = 4
+	TianoCompressPositionBits = 5
+
+	compressBitBufferSize = 32
+	compressMaxMatch = 256
+	compressThreshold = 3
+	compressCodeBits = 16
+	compressCharCount = 0xff + compressMaxMatch + 2 - compressThreshold // NC
+	compressCharBits = 9 // CBIT
+	compressMaxPositionCount = (1 << TianoCompressPositionBits) - 1 // MAXNP
+	compressExtraCount = compressCodeBits + 3 // NT
+	compressExtraBits = 5 // TBIT
+	compressPTCount = compressMaxPositionCount // NPT, the larger of NT and MAXNP
+	compressNodeCount = 2 * compressCharCount - 1
+)
+
+type efiDecompressor struct {
+	source []byte
+	output []byte
+	sourceIndex int
+	compressedSize uint32
+	bitCount uint
+	bitBuffer uint32
+	subBitBuffer uint32
+	blockSize uint16
+	positionBits uint
+
+	left [compressNodeCount]uint16
+	right [compressNodeCount]uint16
+	charLengths [compressCharCount]uint8
+	ptLengths [compressPTCount]uint8
+	charTable [4096]uint16
+	ptTable [256]uint16
+}
+
+// fill shifts count bits out of the bit buffer, reading zeros once the input is exhausted
+func (state *efiDecompressor) fill(count uint) {
+	state.bitBuffer = uint32(uint64(state.bitBuffer) << count)
+	for count > state.bitCount {
+		count -= state.bitCount
+		state.bitBuffer |= uint32(uint64(state.subBitBuffer) << count)
+		state.subBitBuffer = 0
+		if state.compressedSize > 0 && state.sourceIndex < len(state.source) {
+			state.compressedSize--
+			state.subBitBuffer = uint32(state.source[state.sourceIndex])
+			state.sourceIndex++
+		}
+		state.bitCount = 8
+	}
+
+	state.bitCount -= count
+	state.bitBuffer |= state.subBitBuffer >> state.bitCount
+}
+
+func (state *efiDecompressor) bits(count uint) uint32 {
+	result := state.bitBuffer >> (compressBitBufferSize - count)
+	state.fill(count)
+	return result
+}
+
+// walk follows the overflow tree for codes longer than a table's index bits
+func (state *efiDecompressor) walk(value uint16, limit uint16, tableBits uint) (uint16, error) {
+	mask := uint32(1) << (compressBitBufferSize - 1 - tableBits)
+	for value >= limit {
+		if int(value) >= compressNodeCount {
+			return 0, fmt.Errorf("invalid huffman tree node %d", value)
+		}
+		if state.bitBuffer & mask != 0 {
+			value = state.right[value]
+		} else {
+			value = state.left[value]
+		}
+		mask >>= 1
+	}
+
+	return value, nil
+}
+
+// makeTable builds the lookup table and overflow tree for a set of canonical code lengths
+func (state *efiDecompressor) makeTable(lengths []uint8, tableBits uint, table []uint16) error {
+	var count [17]uint16
+	var weight [17]uint16
+	var start [18]uint16
+
+	for index := range table {
+		table[index] = 0
+	}
+	for _, length := range lengths {
+		if length > 16 {
+			return fmt.Errorf("invalid huffman code length %d", length)
+		}
+		count[length]++
+	}
+
+	for index := 1; index <= 16; index++ {
+		start[index + 1] = start[index] + (count[index] << uint(16 - index))
+	}
+	if start[17] != 0 {
+		return fmt.Errorf("huffman code lengths do not form a complete code")
+	}
+
+	shift := 16 - tableBits
+	index := uint(1)
+	for ; index <= tableBits; index++ {
+		start[index] >>= shift
+		weight[index] = uint16(1) << (tableBits - index)
+	}
+	for ; index <= 16; index++ {
+		weight[index] = uint16(1) << (16 - index)
+	}
+
+	available := uint16(len(lengths))
+	mask := uint16(1) << (15 - tableBits)
+	for char, length := range lengths {
+		if length == 0 {
+			continue
+		}
+
+		next := start[length] + weight[length]
+		if uint(length) <= tableBits {
+			if start[length] >= next || int(next) > len(table) {
+				return fmt.Errorf("huffman table overflows")
+			}
+			for code := start[length]; code < next; code++ {
+				table[code] = uint16(char)
+			}
+		} else {
+			code := start[length]
+			pointer := &table[code >> shift]
+			for depth := uint(length) - tableBits; depth != 0; depth-- {
+				if *pointer == 0 && available < compressNodeCount {
+					state.left[available], state.right[available] = 0, 0
+					*pointer = available
+					available++
+				}
+				if *pointer < compressNodeCount {
+					if code & mask != 0 {
+						pointer = &state.right[*pointer]
+					} else {
+						pointer = &state.left[*pointer]
+					}
+				}
+				code <<= 1
+			}
+			*pointer = uint16(char)
+		}
+		start[length] = next
+	}
+
+	return nil
+}
+
+// readPTLengths reads the code lengths of the extra or position set. special is the index
+// after which a 2 bit run of zero lengths follows, or -1 for none.
+func (state *efiDecompressor) readPTLengths(count int, countBits uint, special int) error {
+	number := int(state.bits(countBits))
+	if number == 0 {
+		value := uint16(state.bits(countBits))
+		if int(value) >= count {
+			return fmt.Errorf("invalid single code %d", value)
+		}
+		for index := range state.ptTable {
+			state.ptTable[index] = value
+		}
+		for index := 0; index < count; index++ {
+			state.ptLengths[index] = 0
+		}
+		return nil
+	}
+
+	index := 0
+	for index < number && index < compressPTCount {
+		length := uint(state.bitBuffer >> (compressBitBufferSize - 3))
+		if length == 7 {
+			mask := uint32(1) << (compressBitBufferSize - 1 - 3)
+			for mask & state.bitBuffer != 0 {
+				mask >>= 1
+				length++
+			}
+		}
+		if length < 7 {
+			state.fill(3)
+		} else {
+			state.fill(length - 3)
+		}
+		if length > 16 {
+			return fmt.Errorf("invalid huffman code length %d", length)
+		}
+
+		state.ptLengths[index] = uint8(length)
+		index++
+		if index == special {
+			for zeros := int(state.bits(2)); zeros > 0 && index < compressPTCount; zeros-- {
+				state.ptLengths[index] = 0
+				index++
+			}
+		}
+	}
+	if index > count {
+		return fmt.Errorf("%d code lengths for %d codes", index, count)
+	}
+	for ; index < count; index++ {
+		state.ptLengths[index] = 0
+	}
+
+	return state.makeTable(state.ptLengths[:count], 8, state.ptTable[:])
+}
+
+// readCharLengths reads the char and length code lengths, themselves coded with the extra set
+func (state *efiDecompressor) readCharLengths() error {
+	number := int(state.bits(compressCharBits))
+	if number == 0 {
+		value := uint16(state.bits(compressCharBits))
+		if value >= compressCharCount {
+			return fmt.Errorf("invalid single code %d", value)
+		}
+		for index := range state.charLengths {
+			state.charLengths[index] = 0
+		}
+		for index := range state.charTable {
+			state.charTable[index] = value
+		}
+		return nil
+	}
+
+	index := 0
+	for index < number && index < compressCharCount {
+		value, err := state.walk(state.ptTable[state.bitBuffer >> (compressBitBufferSize - 8)], compressExtraCount, 8)
+		if err != nil { return err }
+		state.fill(uint(state.ptLengths[value]))
+
+		if value > 2 {
+			state.charLengths[index] = uint8(value - 2)
+			index++
+			continue
+		}
+
+		zeros := 1
+		if value == 1 {
+			zeros = int(state.bits(4)) + 3
+		} else if value == 2 {
+			zeros = int(state.bits(compressCharBits)) + 20
+		}
+		for ; zeros > 0 && index < compressCharCount; zeros-- {
+			state.charLengths[index] = 0
+			index++
+		}
+	}
+	for ; index < compressCharCount; index++ {
+		state.charLengths[index] = 0
+	}
+
+	return state.makeTable(state.charLengths[:], 12, state.charTable[:])
+}
+
+// decodeChar returns the next literal byte, or a match length code above 0xff, reading the
+// block's code tables first when a new block starts
+func (state *efiDecompressor) decodeChar() (uint16, error) {
+	if state.blockSize == 0 {
+		state.blockSize = uint16(state.bits(16))
+		err := state.readPTLengths(compressExtraCount, compressExtraBits, 3)
+		if err != nil { return 0, err }
+		err = state.readCharLengths()
+		if err != nil { return 0, err }
+		err = state.readPTLengths(compressMaxPositionCount, state.positionBits, -1)
+		if err != nil { return 0, err }
+	}
+	state.blockSize--
+
+	value, err := state.walk(state.charTable[state.bitBuffer >> (compressBitBufferSize - 12)], compressCharCount, 12)
+	if err != nil { return 0, err }
+	state.fill(uint(state.charLengths[value]))
+
+	return value, nil
+}
+
+// decodePosition returns the distance back to a match, less one
+func (state *efiDecompressor) decodePosition() (uint32, error) {
+	value, err := state.walk(state.ptTable[state.bitBuffer >> (compressBitBufferSize - 8)], compressMaxPositionCount, 8)
+	if err != nil { return 0, err }
+	state.fill(uint(state.ptLengths[value]))
+
+	if value <= 1 {
+		return uint32(value), nil
+	}
+
+	return (uint32(1) << (value - 1)) + state.bits(uint(value - 1)), nil
+}
+
+func (state *efiDecompressor) decode() error {
+	for len(state.output) < cap(state.output) {
+		char, err := state.decodeChar()
+		if err != nil { return err }
+
+		if char < 0x100 {
+			state.output = append(state.output, byte(char))
+			continue
+		}
+
+		length := int(char) - (0x100 - compressThreshold)
+		position, err := state.decodePosition()
+		if err != nil { return err }
+		if uint64(position) >= uint64(len(state.output)) {
+			return fmt.Errorf("match distance %d is before the start of the output", position + 1)
+		}
+
+		from := len(state.output) - int(position) - 1
+		for ; length > 0 && len(state.output) < cap(state.output); length-- {
+			state.output = append(state.output, state.output[from])
+			from++
+		}
+	}
+
+	return nil
+}
+
+// ParseCompressHeader returns the compressed and original sizes of EFI or Tiano compressed data
+func ParseCompressHeader(data []byte) (uint32, uint32, error) {
+	if len(data) < CompressHeaderSize {
+		return 0, 0, fmt.Errorf("not enough data for compression header")
+	}
+
+	return binary.LittleEndian.Uint32(data[0:4]), binary.LittleEndian.Uint32(data[4:8]), nil
+}
+
+// Decompress unpacks EFI (positionBits 4) or Tiano (positionBits 5) compressed data, refusing
+// output larger than limit bytes
+func Decompress(data []byte, positionBits uint, limit int) ([]byte, error) {
+	if positionBits != EFICompressPositionBits && positionBits != TianoCompressPositionBits {
+		return nil, fmt.Errorf("invalid position bits %d", positionBits)
+	}
+
+	compressedSize, originalSize, err := ParseCompressHeader(data)
+	if err != nil { return nil, err }
+	if uint64(compressedSize) > uint64(len(data) - CompressHeaderSize) {
+		return nil, fmt.Errorf("compressed size 0x%x is past the end of the data", compressedSize)
+	}
+	if uint64(originalSize) > uint64(limit) {
+		return nil, fmt.Errorf("original size 0x%x exceeds %d bytes", originalSize, limit)
+	}
+
+	state := &efiDecompressor{
+		source:         data[CompressHeaderSize:(CompressHeaderSize + int(compressedSize))],
+		output:         make([]byte, 0, originalSize),
+		compressedSize: compressedSize,
+		positionBits:   positionBits,
+	}
+	state.fill(compressBitBufferSize)
+
+	err = state.decode()
+	if err != nil { return nil, err }
+
+	return state.output, nil
+}
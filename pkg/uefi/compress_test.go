@@ -0,0 +1,54 @@
+package uefi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	text := readFixture(t, "compress.txt")
+	efi := readFixture(t, "compress.txt.efi")
+	tiano := readFixture(t, "compress.txt.tiano")
+
+	tests := []struct {
+		name         string
+		data         []byte
+		positionBits uint
+		limit        int
+		err          bool
+	}{
+		{"efi", efi, EFICompressPositionBits, len(text), false},
+		{"tiano", tiano, TianoCompressPositionBits, len(text), false},
+		{"efi read as tiano", efi, TianoCompressPositionBits, len(text), true},
+		{"invalid position bits", efi, 6, len(text), true},
+		{"past limit", tiano, TianoCompressPositionBits, len(text) - 1, true},
+		{"truncated", tiano[:(len(tiano) - 16)], TianoCompressPositionBits, len(text), true},
+		{"short header", tiano[:(CompressHeaderSize - 1)], TianoCompressPositionBits, len(text), true},
+	}
+
+	for _, test := range tests {
+		result, err := Decompress(test.data, test.positionBits, test.limit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: decompressed, expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(result, text) {
+			t.Errorf("%s: decompressed data differs", test.name)
+		}
+	}
+}
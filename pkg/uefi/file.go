@@ -0,0 +1,196 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+)
+
+const (
+	FileHeaderSize = 24
+	FileHeader2Size = 32 // with the 64 bit size of large files
+	FileAlignment = 8
+
+	FileTypeRaw = 0x01
+	FileTypeFreeform = 0x02
+	FileTypeSecurityCore = 0x03
+	FileTypePEICore = 0x04
+	FileTypeDXECore = 0x05
+	FileTypePEIM = 0x06
+	FileTypeDriver = 0x07
+	FileTypeCombinedPEIMDriver = 0x08
+	FileTypeApplication = 0x09
+	FileTypeMM = 0x0a
+	FileTypeVolumeImage = 0x0b
+	FileTypeCombinedMMDXE = 0x0c
+	FileTypeMMCore = 0x0d
+	FileTypeOEMMin = 0xc0 // OEM, debug and FFS specific types run from here up
+	FileTypePad = 0xf0
+
+	FileAttributeLargeFile = 0x01
+	FileAttributeChecksum = 0x40
+
+	FileStateHeaderValid = 0x02
+	FileStateDataValid = 0x04
+	FileStateDeleted = 0x10
+
+	// Checksum byte of files without FileAttributeChecksum
+	FileChecksumUnused = 0xaa
+)
+
+type File struct {
+	Name uuid.UUID
+	Type uint8
+	Attributes uint8
+	State uint8 // with the erase polarity removed
+	Offset uint64 // in the image the volume was found in
+	HeaderSize int
+	Data []byte // the whole file, header included
+	ChecksumValid bool // false when FileAttributeChecksum is set and the data does not match
+	Sections []*Section // nil for file types without sections
+	SectionError error // why walking the sections stopped early, nil when it did not
+}
+
+// FileTypeName returns a display name for an FFS file type
+func FileTypeName(fileType uint8) string {
+	switch fileType {
+	case FileTypeRaw:
+		return "raw"
+	case FileTypeFreeform:
+		return "freeform"
+	case FileTypeSecurityCore:
+		return "sec core"
+	case FileTypePEICore:
+		return "pei core"
+	case FileTypeDXECore:
+		return "dxe core"
+	case FileTypePEIM:
+		return "peim"
+	case FileTypeDriver:
+		return "driver"
+	case FileTypeCombinedPEIMDriver:
+		return "peim/driver"
+	case FileTypeApplication:
+		return "application"
+	case FileTypeMM:
+		return "mm"
+	case FileTypeVolumeImage:
+		return "volume image"
+	case FileTypeCombinedMMDXE:
+		return "mm/dxe"
+	case FileTypeMMCore:
+		return "mm core"
+	case FileTypePad:
+		return "pad"
+	}
+
+	return fmt.Sprintf("unknown(0x%02x)", fileType)
+}
+
+// HoldsSections reports whether the file's body is a run of sections, as it is for every
+// standard type except raw
+func (file *File) HoldsSections() bool {
+	return file.Type > FileTypeRaw && file.Type < FileTypeOEMMin
+}
+
+// Body returns the file contents after its header
+func (file *File) Body() []byte {
+	return file.Data[file.HeaderSize:]
+}
+
+// sum8 adds the bytes of data
+func sum8(data []byte) uint8 {
+	result := uint8(0)
+	for _, value := range data {
+		result += value
+	}
+
+	return result
+}
+
+// isErased reports whether data reads as erased flash
+func isErased(data []byte, polarity byte) bool {
+	for _, value := range data {
+		if value != polarity {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseFile decodes the FFS file at offset in a volume
+func parseFile(volume *FirmwareVolume, offset uint64, depth int) (*File, error) {
+	data := volume.Data[offset:]
+	if len(data) < FileHeaderSize {
+		return nil, fmt.Errorf("not enough data for file header")
+	}
+
+	name, err := core.EFIGUID(data[0:16])
+	if err != nil { return nil, err }
+
+	file := &File{
+		Name:       name,
+		Type:       data[0x12],
+		Attributes: data[0x13],
+		State:      data[0x17],
+		Offset:     volume.Offset + offset,
+		HeaderSize: FileHeaderSize,
+	}
+	if volume.ErasePolarity() != 0 {
+		file.State = ^file.State
+	}
+
+	size := uint64(data[0x14]) | uint64(data[0x15]) << 8 | uint64(data[0x16]) << 16
+	if file.Attributes & FileAttributeLargeFile != 0 {
+		if len(data) < FileHeader2Size {
+			return nil, fmt.Errorf("file %s: not enough data for large file header", name)
+		}
+		size = binary.LittleEndian.Uint64(data[0x18:0x20])
+		file.HeaderSize = FileHeader2Size
+	}
+	if size < uint64(file.HeaderSize) || size > uint64(len(data)) {
+		return nil, fmt.Errorf("file %s: size 0x%x is out of bounds", name, size)
+	}
+	file.Data = data[:size]
+
+	// The header checksum covers the header with the data checksum and state taken as zero
+	header := make([]byte, file.HeaderSize)
+	copy(header, data)
+	header[0x11], header[0x17] = 0, 0
+	if sum8(header) != 0 {
+		return nil, fmt.Errorf("file %s: bad header checksum", name)
+	}
+	file.ChecksumValid = file.Attributes & FileAttributeChecksum == 0 || sum8(file.Body()) + data[0x11] == 0
+
+	if file.HoldsSections() {
+		file.Sections, file.SectionError = parseSections(file.Body(), depth + 1)
+	}
+
+	return file, nil
+}
+
+// parseFiles walks the FFS files of a volume until its free space, returning the files before
+// any it cannot decode
+func parseFiles(volume *FirmwareVolume, offset uint64, depth int) ([]*File, error) {
+	result := make([]*File, 0)
+	polarity := volume.ErasePolarity()
+	for offset + FileHeaderSize <= uint64(len(volume.Data)) {
+		if isErased(volume.Data[offset:(offset + FileHeaderSize)], polarity) {
+			break
+		}
+
+		file, err := parseFile(volume, offset, depth)
+		if err != nil {
+			return result, fmt.Errorf("volume at 0x%x: %s", volume.Offset, err)
+		}
+
+		if file.State & FileStateDeleted == 0 && file.State & FileStateDataValid != 0 {
+			result = append(result, file)
+		}
+		offset = align(offset + uint64(len(file.Data)), FileAlignment)
+	}
+
+	return result, nil
+}
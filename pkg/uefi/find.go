@@ -0,0 +1,79 @@
+package uefi
+
+import (
+	"github.com/google/uuid"
+)
+
+// Element is a volume, file or section reached while walking volumes. File and Section are
+// nil for a volume and Section is nil for a file; Volume is always the innermost volume.
+type Element struct {
+	Volume *FirmwareVolume
+	File *File
+	Section *Section
+	Depth int // levels of nesting below the outermost volumes
+}
+
+// GUID returns the name of the volume or file, or the GUID of the section, which is zero for
+// sections other than GUID defined and freeform ones
+func (element *Element) GUID() uuid.UUID {
+	if element.Section != nil {
+		return element.Section.GUID
+	}
+	if element.File != nil {
+		return element.File.Name
+	}
+
+	return element.Volume.GUID()
+}
+
+// Data returns the decoded contents of a section, the body of a file, or a whole volume
+func (element *Element) Data() []byte {
+	if element.Section != nil {
+		return element.Section.Contents()
+	}
+	if element.File != nil {
+		return element.File.Body()
+	}
+
+	return element.Volume.Data
+}
+
+func walkSections(volume *FirmwareVolume, file *File, sections []*Section, depth int, visit func(*Element)) {
+	for _, section := range sections {
+		visit(&Element{Volume: volume, File: file, Section: section, Depth: depth})
+		walkSections(volume, file, section.Sections, depth + 1, visit)
+		if section.Volume != nil {
+			walkVolume(section.Volume, depth + 1, visit)
+		}
+	}
+}
+
+func walkVolume(volume *FirmwareVolume, depth int, visit func(*Element)) {
+	visit(&Element{Volume: volume, Depth: depth})
+	for _, file := range volume.Files {
+		visit(&Element{Volume: volume, File: file, Depth: depth + 1})
+		walkSections(volume, file, file.Sections, depth + 2, visit)
+	}
+}
+
+// Walk calls visit for every volume, file and section under volumes, parents before their
+// children, descending into encapsulation sections and the volumes they hold
+func Walk(volumes []*FirmwareVolume, visit func(*Element)) {
+	for _, volume := range volumes {
+		walkVolume(volume, 0, visit)
+	}
+}
+
+// Find returns every volume, file and section under volumes whose GUID is guid. Volumes match
+// on their name or file system, files on their name, and sections on their definition or
+// subtype GUID.
+func Find(volumes []*FirmwareVolume, guid uuid.UUID) []*Element {
+	result := make([]*Element, 0)
+	Walk(volumes, func(element *Element) {
+		if element.GUID() == guid || (element.Section == nil && element.File == nil && element.Volume.FileSystem == guid) {
+			result = append(result, element)
+		}
+	})
+
+	return result
+}
@@ -0,0 +1,37 @@
+package uefi
+
+import (
+	"github.com/google/uuid"
+)
+
+// guidNames are display names for the GUIDs this package knows about
+var guidNames = map[uuid.UUID]string{
+	FileSystem2GUID:               "EFI_FIRMWARE_FILE_SYSTEM2_GUID",
+	FileSystem3GUID:               "EFI_FIRMWARE_FILE_SYSTEM3_GUID",
+	AppleImmutableVolumeGUID:      "APPLE_IMMUTABLE_FV_GUID",
+	AppleAuthenticationVolumeGUID: "APPLE_AUTHENTICATION_FV_GUID",
+	AppleMicrocodeVolumeGUID:      "APPLE_MICROCODE_FV_GUID",
+	LZMACompressGUID:              "LZMA_CUSTOM_DECOMPRESS_GUID",
+	LZMAF86CompressGUID:           "LZMAF86_CUSTOM_DECOMPRESS_GUID",
+	TianoCompressGUID:             "TIANO_CUSTOM_DECOMPRESS_GUID",
+	BrotliCompressGUID:            "BROTLI_CUSTOM_DECOMPRESS_GUID",
+	CRC32GUID:                     "EFI_CRC32_GUIDED_SECTION_EXTRACTION_GUID",
+	RSA2048SHA256GUID:             "EFI_CERT_TYPE_RSA2048_SHA256_GUID",
+	HashTypeSHA256GUID:            "EFI_HASH_TYPE_SHA256_GUID",
+	EFICapsuleGUID:                "EFI_CAPSULE_GUID",
+}
+
+// GUIDName returns the name of a well known GUID, or the empty string
+func GUIDName(guid uuid.UUID) string {
+	return guidNames[guid]
+}
+
+// DisplayGUID returns a GUID followed by its name when it has one
+func DisplayGUID(guid uuid.UUID) string {
+	name := GUIDName(guid)
+	if name == "" {
+		return guid.String()
+	}
+
+	return guid.String() + " (" + name + ")"
+}
@@ -0,0 +1,140 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	DescriptorSignature = 0x0ff0a55a
+	DescriptorSignatureOffset = 0x10
+	DescriptorRegionCount = 9 // FLREG0 to FLREG8
+
+	RegionDescriptor = 0
+	RegionBIOS = 1
+	RegionME = 2
+	RegionGbE = 3
+	RegionPDR = 4
+	RegionEC = 8
+	RegionPadding = -1 // bytes of the BIOS region outside any volume
+)
+
+// Region is a range of a flash image: a flash descriptor region, or padding between volumes
+type Region struct {
+	Type int
+	Offset uint64
+	Data []byte
+}
+
+// Image is a whole flash image split into its regions and the volumes of its BIOS region
+type Image struct {
+	Data []byte
+	HasDescriptor bool
+	Regions []*Region // ordered by offset
+	Volumes []*FirmwareVolume
+}
+
+// RegionTypeName returns a display name for a region type
+func RegionTypeName(regionType int) string {
+	switch regionType {
+	case RegionDescriptor:
+		return "descriptor"
+	case RegionBIOS:
+		return "bios"
+	case RegionME:
+		return "me"
+	case RegionGbE:
+		return "gbe"
+	case RegionPDR:
+		return "pdr"
+	case RegionEC:
+		return "ec"
+	case RegionPadding:
+		return "padding"
+	}
+
+	return fmt.Sprintf("region%d", regionType)
+}
+
+// parseDescriptor returns the regions an Intel flash descriptor lays out
+func parseDescriptor(data []byte) ([]*Region, error) {
+	if len(data) < DescriptorSignatureOffset + 8 {
+		return nil, fmt.Errorf("not enough data for flash descriptor")
+	}
+
+	map0 := binary.LittleEndian.Uint32(data[(DescriptorSignatureOffset + 4):])
+	base := uint64((map0 >> 16) & 0xff) << 4
+	if base + DescriptorRegionCount * 4 > uint64(len(data)) {
+		return nil, fmt.Errorf("flash region base 0x%x is past the end of the image", base)
+	}
+
+	result := make([]*Region, 0)
+	for index := uint64(0); index < DescriptorRegionCount; index++ {
+		value := binary.LittleEndian.Uint32(data[(base + index * 4):])
+		start := uint64(value & 0x7fff) << 12
+		limit := uint64((value >> 16) & 0x7fff) << 12 | 0xfff
+		// Unused regions have a base above their limit
+		if start > limit {
+			continue
+		}
+		if limit >= uint64(len(data)) {
+			return nil, fmt.Errorf("%s region ends at 0x%x, past the end of the image", RegionTypeName(int(index)), limit)
+		}
+
+		result = append(result, &Region{
+			Type:   int(index),
+			Offset: start,
+			Data:   data[start:(limit + 1)],
+		})
+	}
+
+	return result, nil
+}
+
+// ParseImage splits a flash image into its descriptor regions, when it has a descriptor, and
+// finds the volumes of its BIOS region. Images without a descriptor are taken to be all BIOS.
+// The BIOS region bytes outside any volume are returned as padding regions.
+func ParseImage(data []byte) (*Image, error) {
+	result := &Image{
+		Data: data,
+	}
+
+	bios := &Region{Type: RegionBIOS, Data: data}
+	if len(data) >= DescriptorSignatureOffset + 4 && binary.LittleEndian.Uint32(data[DescriptorSignatureOffset:]) == DescriptorSignature {
+		regions, err := parseDescriptor(data)
+		if err != nil { return nil, err }
+
+		result.HasDescriptor = true
+		result.Regions = regions
+		bios = nil
+		for _, region := range regions {
+			if region.Type == RegionBIOS {
+				bios = region
+			}
+		}
+	} else {
+		result.Regions = []*Region{bios}
+	}
+	if bios == nil {
+		return result, nil
+	}
+
+	result.Volumes = findVolumes(bios.Data, bios.Offset)
+	offset := bios.Offset
+	for _, volume := range result.Volumes {
+		if volume.Offset > offset {
+			result.Regions = append(result.Regions, &Region{Type: RegionPadding, Offset: offset, Data: data[offset:volume.Offset]})
+		}
+		offset = volume.Offset + uint64(len(volume.Data))
+	}
+	if end := bios.Offset + uint64(len(bios.Data)); offset < end {
+		result.Regions = append(result.Regions, &Region{Type: RegionPadding, Offset: offset, Data: data[offset:end]})
+	}
+
+	sort.SliceStable(result.Regions, func(i, j int) bool {
+		return result.Regions[i].Offset < result.Regions[j].Offset
+	})
+
+	return result, nil
+}
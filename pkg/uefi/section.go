@@ -0,0 +1,311 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+	"go-aapl-integrity/pkg/lzma"
+	"hash/crc32"
+	"unicode/utf16"
+)
+
+const (
+	SectionHeaderSize = 4
+	SectionHeader2Size = 8 // with the 32 bit size of large sections
+	SectionAlignment = 4
+	SectionExtendedSize = 0xffffff // the 24 bit size of sections using the large header
+
+	SectionTypeCompression = 0x01
+	SectionTypeGUIDDefined = 0x02
+	SectionTypeDisposable = 0x03
+	SectionTypePE32 = 0x10
+	SectionTypePIC = 0x11
+	SectionTypeTE = 0x12
+	SectionTypeDXEDepex = 0x13
+	SectionTypeVersion = 0x14
+	SectionTypeUserInterface = 0x15
+	SectionTypeCompatibility16 = 0x16
+	SectionTypeVolumeImage = 0x17
+	SectionTypeFreeformSubtypeGUID = 0x18
+	SectionTypeRaw = 0x19
+	SectionTypePEIDepex = 0x1b
+	SectionTypeMMDepex = 0x1c
+
+	CompressionNone = 0x00
+	CompressionStandard = 0x01 // EFI 1.1 or Tiano compression
+
+	// EFI_GUIDED_SECTION_PROCESSING_REQUIRED, set when the contents must be decoded before use
+	GUIDedAttributeProcessingRequired = 0x01
+	GUIDedAttributeAuthStatusValid = 0x02
+
+	// DecompressLimit bounds the output of any one compressed section
+	DecompressLimit = 64 << 20
+)
+
+var (
+	LZMACompressGUID = uuid.MustParse("ee4e5898-3914-4259-9d6e-dc7bd79403cf")
+	LZMAF86CompressGUID = uuid.MustParse("d42ae6bd-1352-4bfb-909a-ca72a6eae889")
+	TianoCompressGUID = uuid.MustParse("a31280ad-481e-41b6-95e8-127f4c984779")
+	BrotliCompressGUID = uuid.MustParse("3d532050-5cda-4fd0-879e-0f7f630d5afb")
+	CRC32GUID = uuid.MustParse("fc1bcdb0-7d31-49aa-936a-a4600d9dd083")
+	RSA2048SHA256GUID = uuid.MustParse("a7717414-c616-4977-9420-844712a735bf")
+	HashTypeSHA256GUID = uuid.MustParse("c1c41626-504c-4092-aca9-41f936934328")
+)
+
+// Section is one FFS section. Encapsulation sections have their decoded contents parsed into
+// Sections or Volume; Error says why that was not possible.
+type Section struct {
+	Type uint8
+	Offset uint64 // in the file body or decoded data holding the section
+	HeaderSize int // up to the contents, including any type specific header
+	Data []byte // the whole section, header included
+	GUID uuid.UUID // the definition of GUID defined sections, the subtype of freeform ones
+	Attributes uint16 // of GUID defined sections
+	Compression uint8 // of compression sections
+	Name string // of user interface sections
+	Decoded []byte // the decompressed or verified contents of encapsulation sections
+	Sections []*Section
+	Volume *FirmwareVolume // of volume image sections
+	Certificate *RSA2048SHA256Certificate // of signed GUID defined sections
+	SignatureConsistent bool // set when a signed section verified against the key in its own header, which is not a trusted key
+	Error error
+}
+
+// SectionTypeName returns a display name for a section type
+func SectionTypeName(sectionType uint8) string {
+	switch sectionType {
+	case SectionTypeCompression:
+		return "compression"
+	case SectionTypeGUIDDefined:
+		return "guid defined"
+	case SectionTypeDisposable:
+		return "disposable"
+	case SectionTypePE32:
+		return "pe32"
+	case SectionTypePIC:
+		return "pic"
+	case SectionTypeTE:
+		return "te"
+	case SectionTypeDXEDepex:
+		return "dxe depex"
+	case SectionTypeVersion:
+		return "version"
+	case SectionTypeUserInterface:
+		return "ui"
+	case SectionTypeCompatibility16:
+		return "compatibility16"
+	case SectionTypeVolumeImage:
+		return "volume image"
+	case SectionTypeFreeformSubtypeGUID:
+		return "freeform"
+	case SectionTypeRaw:
+		return "raw"
+	case SectionTypePEIDepex:
+		return "pei depex"
+	case SectionTypeMMDepex:
+		return "mm depex"
+	}
+
+	return fmt.Sprintf("unknown(0x%02x)", sectionType)
+}
+
+// Body returns the section contents after its headers
+func (section *Section) Body() []byte {
+	return section.Data[section.HeaderSize:]
+}
+
+// Contents returns the decoded contents of encapsulation sections and the body of others
+func (section *Section) Contents() []byte {
+	if section.Decoded != nil {
+		return section.Decoded
+	}
+
+	return section.Body()
+}
+
+// decodeUTF16 converts a NUL terminated little endian UTF-16 string
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, 0, len(data) / 2)
+	for index := 0; index + 1 < len(data); index += 2 {
+		unit := binary.LittleEndian.Uint16(data[index:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// decompressStandard unpacks a standard compression section, which may use either the EFI or
+// the Tiano variant with nothing recording which
+func decompressStandard(data []byte) ([]byte, error) {
+	result, err := Decompress(data, EFICompressPositionBits, DecompressLimit)
+	if err == nil {
+		return result, nil
+	}
+
+	return Decompress(data, TianoCompressPositionBits, DecompressLimit)
+}
+
+// decodeGUIDed processes the contents of a GUID defined section. header holds what follows the
+// common GUID defined fields up to the data, such as a checksum or a certificate.
+func decodeGUIDed(section *Section, header []byte) ([]byte, error) {
+	body := section.Body()
+	switch section.GUID {
+	case LZMACompressGUID:
+		return lzma.Decompress(body, DecompressLimit)
+	case LZMAF86CompressGUID:
+		result, err := lzma.Decompress(body, DecompressLimit)
+		if err != nil { return nil, err }
+		lzma.X86Decode(result)
+		return result, nil
+	case TianoCompressGUID:
+		return Decompress(body, TianoCompressPositionBits, DecompressLimit)
+	case CRC32GUID:
+		if len(header) < 4 {
+			return nil, fmt.Errorf("not enough data for crc32 header")
+		}
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header) {
+			return body, fmt.Errorf("bad crc32")
+		}
+		return body, nil
+	case RSA2048SHA256GUID:
+		certificate, err := ParseRSA2048SHA256Certificate(header)
+		if err != nil { return nil, err }
+		section.Certificate = certificate
+		err = certificate.Verify(body)
+		section.SignatureConsistent = err == nil
+		return body, err
+	}
+
+	if section.Attributes & GUIDedAttributeProcessingRequired != 0 {
+		return nil, fmt.Errorf("unsupported guid defined section %s", section.GUID)
+	}
+
+	return body, nil
+}
+
+// parseSection decodes the section at offset in data, recursing into encapsulation sections
+func parseSection(data []byte, offset uint64, depth int) (*Section, error) {
+	data = data[offset:]
+	if len(data) < SectionHeaderSize {
+		return nil, fmt.Errorf("not enough data for section header")
+	}
+
+	section := &Section{
+		Type:       data[3],
+		Offset:     offset,
+		HeaderSize: SectionHeaderSize,
+	}
+
+	size := uint64(data[0]) | uint64(data[1]) << 8 | uint64(data[2]) << 16
+	if size == SectionExtendedSize {
+		if len(data) < SectionHeader2Size {
+			return nil, fmt.Errorf("not enough data for large section header")
+		}
+		size = uint64(binary.LittleEndian.Uint32(data[4:8]))
+		section.HeaderSize = SectionHeader2Size
+	}
+	if size < uint64(section.HeaderSize) || size > uint64(len(data)) {
+		return nil, fmt.Errorf("section at 0x%x: size 0x%x is out of bounds", offset, size)
+	}
+	section.Data = data[:size]
+
+	header := section.Data[section.HeaderSize:]
+	var guidedHeader []byte
+	switch section.Type {
+	case SectionTypeCompression:
+		if len(header) < 5 {
+			return nil, fmt.Errorf("section at 0x%x: not enough data for compression header", offset)
+		}
+		section.Compression = header[4]
+		section.HeaderSize += 5
+	case SectionTypeGUIDDefined:
+		if len(header) < 20 {
+			return nil, fmt.Errorf("section at 0x%x: not enough data for guid defined header", offset)
+		}
+		section.GUID, _ = core.EFIGUID(header[0:16])
+		dataOffset := int(binary.LittleEndian.Uint16(header[16:18]))
+		section.Attributes = binary.LittleEndian.Uint16(header[18:20])
+		if dataOffset < section.HeaderSize + 20 || dataOffset > len(section.Data) {
+			return nil, fmt.Errorf("section at 0x%x: data offset 0x%x is out of bounds", offset, dataOffset)
+		}
+		guidedHeader = section.Data[(section.HeaderSize + 20):dataOffset]
+		section.HeaderSize = dataOffset
+	case SectionTypeFreeformSubtypeGUID:
+		if len(header) < 16 {
+			return nil, fmt.Errorf("section at 0x%x: not enough data for freeform header", offset)
+		}
+		section.GUID, _ = core.EFIGUID(header[0:16])
+		section.HeaderSize += 16
+	case SectionTypeVersion:
+		if len(header) < 2 {
+			return nil, fmt.Errorf("section at 0x%x: not enough data for version header", offset)
+		}
+		section.HeaderSize += 2
+		section.Name = decodeUTF16(section.Body())
+	case SectionTypeUserInterface:
+		section.Name = decodeUTF16(section.Body())
+	}
+
+	switch section.Type {
+	case SectionTypeCompression:
+		switch section.Compression {
+		case CompressionNone:
+			section.Decoded = section.Body()
+		case CompressionStandard:
+			section.Decoded, section.Error = decompressStandard(section.Body())
+		default:
+			section.Error = fmt.Errorf("unknown compression type %d", section.Compression)
+		}
+	case SectionTypeGUIDDefined:
+		section.Decoded, section.Error = decodeGUIDed(section, guidedHeader)
+	case SectionTypeVolumeImage:
+		section.Volume, section.Error = parseVolume(section.Body(), 0, depth + 1)
+	}
+
+	// A failed checksum or signature still leaves contents worth walking
+	if section.Decoded != nil {
+		sections, err := parseSections(section.Decoded, depth + 1)
+		section.Sections = sections
+		if section.Error == nil {
+			section.Error = err
+		}
+	}
+
+	return section, nil
+}
+
+// parseSections walks a run of sections, returning the sections before any it cannot decode
+func parseSections(data []byte, depth int) ([]*Section, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("sections are nested more than %d deep", maxDepth)
+	}
+
+	result := make([]*Section, 0)
+	offset := uint64(0)
+	for offset + SectionHeaderSize <= uint64(len(data)) {
+		section, err := parseSection(data, offset, depth)
+		if err != nil {
+			return result, err
+		}
+
+		result = append(result, section)
+		offset = align(offset + uint64(len(section.Data)), SectionAlignment)
+	}
+
+	// Anything left must be padding to the section alignment
+	if offset < uint64(len(data)) && !bytes.Equal(data[offset:], make([]byte, uint64(len(data)) - offset)) {
+		return result, fmt.Errorf("0x%x bytes after the last section", uint64(len(data)) - offset)
+	}
+
+	return result, nil
+}
+
+// ParseSections decodes a run of sections such as the body of an FFS file
+func ParseSections(data []byte) ([]*Section, error) {
+	return parseSections(data, 0)
+}
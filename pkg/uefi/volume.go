@@ -0,0 +1,182 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"go-aapl-integrity/pkg/core"
+)
+
+const (
+	VolumeSignature = "_FVH"
+	VolumeSignatureOffset = 0x28
+	VolumeHeaderSize = 0x38 // up to the block map
+	BlockMapEntrySize = 8
+	VolumeExtHeaderSize = 20
+	VolumeAlignment = 8 // volumes are found at this alignment when scanning
+
+	// maxDepth bounds the nesting of volumes inside sections inside files
+	maxDepth = 16
+
+	// EFI_FVB2_ERASE_POLARITY, set when erased flash reads as 0xff
+	VolumeAttributeErasePolarity = 0x00000800
+)
+
+var (
+	FileSystem2GUID = uuid.MustParse("8c8ce578-8a3d-4f1c-9935-896185c32dd3")
+	FileSystem3GUID = uuid.MustParse("5473c07a-3dcb-4dca-bd6f-1e9689e7349a")
+
+	// Apple volume GUIDs as listed by UEFITool. The immutable and authentication volumes hold
+	// FFS files, the microcode volume holds raw microcode updates.
+	AppleImmutableVolumeGUID = uuid.MustParse("04adeead-61ff-4d31-b6ba-64f8bf901f5a")
+	AppleAuthenticationVolumeGUID = uuid.MustParse("bd001b8c-6a71-487b-a14f-0c2a2dcf7a5d")
+	AppleMicrocodeVolumeGUID = uuid.MustParse("153d2197-29bd-44dc-ac59-887f70e41a6b")
+)
+
+// ffsFileSystems are the volume file systems that hold FFS files
+var ffsFileSystems = map[uuid.UUID]bool{
+	FileSystem2GUID:               true,
+	FileSystem3GUID:               true,
+	AppleImmutableVolumeGUID:      true,
+	AppleAuthenticationVolumeGUID: true,
+}
+
+type FirmwareVolume struct {
+	Offset uint64 // in the image the volume was found in, or in the body of its volume image section
+	FileSystem uuid.UUID
+	Name uuid.UUID // from the extended header, zero when there is none
+	Attributes uint32
+	HeaderLength uint16
+	Revision uint8
+	Data []byte
+	Files []*File // nil when the file system does not hold FFS files
+	FileError error // why walking the files stopped early, nil when it did not
+}
+
+// sum16 adds the little endian 16 bit words of data, which must be of even length
+func sum16(data []byte) uint16 {
+	result := uint16(0)
+	for index := 0; index + 1 < len(data); index += 2 {
+		result += binary.LittleEndian.Uint16(data[index:])
+	}
+
+	return result
+}
+
+// ErasePolarity returns the value of erased flash bytes in the volume
+func (volume *FirmwareVolume) ErasePolarity() byte {
+	if volume.Attributes & VolumeAttributeErasePolarity != 0 {
+		return 0xff
+	}
+
+	return 0x00
+}
+
+// HoldsFiles reports whether the volume's file system is one of the FFS formats
+func (volume *FirmwareVolume) HoldsFiles() bool {
+	return ffsFileSystems[volume.FileSystem]
+}
+
+// ParseVolume decodes the firmware volume at the start of data. offset is where data starts
+// in the enclosing image and is only recorded. A volume whose files are damaged is still
+// returned, with the files before the damage and FileError set.
+func ParseVolume(data []byte, offset uint64) (*FirmwareVolume, error) {
+	return parseVolume(data, offset, 0)
+}
+
+func parseVolume(data []byte, offset uint64, depth int) (*FirmwareVolume, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("volumes are nested more than %d deep", maxDepth)
+	}
+	if len(data) < VolumeHeaderSize + BlockMapEntrySize {
+		return nil, fmt.Errorf("not enough data for volume header")
+	}
+	if string(data[VolumeSignatureOffset:(VolumeSignatureOffset + 4)]) != VolumeSignature {
+		return nil, fmt.Errorf("bad volume signature %x", data[VolumeSignatureOffset:(VolumeSignatureOffset + 4)])
+	}
+
+	length := binary.LittleEndian.Uint64(data[0x20:0x28])
+	headerLength := binary.LittleEndian.Uint16(data[0x30:0x32])
+	if uint64(headerLength) < VolumeHeaderSize + BlockMapEntrySize || uint64(headerLength) > length || headerLength % 2 != 0 {
+		return nil, fmt.Errorf("invalid volume header length 0x%x", headerLength)
+	}
+	if length > uint64(len(data)) {
+		return nil, fmt.Errorf("volume length 0x%x is past the end of the data", length)
+	}
+	if sum16(data[:headerLength]) != 0 {
+		return nil, fmt.Errorf("bad volume header checksum")
+	}
+
+	fileSystem, err := core.EFIGUID(data[0x10:0x20])
+	if err != nil { return nil, err }
+
+	result := &FirmwareVolume{
+		Offset:       offset,
+		FileSystem:   fileSystem,
+		Attributes:   binary.LittleEndian.Uint32(data[0x2c:0x30]),
+		HeaderLength: headerLength,
+		Revision:     data[0x37],
+		Data:         data[:length],
+	}
+
+	filesStart := uint64(headerLength)
+	extHeaderOffset := uint64(binary.LittleEndian.Uint16(data[0x34:0x36]))
+	if extHeaderOffset != 0 {
+		if extHeaderOffset + VolumeExtHeaderSize > length {
+			return nil, fmt.Errorf("extended header at 0x%x is past the end of the volume", extHeaderOffset)
+		}
+
+		result.Name, err = core.EFIGUID(data[extHeaderOffset:])
+		if err != nil { return nil, err }
+
+		extHeaderSize := uint64(binary.LittleEndian.Uint32(data[(extHeaderOffset + 16):]))
+		if extHeaderSize < VolumeExtHeaderSize || extHeaderOffset + extHeaderSize > length {
+			return nil, fmt.Errorf("invalid extended header size 0x%x", extHeaderSize)
+		}
+		filesStart = align(extHeaderOffset + extHeaderSize, FileAlignment)
+	}
+
+	if result.HoldsFiles() {
+		result.Files, result.FileError = parseFiles(result, filesStart, depth)
+	}
+
+	return result, nil
+}
+
+// FindVolumes scans an image for firmware volumes, skipping over each volume it finds
+func FindVolumes(image []byte) []*FirmwareVolume {
+	return findVolumes(image, 0)
+}
+
+// findVolumes scans data found at base in an image for firmware volumes
+func findVolumes(data []byte, base uint64) []*FirmwareVolume {
+	result := make([]*FirmwareVolume, 0)
+	for offset := 0; offset + VolumeSignatureOffset + 4 <= len(data); offset += VolumeAlignment {
+		if string(data[(offset + VolumeSignatureOffset):(offset + VolumeSignatureOffset + 4)]) != VolumeSignature {
+			continue
+		}
+
+		volume, err := ParseVolume(data[offset:], base + uint64(offset))
+		if err != nil {
+			continue
+		}
+
+		result = append(result, volume)
+		offset += len(volume.Data) - VolumeAlignment
+	}
+
+	return result
+}
+
+// GUID returns the volume's name, or its file system GUID when it has none
+func (volume *FirmwareVolume) GUID() uuid.UUID {
+	if volume.Name != uuid.Nil {
+		return volume.Name
+	}
+
+	return volume.FileSystem
+}
+
+func align(value uint64, alignment uint64) uint64 {
+	return (value + alignment - 1) &^ (alignment - 1)
+}